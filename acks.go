@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"kinesis_consumer/consumer"
+)
+
+// how long shutdown waits for records handlers acknowledge asynchronously
+const ackShutdownTimeout = 10 * time.Second
+
+type ackEntry struct {
+	seq  string
+	done bool
+	// size is the decoded size, stage the in-flight stage the record is counted in
+	size  int64
+	stage *inFlightStage
+}
+
+// ackTracker keeps a shard's records in sequence until they are done with, so the checkpoint only
+// moves past records that are, also when handlers finish out of order or acknowledge later
+// (consumer.Async).
+type ackTracker struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	limit   int
+	pending []*ackEntry
+	// acked is the last sequence number with everything up to it done
+	acked        string
+	checkpointed string
+	// uncheckpointed counts the acknowledged records up to acked, which leave awaiting_checkpoint
+	// with the next checkpoint
+	uncheckpointed      int
+	uncheckpointedBytes int64
+	closed              bool
+}
+
+func newAckTracker(ctx context.Context, limit int) *ackTracker {
+	if limit <= 0 {
+		limit = 10000
+	}
+	t := &ackTracker{limit: limit}
+	t.cond = sync.NewCond(&t.mu)
+	context.AfterFunc(ctx, t.wake)
+	return t
+}
+
+// add starts tracking a decoded record of size bytes, counted in stageDecoded. It blocks while
+// limit records are waiting to be acknowledged. seq is empty for a record the checkpoint can't stop
+// at, one of the user records of an aggregated record but its last.
+func (t *ackTracker) add(ctx context.Context, seq string, size int64) *ackEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for len(t.pending) >= t.limit && ctx.Err() == nil {
+		t.cond.Wait()
+	}
+	e := &ackEntry{seq: seq, size: size, stage: stageDecoded}
+	t.pending = append(t.pending, e)
+	return e
+}
+
+// returned moves a record whose handler returned without acknowledging it to awaiting_sink.
+func (t *ackTracker) returned(e *ackEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !e.done {
+		t.move(e, stageAwaitingSink)
+	}
+}
+
+func (t *ackTracker) ack(e *ackEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e.done = true
+	t.move(e, stageAwaitingCheckpoint)
+	n := 0
+	for n < len(t.pending) && t.pending[n].done {
+		if seq := t.pending[n].seq; seq != "" {
+			t.acked = seq
+		}
+		if !t.closed {
+			t.uncheckpointed++
+			t.uncheckpointedBytes += t.pending[n].size
+		}
+		n++
+	}
+	if n > 0 {
+		t.pending = t.pending[n:]
+		t.cond.Broadcast()
+	}
+}
+
+// move counts e in stage instead of the one it was in. t.mu must be held.
+func (t *ackTracker) move(e *ackEntry, stage *inFlightStage) {
+	if t.closed {
+		return
+	}
+	e.stage.add(-1, -e.size)
+	stage.add(1, e.size)
+	e.stage = stage
+}
+
+func (t *ackTracker) wake() {
+	t.mu.Lock()
+	t.cond.Broadcast()
+	t.mu.Unlock()
+}
+
+// drain waits up to timeout for outstanding acknowledgements.
+func (t *ackTracker) drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		t.mu.Lock()
+		waiting := 0
+		for _, e := range t.pending {
+			if !e.done {
+				waiting++
+			}
+		}
+		t.mu.Unlock()
+		if waiting == 0 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	fmt.Println("gave up waiting for records to be acknowledged, they'll be read again on restart")
+}
+
+// checkpoint stores the acknowledged position if it moved since the last call.
+func (t *ackTracker) checkpoint(store checkpointStore, stream, shard string) error {
+	t.mu.Lock()
+	acked, records, bytes := t.acked, t.uncheckpointed, t.uncheckpointedBytes
+	t.mu.Unlock()
+	if acked == "" || acked == t.checkpointed {
+		return nil
+	}
+	if store != nil {
+		if err := consumer.WrapCheckpoint(store.Set)(stream, shard, acked); err != nil {
+			return err
+		}
+	}
+	t.checkpointed = acked
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.closed {
+		t.uncheckpointed -= records
+		t.uncheckpointedBytes -= bytes
+		stageAwaitingCheckpoint.add(-records, -bytes)
+	}
+	return nil
+}
+
+// close stops counting the shard's records in the in-flight gauges once it isn't read anymore;
+// acknowledgements that still come change nothing.
+func (t *ackTracker) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	for _, e := range t.pending {
+		e.stage.add(-1, -e.size)
+	}
+	stageAwaitingCheckpoint.add(-t.uncheckpointed, -t.uncheckpointedBytes)
+	t.uncheckpointed, t.uncheckpointedBytes = 0, 0
+	t.closed = true
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"kinesis_consumer/consumer"
+)
+
+// AggregateConfig is the handler_config of the "aggregate" handler.
+//
+//	"handler": "aggregate",
+//	"handler_config": {"window": "1m", "group_by": "device.type", "sum": "price", "lateness": "30s"}
+type AggregateConfig struct {
+	Window  Duration `json:"window"`
+	GroupBy string   `json:"group_by"`
+	Sum     string   `json:"sum"`
+	// Lateness is how long a window stays open after every shard's latest record is past its end,
+	// for records that arrive out of order. Records for a window already emitted are dropped.
+	Lateness Duration `json:"lateness"`
+	// MaxSkew is how far ahead of the clock an event time may move the watermark, so a producer
+	// whose clock is off doesn't close every window. Default 1m.
+	MaxSkew Duration `json:"max_skew"`
+}
+
+var lateRecords = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "aggregate_late_records_total",
+	Help:      "Records the aggregate handler dropped because their window was already emitted.",
+})
+
+func init() {
+	consumer.RegisterHandlerFactory("aggregate", newAggregator)
+}
+
+// shardProgress is the latest record time of a shard, seen at the wall clock time seenAt.
+type shardProgress struct {
+	latest time.Time
+	seenAt time.Time
+}
+
+type aggregate struct {
+	count         int64
+	sum           float64
+	partitionKeys map[string]struct{}
+}
+
+// aggregator counts records per window and group, sums a numeric field and counts distinct
+// partition keys. Windows go by Record.Time, the event time when there is one. A window is emitted
+// once the watermark, minus the lateness, is past its end; whatever is left is emitted on close.
+type aggregator struct {
+	cfg AggregateConfig
+
+	mu      sync.Mutex
+	windows map[time.Time]map[string]*aggregate
+	// shards has the latest record time of every shard seen, so a lagging shard holds the
+	// windows open instead of having its records dropped as late
+	shards    map[string]*shardProgress
+	startedAt time.Time
+	// windows starting before emitted are done with
+	emitted time.Time
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newAggregator(raw json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+	cfg := AggregateConfig{Window: Duration{time.Minute}, MaxSkew: Duration{time.Minute}}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("invalid aggregate handler_config: %w", err)
+		}
+	}
+	if cfg.Window.Duration <= 0 {
+		return nil, nil, fmt.Errorf("aggregate window must be positive, got %s", cfg.Window)
+	}
+	if cfg.Lateness.Duration < 0 {
+		return nil, nil, fmt.Errorf("aggregate lateness must not be negative, got %s", cfg.Lateness)
+	}
+	if cfg.MaxSkew.Duration < 0 {
+		return nil, nil, fmt.Errorf("aggregate max_skew must not be negative, got %s", cfg.MaxSkew)
+	}
+
+	a := &aggregator{
+		cfg:       cfg,
+		windows:   make(map[time.Time]map[string]*aggregate),
+		shards:    make(map[string]*shardProgress),
+		startedAt: clock.Now(),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go a.flushLoop()
+	return a.handle, a, nil
+}
+
+func (a *aggregator) handle(_ context.Context, r *consumer.Record) error {
+	var fields map[string]any
+	if a.cfg.GroupBy != "" || a.cfg.Sum != "" {
+		// records that aren't JSON objects still count, in the "" group
+		json.Unmarshal(r.Data, &fields)
+	}
+
+	group := ""
+	if a.cfg.GroupBy != "" {
+		if v, ok := jsonField(fields, a.cfg.GroupBy); ok {
+			group = fmt.Sprint(v)
+		}
+	}
+
+	t := r.Time()
+	start := t.Truncate(a.cfg.Window.Duration)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := clock.Now()
+	shard := a.shards[r.ShardID]
+	if shard == nil {
+		shard = &shardProgress{}
+		a.shards[r.ShardID] = shard
+	}
+	shard.seenAt = now
+	// an event time from the future still counts in its window, but moves the watermark no further
+	// than the allowed skew
+	progress := t
+	if limit := now.Add(a.cfg.MaxSkew.Duration); progress.After(limit) {
+		progress = limit
+	}
+	if progress.After(shard.latest) {
+		shard.latest = progress
+		// a record from a later window closes the earlier ones, once every shard is past them
+		a.advance(a.watermark(now))
+	}
+	if start.Before(a.emitted) {
+		fmt.Printf("\tdropping late record %s %s for window %s, it was already emitted\n", r.ShardID, r.SequenceNumber, start.UTC())
+		lateRecords.Inc()
+		return nil
+	}
+
+	groups := a.windows[start]
+	if groups == nil {
+		groups = make(map[string]*aggregate)
+		a.windows[start] = groups
+	}
+	agg := groups[group]
+	if agg == nil {
+		agg = &aggregate{partitionKeys: make(map[string]struct{})}
+		groups[group] = agg
+	}
+	agg.count++
+	agg.partitionKeys[r.PartitionKey] = struct{}{}
+	if a.cfg.Sum != "" {
+		if v, ok := jsonField(fields, a.cfg.Sum); ok {
+			if f, ok := v.(float64); ok {
+				agg.sum += f
+			}
+		}
+	}
+	return nil
+}
+
+func (a *aggregator) flushLoop() {
+	defer close(a.done)
+
+	ticker := clock.NewTicker(a.cfg.Window.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case now := <-ticker.C():
+			a.mu.Lock()
+			a.advance(a.watermark(now))
+			a.mu.Unlock()
+		}
+	}
+}
+
+// watermark is the record time every shard has got to at wall clock time now: the earliest of
+// the shards' latest record times. A shard's record time moves on with the clock, a window behind,
+// while nothing comes in, so idle and closed shards don't hold the others back. It is zero for the
+// first window length, which gives shards that are behind, e.g. after a restart, time to be seen.
+// a.mu must be held.
+func (a *aggregator) watermark(now time.Time) time.Time {
+	if now.Sub(a.startedAt) < a.cfg.Window.Duration {
+		return time.Time{}
+	}
+	var earliest time.Time
+	for _, shard := range a.shards {
+		t := shard.latest
+		if idle := shard.latest.Add(now.Sub(shard.seenAt) - a.cfg.Window.Duration); idle.After(t) {
+			t = idle
+		}
+		if earliest.IsZero() || t.Before(earliest) {
+			earliest = t
+		}
+	}
+	return earliest
+}
+
+// advance emits the windows that ended before t minus the lateness. a.mu must be held.
+func (a *aggregator) advance(t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	before := t.Add(-a.cfg.Lateness.Duration).Truncate(a.cfg.Window.Duration)
+	if before.After(a.emitted) {
+		a.emitted = before
+		a.flushBefore(before)
+	}
+}
+
+// flushBefore emits and forgets all windows that started before t. a.mu must be held.
+func (a *aggregator) flushBefore(t time.Time) {
+	var starts []time.Time
+	for start := range a.windows {
+		if start.Before(t) {
+			starts = append(starts, start)
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+
+	for _, start := range starts {
+		groups := a.windows[start]
+		names := make([]string, 0, len(groups))
+		for name := range groups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			agg := groups[name]
+			line, _ := json.Marshal(map[string]any{
+				"window_start":            start.UTC(),
+				"window_end":              start.Add(a.cfg.Window.Duration).UTC(),
+				"group":                   name,
+				"count":                   agg.count,
+				"sum":                     agg.sum,
+				"distinct_partition_keys": len(agg.partitionKeys),
+			})
+			fmt.Println(string(line))
+		}
+		delete(a.windows, start)
+	}
+}
+
+func (a *aggregator) Close() error {
+	close(a.stop)
+	<-a.done
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.flushBefore(time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC))
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"kinesis_consumer/consumer"
+)
+
+func TestAggregatorWaitsForLaggingShard(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := consumer.NewFakeClock(start)
+	defer func(c consumer.Clock) { clock = c }(clock)
+	clock = fake
+
+	handle, closer, err := newAggregator([]byte(`{"window": "1m"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	a := closer.(*aggregator)
+
+	record := func(shard string, at time.Time) {
+		handle(context.Background(), &consumer.Record{ShardID: shard, SequenceNumber: "1", ArrivalTime: at})
+	}
+	late := testutil.ToFloat64(lateRecords)
+	// shard 0 is caught up, shard 1 still reads records from 10 minutes before
+	record("shardId-000000000000", start.Add(10*time.Minute))
+	record("shardId-000000000001", start)
+	fake.Advance(90 * time.Second)
+	record("shardId-000000000000", start.Add(11*time.Minute))
+	record("shardId-000000000001", start.Add(time.Second))
+	record("shardId-000000000001", start.Add(time.Minute))
+	if got := testutil.ToFloat64(lateRecords) - late; got != 0 {
+		t.Errorf("%v records of the lagging shard dropped as late", got)
+	}
+
+	// once the lagging shard caught up, the windows before it close
+	record("shardId-000000000001", start.Add(10*time.Minute))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, open := a.windows[start]; open {
+		t.Error("window not emitted once every shard is past it")
+	}
+}
+
+func TestAggregatorClampsFutureEventTime(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := consumer.NewFakeClock(start)
+	defer func(c consumer.Clock) { clock = c }(clock)
+	clock = fake
+
+	tests := []struct {
+		name    string
+		config  string
+		future  time.Duration
+		then    time.Duration
+		dropped float64
+	}{
+		{"a day ahead", `{"window": "1m"}`, 24 * time.Hour, 2 * time.Minute, 0},
+		{"within the skew", `{"window": "1m", "max_skew": "10m"}`, 5 * time.Minute, 2 * time.Minute, 1},
+		{"no skew", `{"window": "1m", "max_skew": "0s"}`, time.Hour, time.Minute, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handle, closer, err := newAggregator([]byte(tt.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closer.Close()
+
+			// past the first window, when windows start to close
+			fake.Advance(2 * time.Minute)
+			now := fake.Now()
+			record := func(at time.Time) {
+				handle(context.Background(), &consumer.Record{ShardID: "shardId-000000000000", SequenceNumber: "1", ArrivalTime: at})
+			}
+			late := testutil.ToFloat64(lateRecords)
+			record(now)
+			record(now.Add(tt.future))
+			record(now.Add(tt.then))
+			if got := testutil.ToFloat64(lateRecords) - late; got != tt.dropped {
+				t.Errorf("%v records dropped as late, want %v", got, tt.dropped)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// runAnalyze is the "analyze" command. It samples the stream from LATEST for a while, without
+// touching checkpoints, with one of the analysis handlers, which prints its report at the end.
+func runAnalyze(configPath string, opts consumeOptions, args []string) {
+	if len(args) == 0 {
+		fatalf("analyze needs a mode: duplicates, keys or throughput")
+	}
+	mode := args[0]
+	fs := flag.NewFlagSet("analyze "+mode, flag.ExitOnError)
+	sample := fs.Duration("for", 5*time.Minute, "how long to sample the stream")
+
+	var handlerConfig any
+	switch mode {
+	case "duplicates":
+		window := fs.Duration("window", 10*time.Minute, "how long a payload is remembered")
+		fs.Parse(args[1:])
+		handlerConfig = map[string]string{"window": window.String()}
+	case "keys":
+		hot := fs.Float64("hot", 2, "flag shards that get this many times their even share of records")
+		fs.Parse(args[1:])
+		handlerConfig = map[string]float64{"hot_factor": *hot}
+	case "throughput":
+		target := fs.Float64("target", 0.7, "share of the shard write limits to plan for at peak")
+		fs.Parse(args[1:])
+		handlerConfig = map[string]float64{"target": *target}
+	default:
+		fatalf("unknown analyze mode %q, want duplicates, keys or throughput", mode)
+	}
+
+	opts.iteratorType = string(types.ShardIteratorTypeLatest)
+	opts.noCheckpoints = true
+	opts.handler = mode
+	opts.handlerConfig, _ = json.Marshal(handlerConfig)
+	opts.stopAfter = *sample
+	fmt.Fprintln(os.Stderr, "sampling the stream for", *sample, "(Ctrl-C stops early)")
+	runConsume(configPath, opts)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// RateAnomalyConfig flags shards whose record rate drops to zero, drops or spikes against its
+// recent average (an EWMA), which usually means a producer stopped or misbehaves.
+//
+//	"rate_anomaly": {"enabled": true, "interval": "1m", "factor": 3, "sns_topic_arn": "arn:aws:sns:..."}
+type RateAnomalyConfig struct {
+	Enabled bool `json:"enabled"`
+	// Interval is how long records are counted for each check, 1m when not set.
+	Interval Duration `json:"interval"`
+	// Alpha is the weight of the latest interval in the average, 0.1 when not set.
+	Alpha float64 `json:"alpha"`
+	// Factor flags a rate above Factor times the average as a spike and one below the average
+	// divided by Factor as a drop, 3 when not set.
+	Factor float64 `json:"factor"`
+	// MinRate is the average, in records a second, below which a shard is too quiet to judge, 1
+	// when not set.
+	MinRate float64 `json:"min_rate"`
+	// Warmup is how many intervals the average is learned for before anything is flagged, 10 when
+	// not set.
+	Warmup int `json:"warmup"`
+	// SNSTopicARN also gets a message when a shard's rate becomes anomalous and when it recovers.
+	SNSTopicARN string `json:"sns_topic_arn"`
+}
+
+var (
+	recordRateBaseline = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "record_rate_baseline",
+		Help:      "Average records a second per shard the rate anomaly detector compares against.",
+	}, []string{"shard"})
+	recordRateAnomaly = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "record_rate_anomaly",
+		Help:      "1 while a shard's record rate is anomalous, by kind (zero, drop or spike).",
+	}, []string{"shard", "kind"})
+)
+
+// rateCounter counts the records each shard got between checks. Only shards that fetched
+// during an interval are checked, so paused and closed shards aren't taken for outages.
+type rateCounter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+var recordRates = &rateCounter{counts: make(map[string]int64)}
+
+// add counts the records of one GetRecords call (or fan-out event), which may be none.
+func (rc *rateCounter) add(shardID string, records int) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.counts[shardID] += int64(records)
+}
+
+func (rc *rateCounter) take() map[string]int64 {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	counts := rc.counts
+	rc.counts = make(map[string]int64)
+	return counts
+}
+
+type shardRate struct {
+	average   float64
+	intervals int
+	anomaly   string
+}
+
+// watchRecordRate checks every shard's record rate every interval until ctx is done.
+func watchRecordRate(ctx context.Context, snsClient *sns.Client, cfg *Config) {
+	ac := cfg.RateAnomaly
+	if !ac.Enabled {
+		return
+	}
+	if ac.Interval.Duration <= 0 {
+		ac.Interval.Duration = time.Minute
+	}
+	if ac.Alpha <= 0 || ac.Alpha > 1 {
+		ac.Alpha = 0.1
+	}
+	if ac.Factor <= 1 {
+		ac.Factor = 3
+	}
+	if ac.MinRate <= 0 {
+		ac.MinRate = 1
+	}
+	if ac.Warmup <= 0 {
+		ac.Warmup = 10
+	}
+
+	shards := make(map[string]*shardRate)
+	recordRates.take()
+	ticker := clock.NewTicker(ac.Interval.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+
+		for shard, count := range recordRates.take() {
+			// a shard working through a backlog reads as fast as it can, not as fast as records come in
+			if lag, ok := shardLag.Load(shard); ok && lag.(time.Duration) > ac.Interval.Duration {
+				continue
+			}
+			s := shards[shard]
+			if s == nil {
+				s = &shardRate{}
+				shards[shard] = s
+			}
+			rate := float64(count) / ac.Interval.Duration.Seconds()
+
+			anomaly := ""
+			if s.intervals >= ac.Warmup && s.average >= ac.MinRate {
+				switch {
+				case rate == 0:
+					anomaly = "zero"
+				case rate > s.average*ac.Factor:
+					anomaly = "spike"
+				case rate < s.average/ac.Factor:
+					anomaly = "drop"
+				}
+			}
+			if anomaly != s.anomaly {
+				if s.anomaly != "" {
+					recordRateAnomaly.WithLabelValues(shard, s.anomaly).Set(0)
+				}
+				if anomaly != "" {
+					recordRateAnomaly.WithLabelValues(shard, anomaly).Set(1)
+					alertRateAnomaly(ctx, snsClient, ac, fmt.Sprintf("%s/%s record rate %s: %.1f records/s against an average of %.1f",
+						cfg.StreamName, shard, anomaly, rate, s.average))
+				} else {
+					alertRateAnomaly(ctx, snsClient, ac, fmt.Sprintf("%s/%s record rate recovered: %.1f records/s against an average of %.1f",
+						cfg.StreamName, shard, rate, s.average))
+				}
+				s.anomaly = anomaly
+			}
+
+			// an outage would teach the average that no records is normal; drops and spikes that
+			// last are taken as the new normal as the average catches up
+			if anomaly != "zero" {
+				if s.intervals == 0 {
+					s.average = rate
+				} else {
+					s.average = ac.Alpha*rate + (1-ac.Alpha)*s.average
+				}
+				s.intervals++
+			}
+			recordRateBaseline.WithLabelValues(shard).Set(s.average)
+		}
+	}
+}
+
+func alertRateAnomaly(ctx context.Context, snsClient *sns.Client, ac RateAnomalyConfig, msg string) {
+	fmt.Println("rate anomaly:", msg)
+	if ac.SNSTopicARN == "" {
+		return
+	}
+	_, err := snsClient.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(ac.SNSTopicARN),
+		Subject:  aws.String("kinesis_consumer rate anomaly"),
+		Message:  aws.String(msg),
+	})
+	if err != nil {
+		fmt.Printf("failed to publish rate anomaly to %s, err=%+v\n", ac.SNSTopicARN, err)
+	}
+}
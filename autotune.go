@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+const (
+	autoTuneSamples = 500
+	// below this per record, handing records to workers costs about as much as decoding them
+	parallelDecodeThreshold = 10 * time.Microsecond
+)
+
+// decodeTuning is what "decode": {"auto_tune": true} picked at startup.
+type decodeTuning struct {
+	workers, zstdConcurrency int
+}
+
+// apply fills in the decode settings the config leaves at 0.
+func (t *decodeTuning) apply(dc *DecodeConfig) {
+	if t == nil {
+		return
+	}
+	if dc.Workers == 0 {
+		dc.Workers = t.workers
+	}
+	if dc.ZstdConcurrency == 0 {
+		dc.ZstdConcurrency = t.zstdConcurrency
+	}
+}
+
+// autoTuneDecode reads up to autoTuneSamples records from the start of a shard, times decoding
+// each of them, and picks decode workers and zstd concurrency for this host's cores and that
+// payload mix. Nothing is handled or checkpointed. It returns nil when there was nothing to sample.
+func autoTuneDecode(ctx context.Context, client *kinesis.Client, cfg *Config) (*decodeTuning, error) {
+	shards := []string{cfg.ShardID}
+	if cfg.ShardID == allShards {
+		listed, err := listShards(ctx, client, cfg)
+		if err != nil {
+			return nil, err
+		}
+		shards = shards[:0]
+		for _, s := range listed {
+			shards = append(shards, aws.ToString(s.ShardId))
+		}
+		if len(shards) == 0 {
+			return nil, nil
+		}
+	}
+
+	name, streamARN := cfg.streamRef()
+	it, err := client.GetShardIterator(ctx, &kinesis.GetShardIteratorInput{
+		StreamName:        name,
+		StreamARN:         streamARN,
+		ShardId:           aws.String(shards[0]),
+		ShardIteratorType: types.ShardIteratorTypeTrimHorizon,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get a shard iterator to sample %s: %w", shards[0], err)
+	}
+	var records []types.Record
+	// the first calls at the trim horizon can come back empty even though the shard has data
+	for iterator, calls := it.ShardIterator, 0; iterator != nil && len(records) < autoTuneSamples && calls < 5; calls++ {
+		resp, err := client.GetRecords(ctx, &kinesis.GetRecordsInput{
+			ShardIterator: iterator,
+			StreamARN:     streamARN,
+			Limit:         aws.Int32(int32(autoTuneSamples - len(records))),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to sample %s: %w", shards[0], err)
+		}
+		records = append(records, resp.Records...)
+		iterator = resp.NextShardIterator
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	type codecTimes struct {
+		records int
+		in, out int
+		elapsed time.Duration
+	}
+	byCodec := make(map[string]*codecTimes)
+	var total time.Duration
+	dc := cfg.Decode
+	dc.Workers = 0
+	decoder := newDecoderPool(dc, cfg.StreamName)
+	for i := range records {
+		start := time.Now()
+		_, results := decoder.decodeBatch("", records[i:i+1])
+		res := results[0]
+		elapsed := time.Since(start)
+		total += elapsed
+
+		codec := res.codec
+		if res.err != nil {
+			codec = "failed"
+		}
+		c := byCodec[codec]
+		if c == nil {
+			c = &codecTimes{}
+			byCodec[codec] = c
+		}
+		c.records++
+		c.in += len(records[i].Data)
+		c.out += len(res.data)
+		c.elapsed += elapsed
+	}
+
+	procs := runtime.GOMAXPROCS(0)
+	perRecord := total / time.Duration(len(records))
+	t := &decodeTuning{}
+	if perRecord >= parallelDecodeThreshold {
+		// every shard runs its own decode workers
+		if t.workers = procs / len(shards); t.workers < 2 {
+			t.workers = 0
+		}
+	}
+	if byCodec["zstd"] != nil {
+		t.zstdConcurrency = procs
+	}
+
+	codecs := make([]string, 0, len(byCodec))
+	for codec := range byCodec {
+		codecs = append(codecs, codec)
+	}
+	sort.Strings(codecs)
+	fmt.Printf("auto_tune: sampled %d records of %s, %d cores, %d shards\n", len(records), shards[0], procs, len(shards))
+	for _, codec := range codecs {
+		c := byCodec[codec]
+		fmt.Printf("\t%-6s %6d records %10d B avg in %10d B avg out %10v avg decode\n",
+			codec, c.records, c.in/c.records, c.out/c.records, c.elapsed/time.Duration(c.records))
+	}
+	fmt.Printf("\tdecode workers %d, zstd_concurrency %d (0 is inline and the library default)\n", t.workers, t.zstdConcurrency)
+	return t, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// AWSConfig overrides the SDK defaults. Zero values leave the default in place.
+type AWSConfig struct {
+	// APITimeout bounds each HTTP attempt of an API call.
+	APITimeout  Duration   `json:"api_timeout"`
+	MaxAttempts int        `json:"max_attempts"`
+	RetryMode   string     `json:"retry_mode"` // "standard" or "adaptive"
+	HTTP        HTTPConfig `json:"http"`
+
+	// FIPS endpoints are required in GovCloud, dual-stack ones in IPv6-only VPCs.
+	UseFIPSEndpoint      bool `json:"use_fips_endpoint"`
+	UseDualStackEndpoint bool `json:"use_dualstack_endpoint"`
+	// EndpointURL sends every AWS call to one endpoint, e.g. LocalStack's http://localhost:4566.
+	EndpointURL string `json:"endpoint_url"`
+	// RequirePrivateEndpoint fails startup when the Kinesis endpoint resolves to public addresses,
+	// for deployments that must only reach Kinesis through an interface VPC endpoint.
+	RequirePrivateEndpoint bool `json:"require_private_endpoint"`
+}
+
+type HTTPConfig struct {
+	DisableKeepAlives   bool     `json:"disable_keep_alives"`
+	MaxIdleConnsPerHost int      `json:"max_idle_conns_per_host"`
+	IdleConnTimeout     Duration `json:"idle_conn_timeout"`
+	// Proxy is used instead of HTTPS_PROXY/HTTP_PROXY from the environment: http://, https://
+	// or socks5:// with optional user:password@.
+	Proxy string `json:"proxy"`
+	// CABundle is a PEM file of extra CAs to trust, for proxies that inspect TLS. AWS_CA_BUNDLE
+	// in the environment works too.
+	CABundle string `json:"ca_bundle"`
+}
+
+// proxyFlag and caBundleFlag, set by -proxy and -ca-bundle, win over the config file.
+var proxyFlag, caBundleFlag string
+
+func loadAWSConfig(ctx context.Context, cfg *Config) (aws.Config, error) {
+	ac := cfg.AWS
+	opts := []func(*config.LoadOptions) error{config.WithRegion(cfg.Region)}
+
+	if ac.MaxAttempts > 0 {
+		opts = append(opts, config.WithRetryMaxAttempts(ac.MaxAttempts))
+	}
+	if ac.RetryMode != "" {
+		mode, err := aws.ParseRetryMode(ac.RetryMode)
+		if err != nil {
+			return aws.Config{}, err
+		}
+		opts = append(opts, config.WithRetryMode(mode))
+	}
+
+	if ac.UseFIPSEndpoint {
+		opts = append(opts, config.WithUseFIPSEndpoint(aws.FIPSEndpointStateEnabled))
+	}
+	if ac.UseDualStackEndpoint {
+		opts = append(opts, config.WithUseDualStackEndpoint(aws.DualStackEndpointStateEnabled))
+	}
+
+	if proxyFlag != "" {
+		ac.HTTP.Proxy = proxyFlag
+	}
+	if caBundleFlag != "" {
+		ac.HTTP.CABundle = caBundleFlag
+	}
+
+	var proxyURL *url.URL
+	if ac.HTTP.Proxy != "" {
+		var err error
+		if proxyURL, err = url.Parse(ac.HTTP.Proxy); err != nil {
+			return aws.Config{}, fmt.Errorf("invalid proxy %q: %w", ac.HTTP.Proxy, err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return aws.Config{}, fmt.Errorf("invalid proxy %q: scheme must be http, https or socks5", ac.HTTP.Proxy)
+		}
+	}
+	if ac.HTTP.CABundle != "" {
+		pem, err := os.ReadFile(ac.HTTP.CABundle)
+		if err != nil {
+			return aws.Config{}, fmt.Errorf("failed to read ca_bundle: %w", err)
+		}
+		opts = append(opts, config.WithCustomCABundle(bytes.NewReader(pem)))
+	}
+
+	httpClient := awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		tr.DisableKeepAlives = ac.HTTP.DisableKeepAlives
+		if ac.HTTP.MaxIdleConnsPerHost > 0 {
+			tr.MaxIdleConnsPerHost = ac.HTTP.MaxIdleConnsPerHost
+		}
+		if ac.HTTP.IdleConnTimeout.Duration > 0 {
+			tr.IdleConnTimeout = ac.HTTP.IdleConnTimeout.Duration
+		}
+		if proxyURL != nil {
+			tr.Proxy = http.ProxyURL(proxyURL)
+		}
+	})
+	if ac.APITimeout.Duration > 0 {
+		httpClient = httpClient.WithTimeout(ac.APITimeout.Duration)
+	}
+	opts = append(opts, config.WithHTTPClient(httpClient))
+
+	awsCfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	if ac.EndpointURL != "" {
+		awsCfg.BaseEndpoint = aws.String(ac.EndpointURL)
+	}
+	return awsCfg, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"kinesis_consumer/consumer"
+)
+
+// FlushConfig is when a batching handler sends what it collected: once MaxRecords records or
+// MaxBytes bytes are pending, or MaxLatency after the batch was started, whichever comes first.
+// Small batches keep records fresh, big ones make fewer, cheaper calls.
+//
+//	"flush": {"max_records": 500, "max_bytes": "4MB", "max_latency": "1s", "max_in_flight": 4}
+type FlushConfig struct {
+	MaxRecords int      `json:"max_records"`
+	MaxBytes   byteSize `json:"max_bytes"`
+	MaxLatency Duration `json:"max_latency"`
+	// MaxInFlight is how many batches may be sending at once before the consumer waits, no
+	// limit when 0.
+	MaxInFlight int `json:"max_in_flight"`
+}
+
+// legacyFlush has the batch_size, linger and max_in_flight keys the batching handlers took before
+// "flush", still read as the flush settings they were so older configs keep their batch sizes.
+type legacyFlush struct {
+	// Deprecated: use flush.max_records.
+	BatchSize int `json:"batch_size"`
+	// Deprecated: use flush.max_latency.
+	Linger Duration `json:"linger"`
+	// Deprecated: use flush.max_in_flight.
+	MaxInFlight int `json:"max_in_flight"`
+}
+
+// flush returns fc with what it leaves unset taken from the deprecated keys, warning about each one
+// that is used.
+func (l legacyFlush) flush(handler string, fc FlushConfig) FlushConfig {
+	if l.BatchSize > 0 {
+		fmt.Printf("warning: the %s handler's batch_size is deprecated, use flush.max_records\n", handler)
+		if fc.MaxRecords <= 0 {
+			fc.MaxRecords = l.BatchSize
+		}
+	}
+	if l.Linger.Duration > 0 {
+		fmt.Printf("warning: the %s handler's linger is deprecated, use flush.max_latency\n", handler)
+		if fc.MaxLatency.Duration <= 0 {
+			fc.MaxLatency = l.Linger
+		}
+	}
+	if l.MaxInFlight > 0 {
+		fmt.Printf("warning: the %s handler's max_in_flight is deprecated, use flush.max_in_flight\n", handler)
+		if fc.MaxInFlight <= 0 {
+			fc.MaxInFlight = l.MaxInFlight
+		}
+	}
+	return fc
+}
+
+// batcher returns the batcher for fc, with what fc leaves unset taken from def, and MaxRecords and
+// MaxBytes capped at what the destination takes in one call (maxRecords 0 is no cap).
+func (fc FlushConfig) batcher(name string, def FlushConfig, maxRecords, maxBytes int, send func(items [][]byte) error) *asyncBatcher {
+	if fc.MaxRecords <= 0 {
+		fc.MaxRecords = def.MaxRecords
+	}
+	if maxRecords > 0 {
+		fc.MaxRecords = min(fc.MaxRecords, maxRecords)
+	}
+	if fc.MaxBytes <= 0 || int(fc.MaxBytes) > maxBytes {
+		fc.MaxBytes = byteSize(maxBytes)
+	}
+	if fc.MaxLatency.Duration <= 0 {
+		fc.MaxLatency = def.MaxLatency
+	}
+	if fc.MaxInFlight <= 0 {
+		fc.MaxInFlight = def.MaxInFlight
+	}
+	return &asyncBatcher{
+		name:        name,
+		maxItems:    fc.MaxRecords,
+		maxBytes:    int(fc.MaxBytes),
+		linger:      fc.MaxLatency.Duration,
+		maxInFlight: fc.MaxInFlight,
+		send:        send,
+	}
+}
+
+// asyncBatcher collects encoded records from a handler and sends them in batches. Each record is
+// acknowledged (consumer.Async) once its batch was sent. A failed batch acknowledges its records
+// with the error, which hands them to the poison policy: the shard is only checkpointed past them
+// once they're in the retry stream, or skipped to the DLQ and the audit log.
+type asyncBatcher struct {
+	// name is what failures are logged as
+	name     string
+	maxItems int
+	maxBytes int
+	// linger is how long a batch that isn't full waits for more records
+	linger time.Duration
+	// maxInFlight, when set, is how many batches may be sending at once; adding blocks while
+	// that many are, so a slow destination slows the consumer down instead of piling up batches
+	maxInFlight int
+	send        func(items [][]byte) error
+
+	mu      sync.Mutex
+	pending [][]byte
+	acks    []func(error)
+	size    int
+	timer   *time.Timer
+	sending chan struct{}
+	// inFlight counts the batches sending, up to their acks
+	inFlight sync.WaitGroup
+}
+
+// add queues item, which must not point into Record.Data. Called outside the consumer, where
+// there's nothing to acknowledge, it sends item right away.
+func (b *asyncBatcher) add(ctx context.Context, item []byte) error {
+	ack := consumer.Async(ctx)
+	if ack == nil {
+		return b.send([][]byte{item})
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.size+len(item) > b.maxBytes {
+		b.flush()
+	}
+	b.pending = append(b.pending, item)
+	b.acks = append(b.acks, ack)
+	b.size += len(item)
+	if len(b.pending) >= b.maxItems {
+		b.flush()
+	} else if b.timer == nil {
+		b.timer = time.AfterFunc(b.linger, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.flush()
+		})
+	}
+	return nil
+}
+
+// flush sends the pending batch in the background and acks its records when done, after waiting
+// for a free slot when maxInFlight batches are sending. b.mu must be held.
+func (b *asyncBatcher) flush() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.pending) == 0 {
+		return
+	}
+	items, acks := b.pending, b.acks
+	b.pending, b.acks, b.size = nil, nil, 0
+	if b.maxInFlight > 0 {
+		if b.sending == nil {
+			b.sending = make(chan struct{}, b.maxInFlight)
+		}
+		b.sending <- struct{}{}
+	}
+	b.inFlight.Add(1)
+	go func() {
+		defer b.inFlight.Done()
+		err := b.send(items)
+		if b.sending != nil {
+			<-b.sending
+		}
+		if err != nil {
+			fmt.Printf("\tsending %d records to %s failed, err=%+v\n", len(items), b.name, err)
+		}
+		for _, ack := range acks {
+			ack(err)
+		}
+	}()
+}
+
+// close sends what is still pending and waits until every batch was sent and acked, so the
+// handler and the poison policy behind the acks can be closed after it.
+func (b *asyncBatcher) close() {
+	b.mu.Lock()
+	b.flush()
+	b.mu.Unlock()
+	b.inFlight.Wait()
+}
+
+// appendField appends s to item with a uvarint length in front, for handlers that queue a record's
+// metadata (its partition key, the object it goes to) with its data.
+func appendField(item []byte, s string) []byte {
+	item = binary.AppendUvarint(item, uint64(len(s)))
+	return append(item, s...)
+}
+
+// cutField takes a field appendField added off the front of item.
+func cutField(item []byte) (string, []byte) {
+	n, size := binary.Uvarint(item)
+	return string(item[size : size+int(n)]), item[size+int(n):]
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeprecatedFlushKeys(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		maxItems    int
+		linger      time.Duration
+		maxInFlight int
+	}{
+		{"defaults", `{"table": "events"}`, 10000, time.Second, 0},
+		{"flush", `{"table": "events", "flush": {"max_records": 50, "max_latency": "2s"}}`, 50, 2 * time.Second, 0},
+		{"deprecated keys", `{"table": "events", "batch_size": 200, "linger": "5s", "max_in_flight": 2}`, 200, 5 * time.Second, 2},
+		{"flush wins", `{"table": "events", "batch_size": 200, "flush": {"max_records": 50}}`, 50, time.Second, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, closer, err := newClickHouseWriter([]byte(tt.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closer.Close()
+			b := closer.(*clickHouseWriter).batch
+			if b.maxItems != tt.maxItems || b.linger != tt.linger || b.maxInFlight != tt.maxInFlight {
+				t.Errorf("got %d records, %s, %d in flight, want %d, %s, %d",
+					b.maxItems, b.linger, b.maxInFlight, tt.maxItems, tt.linger, tt.maxInFlight)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"github.com/ulikunitz/xz/lzma"
+
+	"kinesis_consumer/consumer"
+)
+
+// Payload sizes in the bench corpus: a typical event, a batch of events and a fat record.
+var benchSizes = []struct {
+	name string
+	size int
+}{
+	{"small", 512},
+	{"medium", 16 << 10},
+	{"large", 512 << 10},
+}
+
+// benchPayload builds a JSON document of roughly size bytes that compresses like real event data.
+func benchPayload(size int) []byte {
+	var b strings.Builder
+	b.WriteString(`{"events":[`)
+	for i := 0; b.Len() < size; i++ {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `{"id":%d,"device":"dev-%04d","ts":%d,"price":%d.%02d,"qty":%d,"tags":["a","b"]}`,
+			i, i%977, 1700000000000+i*37, i%300, i%100, i%7)
+	}
+	b.WriteString(`]}`)
+	return []byte(b.String())
+}
+
+// benchFrame wraps data the way a8m/kinesis_producer does: variable length metadata in front,
+// 16 bytes at the end.
+func benchFrame(data []byte) []byte {
+	framed := append([]byte("\x0a\x07\x12\x05pk-42\x1a"), data...)
+	return append(framed, bytes.Repeat([]byte{0xee}, 16)...)
+}
+
+type benchCase struct {
+	name string
+	size int
+	fn   func(b *testing.B)
+}
+
+func benchCases(p *pipeline) []benchCase {
+	zstdEnc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+
+	f, _ := newFooter(p.cfg.Decode.Footer)
+
+	var cases []benchCase
+	for _, sz := range benchSizes {
+		payload := benchPayload(sz.size)
+
+		zstdRecord := benchFrame(zstdEnc.EncodeAll(payload, nil))
+		plainRecord := benchFrame(payload)
+		zstdStripped, _ := f.strip(zstdRecord)
+		plainStripped, _ := f.strip(plainRecord)
+
+		var gz bytes.Buffer
+		gw := gzip.NewWriter(&gz)
+		gw.Write(payload)
+		gw.Close()
+
+		var xz bytes.Buffer
+		lw, _ := lzma.NewWriter(&xz)
+		lw.Write(payload)
+		lw.Close()
+
+		lz := make([]byte, lz4.CompressBlockBound(len(payload)))
+		n, _ := lz4.CompressBlock(payload, lz, nil)
+		lz = lz[:n]
+
+		cases = append(cases,
+			benchCase{"zstd/" + sz.name, len(payload), func(b *testing.B) {
+				var buf []byte
+				for i := 0; i < b.N; i++ {
+					buf, _ = zstdDecompressTo(buf, zstdStripped)
+				}
+			}},
+			benchCase{"gzip/" + sz.name, len(payload), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					gzipDecompress(gz.Bytes())
+				}
+			}},
+			benchCase{"lzma/" + sz.name, len(payload), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					lzmaDecompress(xz.Bytes())
+				}
+			}},
+			benchCase{"lz4/" + sz.name, len(payload), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					lz4Decompress(lz)
+				}
+			}},
+			benchCase{"plain/" + sz.name, len(payload), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					decodeRecord(nil, plainStripped)
+				}
+			}},
+			benchCase{"pipeline/" + sz.name, len(payload), func(b *testing.B) {
+				ctx := context.Background()
+				discard := func(context.Context, *consumer.Record) error { return nil }
+				var buf []byte
+				for i := 0; i < b.N; i++ {
+					stripped, _ := f.strip(zstdRecord)
+					data, _, _ := decodeRecord(buf, stripped)
+					if cap(data) <= smallRecordSize {
+						buf = data[:0]
+					}
+					if t, err := p.transform.apply(data); err == nil {
+						data = t
+					}
+					if processed, err := p.plugin.apply(ctx, data); err == nil {
+						data = processed
+					}
+					discard(ctx, &consumer.Record{Data: data})
+				}
+			}},
+		)
+	}
+
+	// KPL aggregated records of 100 small events
+	events := make([][]byte, 100)
+	size := 0
+	for i := range events {
+		events[i] = benchPayload(256)
+		size += len(events[i])
+	}
+	aggregated := []types.Record{kplAggregate("1", []string{"pk-1", "pk-2", "pk-3"}, events...)}
+	cases = append(cases, benchCase{"deaggregate", size, func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			deaggregate(aggregated)
+		}
+	}})
+	return cases
+}
+
+// runBench is the "bench" subcommand. It times the decode paths and the record pipeline
+// (with the transform and WASM plugin from -config, if any) on a generated corpus, so a
+// slower build shows up as fewer records/sec or more allocations.
+func runBench(configPath string) {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		panic(err)
+	}
+	p, err := newPipeline(cfg)
+	if err != nil {
+		panic(err)
+	}
+	defer p.close()
+
+	fmt.Printf("%-18s %14s %12s %12s %12s\n", "benchmark", "records/sec", "MB/sec", "B/record", "allocs/rec")
+	for _, c := range benchCases(p) {
+		res := testing.Benchmark(func(b *testing.B) {
+			b.ReportAllocs()
+			c.fn(b)
+		})
+		perSec := float64(res.N) / res.T.Seconds()
+		fmt.Printf("%-18s %14.0f %12.1f %12d %12d\n",
+			c.name, perSec, perSec*float64(c.size)/1e6, res.AllocedBytesPerOp(), res.AllocsPerOp())
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/klauspost/compress/zstd"
+
+	"kinesis_consumer/consumer"
+)
+
+// The benchmarks time the decode paths, KPL deaggregation, the record pipeline and checkpointing
+// on a generated corpus, so a slower build shows up as fewer records/sec or more allocations:
+//
+//	go test -run '^$' -bench . -benchmem
+//
+// The bench subcommand runs the same decode and deaggregation cases without a Go toolchain.
+
+// benchSized runs fn as a sub-benchmark for each payload size, with the throughput in payload bytes.
+func benchSized(b *testing.B, fn func(b *testing.B, payload []byte)) {
+	for _, sz := range benchSizes {
+		payload := benchPayload(sz.size)
+		b.Run(sz.name, func(b *testing.B) {
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			fn(b, payload)
+		})
+	}
+}
+
+// BenchmarkDecode runs the cases of the bench subcommand: each codec, deaggregation and the
+// record pipeline up to the handler, on every payload size.
+func BenchmarkDecode(b *testing.B) {
+	p, err := newPipeline(defaultConfig())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer p.close()
+	for _, c := range benchCases(p) {
+		b.Run(c.name, func(b *testing.B) {
+			b.SetBytes(int64(c.size))
+			b.ReportAllocs()
+			c.fn(b)
+		})
+	}
+}
+
+func init() {
+	consumer.RegisterHandler("bench-discard", func(context.Context, *consumer.Record) error { return nil })
+}
+
+// BenchmarkPipeline times processBatch on batches of 100 framed zstd records, through decoding,
+// the transform and a handler that discards them.
+func BenchmarkPipeline(b *testing.B) {
+	cfg := defaultConfig()
+	cfg.Handler = "bench-discard"
+	p, err := newPipeline(cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer p.close()
+
+	enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	benchSized(b, func(b *testing.B, payload []byte) {
+		records := make([]types.Record, 100)
+		for i := range records {
+			records[i] = types.Record{
+				Data:           benchFrame(enc.EncodeAll(payload, nil)),
+				PartitionKey:   aws.String(fmt.Sprint("pk-", i)),
+				SequenceNumber: aws.String(fmt.Sprint(i)),
+			}
+		}
+		b.SetBytes(int64(len(payload) * len(records)))
+		ctx := context.Background()
+		decoder := newDecoderPool(cfg.Decode, cfg.StreamName)
+		defer decoder.close()
+		acks := newAckTracker(ctx, 0)
+
+		// processBatch logs every record; the benchmark's result is printed once this returns
+		stdout := os.Stdout
+		os.Stdout, _ = os.Open(os.DevNull)
+		defer func() { os.Stdout = stdout }()
+		for i := 0; i < b.N; i++ {
+			if _, err := p.processBatch(ctx, decoder, nil, acks, "shardId-000000000000", records, 0); err != nil {
+				b.Fatal(err)
+			}
+			acks.checkpoint(nil, "", "")
+		}
+	})
+}
+
+// BenchmarkCheckpoint times storing a shard's checkpoint in the bolt store.
+func BenchmarkCheckpoint(b *testing.B) {
+	store, err := openBoltStore(filepath.Join(b.TempDir(), "checkpoints.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer store.Close()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := store.Set("stream", "shardId-000000000000", fmt.Sprintf("49590338271490256608559692538361571095921575989%09d", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
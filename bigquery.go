@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	"kinesis_consumer/consumer"
+)
+
+// BigQueryConfig is the handler_config of the "bigquery" handler.
+//
+//	"handler": "bigquery",
+//	"handler_config": {"project": "analytics", "dataset": "kinesis", "table": "events",
+//		"columns": {"ts": "timestamp", "device": "device.id", "shard": "@shard", "raw": "@data"},
+//		"dead_letter": "bigquery-rejected.jsonl"}
+type BigQueryConfig struct {
+	Project string `json:"project"`
+	Dataset string `json:"dataset"`
+	Table   string `json:"table"`
+	// Columns maps each column to a field of the JSON payload, like the clickhouse handler's;
+	// @arrival_time is an RFC 3339 timestamp. Without columns the payload's fields are the row.
+	Columns map[string]string `json:"columns"`
+	// IgnoreUnknownValues drops fields the table has no column for instead of rejecting the row.
+	IgnoreUnknownValues bool `json:"ignore_unknown_values"`
+	// DeadLetter is a file that gets the rows BigQuery rejects as invalid as JSON lines, with
+	// its errors. Without it a rejected row fails its batch, into "poison".
+	DeadLetter string `json:"dead_letter"`
+	// Endpoint is https://bigquery.googleapis.com when not set; an http:// one is taken to be an
+	// emulator and called without credentials.
+	Endpoint string `json:"endpoint"`
+	// Flush is 500 rows, 9MB and 1s when not set.
+	Flush FlushConfig `json:"flush"`
+}
+
+const (
+	// insertAll takes at most 10MB and 50000 rows a request
+	bigqueryMaxRequestBytes = 9 << 20
+	bigqueryMaxRows         = 50000
+	// bigqueryInsertAttempts is how often a request or row that fails for a reason other than
+	// being invalid is sent before giving up
+	bigqueryInsertAttempts = 5
+)
+
+var bigqueryRejectedRows = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "bigquery_rejected_rows_total",
+	Help:      "Rows BigQuery rejected as invalid, written to the bigquery handler's dead_letter.",
+})
+
+func init() {
+	consumer.RegisterHandlerFactory("bigquery", newBigQueryWriter)
+}
+
+// bigqueryWriter streams records into a BigQuery table with tabledata.insertAll, batched and
+// acknowledged like the pubsub handler's. Every row has the record's idempotency key as its
+// insertId, which BigQuery uses to drop rows sent again shortly after. A request BigQuery throttles
+// or fails (429, 5xx) is sent again with backoff, and so are rows it failed to insert; the rows it
+// rejects as invalid go to the dead letter file while the rest of their batch is inserted.
+type bigqueryWriter struct {
+	cfg    BigQueryConfig
+	url    string
+	client *http.Client
+	batch  *asyncBatcher
+
+	// mu serializes writes to deadLetter, which is nil without cfg.DeadLetter
+	mu         sync.Mutex
+	deadLetter *os.File
+}
+
+type bigqueryRow struct {
+	InsertID string          `json:"insertId"`
+	JSON     json.RawMessage `json:"json"`
+}
+
+type bigqueryInsertErrors struct {
+	InsertErrors []struct {
+		Index  int               `json:"index"`
+		Errors []json.RawMessage `json:"errors"`
+	} `json:"insertErrors"`
+}
+
+func newBigQueryWriter(raw json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+	var cfg BigQueryConfig
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("invalid bigquery handler_config: %w", err)
+		}
+	}
+	if cfg.Project == "" || cfg.Dataset == "" || cfg.Table == "" {
+		return nil, nil, fmt.Errorf("the bigquery handler needs a project, dataset and table")
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://bigquery.googleapis.com"
+	}
+
+	client := &http.Client{Timeout: time.Minute}
+	if !strings.HasPrefix(cfg.Endpoint, "http://") {
+		ts, err := google.DefaultTokenSource(context.Background(), "https://www.googleapis.com/auth/bigquery.insertdata")
+		if err != nil {
+			return nil, nil, fmt.Errorf("no Google credentials for bigquery: %w", err)
+		}
+		client.Transport = &oauth2.Transport{Source: ts}
+	}
+
+	w := &bigqueryWriter{
+		cfg: cfg,
+		url: fmt.Sprintf("%s/bigquery/v2/projects/%s/datasets/%s/tables/%s/insertAll",
+			strings.TrimSuffix(cfg.Endpoint, "/"), cfg.Project, cfg.Dataset, cfg.Table),
+		client: client,
+	}
+	if cfg.DeadLetter != "" {
+		var err error
+		if w.deadLetter, err = os.OpenFile(cfg.DeadLetter, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+			return nil, nil, fmt.Errorf("failed to open bigquery dead_letter %s: %w", cfg.DeadLetter, err)
+		}
+	}
+	w.batch = cfg.Flush.batcher("bigquery", FlushConfig{MaxRecords: 500, MaxLatency: Duration{time.Second}},
+		bigqueryMaxRows, bigqueryMaxRequestBytes, w.insert)
+	return w.handle, w, nil
+}
+
+// handle queues the record as an insertAll row.
+func (w *bigqueryWriter) handle(ctx context.Context, r *consumer.Record) error {
+	values, err := columnValues(r, w.cfg.Columns, time.RFC3339Nano)
+	if err != nil {
+		return err
+	}
+	row, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	item, err := json.Marshal(bigqueryRow{InsertID: r.IdempotencyKey(), JSON: row})
+	if err != nil {
+		return err
+	}
+	return w.batch.add(ctx, item)
+}
+
+// insert sends JSON encoded bigqueryRows in one insertAll request, and again the rows BigQuery
+// failed to insert, until only the invalid ones are left.
+func (w *bigqueryWriter) insert(rows [][]byte) error {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		failed, retry, err := w.post(rows)
+		if err == nil {
+			var rejected [][]byte
+			var rejections []json.RawMessage
+			rows, rejected, rejections = splitRejected(rows, failed)
+			if len(rejected) > 0 {
+				if err = w.deadLetterRows(rejected, rejections); err != nil {
+					return err
+				}
+			}
+			if len(rows) == 0 {
+				return nil
+			}
+			retry, err = true, fmt.Errorf("bigquery failed to insert %d rows, first %s", len(rows), firstError(failed))
+		}
+		if !retry || attempt == bigqueryInsertAttempts {
+			return err
+		}
+		fmt.Printf("\tbigquery insert failed, retrying in %v, err=%+v\n", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post sends rows in one insertAll request. It returns the rows' insert errors, or the request's
+// error and whether it is worth retrying.
+func (w *bigqueryWriter) post(rows [][]byte) (failed bigqueryInsertErrors, retry bool, err error) {
+	opts := fmt.Sprintf(`{"skipInvalidRows":true,"ignoreUnknownValues":%t,"rows":[`, w.cfg.IgnoreUnknownValues)
+	body := append([]byte(opts), bytes.Join(rows, []byte(","))...)
+	body = append(body, "]}"...)
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return failed, true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return failed, retry, fmt.Errorf("bigquery insertAll returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&failed); err != nil {
+		return failed, true, fmt.Errorf("invalid bigquery insertAll response: %w", err)
+	}
+	return failed, false, nil
+}
+
+// splitRejected sorts the rows of a request by its insert errors: the rows to send again, which
+// failed for another reason than being invalid, and the rejected ones with their errors. Rows
+// without errors were inserted.
+func splitRejected(rows [][]byte, failed bigqueryInsertErrors) (again, rejected [][]byte, rejections []json.RawMessage) {
+	for _, e := range failed.InsertErrors {
+		if e.Index < 0 || e.Index >= len(rows) {
+			continue
+		}
+		invalid := false
+		for _, reason := range e.Errors {
+			var re struct{ Reason string }
+			if json.Unmarshal(reason, &re) == nil && re.Reason == "invalid" {
+				invalid = true
+			}
+		}
+		if invalid {
+			errs, _ := json.Marshal(e.Errors)
+			rejected = append(rejected, rows[e.Index])
+			rejections = append(rejections, errs)
+		} else {
+			again = append(again, rows[e.Index])
+		}
+	}
+	return again, rejected, rejections
+}
+
+func firstError(failed bigqueryInsertErrors) string {
+	for _, e := range failed.InsertErrors {
+		if len(e.Errors) > 0 {
+			return string(e.Errors[0])
+		}
+	}
+	return "unknown"
+}
+
+// deadLetterRows writes rejected rows to the dead letter file, or fails their batch without one.
+func (w *bigqueryWriter) deadLetterRows(rows [][]byte, rejections []json.RawMessage) error {
+	if w.deadLetter == nil {
+		return fmt.Errorf("bigquery rejected %d rows, first %s", len(rows), rejections[0])
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i, item := range rows {
+		var row bigqueryRow
+		json.Unmarshal(item, &row)
+		line, _ := json.Marshal(map[string]any{
+			"time":            wallClock.Now().UTC(),
+			"table":           w.cfg.Project + "." + w.cfg.Dataset + "." + w.cfg.Table,
+			"idempotency_key": row.InsertID,
+			"row":             row.JSON,
+			"errors":          rejections[i],
+		})
+		if _, err := w.deadLetter.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("writing to the bigquery dead_letter failed: %w", err)
+		}
+	}
+	bigqueryRejectedRows.Add(float64(len(rows)))
+	return nil
+}
+
+// Close inserts what is still pending.
+func (w *bigqueryWriter) Close() error {
+	w.batch.close()
+	if w.deadLetter != nil {
+		return w.deadLetter.Close()
+	}
+	return nil
+}
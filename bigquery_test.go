@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"kinesis_consumer/consumer"
+)
+
+func TestBigQueryWriter(t *testing.T) {
+	tests := []struct {
+		name       string
+		deadLetter bool
+		wantErr    bool
+	}{
+		{"dead letter", true, false},
+		{"no dead letter", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			// inserted has the rows the fake took by insertId
+			inserted := make(map[string]map[string]any)
+			requests := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				requests++
+				if req.URL.Path != "/bigquery/v2/projects/p/datasets/d/tables/events/insertAll" {
+					t.Errorf("got path %s", req.URL.Path)
+				}
+				var in struct {
+					SkipInvalidRows bool
+					Rows            []struct {
+						InsertID string
+						JSON     map[string]any
+					}
+				}
+				if err := json.NewDecoder(req.Body).Decode(&in); err != nil || !in.SkipInvalidRows {
+					t.Fatalf("bad request, skipInvalidRows %v, err=%v", in.SkipInvalidRows, err)
+				}
+				var errs []string
+				for i, row := range in.Rows {
+					switch {
+					case row.JSON["device"] == nil:
+						errs = append(errs, fmt.Sprintf(`{"index": %d, "errors": [{"reason": "invalid", "location": "device", "message": "Missing required field"}]}`, i))
+					case row.JSON["device"] == "flaky" && requests == 1:
+						errs = append(errs, fmt.Sprintf(`{"index": %d, "errors": [{"reason": "backendError"}]}`, i))
+					default:
+						inserted[row.InsertID] = row.JSON
+					}
+				}
+				fmt.Fprintf(w, `{"kind": "bigquery#tableDataInsertAllResponse", "insertErrors": [%s]}`, strings.Join(errs, ","))
+			}))
+			defer srv.Close()
+
+			deadLetter := filepath.Join(t.TempDir(), "rejected.jsonl")
+			config := map[string]any{"project": "p", "dataset": "d", "table": "events", "endpoint": srv.URL,
+				"columns": map[string]string{"device": "device.id", "shard": "@shard"}, "flush": map[string]any{"max_records": 3}}
+			if tt.deadLetter {
+				config["dead_letter"] = deadLetter
+			}
+			raw, _ := json.Marshal(config)
+			handle, closer, err := newBigQueryWriter(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			payloads := []string{`{"device": {"id": "d-1"}}`, `{"other": 1}`, `{"device": {"id": "flaky"}}`}
+			acked := make(chan error, len(payloads))
+			for i, data := range payloads {
+				ctx, _ := consumer.NewAsyncContext(context.Background(), func(err error) { acked <- err })
+				r := &consumer.Record{ShardID: "shardId-000000000000", SequenceNumber: fmt.Sprint(i), Data: []byte(data)}
+				if err := handle(ctx, r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			closer.Close()
+			for range payloads {
+				if err := <-acked; (err != nil) != tt.wantErr {
+					t.Fatalf("ack err=%v, want error %v", err, tt.wantErr)
+				}
+			}
+			if tt.wantErr {
+				return
+			}
+
+			want := map[string]string{"shardId-000000000000:0": "d-1", "shardId-000000000000:2": "flaky"}
+			if len(inserted) != len(want) || requests != 2 {
+				t.Fatalf("inserted %v in %d requests, want %v in 2", inserted, requests, want)
+			}
+			for id, device := range want {
+				if row := inserted[id]; row["device"] != device || row["shard"] != "shardId-000000000000" {
+					t.Errorf("row %s is %v, want device %s", id, row, device)
+				}
+			}
+
+			f, err := os.Open(deadLetter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			var lines []map[string]any
+			for sc := bufio.NewScanner(f); sc.Scan(); {
+				var line map[string]any
+				if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+					t.Fatal(err)
+				}
+				lines = append(lines, line)
+			}
+			if len(lines) != 1 || lines[0]["idempotency_key"] != "shardId-000000000000:1" || lines[0]["table"] != "p.d.events" || lines[0]["errors"] == nil {
+				t.Errorf("dead letter has %v, want the row of record 1 with its errors", lines)
+			}
+		})
+	}
+}
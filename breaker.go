@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// CircuitBreakerConfig stops calling a handler whose downstream is down. After Failures failed
+// calls in a row the breaker opens: handler calls wait, and so does reading the shards, instead of
+// records being skipped to the DLQ. After OpenFor one call goes through as a probe and closes the
+// breaker again if it succeeds.
+//
+//	"poison": {"max_attempts": 3, "circuit_breaker": {"failures": 10, "open_for": "30s"}}
+type CircuitBreakerConfig struct {
+	// Failures in a row that open the breaker, off when 0. It must be above max_attempts, or a
+	// single poison record would open it and never be skipped.
+	Failures int `json:"failures"`
+	// OpenFor is how long the breaker stays open before a probe, 30s when not set.
+	OpenFor Duration `json:"open_for"`
+}
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var (
+	breakerState = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "circuit_breaker_state",
+		Help:      "State of the handler's circuit breaker: 0 closed, 1 open, 2 half-open.",
+	})
+	breakerOpens = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "circuit_breaker_opens_total",
+		Help:      "Times the handler's circuit breaker opened.",
+	})
+	routeBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "route_circuit_breaker_state",
+		Help:      "State of each router route's circuit breaker: 0 closed, 1 open, 2 half-open.",
+	}, []string{"route"})
+	routeBreakerOpens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "route_circuit_breaker_opens_total",
+		Help:      "Times each router route's circuit breaker opened.",
+	}, []string{"route"})
+)
+
+type circuitBreaker struct {
+	cfg CircuitBreakerConfig
+	// name is what the log lines call the breaker, gauge and opens its metrics
+	name  string
+	gauge prometheus.Gauge
+	opens prometheus.Counter
+	// onChange, if set, is called with mu held whenever the state changes
+	onChange func()
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	// changed is closed and replaced whenever the state changes, to wake up waiting calls
+	changed chan struct{}
+}
+
+// newCircuitBreaker returns nil when the breaker is off; a nil breaker lets every call through.
+func newCircuitBreaker(cfg CircuitBreakerConfig, maxAttempts int) (*circuitBreaker, error) {
+	if cfg.Failures <= 0 {
+		return nil, nil
+	}
+	if cfg.Failures <= maxAttempts {
+		return nil, fmt.Errorf("circuit_breaker.failures (%d) must be above max_attempts (%d)", cfg.Failures, maxAttempts)
+	}
+	if cfg.OpenFor.Duration <= 0 {
+		cfg.OpenFor.Duration = 30 * time.Second
+	}
+	breakerState.Set(breakerClosed)
+	return &circuitBreaker{cfg: cfg, name: "circuit breaker", gauge: breakerState, opens: breakerOpens, changed: make(chan struct{})}, nil
+}
+
+// newRouteBreaker returns the breaker of a router route, nil when it is off.
+func newRouteBreaker(route string, cfg CircuitBreakerConfig, maxAttempts int) (*circuitBreaker, error) {
+	if cfg.Failures <= 0 {
+		return nil, nil
+	}
+	b, err := newCircuitBreaker(cfg, maxAttempts)
+	if err != nil {
+		return nil, err
+	}
+	b.name, b.gauge, b.opens = "route "+route+" circuit breaker", routeBreakerState.WithLabelValues(route), routeBreakerOpens.WithLabelValues(route)
+	b.gauge.Set(breakerClosed)
+	return b, nil
+}
+
+// setState must be called with b.mu held.
+func (b *circuitBreaker) setState(state int) {
+	b.state = state
+	b.gauge.Set(float64(state))
+	close(b.changed)
+	b.changed = make(chan struct{})
+	if b.onChange != nil {
+		b.onChange()
+	}
+}
+
+// open reports whether the breaker is open or half-open; a nil breaker never is.
+func (b *circuitBreaker) open() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != breakerClosed
+}
+
+// try lets a call through right away while the breaker is closed, and as the one probe once it
+// has been open for open_for. Otherwise it returns how long to wait before trying again and the
+// channel that is closed when the state changes.
+func (b *circuitBreaker) try() (ok bool, wait time.Duration, changed <-chan struct{}) {
+	if b == nil {
+		return true, 0, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerClosed {
+		return true, 0, nil
+	}
+	wait = b.openedAt.Add(b.cfg.OpenFor.Duration).Sub(wallClock.Now())
+	if b.state == breakerOpen && wait <= 0 {
+		fmt.Printf("%s half-open, probing the handler\n", b.name)
+		b.setState(breakerHalfOpen)
+		return true, 0, nil
+	}
+	if b.state == breakerHalfOpen || wait <= 0 {
+		// a probe is out, wait for its result
+		wait = b.cfg.OpenFor.Duration
+	}
+	return false, wait, b.changed
+}
+
+// acquire waits until try lets a call through.
+func (b *circuitBreaker) acquire(ctx context.Context) error {
+	for {
+		ok, wait, changed := b.try()
+		if ok {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		case <-wallClock.After(wait):
+		}
+	}
+}
+
+// done reports how a call went. tripped is true when the call's failure opened the breaker from
+// closed, so it failed because the downstream is down rather than because of the record. Failed
+// probes and failures while the breaker is open count against their record: a poison record that
+// ends up as the probe still reaches the DLQ.
+func (b *circuitBreaker) done(err error) (tripped bool) {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		if b.state != breakerClosed {
+			fmt.Printf("%s closed, the handler works again\n", b.name)
+			b.setState(breakerClosed)
+		}
+		return false
+	}
+
+	switch b.state {
+	case breakerClosed:
+		if b.failures++; b.failures < b.cfg.Failures {
+			return false
+		}
+		fmt.Printf("%s open after %d failures in a row, pausing for %s, err=%+v\n", b.name, b.failures, b.cfg.OpenFor, err)
+		b.opens.Inc()
+		b.openedAt = wallClock.Now()
+		b.setState(breakerOpen)
+		return true
+	case breakerHalfOpen:
+		fmt.Printf("%s probe failed, pausing for %s, err=%+v\n", b.name, b.cfg.OpenFor, err)
+		b.openedAt = wallClock.Now()
+		b.setState(breakerOpen)
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"kinesis_consumer/consumer"
+)
+
+// useFakeWallClock swaps wallClock for a FakeClock standing at the current time, so deadlines the
+// standard library keeps on the real clock, like a context's, stay in the future.
+func useFakeWallClock(t *testing.T) *consumer.FakeClock {
+	fake := consumer.NewFakeClock(time.Now())
+	old := wallClock
+	wallClock = fake
+	t.Cleanup(func() { wallClock = old })
+	return fake
+}
+
+// waitForWaiters waits until n timers are waiting on fake, which goroutines start on their own.
+func waitForWaiters(t *testing.T, fake *consumer.FakeClock, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); fake.Waiters() < n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d timers waiting, want %d", fake.Waiters(), n)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	failed := errors.New("downstream down")
+	tests := []struct {
+		name string
+		// results are the calls reported before acquiring
+		results []error
+		// advance is how far the clock moves while acquire waits
+		advance   time.Duration
+		wantWait  bool
+		wantState int
+	}{
+		{"closed", []error{failed, failed}, 0, false, breakerClosed},
+		{"success resets the count", []error{failed, failed, nil, failed, failed}, 0, false, breakerClosed},
+		{"open until open_for", []error{failed, failed, failed}, 30 * time.Second, true, breakerHalfOpen},
+		{"probe failed", []error{failed, failed, failed, failed}, 30 * time.Second, true, breakerHalfOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeWallClock(t)
+			b, err := newCircuitBreaker(CircuitBreakerConfig{Failures: 3, OpenFor: Duration{30 * time.Second}}, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range tt.results {
+				if b.state == breakerOpen {
+					// the probe after a trip
+					fake.Advance(b.cfg.OpenFor.Duration)
+					if err := b.acquire(context.Background()); err != nil {
+						t.Fatal(err)
+					}
+				}
+				b.done(r)
+			}
+
+			acquired := make(chan error, 1)
+			go func() { acquired <- b.acquire(context.Background()) }()
+			if tt.wantWait {
+				waitForWaiters(t, fake, 1)
+				fake.Advance(tt.advance - time.Second)
+				select {
+				case <-acquired:
+					t.Fatal("call went through before open_for")
+				case <-time.After(10 * time.Millisecond):
+				}
+				fake.Advance(time.Second)
+			}
+			select {
+			case err := <-acquired:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("call still waiting")
+			}
+			if b.state != tt.wantState {
+				t.Errorf("state %d, want %d", b.state, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerProbe(t *testing.T) {
+	tests := []struct {
+		name      string
+		probe     error
+		wantState int
+	}{
+		{"succeeds", nil, breakerClosed},
+		{"fails", errors.New("still down"), breakerOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeWallClock(t)
+			b, err := newCircuitBreaker(CircuitBreakerConfig{Failures: 2, OpenFor: Duration{time.Minute}}, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.done(errors.New("down"))
+			if !b.done(errors.New("down")) {
+				t.Fatal("breaker didn't trip")
+			}
+			fake.Advance(time.Minute)
+			if err := b.acquire(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if tripped := b.done(tt.probe); tripped {
+				t.Error("probe counted as a trip")
+			}
+			if b.state != tt.wantState {
+				t.Errorf("state %d, want %d", b.state, tt.wantState)
+			}
+			if tt.wantState == breakerOpen && !b.openedAt.Equal(fake.Now()) {
+				t.Errorf("reopened at %s, want %s", b.openedAt, fake.Now())
+			}
+		})
+	}
+}
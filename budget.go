@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var inflightBytes = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "inflight_bytes",
+	Help:      "Compressed plus decompressed bytes of the batches currently being processed.",
+})
+
+// byteBudget caps the bytes held by batches in flight across all shards. A batch that doesn't fit
+// waits until others are released, except when nothing else is in flight: a single batch bigger
+// than the whole budget is let through rather than waiting forever.
+type byteBudget struct {
+	max int64
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	used int64
+}
+
+func newByteBudget(max int64) *byteBudget {
+	if max <= 0 {
+		return nil
+	}
+	b := &byteBudget{max: max}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire blocks until n bytes fit in the budget or ctx is done.
+func (b *byteBudget) acquire(ctx context.Context, n int64) error {
+	if b == nil || n <= 0 {
+		return nil
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.cond.Broadcast()
+	})
+	defer stop()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.used > 0 && b.used+n > b.max {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b.cond.Wait()
+	}
+	b.used += n
+	inflightBytes.Set(float64(b.used))
+	return nil
+}
+
+// grow adds n bytes to a batch that already holds some, its decompressed records, without waiting:
+// a batch waiting for more while it holds bytes could wait for batches that wait for it. The bytes
+// count all the same, so batches that haven't started wait until they're released.
+func (b *byteBudget) grow(n int64) {
+	if b == nil || n <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used += n
+	inflightBytes.Set(float64(b.used))
+}
+
+func (b *byteBudget) release(n int64) {
+	if b == nil || n <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	inflightBytes.Set(float64(b.used))
+	b.cond.Broadcast()
+}
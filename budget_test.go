@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+func TestByteBudgetGrowDoesNotWait(t *testing.T) {
+	// two batches that are let in and then decompress past the budget must both get through
+	b := newByteBudget(100)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := b.acquire(ctx, 60); err != nil {
+		t.Fatal(err)
+	}
+	b.grow(200)
+
+	second := make(chan error, 1)
+	go func() { second <- b.acquire(ctx, 30) }()
+	select {
+	case err := <-second:
+		t.Fatalf("second batch let in over the budget, err=%v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	b.release(260)
+	if err := <-second; err != nil {
+		t.Fatal(err)
+	}
+	b.grow(500)
+	b.release(530)
+	if b.used != 0 {
+		t.Errorf("%d bytes still used", b.used)
+	}
+}
+
+func TestProcessBatchReleasesReservation(t *testing.T) {
+	defer func(b *byteBudget) { memoryBudget = b }(memoryBudget)
+	memoryBudget = newByteBudget(2 * maxGetRecordsBytes)
+
+	cfg := defaultConfig()
+	cfg.Handler = "bench-discard"
+	p, err := newPipeline(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+	ctx := context.Background()
+	decoder := newDecoderPool(cfg.Decode, cfg.StreamName)
+	defer decoder.close()
+
+	// reserved before the fetch, as processKinesisRecords does
+	if err := memoryBudget.acquire(ctx, maxGetRecordsBytes); err != nil {
+		t.Fatal(err)
+	}
+	records := []types.Record{{Data: []byte("record"), PartitionKey: aws.String("pk"), SequenceNumber: aws.String("1")}}
+	if _, err := p.processBatch(ctx, decoder, nil, newAckTracker(ctx, 0), "shardId-000000000000", records, maxGetRecordsBytes); err != nil {
+		t.Fatal(err)
+	}
+	if memoryBudget.used != 0 {
+		t.Errorf("%d bytes still used after the batch", memoryBudget.used)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	bolt "go.etcd.io/bbolt"
+
+	"kinesis_consumer/consumer"
+)
+
+// checkpointStore remembers the last sequence number handled per stream and shard,
+// so a restart picks up AFTER_SEQUENCE_NUMBER instead of replaying or skipping data.
+type checkpointStore interface {
+	Get(stream, shard string) (seq string, err error)
+	Set(stream, shard, seq string) error
+	List() ([]checkpoint, error)
+	Close() error
+}
+
+// A checkpoint is normally the last handled sequence number. "checkpoint reset" can also store
+// TRIM_HORIZON, LATEST or AT_TIMESTAMP:<RFC 3339 time> to force where the next start reads from.
+type checkpoint struct {
+	Stream         string `json:"stream"`
+	Shard          string `json:"shard"`
+	SequenceNumber string `json:"sequence_number"`
+}
+
+const atTimestampPrefix = string(types.ShardIteratorTypeAtTimestamp) + ":"
+
+// applyCheckpoint points a GetShardIterator request at a stored checkpoint.
+func applyCheckpoint(in *kinesis.GetShardIteratorInput, seq string) error {
+	switch {
+	case seq == string(types.ShardIteratorTypeTrimHorizon) || seq == string(types.ShardIteratorTypeLatest):
+		in.ShardIteratorType = types.ShardIteratorType(seq)
+	case strings.HasPrefix(seq, atTimestampPrefix):
+		ts, err := time.Parse(time.RFC3339, strings.TrimPrefix(seq, atTimestampPrefix))
+		if err != nil {
+			return fmt.Errorf("invalid checkpoint %q: %w", seq, err)
+		}
+		in.ShardIteratorType = types.ShardIteratorTypeAtTimestamp
+		in.Timestamp = aws.Time(ts)
+	default:
+		in.ShardIteratorType = types.ShardIteratorTypeAfterSequenceNumber
+		in.StartingSequenceNumber = aws.String(seq)
+	}
+	return nil
+}
+
+type CheckpointConfig struct {
+	// Path of the bolt file. Checkpointing is off when empty.
+	Path string `json:"path"`
+}
+
+var (
+	checkpointsBucket = []byte("checkpoints")
+	ownerBucket       = []byte("owner")
+)
+
+// boltStore keeps checkpoints in a local bbolt file, for single-node deployments without DynamoDB.
+// bbolt takes an exclusive file lock, so a second consumer pointed at the same file fails to start
+// instead of fighting over the shards; the owner bucket records who holds it.
+type boltStore struct {
+	db       *bolt.DB
+	readOnly bool
+}
+
+// boltLockTimeout is how long opening a store waits for the file lock another consumer holds.
+var boltLockTimeout = 5 * time.Second
+
+// openBolt opens the bbolt file at path, failing with consumer.ErrCheckpointConflict when another
+// consumer holds its lock.
+func openBolt(path string, readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltLockTimeout, ReadOnly: readOnly})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, consumer.ErrCheckpointConflict
+	}
+	return db, err
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	if err := compactBolt(path); err != nil {
+		return nil, err
+	}
+
+	db, err := openBolt(path, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open checkpoint store %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(checkpointsBucket); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucketIfNotExists(ownerBucket)
+		if err != nil {
+			return err
+		}
+		if prev := b.Get([]byte("current")); prev != nil {
+			fmt.Println("checkpoint store was not released by its last owner, it probably crashed:", string(prev))
+		}
+		host, _ := os.Hostname()
+		owner, _ := json.Marshal(map[string]any{"host": host, "pid": os.Getpid(), "since": time.Now().UTC()})
+		return b.Put([]byte("current"), owner)
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize checkpoint store %s: %w", path, err)
+	}
+	return &boltStore{db: db}, nil
+}
+
+// openBoltStoreReadOnly opens an existing store for reading only: no compaction and no owner entry.
+func openBoltStoreReadOnly(path string) (*boltStore, error) {
+	db, err := openBolt(path, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open checkpoint store %s: %w", path, err)
+	}
+	return &boltStore{db: db, readOnly: true}, nil
+}
+
+func checkpointKey(stream, shard string) []byte {
+	return []byte(stream + "/" + shard)
+}
+
+func (s *boltStore) Get(stream, shard string) (seq string, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(checkpointsBucket); b != nil {
+			seq = string(b.Get(checkpointKey(stream, shard)))
+		}
+		return nil
+	})
+	return
+}
+
+func (s *boltStore) Set(stream, shard, seq string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(checkpointsBucket).Put(checkpointKey(stream, shard), []byte(seq))
+	})
+}
+
+func (s *boltStore) List() (checkpoints []checkpoint, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(checkpointsBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			stream, shard, _ := strings.Cut(string(k), "/")
+			checkpoints = append(checkpoints, checkpoint{Stream: stream, Shard: shard, SequenceNumber: string(v)})
+			return nil
+		})
+	})
+	return
+}
+
+// Close releases the store explicitly: the owner entry is removed so whoever opens it next
+// can tell the previous consumer shut down cleanly rather than crashed.
+func (s *boltStore) Close() error {
+	if s.readOnly {
+		return s.db.Close()
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(ownerBucket).Delete([]byte("current"))
+	})
+	if err != nil {
+		fmt.Printf("failed to release checkpoint store, err=%+v\n", err)
+	}
+	return s.db.Close()
+}
+
+// compactBolt rewrites the file at startup so pages freed by checkpoint updates are given back.
+func compactBolt(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	src, err := openBolt(path, true)
+	if err != nil {
+		return fmt.Errorf("failed to open checkpoint store %s for compaction: %w", path, err)
+	}
+
+	tmp := path + ".compact"
+	os.Remove(tmp)
+	dst, err := bolt.Open(tmp, 0600, nil)
+	if err != nil {
+		src.Close()
+		return fmt.Errorf("failed to create %s: %w", tmp, err)
+	}
+	err = bolt.Compact(dst, src, 1<<20)
+	// Windows can't replace a file that is still open, so both are closed before the rename
+	src.Close()
+	if err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to compact checkpoint store %s: %w", path, err)
+	}
+	if err = dst.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// dryRunStore reads checkpoints from the real store, if there is one, and only prints writes.
+type dryRunStore struct {
+	store checkpointStore
+}
+
+func (s dryRunStore) Get(stream, shard string) (string, error) {
+	if s.store == nil {
+		return "", nil
+	}
+	return s.store.Get(stream, shard)
+}
+
+func (s dryRunStore) Set(stream, shard, seq string) error {
+	fmt.Printf("dry-run: would checkpoint %s/%s at %s\n", stream, shard, seq)
+	return nil
+}
+
+func (s dryRunStore) List() ([]checkpoint, error) {
+	if s.store == nil {
+		return nil, nil
+	}
+	return s.store.List()
+}
+
+func (s dryRunStore) Close() error {
+	if s.store == nil {
+		return nil
+	}
+	return s.store.Close()
+}
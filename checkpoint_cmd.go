@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+const checkpointUsage = `usage: kinesis_consumer [-config file] checkpoint <command> [args]
+
+commands:
+  export [-o file]   write all checkpoints as JSON (stdout by default)
+  import [-i file]   restore checkpoints from JSON written by export (stdin by default)
+  reset -to trim-horizon|latest|<RFC 3339 time> [-stream name] [-shard id]
+                     make the next start read from there; without -shard (or with
+                     -shard "*") every checkpointed shard of the stream is reset
+`
+
+// runCheckpoint is the "checkpoint" subcommand. It works on the store named in the config file,
+// which must not be in use by a running consumer.
+func runCheckpoint(configPath string, args []string) {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, checkpointUsage)
+		os.Exit(2)
+	}
+	// the store is closed by the time this exits
+	if err := checkpointCommand(configPath, args); err != nil {
+		fatalf("%v", err)
+	}
+}
+
+func checkpointCommand(configPath string, args []string) error {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	var store checkpointStore
+	switch {
+	case cfg.Lease.Backend != "":
+		store, err = openLeaseStore(cfg)
+	case cfg.Checkpoint.Path != "":
+		store, err = openBoltStore(cfg.Checkpoint.Path)
+	default:
+		return fmt.Errorf("no checkpoint store configured, set checkpoint.path in the config file")
+	}
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if err := operatorAudit.open(cfg); err != nil {
+		return err
+	}
+	defer operatorAudit.close()
+
+	switch args[0] {
+	case "export":
+		fs := flag.NewFlagSet("checkpoint export", flag.ExitOnError)
+		out := fs.String("o", "", "output file")
+		fs.Parse(args[1:])
+		if err := exportCheckpoints(store, *out); err != nil {
+			return fmt.Errorf("export failed: %w", err)
+		}
+	case "import":
+		fs := flag.NewFlagSet("checkpoint import", flag.ExitOnError)
+		in := fs.String("i", "", "input file")
+		fs.Parse(args[1:])
+		if err := importCheckpoints(store, *in); err != nil {
+			return fmt.Errorf("import failed: %w", err)
+		}
+	case "reset":
+		fs := flag.NewFlagSet("checkpoint reset", flag.ExitOnError)
+		to := fs.String("to", "", "trim-horizon, latest or an RFC 3339 time")
+		stream := fs.String("stream", cfg.StreamName, "stream name")
+		shard := fs.String("shard", "", "shard id, all checkpointed shards of the stream if empty")
+		fs.Parse(args[1:])
+		if err := resetCheckpoints(store, *stream, *shard, *to, cfg.ShardID); err != nil {
+			return fmt.Errorf("reset failed: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown checkpoint command %q\n%s", args[0], checkpointUsage)
+	}
+	return nil
+}
+
+func exportCheckpoints(store checkpointStore, path string) error {
+	checkpoints, err := store.List()
+	if err != nil {
+		return err
+	}
+	if checkpoints == nil {
+		checkpoints = []checkpoint{}
+	}
+
+	var w io.Writer = os.Stdout
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(checkpoints)
+}
+
+func importCheckpoints(store checkpointStore, path string) error {
+	var r io.Reader = os.Stdin
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var checkpoints []checkpoint
+	if err := json.NewDecoder(r).Decode(&checkpoints); err != nil {
+		return fmt.Errorf("invalid checkpoint JSON: %w", err)
+	}
+	for _, c := range checkpoints {
+		if c.Stream == "" || c.Shard == "" || c.SequenceNumber == "" {
+			return fmt.Errorf("checkpoint %+v is missing stream, shard or sequence_number", c)
+		}
+		old, err := store.Get(c.Stream, c.Shard)
+		if err != nil {
+			return err
+		}
+		if err := store.Set(c.Stream, c.Shard, c.SequenceNumber); err != nil {
+			return err
+		}
+		operatorAudit.record("checkpoint_import", localOperator(), map[string]any{
+			"stream": c.Stream, "shard": c.Shard, "from": old, "to": c.SequenceNumber,
+		})
+		fmt.Fprintf(os.Stderr, "%s/%s -> %s\n", c.Stream, c.Shard, c.SequenceNumber)
+	}
+	return nil
+}
+
+func resetCheckpoints(store checkpointStore, stream, shard, to, defaultShard string) error {
+	var position string
+	switch to {
+	case "trim-horizon":
+		position = string(types.ShardIteratorTypeTrimHorizon)
+	case "latest":
+		// the tip as of now, not of whenever the consumer starts next: LATEST would be resolved again
+		// on every start until a record is checkpointed, skipping what was written in between
+		position = atTimestampPrefix + wallClock.Now().UTC().Format(time.RFC3339Nano)
+	case "":
+		return fmt.Errorf("-to is required")
+	default:
+		ts, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return fmt.Errorf("-to must be trim-horizon, latest or an RFC 3339 time: %w", err)
+		}
+		position = atTimestampPrefix + ts.UTC().Format(time.RFC3339)
+	}
+
+	shards := []string{shard}
+	if shard == "" || shard == allShards {
+		checkpoints, err := store.List()
+		if err != nil {
+			return err
+		}
+		shards = nil
+		for _, c := range checkpoints {
+			if c.Stream == stream {
+				shards = append(shards, c.Shard)
+			}
+		}
+		if len(shards) == 0 {
+			shards = []string{defaultShard}
+		}
+	}
+	// no shard reads a checkpoint stored under "*"
+	if len(shards) == 1 && shards[0] == allShards {
+		return fmt.Errorf("no shard of %s is checkpointed yet and shard_id is %q, pass -shard to reset one", stream, allShards)
+	}
+
+	for _, s := range shards {
+		old, err := store.Get(stream, s)
+		if err != nil {
+			return err
+		}
+		if err := store.Set(stream, s, position); err != nil {
+			return err
+		}
+		operatorAudit.record("checkpoint_reset", localOperator(), map[string]any{
+			"stream": stream, "shard": s, "from": old, "to": position,
+		})
+		fmt.Fprintf(os.Stderr, "%s/%s: %q -> %s\n", stream, s, old, position)
+	}
+	return nil
+}
+
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
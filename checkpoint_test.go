@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+
+	"kinesis_consumer/consumer"
+)
+
+// TestHoldBoltStore isn't a test: run by TestBoltStoreConflict as the second process, it holds the
+// store named by HOLD_BOLT_STORE until its stdin is closed.
+func TestHoldBoltStore(t *testing.T) {
+	path := os.Getenv("HOLD_BOLT_STORE")
+	if path == "" {
+		t.Skip("only run by TestBoltStoreConflict")
+	}
+	s, err := openBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	os.Stdout.WriteString("holding\n")
+	bufio.NewReader(os.Stdin).ReadString('\n')
+}
+
+func TestBoltStoreConflict(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoints.db")
+	s, err := openBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	holder := exec.Command(os.Args[0], "-test.run=^TestHoldBoltStore$")
+	holder.Env = append(os.Environ(), "HOLD_BOLT_STORE="+path)
+	stdin, _ := holder.StdinPipe()
+	stdout, _ := holder.StdoutPipe()
+	if err := holder.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Wait()
+	defer stdin.Close()
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); line != "holding\n" {
+		t.Fatalf("second process didn't open the store: %q, %v", line, err)
+	}
+
+	defer func(timeout time.Duration) { boltLockTimeout = timeout }(boltLockTimeout)
+	boltLockTimeout = 100 * time.Millisecond
+	if _, err := openBoltStore(path); !errors.Is(err, consumer.ErrCheckpointConflict) {
+		t.Errorf("opening a held store failed with %v, want ErrCheckpointConflict", err)
+	}
+	if _, err := openBoltStoreReadOnly(path); !errors.Is(err, consumer.ErrCheckpointConflict) {
+		t.Errorf("reading a held store failed with %v, want ErrCheckpointConflict", err)
+	}
+}
+
+func TestShardStartMaxAgeOnlyWithoutCheckpoint(t *testing.T) {
+	s, err := openBoltStore(filepath.Join(t.TempDir(), "checkpoints.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cfg := &Config{StreamName: "stream", ShardIteratorType: "TRIM_HORIZON", MaxAge: Duration{time.Hour}}
+
+	in, err := shardStart(cfg, s, "shardId-000000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.ShardIteratorType != types.ShardIteratorTypeAtTimestamp {
+		t.Errorf("shard without a checkpoint starts at %s, want AT_TIMESTAMP", in.ShardIteratorType)
+	}
+
+	// as left by checkpoint reset -to trim-horizon
+	if err := s.Set("stream", "shardId-000000000001", "TRIM_HORIZON"); err != nil {
+		t.Fatal(err)
+	}
+	if in, err = shardStart(cfg, s, "shardId-000000000001"); err != nil {
+		t.Fatal(err)
+	}
+	if in.ShardIteratorType != types.ShardIteratorTypeTrimHorizon {
+		t.Errorf("shard reset to TRIM_HORIZON starts at %s", in.ShardIteratorType)
+	}
+}
+
+func TestResetCheckpointsAllShards(t *testing.T) {
+	s, err := openBoltStore(filepath.Join(t.TempDir(), "checkpoints.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := resetCheckpoints(s, "stream", "", "trim-horizon", allShards); err == nil {
+		t.Error("reset of a stream without checkpoints and shard_id \"*\" succeeded")
+	}
+	if seq, _ := s.Get("stream", allShards); seq != "" {
+		t.Errorf("checkpoint stored under %q", allShards)
+	}
+
+	s.Set("stream", "shardId-000000000000", "49590338271490256608559692538361571095921575989136588898")
+	if err := resetCheckpoints(s, "stream", allShards, "latest", allShards); err != nil {
+		t.Fatal(err)
+	}
+	if seq, _ := s.Get("stream", "shardId-000000000000"); !strings.HasPrefix(seq, atTimestampPrefix) {
+		t.Errorf("checkpointed shard reset to %q, want the time of the reset", seq)
+	}
+}
+
+func TestShardStartPinsLatestCheckpoint(t *testing.T) {
+	s, err := openBoltStore(filepath.Join(t.TempDir(), "checkpoints.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	at := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	defer func(c consumer.Clock) { wallClock = c }(wallClock)
+	wallClock = consumer.NewFakeClock(at)
+	cfg := &Config{StreamName: "stream"}
+
+	s.Set("stream", "shardId-000000000000", "LATEST")
+	for range 2 {
+		in, err := shardStart(cfg, s, "shardId-000000000000")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if in.ShardIteratorType != types.ShardIteratorTypeAtTimestamp || !in.Timestamp.Equal(at) {
+			t.Errorf("LATEST checkpoint starts at %s %v, want AT_TIMESTAMP %s", in.ShardIteratorType, in.Timestamp, at)
+		}
+		// a restart later still starts where the first one did
+		wallClock.(*consumer.FakeClock).Advance(time.Hour)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"kinesis_consumer/consumer"
+)
+
+// ClickHouseConfig is the handler_config of the "clickhouse" handler.
+//
+//	"handler": "clickhouse",
+//	"handler_config": {"url": "http://localhost:8123", "table": "events",
+//		"columns": {"ts": "timestamp", "device": "device.id", "shard": "@shard", "raw": "@data"},
+//		"flush": {"max_records": 10000, "max_latency": "1s"}}
+type ClickHouseConfig struct {
+	// URL of the HTTP interface, http://localhost:8123 when not set.
+	URL      string `json:"url"`
+	Database string `json:"database"`
+	Table    string `json:"table"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Columns maps each column to a field of the JSON payload, or to @partition_key, @shard,
+	// @sequence_number, @arrival_time or @data (the whole payload as a string). Without columns
+	// the payload's fields are inserted as they are.
+	Columns map[string]string `json:"columns"`
+	// Flush is 10000 records, 64MB and 1s when not set.
+	Flush FlushConfig `json:"flush"`
+	legacyFlush
+}
+
+const clickHouseMaxInsertBytes = 64 << 20
+
+func init() {
+	consumer.RegisterHandlerFactory("clickhouse", newClickHouseWriter)
+}
+
+// clickHouseWriter inserts records into a ClickHouse table in JSONEachRow batches, as async inserts
+// the server buffers and flushes. Each insert waits for that flush before its records are
+// acknowledged, so checkpoints only move past rows ClickHouse has written or, after a failed
+// insert, the poison policy has moved on from.
+type clickHouseWriter struct {
+	cfg    ClickHouseConfig
+	url    string
+	client *http.Client
+	batch  *asyncBatcher
+}
+
+func newClickHouseWriter(raw json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+	cfg := ClickHouseConfig{URL: "http://localhost:8123"}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("invalid clickhouse handler_config: %w", err)
+		}
+	}
+	if !plainIdentifier.MatchString(cfg.Table) || (cfg.Database != "" && !plainIdentifier.MatchString(cfg.Database)) {
+		return nil, nil, fmt.Errorf("the clickhouse handler needs a table (and optional database) that is a plain identifier")
+	}
+
+	table := cfg.Table
+	if cfg.Database != "" {
+		table = cfg.Database + "." + table
+	}
+	query := url.Values{
+		"query":                 {"INSERT INTO " + table + " FORMAT JSONEachRow"},
+		"async_insert":          {"1"},
+		"wait_for_async_insert": {"1"},
+	}
+	w := &clickHouseWriter{
+		cfg:    cfg,
+		url:    strings.TrimSuffix(cfg.URL, "/") + "/?" + query.Encode(),
+		client: &http.Client{Timeout: time.Minute},
+	}
+	w.batch = cfg.flush("clickhouse", cfg.Flush).batcher("clickhouse", FlushConfig{MaxRecords: 10000, MaxLatency: Duration{time.Second}},
+		0, clickHouseMaxInsertBytes, w.insert)
+	return w.handle, w, nil
+}
+
+func (w *clickHouseWriter) handle(ctx context.Context, r *consumer.Record) error {
+	row, err := w.row(r)
+	if err != nil {
+		return err
+	}
+	return w.batch.add(ctx, row)
+}
+
+// row encodes r as a JSONEachRow line.
+func (w *clickHouseWriter) row(r *consumer.Record) ([]byte, error) {
+	row, err := columnValues(r, w.cfg.Columns, "2006-01-02 15:04:05.000")
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(row)
+}
+
+// insert sends JSONEachRow lines as one insert.
+func (w *clickHouseWriter) insert(rows [][]byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(bytes.Join(rows, []byte("\n"))))
+	if err != nil {
+		return err
+	}
+	if w.cfg.Username != "" {
+		req.SetBasicAuth(w.cfg.Username, w.cfg.Password)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("clickhouse insert returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// Close inserts what is still pending.
+func (w *clickHouseWriter) Close() error {
+	w.batch.close()
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"time"
+
+	"kinesis_consumer/consumer"
+)
+
+// clock is the time the consumer goes by where it waits or measures along with the records: priority
+// delays, aggregate windows, the freshness SLO and rate anomalies. Calls to AWS, timeouts and
+// shutdown stay on the wall clock.
+var clock = consumer.SystemClock()
+
+// wallClock is the time the consumer goes by where it waits on the handler or downstream instead:
+// handler timeouts, poison policy backoff, the circuit breaker and replay pacing. It stays the wall
+// clock during a replay in virtual time, which only moves as records are handled and would never
+// get a paused shard going again. Tests swap it for a FakeClock.
+var wallClock = consumer.SystemClock()
+
+// virtualClock is clock during a replay with -virtual-time, nil otherwise. It follows the arrival
+// times of the records handled, so windows close, freshness is measured and rates are evaluated as
+// when the records came in, however fast they are read now.
+var virtualClock *consumer.FakeClock
+
+func useVirtualTime(from time.Time) {
+	virtualClock = consumer.NewFakeClock(from)
+	clock = virtualClock
+}
+
+// advanceClock moves virtual time on to the arrival time of a record about to be handled.
+func advanceClock(arrival time.Time) {
+	if virtualClock != nil && !arrival.IsZero() {
+		virtualClock.AdvanceTo(arrival)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// A command is one of the things kinesis_consumer can do, picked by the first argument after the
+// flags. The flags before it are shared: -config by all commands, the rest by consume, tail and replay.
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(configPath string, opts consumeOptions, args []string)
+}
+
+var commands = []command{
+	{"consume", "", "read the stream and hand records to the handler, checkpointing as it goes (the default)",
+		func(configPath string, opts consumeOptions, _ []string) { runConsume(configPath, opts) }},
+	{"tail", "[-format text|lambda|protobuf] [-o file]", "print new records as they arrive, from LATEST, without touching checkpoints",
+		runTail},
+	{"replay", "-since 2h|<RFC 3339 time> [-speed 1x|10x|max] [-virtual-time]", "hand records from a point in time to the handler again, without touching checkpoints",
+		runReplay},
+	{"analyze", "duplicates|keys|throughput [-for 5m] ...", "sample the stream from LATEST and report on it, without touching checkpoints",
+		runAnalyze},
+	{"diff", "-key field -a from..to [-b from..to] [-a-stream s] [-b-stream s] ...", "compare the records of two time windows or two streams by a key field",
+		func(configPath string, _ consumeOptions, args []string) { runDiff(configPath, args) }},
+	{"cost", "[-for 1m] [-consumers n]", "compare the monthly cost of polling and enhanced fan-out at the measured throughput",
+		runCost},
+	{"produce", "[-partition-key key] [-codec zstd|gzip|none]", "put every line of stdin as a record",
+		func(configPath string, _ consumeOptions, args []string) { runProduce(configPath, args) }},
+	{"describe", "", "show the stream's retention, encryption and shard counts",
+		func(configPath string, _ consumeOptions, _ []string) { runDescribe(configPath) }},
+	{"shards", "", "list the stream's shards with their hash key ranges and parents",
+		func(configPath string, _ consumeOptions, _ []string) { runShards(configPath) }},
+	{"checkpoint", "export|import|reset ...", "manage the checkpoint store",
+		func(configPath string, _ consumeOptions, args []string) { runCheckpoint(configPath, args) }},
+	{"verify", "", "check that every checkpoint is still within the stream's retention",
+		func(configPath string, _ consumeOptions, _ []string) { runVerify(configPath) }},
+	{"verify-migration", "-old s -new s -key field [-since 10m] [-for 1h] [-grace 1m] ...", "check that an old and a new stream get the same records while a producer moves",
+		func(configPath string, _ consumeOptions, args []string) { runVerifyMigration(configPath, args) }},
+	{"verify-s3", "[-deep]", "check that the s3 handler's manifests archive every batch exactly once",
+		func(configPath string, _ consumeOptions, args []string) { runVerifyS3(configPath, args) }},
+	{"doctor", "", "check credentials and permissions before running",
+		func(configPath string, _ consumeOptions, _ []string) { runDoctor(configPath) }},
+	{"bench", "", "time the decoders and the record pipeline",
+		func(configPath string, _ consumeOptions, _ []string) { runBench(configPath) }},
+	{"corpus", "[-dir dir] [-update]", "check the decoders against the golden files in testdata/corpus",
+		func(_ string, _ consumeOptions, args []string) { runCorpus(args) }},
+	{"config", "schema [-handler name] [-json]", "list the config file's keys with their types and defaults",
+		func(_ string, _ consumeOptions, args []string) { runConfig(args) }},
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "usage: kinesis_consumer [flags] [command] [args]")
+	fmt.Fprintln(out, "\ncommands:")
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-16s %s\n", c.name, c.summary)
+		if c.args != "" {
+			fmt.Fprintf(out, "  %-16s   %s %s\n", "", c.name, c.args)
+		}
+	}
+	fmt.Fprintln(out, "\nflags:")
+	flag.PrintDefaults()
+}
+
+// runTail prints records from the tip of the stream with the print handler, like tail -f.
+// -format lambda writes them as Lambda Kinesis events instead, -format protobuf as Record messages.
+func runTail(configPath string, opts consumeOptions, args []string) {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	format := fs.String("format", "text", "text, lambda for Lambda Kinesis event JSON, one event per line, or protobuf for length-delimited Record messages (record.proto)")
+	out := fs.String("o", "", "with -format lambda, write the events to this file instead of stdout; with -format protobuf, where to write the records")
+	batch := fs.Int("batch-size", 1, "with -format lambda, records per event")
+	fs.Parse(args)
+
+	opts.iteratorType = string(types.ShardIteratorTypeLatest)
+	opts.noCheckpoints = true
+	switch *format {
+	case "text":
+		opts.handler = "print"
+	case "lambda":
+		cfg, err := loadConfig(configPath)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		sourceARN := cfg.StreamARN
+		if sourceARN == "" {
+			// the account isn't known without an API call, Lambda code rarely looks at it
+			sourceARN = fmt.Sprintf("arn:aws:kinesis:%s:000000000000:stream/%s", cfg.Region, cfg.StreamName)
+		}
+		opts.handler = "lambda"
+		opts.handlerConfig, _ = json.Marshal(LambdaConfig{Path: *out, BatchSize: *batch, EventSourceARN: sourceARN, AWSRegion: cfg.Region})
+	case "protobuf":
+		if *out == "" {
+			fatalf("tail -format protobuf needs -o")
+		}
+		opts.handler = "protobuf"
+		opts.handlerConfig, _ = json.Marshal(ProtobufConfig{Path: *out})
+	default:
+		fatalf("unknown tail format %q, want text, lambda or protobuf", *format)
+	}
+	runConsume(configPath, opts)
+}
+
+// runReplay reads from a point in time within retention with the configured handler. It starts
+// from the trim horizon bounded by max_age, so each shard starts at that time. -speed paces the
+// records by their arrival times instead of handing them over as fast as they are read.
+func runReplay(configPath string, opts consumeOptions, args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	since := fs.String("since", "", "how far back to start, a duration such as 2h or an RFC 3339 time")
+	speed := fs.String("speed", "max", "1x hands records over with the gaps they arrived with, 10x ten times faster, max as fast as they are read")
+	virtual := fs.Bool("virtual-time", false, "let time follow the arrival times of the records replayed, for windows, freshness and rates")
+	fs.Parse(args)
+	var err error
+	if opts.speed, err = parseSpeed(*speed); err != nil {
+		fatalf("%v", err)
+	}
+
+	var from time.Time
+	if d, err := time.ParseDuration(*since); err == nil {
+		from = time.Now().Add(-d)
+	} else if from, err = time.Parse(time.RFC3339, *since); err != nil {
+		fatalf("replay needs -since with a duration such as 2h or an RFC 3339 time")
+	}
+
+	opts.iteratorType = string(types.ShardIteratorTypeTrimHorizon)
+	opts.maxAge = time.Since(from)
+	opts.noCheckpoints = true
+	if *virtual {
+		opts.virtualFrom = from
+	}
+	fmt.Fprintln(os.Stderr, "replaying from", from.Format(time.RFC3339))
+	runConsume(configPath, opts)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// completion lists the commands, so it's added once they're initialized.
+func init() {
+	commands = append(commands, command{"completion", "bash|zsh|fish", "print a shell completion script, e.g. source <(kinesis_consumer completion bash)",
+		func(_ string, _ consumeOptions, args []string) { runCompletion(args) }})
+}
+
+// commandWords are what can follow a command, for shell completion.
+var commandWords = map[string][]string{
+	"analyze":          {"duplicates", "keys", "throughput"},
+	"checkpoint":       {"export", "import", "reset"},
+	"config":           {"schema"},
+	"completion":       {"bash", "zsh", "fish"},
+	"tail":             {"-format", "-o", "-batch-size"},
+	"replay":           {"-since", "-speed", "-virtual-time"},
+	"cost":             {"-for", "-consumers"},
+	"diff":             {"-key", "-a", "-b", "-a-stream", "-b-stream", "-ignore", "-show", "-json"},
+	"verify-migration": {"-old", "-new", "-key", "-since", "-for", "-grace", "-interval", "-ignore", "-json"},
+	"produce":          {"-partition-key", "-codec"},
+	"corpus":           {"-dir", "-update"},
+}
+
+// fileFlags take a path.
+var fileFlags = []string{"-config", "-report", "-ca-bundle", "-o", "-i", "-dir"}
+
+// runCompletion is the "completion" command, it prints a completion script for shell:
+//
+//	source <(kinesis_consumer completion bash)
+func runCompletion(args []string) {
+	if len(args) != 1 {
+		fatalf("usage: kinesis_consumer completion bash|zsh|fish")
+	}
+	var flags []string
+	flag.VisitAll(func(f *flag.Flag) { flags = append(flags, "-"+f.Name) })
+	sort.Strings(flags)
+
+	switch args[0] {
+	case "bash":
+		fmt.Print(bashCompletion(flags))
+	case "zsh":
+		fmt.Print("autoload -U +X bashcompinit && bashcompinit\n" + bashCompletion(flags))
+	case "fish":
+		fmt.Print(fishCompletion())
+	default:
+		fatalf("no completion for shell %q, want bash, zsh or fish", args[0])
+	}
+}
+
+func bashCompletion(flags []string) string {
+	names := make([]string, len(commands))
+	for i, c := range commands {
+		names[i] = c.name
+	}
+
+	var b strings.Builder
+	b.WriteString("_kinesis_consumer() {\n")
+	b.WriteString("\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\" cmd i\n")
+	fmt.Fprintf(&b, "\tcase \"$prev\" in\n\t%s)\n\t\tCOMPREPLY=($(compgen -f -- \"$cur\"))\n\t\treturn;;\n\tesac\n", strings.Join(fileFlags, "|"))
+	b.WriteString("\tfor ((i = 1; i < COMP_CWORD; i++)); do\n")
+	fmt.Fprintf(&b, "\t\tcase \"${COMP_WORDS[i]}\" in\n\t\t%s)\n\t\t\tcmd=\"${COMP_WORDS[i]}\"\n\t\t\tbreak;;\n\t\tesac\n", strings.Join(names, "|"))
+	b.WriteString("\tdone\n\tcase \"$cmd\" in\n")
+	fmt.Fprintf(&b, "\t\"\") COMPREPLY=($(compgen -W %q -- \"$cur\"));;\n", strings.Join(append(names, flags...), " "))
+	for _, name := range names {
+		if words := commandWords[name]; words != nil {
+			fmt.Fprintf(&b, "\t%s) COMPREPLY=($(compgen -W %q -- \"$cur\"));;\n", name, strings.Join(words, " "))
+		}
+	}
+	b.WriteString("\tesac\n}\ncomplete -F _kinesis_consumer kinesis_consumer\n")
+	return b.String()
+}
+
+func fishCompletion() string {
+	var b strings.Builder
+	b.WriteString("complete -c kinesis_consumer -f\n")
+	for _, c := range commands {
+		fmt.Fprintf(&b, "complete -c kinesis_consumer -n __fish_use_subcommand -a %s -d %s\n", c.name, fishQuote(c.summary))
+		for _, word := range commandWords[c.name] {
+			if opt, ok := strings.CutPrefix(word, "-"); ok {
+				fmt.Fprintf(&b, "complete -c kinesis_consumer -n '__fish_seen_subcommand_from %s' -o %s\n", c.name, opt)
+			} else {
+				fmt.Fprintf(&b, "complete -c kinesis_consumer -n '__fish_seen_subcommand_from %s' -a %s\n", c.name, word)
+			}
+		}
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		arg := " -r"
+		if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && bf.IsBoolFlag() {
+			arg = ""
+		}
+		fmt.Fprintf(&b, "complete -c kinesis_consumer -n __fish_use_subcommand -o %s%s -d %s\n", f.Name, arg, fishQuote(f.Usage))
+	})
+	for _, f := range fileFlags {
+		fmt.Fprintf(&b, "complete -c kinesis_consumer -o %s -r -F\n", strings.TrimPrefix(f, "-"))
+	}
+	return b.String()
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), "'", `\'`) + "'"
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionConfig compresses what the consumer writes out, independent of how records came in.
+//
+//	"dlq_compression": {"codec": "zstd", "level": 3}
+type CompressionConfig struct {
+	// Codec is "gzip", "zstd" or empty for none.
+	Codec string `json:"codec"`
+	// Level is the codec's own level (gzip 1-9, zstd 1-22), 0 keeps its default.
+	Level int `json:"level"`
+}
+
+func (cc CompressionConfig) validate() error {
+	switch cc.Codec {
+	case "":
+	case "gzip":
+		if cc.Level != 0 && (cc.Level < gzip.BestSpeed || cc.Level > gzip.BestCompression) {
+			return fmt.Errorf("gzip level must be 1-9, got %d", cc.Level)
+		}
+	case "zstd":
+		if cc.Level < 0 || cc.Level > 22 {
+			return fmt.Errorf("zstd level must be 1-22, got %d", cc.Level)
+		}
+	default:
+		return fmt.Errorf("compression codec %q is not one of gzip or zstd", cc.Codec)
+	}
+	return nil
+}
+
+// compress returns data as one gzip member or zstd frame, data itself without a codec. Members
+// and frames concatenate into a valid file, so each write stands on its own: a crash or a second
+// writer appending to the same file can't corrupt what's already there.
+func (cc CompressionConfig) compress(data []byte) ([]byte, error) {
+	switch cc.Codec {
+	case "gzip":
+		level := cc.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		var buf bytes.Buffer
+		zw, err := gzip.NewWriterLevel(&buf, level)
+		if err != nil {
+			return nil, err
+		}
+		zw.Write(data)
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "zstd":
+		var opts []zstd.EOption
+		if cc.Level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(cc.Level)))
+		}
+		enc, err := zstd.NewWriter(nil, opts...)
+		if err != nil {
+			return nil, err
+		}
+		defer enc.Close()
+		return enc.EncodeAll(data, nil), nil
+	}
+	return data, nil
+}
+
+// writer returns a writer that compresses what is written to it into w, as one gzip member or
+// zstd frame once it's closed, like compress does all at once.
+func (cc CompressionConfig) writer(w io.Writer) (io.WriteCloser, error) {
+	switch cc.Codec {
+	case "gzip":
+		level := cc.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case "zstd":
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if cc.Level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(cc.Level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	}
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressionExtension is the file extension of what codec compresses, for names the consumer
+// picks itself.
+func compressionExtension(codec string) string {
+	switch codec {
+	case "gzip":
+		return ".gz"
+	case "zstd":
+		return ".zst"
+	}
+	return ""
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// Config is read from the JSON file passed with -config.
+// Anything left out of the file falls back to the constants in kinesis_consumer.go.
+type Config struct {
+	Region     string `json:"region"`
+	StreamName string `json:"stream_name"`
+	// StreamARN takes precedence over StreamName and sets the region. Needed for cross-account streams.
+	StreamARN   string            `json:"stream_arn"`
+	ShardID     string            `json:"shard_id"` // "*" for all shards
+	ShardFilter ShardFilterConfig `json:"shard_filter"`
+	// MaxAge bounds how far back a shard without a checkpoint is read from when the iterator
+	// type is TRIM_HORIZON, so a cold start doesn't replay days of data by accident.
+	MaxAge            Duration             `json:"max_age"`
+	ShardIteratorType string               `json:"shard_iterator_type"`
+	Transform         TransformConfig      `json:"transform"`
+	Enrich            EnrichConfig         `json:"enrich"`
+	EventTime         EventTimeConfig      `json:"event_time"`
+	WasmModule        string               `json:"wasm_module"`
+	Handler           string               `json:"handler"`
+	HandlerConfig     json.RawMessage      `json:"handler_config"`
+	Poison            PoisonConfig         `json:"poison"`
+	AWS               AWSConfig            `json:"aws"`
+	Checkpoint        CheckpointConfig     `json:"checkpoint"`
+	Lease             LeaseConfig          `json:"lease"`
+	Decode            DecodeConfig         `json:"decode"`
+	Handle            HandleConfig         `json:"handle"`
+	Scaling           ScalingConfig        `json:"scaling"`
+	RetentionAlert    RetentionAlertConfig `json:"retention_alert"`
+	RateAnomaly       RateAnomalyConfig    `json:"rate_anomaly"`
+	FanOut            FanOutConfig         `json:"fan_out"`
+	SkipAhead         SkipAheadConfig      `json:"skip_ahead"`
+	SchemaDrift       SchemaDriftConfig    `json:"schema_drift"`
+	Priority          PriorityConfig       `json:"priority"`
+	// FreshnessSLO warns when records take too long from arrival to being processed.
+	FreshnessSLO FreshnessSLOConfig `json:"freshness_slo"`
+	// MaxInflightBytes caps compressed plus decompressed bytes of batches being processed
+	// across all shards, so the consumer fits in a small container. 0 means no limit.
+	MaxInflightBytes int64 `json:"max_inflight_bytes"`
+	// StateDir is where the duplicates window and enrich lookup caches are saved on shutdown
+	// and loaded on start, see stateDir. Off when empty.
+	StateDir string `json:"state_dir"`
+	// MetricsAddr is where Prometheus metrics are served, e.g. ":9090". Off when empty.
+	MetricsAddr string `json:"metrics_addr"`
+	// StatsD also sends the metrics to a StatsD or DogStatsD agent.
+	StatsD StatsDConfig `json:"statsd"`
+	// Tracing continues producers' traces through the consumer, see TracingConfig.
+	Tracing TracingConfig `json:"tracing"`
+	// Sentry reports decode, handler and sink errors, see SentryConfig.
+	Sentry SentryConfig `json:"sentry"`
+	// DryRun decodes everything but only prints what would be handled and checkpointed.
+	DryRun bool `json:"dry_run"`
+	// AdminAddr is where the pause/resume endpoints are served. Off when empty.
+	AdminAddr string `json:"admin_addr"`
+	// OperatorAuditLog also appends the operator actions that are always printed, see auditLog.
+	OperatorAuditLog string `json:"operator_audit_log"`
+	// StartingSequenceNumber is where AT_SEQUENCE_NUMBER starts, only set by -start-sequence.
+	StartingSequenceNumber string `json:"-"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Region:            region,
+		StreamName:        streamName,
+		ShardID:           shardID,
+		ShardIteratorType: string(shardIteratorType),
+		Handler:           "print",
+	}
+}
+
+// configOverrides, if set, is applied to every config loaded.
+var configOverrides func(*Config)
+
+func loadConfig(path string) (*Config, error) {
+	cfg, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if configOverrides != nil {
+		configOverrides(cfg)
+	}
+	return cfg, nil
+}
+
+func readConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+	if err = json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	if err = cfg.resolveStreamARN(); err != nil {
+		return nil, err
+	}
+	if err = cfg.Decode.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if err = cfg.EventTime.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if err = cfg.SkipAhead.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if err = cfg.Lease.validate(cfg); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// resolveStreamARN sets the region and stream name from StreamARN, if there is one.
+func (c *Config) resolveStreamARN() error {
+	if c.StreamARN == "" {
+		return nil
+	}
+	a, err := arn.Parse(c.StreamARN)
+	if err != nil || a.Service != "kinesis" || !strings.HasPrefix(a.Resource, "stream/") {
+		return fmt.Errorf("stream_arn %q is not a kinesis stream ARN", c.StreamARN)
+	}
+	c.Region = a.Region
+	c.StreamName = strings.TrimPrefix(a.Resource, "stream/")
+	return nil
+}
+
+// streamRef returns the StreamName and StreamARN to put in a Kinesis API request.
+func (c *Config) streamRef() (name, streamARN *string) {
+	if c.StreamARN != "" {
+		return nil, aws.String(c.StreamARN)
+	}
+	return aws.String(c.StreamName), nil
+}
+
+func (c *Config) iteratorType() types.ShardIteratorType {
+	return types.ShardIteratorType(c.ShardIteratorType)
+}
+
+// Duration is a time.Duration that reads from JSON as a string such as "30s" or "5m".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
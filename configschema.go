@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// handlerConfigs are the handler_config types of the configurable handlers, for config schema.
+// Handlers only built with a tag add theirs from their init function.
+var handlerConfigs = map[string]any{
+	"aggregate":  AggregateConfig{},
+	"bigquery":   BigQueryConfig{},
+	"clickhouse": ClickHouseConfig{},
+	"duplicates": DuplicatesConfig{},
+	"eventhubs":  EventHubsConfig{},
+	"file":       FileConfig{},
+	"http":       HTTPSinkConfig{},
+	"kafka":      KafkaConfig{},
+	"keys":       KeysConfig{},
+	"kinesis":    KinesisForwardConfig{},
+	"lambda":     LambdaConfig{},
+	"logs":       LogsConfig{},
+	"mqtt":       MQTTConfig{},
+	"nats":       NATSConfig{},
+	"postgres":   PostgresConfig{},
+	"protobuf":   ProtobufConfig{},
+	"pubsub":     PubSubConfig{},
+	"router":     RouterConfig{},
+	"s3":         S3Config{},
+	"sqs":        SQSConfig{},
+	"throughput": ThroughputConfig{},
+}
+
+// configKey is one key of the config file, in dotted form; "[]" stands for every element of a
+// list and "*" for every key of an object.
+type configKey struct {
+	Key     string `json:"key"`
+	Type    string `json:"type"`
+	Default any    `json:"default,omitempty"`
+}
+
+var (
+	durationType   = reflect.TypeOf(Duration{})
+	byteSizeType   = reflect.TypeOf(byteSize(0))
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// configKeys lists the keys of the struct t, with the defaults v has (v may be invalid).
+func configKeys(prefix string, t reflect.Type, v reflect.Value, keys *[]configKey) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || name == "" || !f.IsExported() {
+			continue
+		}
+		var fv reflect.Value
+		if v.IsValid() {
+			fv = v.Field(i)
+		}
+		configKeysOf(prefix+name, f.Type, fv, keys)
+	}
+}
+
+func configKeysOf(key string, t reflect.Type, v reflect.Value, keys *[]configKey) {
+	k := configKey{Key: key, Type: configType(t)}
+	if v.IsValid() && !v.IsZero() {
+		k.Default = v.Interface()
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+		v = reflect.Value{}
+	}
+	switch {
+	case t == durationType || t == byteSizeType:
+	case t.Kind() == reflect.Struct:
+		configKeys(key+".", t, v, keys)
+		return
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Struct && t.Elem() != durationType:
+		*keys = append(*keys, k)
+		configKeys(key+"[].", t.Elem(), reflect.Value{}, keys)
+		return
+	case t.Kind() == reflect.Map && t.Elem().Kind() == reflect.Struct && t.Elem() != durationType:
+		*keys = append(*keys, k)
+		configKeys(key+".*.", t.Elem(), reflect.Value{}, keys)
+		return
+	}
+	*keys = append(*keys, k)
+}
+
+// configType names t as it is written in the config file.
+func configType(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == durationType:
+		return "duration"
+	case t == byteSizeType:
+		return "size"
+	case t == rawMessageType:
+		return "json"
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		return "object"
+	case reflect.Slice:
+		return "list of " + configType(t.Elem())
+	case reflect.Map:
+		return "object of " + configType(t.Elem())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Interface:
+		return "any"
+	}
+	return t.Kind().String()
+}
+
+const configUsage = `usage: kinesis_consumer config schema [-handler name] [-json]
+
+prints every key of the config file with its type and compiled-in default; with -handler the
+keys of that handler's handler_config instead. Defaults that depend on other keys are described
+in the README.
+`
+
+// runConfig is the "config" command.
+func runConfig(args []string) {
+	if len(args) == 0 || args[0] != "schema" {
+		fmt.Fprint(os.Stderr, configUsage)
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("config schema", flag.ExitOnError)
+	handler := fs.String("handler", "", "list the handler_config keys of this handler")
+	asJSON := fs.Bool("json", false, "print the keys as a JSON list")
+	fs.Parse(args[1:])
+
+	var keys []configKey
+	if *handler == "" {
+		cfg := defaultConfig()
+		configKeys("", reflect.TypeOf(*cfg), reflect.ValueOf(*cfg), &keys)
+	} else {
+		hc, ok := handlerConfigs[*handler]
+		if !ok {
+			names := make([]string, 0, len(handlerConfigs))
+			for name := range handlerConfigs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			fatalf("handler %q has no handler_config, configurable handlers are %v", *handler, names)
+		}
+		configKeys("", reflect.TypeOf(hc), reflect.Value{}, &keys)
+	}
+
+	if *asJSON {
+		out, _ := json.MarshalIndent(keys, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tTYPE\tDEFAULT")
+	for _, k := range keys {
+		def := ""
+		if k.Default != nil {
+			b, _ := json.Marshal(k.Default)
+			def = string(b)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", k.Key, k.Type, def)
+	}
+	w.Flush()
+}
@@ -0,0 +1,315 @@
+// Package arrowbatch hands the records a consumer decodes to Go code as Apache Arrow record
+// batches, for analytics code that feeds DataFrames and wants columns rather than one JSON
+// payload at a time.
+//
+// A batch has the record's metadata as columns, and the payload's fields the embedding code asks
+// for, typed:
+//
+//	handler, closer, err := arrowbatch.NewHandler(arrowbatch.Options{
+//		Columns: []arrowbatch.Column{
+//			{Name: "device", Path: "device.id", Type: arrow.BinaryTypes.String},
+//			{Name: "temperature", Path: "reading.celsius", Type: arrow.PrimitiveTypes.Float64},
+//		},
+//		MaxRows: 10000,
+//	}, func(ctx context.Context, batch arrow.Record) error {
+//		return frame.Append(batch)
+//	})
+//	consumer.RegisterHandlerFactory("frames", func(json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+//		return handler, closer, nil
+//	})
+package arrowbatch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+
+	"kinesis_consumer/consumer"
+)
+
+// Column is a field of the JSON payload that becomes a column of the batches.
+type Column struct {
+	Name string
+	// Path is a dotted path into the payload such as "device.id".
+	Path string
+	// Type is arrow.BinaryTypes.String, arrow.PrimitiveTypes.Int64 or Float64,
+	// arrow.FixedWidthTypes.Boolean or an *arrow.TimestampType, which takes RFC 3339 strings. A
+	// record lacking the field, or with a value that doesn't fit the type, gets a null. String
+	// columns take any value, objects and arrays as their JSON.
+	Type arrow.DataType
+}
+
+// Options of NewHandler.
+type Options struct {
+	Columns []Column
+	// MaxRows is how many records a batch has at most, 1000 when not set.
+	MaxRows int
+	// MaxLatency is how long a batch that isn't full waits for more records, 1s when not set.
+	MaxLatency time.Duration
+	// Allocator is memory.DefaultAllocator when not set.
+	Allocator memory.Allocator
+}
+
+// The metadata columns every batch starts with.
+var metadataFields = []arrow.Field{
+	{Name: "shard_id", Type: arrow.BinaryTypes.String},
+	{Name: "sequence_number", Type: arrow.BinaryTypes.String},
+	{Name: "sub_sequence_number", Type: arrow.PrimitiveTypes.Int64},
+	{Name: "partition_key", Type: arrow.BinaryTypes.String},
+	{Name: "arrival_time", Type: &arrow.TimestampType{Unit: arrow.Millisecond, TimeZone: "UTC"}},
+	{Name: "event_time", Type: &arrow.TimestampType{Unit: arrow.Millisecond, TimeZone: "UTC"}, Nullable: true},
+	{Name: "data", Type: arrow.BinaryTypes.Binary},
+}
+
+// Schema returns the schema of the batches with columns: the metadata columns shard_id,
+// sequence_number, sub_sequence_number, partition_key, arrival_time, event_time and data (the
+// payload), followed by columns.
+func Schema(columns []Column) (*arrow.Schema, error) {
+	fields := append([]arrow.Field(nil), metadataFields...)
+	for _, c := range columns {
+		switch c.Type.(type) {
+		case *arrow.StringType, *arrow.Int64Type, *arrow.Float64Type, *arrow.BooleanType, *arrow.TimestampType:
+		default:
+			return nil, fmt.Errorf("column %s: unsupported type %v", c.Name, c.Type)
+		}
+		if c.Path == "" {
+			return nil, fmt.Errorf("column %s has no path", c.Name)
+		}
+		fields = append(fields, arrow.Field{Name: c.Name, Type: c.Type, Nullable: true})
+	}
+	return arrow.NewSchema(fields, nil), nil
+}
+
+// Builder appends records to a batch.
+type Builder struct {
+	columns []Column
+	b       *array.RecordBuilder
+	rows    int
+}
+
+// NewBuilder returns a Builder of batches with columns; it must be released.
+func NewBuilder(mem memory.Allocator, columns []Column) (*Builder, error) {
+	schema, err := Schema(columns)
+	if err != nil {
+		return nil, err
+	}
+	return &Builder{columns: columns, b: array.NewRecordBuilder(mem, schema)}, nil
+}
+
+// Append adds r as a row. The payload is only decoded when there are columns; one that isn't a
+// JSON object gets nulls in them.
+func (b *Builder) Append(r *consumer.Record) {
+	fields := b.b.Fields()
+	fields[0].(*array.StringBuilder).Append(r.ShardID)
+	fields[1].(*array.StringBuilder).Append(r.SequenceNumber)
+	fields[2].(*array.Int64Builder).Append(int64(r.SubSequenceNumber))
+	fields[3].(*array.StringBuilder).Append(r.PartitionKey)
+	fields[4].(*array.TimestampBuilder).Append(arrow.Timestamp(r.ArrivalTime.UnixMilli()))
+	if r.EventTime.IsZero() {
+		fields[5].AppendNull()
+	} else {
+		fields[5].(*array.TimestampBuilder).Append(arrow.Timestamp(r.EventTime.UnixMilli()))
+	}
+	fields[6].(*array.BinaryBuilder).Append(r.Data)
+	b.rows++
+
+	if len(b.columns) == 0 {
+		return
+	}
+	var payload map[string]any
+	dec := json.NewDecoder(bytes.NewReader(r.Data))
+	dec.UseNumber()
+	if dec.Decode(&payload) != nil {
+		payload = nil
+	}
+	for i, c := range b.columns {
+		appendValue(fields[len(metadataFields)+i], c, lookup(payload, c.Path))
+	}
+}
+
+// lookup finds a dotted path in a decoded payload, nil if it isn't there.
+func lookup(payload map[string]any, path string) any {
+	var v any = payload
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+// appendValue appends v to the column's builder, a null when it doesn't fit.
+func appendValue(fb array.Builder, c Column, v any) {
+	if v == nil {
+		fb.AppendNull()
+		return
+	}
+	switch fb := fb.(type) {
+	case *array.StringBuilder:
+		switch v := v.(type) {
+		case string:
+			fb.Append(v)
+		case json.Number:
+			fb.Append(v.String())
+		default:
+			s, _ := json.Marshal(v)
+			fb.Append(string(s))
+		}
+		return
+	case *array.Int64Builder:
+		if n, ok := v.(json.Number); ok {
+			if i, err := n.Int64(); err == nil {
+				fb.Append(i)
+				return
+			}
+		}
+	case *array.Float64Builder:
+		if n, ok := v.(json.Number); ok {
+			if f, err := n.Float64(); err == nil {
+				fb.Append(f)
+				return
+			}
+		}
+	case *array.BooleanBuilder:
+		if b, ok := v.(bool); ok {
+			fb.Append(b)
+			return
+		}
+	case *array.TimestampBuilder:
+		if s, ok := v.(string); ok {
+			if ts, err := arrow.TimestampFromString(s, c.Type.(*arrow.TimestampType).Unit); err == nil {
+				fb.Append(ts)
+				return
+			}
+		}
+	}
+	fb.AppendNull()
+}
+
+// Len is how many rows the batch has.
+func (b *Builder) Len() int {
+	return b.rows
+}
+
+// NewRecord returns the batch built so far, which the caller must release, and starts a new one.
+func (b *Builder) NewRecord() arrow.Record {
+	b.rows = 0
+	return b.b.NewRecord()
+}
+
+// Release frees the builder's memory.
+func (b *Builder) Release() {
+	b.b.Release()
+}
+
+// batcher collects records into batches for the function NewHandler got.
+type batcher struct {
+	opts Options
+	fn   func(ctx context.Context, batch arrow.Record) error
+
+	mu      sync.Mutex
+	b       *Builder
+	acks    []func(error)
+	timer   *time.Timer
+	sending chan struct{}
+	// inFlight counts the batches handed to fn, up to their acks
+	inFlight sync.WaitGroup
+}
+
+// NewHandler returns a handler that collects records into batches of up to opts.MaxRows rows and
+// calls fn with each, one batch at a time and in order. Records are acknowledged with
+// consumer.Async once fn returned, with its error, so the consumer only checkpoints past records
+// fn took; fn must not keep the batch after returning without retaining it. Outside a consumer
+// every record is a batch of its own. Closing the handler hands fn what is still pending.
+func NewHandler(opts Options, fn func(ctx context.Context, batch arrow.Record) error) (consumer.HandlerFunc, io.Closer, error) {
+	if opts.MaxRows <= 0 {
+		opts.MaxRows = 1000
+	}
+	if opts.MaxLatency <= 0 {
+		opts.MaxLatency = time.Second
+	}
+	if opts.Allocator == nil {
+		opts.Allocator = memory.DefaultAllocator
+	}
+	b, err := NewBuilder(opts.Allocator, opts.Columns)
+	if err != nil {
+		return nil, nil, err
+	}
+	h := &batcher{opts: opts, fn: fn, b: b, sending: make(chan struct{}, 1)}
+	return h.handle, h, nil
+}
+
+func (h *batcher) handle(ctx context.Context, r *consumer.Record) error {
+	ack := consumer.Async(ctx)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ack == nil {
+		h.flush()
+		h.b.Append(r)
+		batch := h.b.NewRecord()
+		defer batch.Release()
+		// wait for the batches before it
+		h.sending <- struct{}{}
+		defer func() { <-h.sending }()
+		return h.fn(ctx, batch)
+	}
+
+	h.b.Append(r)
+	h.acks = append(h.acks, ack)
+	if h.b.Len() >= h.opts.MaxRows {
+		h.flush()
+	} else if h.timer == nil {
+		h.timer = time.AfterFunc(h.opts.MaxLatency, func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			h.flush()
+		})
+	}
+	return nil
+}
+
+// flush hands the pending batch to fn in the background once the batch before it is done, and
+// acks its records. h.mu must be held.
+func (h *batcher) flush() {
+	if h.timer != nil {
+		h.timer.Stop()
+		h.timer = nil
+	}
+	if h.b.Len() == 0 {
+		return
+	}
+	batch, acks := h.b.NewRecord(), h.acks
+	h.acks = nil
+	h.sending <- struct{}{}
+	h.inFlight.Add(1)
+	go func() {
+		defer h.inFlight.Done()
+		err := h.fn(context.Background(), batch)
+		batch.Release()
+		<-h.sending
+		for _, ack := range acks {
+			ack(err)
+		}
+	}()
+}
+
+// Close hands fn what is still pending and waits until every batch was acked.
+func (h *batcher) Close() error {
+	h.mu.Lock()
+	h.flush()
+	h.mu.Unlock()
+	h.inFlight.Wait()
+	h.b.Release()
+	return nil
+}
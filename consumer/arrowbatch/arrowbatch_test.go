@@ -0,0 +1,131 @@
+package arrowbatch
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+
+	"kinesis_consumer/consumer"
+)
+
+var testColumns = []Column{
+	{Name: "device", Path: "device.id", Type: arrow.BinaryTypes.String},
+	{Name: "count", Path: "count", Type: arrow.PrimitiveTypes.Int64},
+	{Name: "celsius", Path: "reading.celsius", Type: arrow.PrimitiveTypes.Float64},
+	{Name: "ok", Path: "ok", Type: arrow.FixedWidthTypes.Boolean},
+	{Name: "ts", Path: "ts", Type: &arrow.TimestampType{Unit: arrow.Millisecond, TimeZone: "UTC"}},
+}
+
+func TestBuilder(t *testing.T) {
+	mem := memory.NewCheckedAllocator(memory.NewGoAllocator())
+	defer mem.AssertSize(t, 0)
+
+	b, err := NewBuilder(mem, testColumns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Release()
+	arrival := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	b.Append(&consumer.Record{ShardID: "shardId-000000000000", SequenceNumber: "1", PartitionKey: "k", ArrivalTime: arrival,
+		Data: []byte(`{"device": {"id": "d-1"}, "count": 3, "reading": {"celsius": 21.5}, "ok": true, "ts": "2026-01-01T00:00:01Z"}`)})
+	// wrong types and missing fields are nulls, and so is everything of a payload that isn't JSON
+	b.Append(&consumer.Record{ShardID: "shardId-000000000000", SequenceNumber: "2", ArrivalTime: arrival, EventTime: arrival,
+		Data: []byte(`{"device": {"id": 7}, "count": "3", "ok": 1, "ts": "yesterday"}`)})
+	b.Append(&consumer.Record{ShardID: "shardId-000000000000", SequenceNumber: "3", ArrivalTime: arrival, Data: []byte("not json")})
+	if b.Len() != 3 {
+		t.Fatalf("got %d rows, want 3", b.Len())
+	}
+	batch := b.NewRecord()
+	defer batch.Release()
+	if b.Len() != 0 {
+		t.Errorf("builder has %d rows after NewRecord", b.Len())
+	}
+
+	col := func(name string) arrow.Array {
+		t.Helper()
+		i := batch.Schema().FieldIndices(name)
+		if len(i) != 1 {
+			t.Fatalf("no column %s", name)
+		}
+		return batch.Column(i[0])
+	}
+	tests := []struct {
+		column string
+		want   string
+	}{
+		{"sequence_number", `["1" "2" "3"]`},
+		{"event_time", "[(null) 1767225600000 (null)]"},
+		{"data", `["{\"device\": {\"id\": \"d-1\"}, \"count\": 3, \"reading\": {\"celsius\": 21.5}, \"ok\": true, \"ts\": \"2026-01-01T00:00:01Z\"}" "{\"device\": {\"id\": 7}, \"count\": \"3\", \"ok\": 1, \"ts\": \"yesterday\"}" "not json"]`},
+		{"device", `["d-1" "7" (null)]`},
+		{"count", "[3 (null) (null)]"},
+		{"celsius", "[21.5 (null) (null)]"},
+		{"ok", "[true (null) (null)]"},
+		{"ts", "[1767225601000 (null) (null)]"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(col(tt.column)); got != tt.want {
+			t.Errorf("column %s is %s, want %s", tt.column, got, tt.want)
+		}
+	}
+}
+
+func TestSchemaUnsupportedType(t *testing.T) {
+	if _, err := Schema([]Column{{Name: "d", Path: "d", Type: arrow.PrimitiveTypes.Date32}}); err == nil {
+		t.Error("got no error for a date32 column")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	mem := memory.NewCheckedAllocator(memory.NewGoAllocator())
+	defer mem.AssertSize(t, 0)
+
+	var mu sync.Mutex
+	var batches []string
+	handle, closer, err := NewHandler(Options{Columns: testColumns[:1], MaxRows: 2, MaxLatency: time.Hour, Allocator: mem},
+		func(ctx context.Context, batch arrow.Record) error {
+			mu.Lock()
+			defer mu.Unlock()
+			batches = append(batches, fmt.Sprint(batch.Column(int(batch.NumCols())-1).(*array.String)))
+			if batch.NumRows() == 1 {
+				return fmt.Errorf("refused")
+			}
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// outside a consumer a record is a batch of its own, and its error is the handler's
+	if err := handle(context.Background(), &consumer.Record{Data: []byte(`{}`)}); err == nil {
+		t.Error("got no error for a refused one-record batch")
+	}
+
+	acked := make(chan error, 3)
+	for i := range 3 {
+		ctx, _ := consumer.NewAsyncContext(context.Background(), func(err error) { acked <- err })
+		r := &consumer.Record{SequenceNumber: fmt.Sprint(i), Data: []byte(fmt.Sprintf(`{"device": {"id": "d-%d"}}`, i))}
+		if err := handle(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first two are a full batch
+	for range 2 {
+		if err := <-acked; err != nil {
+			t.Fatal(err)
+		}
+	}
+	closer.Close()
+	if err := <-acked; err == nil {
+		t.Error("record acked although its batch was refused")
+	}
+	if fmt.Sprint(batches) != `[[(null)] ["d-0" "d-1"] ["d-2"]]` {
+		t.Errorf("got batches %v", batches)
+	}
+
+}
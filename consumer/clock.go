@@ -0,0 +1,148 @@
+package consumer
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is where the time-dependent parts of the consumer get the time from: poll delays, window
+// aggregation, freshness and rate evaluation. A FakeClock makes them testable without waiting, and
+// lets a replay run in virtual time.
+type Clock interface {
+	Now() time.Time
+	// After is like time.After.
+	After(d time.Duration) <-chan time.Time
+	// NewTicker is like time.NewTicker.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is a *time.Ticker as a Clock hands it out.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// SystemClock returns the wall clock.
+func SystemClock() Clock {
+	return systemClock{}
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (systemClock) NewTicker(d time.Duration) Ticker       { return systemTicker{time.NewTicker(d)} }
+
+type systemTicker struct{ t *time.Ticker }
+
+func (t systemTicker) C() <-chan time.Time { return t.t.C }
+func (t systemTicker) Stop()               { t.t.Stop() }
+
+// FakeClock only moves when told to. Timers and tickers fire as it passes their time; like a
+// time.Ticker, a ticker that isn't read drops ticks instead of queueing them.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+type fakeWaiter struct {
+	at     time.Time
+	period time.Duration
+	c      chan time.Time
+}
+
+// NewFakeClock returns a FakeClock that stands at now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.add(d, 0).c
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for FakeClock.NewTicker")
+	}
+	return &fakeTicker{clock: c, w: c.add(d, d)}
+}
+
+func (c *FakeClock) add(d, period time.Duration) *fakeWaiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := &fakeWaiter{at: c.now.Add(d), period: period, c: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.c <- c.now
+		return w
+	}
+	c.waiters = append(c.waiters, w)
+	return w
+}
+
+func (c *FakeClock) remove(w *fakeWaiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, o := range c.waiters {
+		if o == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// Waiters returns how many timers and tickers wait for the clock to pass their time, so a test
+// can tell a goroutine is blocked on the clock before advancing it.
+func (c *FakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+// Advance moves the clock forward by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.AdvanceTo(c.Now().Add(d))
+}
+
+// AdvanceTo moves the clock forward to t. It never goes back: a t before the clock's time is
+// ignored, so several goroutines can each move it to the latest time they have seen.
+func (c *FakeClock) AdvanceTo(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !t.After(c.now) {
+		return
+	}
+	c.now = t
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(t) {
+			waiters = append(waiters, w)
+			continue
+		}
+		select {
+		case w.c <- t:
+		default:
+		}
+		if w.period > 0 {
+			// the ticks t skipped over are dropped
+			w.at = w.at.Add((t.Sub(w.at)/w.period + 1) * w.period)
+			waiters = append(waiters, w)
+		}
+	}
+	clear(c.waiters[len(waiters):])
+	c.waiters = waiters
+}
+
+type fakeTicker struct {
+	clock *FakeClock
+	w     *fakeWaiter
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.w.c }
+func (t *fakeTicker) Stop()               { t.clock.remove(t.w) }
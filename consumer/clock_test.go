@@ -0,0 +1,144 @@
+package consumer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClockAfter(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		after   time.Duration
+		advance []time.Duration
+		fired   bool
+	}{
+		{"not yet", time.Minute, []time.Duration{30 * time.Second}, false},
+		{"exactly", time.Minute, []time.Duration{time.Minute}, true},
+		{"in steps", time.Minute, []time.Duration{30 * time.Second, 30 * time.Second}, true},
+		{"past", time.Minute, []time.Duration{time.Hour}, true},
+		{"zero fires right away", 0, nil, true},
+		{"negative fires right away", -time.Second, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewFakeClock(start)
+			ch := c.After(tt.after)
+			for _, d := range tt.advance {
+				c.Advance(d)
+			}
+			select {
+			case at := <-ch:
+				if !tt.fired {
+					t.Fatalf("fired at %s", at)
+				}
+				if at.Before(start.Add(tt.after)) && tt.after > 0 {
+					t.Errorf("fired at %s, before %s", at, start.Add(tt.after))
+				}
+			default:
+				if tt.fired {
+					t.Fatal("didn't fire")
+				}
+			}
+			want := 1
+			if tt.fired {
+				want = 0
+			}
+			if got := c.Waiters(); got != want {
+				t.Errorf("%d waiters, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestFakeClockAdvanceTo(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		to   []time.Time
+		want time.Time
+	}{
+		{"forward", []time.Time{start.Add(time.Hour)}, start.Add(time.Hour)},
+		{"never back", []time.Time{start.Add(time.Hour), start.Add(time.Minute)}, start.Add(time.Hour)},
+		{"before start", []time.Time{start.Add(-time.Hour)}, start},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewFakeClock(start)
+			for _, to := range tt.to {
+				c.AdvanceTo(to)
+			}
+			if got := c.Now(); !got.Equal(tt.want) {
+				t.Errorf("clock at %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFakeClockTicker(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		advance []time.Duration
+		ticks   int
+	}{
+		{"none", []time.Duration{59 * time.Second}, 0},
+		{"one per period", []time.Duration{time.Minute, time.Minute, time.Minute}, 3},
+		{"skipped ticks are dropped", []time.Duration{10 * time.Minute}, 1},
+		{"then on schedule", []time.Duration{90 * time.Second, 30 * time.Second}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewFakeClock(start)
+			ticker := c.NewTicker(time.Minute)
+			defer ticker.Stop()
+			ticks := 0
+			for _, d := range tt.advance {
+				c.Advance(d)
+				select {
+				case <-ticker.C():
+					ticks++
+				default:
+				}
+			}
+			if ticks != tt.ticks {
+				t.Errorf("%d ticks, want %d", ticks, tt.ticks)
+			}
+		})
+	}
+}
+
+func TestFakeClockTickerStop(t *testing.T) {
+	c := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	ticker := c.NewTicker(time.Minute)
+	ticker.Stop()
+	if got := c.Waiters(); got != 0 {
+		t.Fatalf("%d waiters after Stop", got)
+	}
+	c.Advance(time.Hour)
+	select {
+	case <-ticker.C():
+		t.Error("stopped ticker ticked")
+	default:
+	}
+}
+
+func TestSystemClock(t *testing.T) {
+	c := SystemClock()
+	before := time.Now()
+	if now := c.Now(); now.Before(before) || time.Since(now) > time.Minute {
+		t.Errorf("Now() = %s, it is %s", now, before)
+	}
+	select {
+	case <-c.After(time.Millisecond):
+	case <-time.After(10 * time.Second):
+		t.Fatal("After didn't fire")
+	}
+	ticker := c.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	select {
+	case <-ticker.C():
+	case <-time.After(10 * time.Second):
+		t.Fatal("ticker didn't tick")
+	}
+}
@@ -0,0 +1,51 @@
+package consumer
+
+import "errors"
+
+// Errors the consumer fails or stops with come wrapped with details; check for them with errors.Is.
+var (
+	// ErrDecompression means a record could not be decoded with its codec.
+	ErrDecompression = errors.New("decompression failed")
+	// ErrCheckpointConflict means the checkpoint store is held by another consumer.
+	ErrCheckpointConflict = errors.New("checkpoint store is in use by another consumer")
+	// ErrShardClosed means a reshard closed the shard and all of its records have been read.
+	ErrShardClosed = errors.New("shard is closed")
+	// ErrIteratorExpired means a shard iterator wasn't used within the 5 minutes Kinesis allows.
+	ErrIteratorExpired = errors.New("shard iterator expired")
+	// ErrHandlerPanic means a handler panicked; the consumer recovers and treats it as a failure.
+	ErrHandlerPanic = errors.New("handler panicked")
+	// ErrHandlerTimeout means a handler failed after running past handle.timeout or handle.batch_timeout.
+	ErrHandlerTimeout = errors.New("handler timed out")
+)
+
+// ShardError is what reading a shard stops with. Failures are raised as a panic with a *ShardError,
+// so they can be told apart after a recover as well.
+type ShardError struct {
+	Stream  string
+	ShardID string
+	Err     error
+}
+
+func (e *ShardError) Error() string {
+	return e.Stream + "/" + e.ShardID + ": " + e.Err.Error()
+}
+
+func (e *ShardError) Unwrap() error {
+	return e.Err
+}
+
+// RecordError is a failure to handle a record, with the record it happened on.
+type RecordError struct {
+	ShardID        string
+	SequenceNumber string
+	PartitionKey   string
+	Err            error
+}
+
+func (e *RecordError) Error() string {
+	return e.ShardID + "/" + e.SequenceNumber + " (partition key " + e.PartitionKey + "): " + e.Err.Error()
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
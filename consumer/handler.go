@@ -0,0 +1,295 @@
+// Package consumer holds the pieces of kinesis_consumer that other code can build on.
+//
+// Handlers are registered by name, usually from an init function in their own file,
+// and picked at runtime with the "handler" config key:
+//
+//	func init() {
+//		consumer.RegisterHandler("audit", func(ctx context.Context, r *consumer.Record) error {
+//			...
+//		})
+//	}
+//
+// A shard's records reach the handler in sequence number order, unless handle.workers is set.
+// Then records are handled in parallel and only handlers registered with RegisterOrderedHandler
+// (or every handler, with handle.ordered) still see each partition key's records in order.
+//
+// A handler can also finish with a record after returning, see Async.
+//
+// A Record's Data belongs to the consumer, see Record.Retain for keeping or changing it.
+//
+// Middleware wraps the steps every record goes through (fetch, decode, handle and checkpoint), like
+// HTTP middleware wraps a handler: each gets the next step and returns one that runs in its place,
+// so it can run code around it, change what goes in or comes out, or skip it:
+//
+//	func init() {
+//		consumer.UseHandle(func(next consumer.HandlerFunc) consumer.HandlerFunc {
+//			return func(ctx context.Context, r *consumer.Record) error {
+//				start := time.Now()
+//				err := next(ctx, r)
+//				log.Printf("%s %s took %s", r.ShardID, r.SequenceNumber, time.Since(start))
+//				return err
+//			}
+//		})
+//	}
+//
+// Middleware registered first runs outermost. It must be safe for concurrent use, shards and
+// handler workers call it in parallel.
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Record is a decoded kinesis record as seen by a handler.
+type Record struct {
+	ShardID        string
+	SequenceNumber string
+	// Aggregated is true for the user records of a KPL aggregated record, which share its
+	// SequenceNumber; SubSequenceNumber is their position in it.
+	Aggregated        bool
+	SubSequenceNumber int
+	PartitionKey      string
+	ArrivalTime       time.Time
+	// EventTime is read from the payload when event_time is configured, zero otherwise.
+	EventTime time.Time
+	// EncryptionType is "KMS" for records encrypted at rest, "NONE" or empty otherwise.
+	EncryptionType string
+	// Size is what the record takes up on the stream, its partition key plus its data as put,
+	// which is what counts toward the per-shard throughput limits.
+	Size int
+	// Header holds the key=value pairs of the header the producer put in front of the data, such
+	// as "content-type", when decode.headers is on; nil for records without one.
+	Header map[string]string
+	// Data is the decompressed (and transformed) payload. It belongs to the consumer: it may point
+	// into a buffer that is reused for the next record or into the record as read from the stream,
+	// so handlers must not change it or use it after they return. Retain copies it.
+	Data []byte
+}
+
+// Retain returns a copy of the record the handler owns, for using it after returning, e.g. in a
+// batch or with Async, or for changing its Data or Header.
+func (r *Record) Retain() *Record {
+	c := *r
+	c.Data = bytes.Clone(r.Data)
+	c.Header = maps.Clone(r.Header)
+	return &c
+}
+
+// Time is the record's event time, or its arrival time when it has none.
+func (r *Record) Time() time.Time {
+	if !r.EventTime.IsZero() {
+		return r.EventTime
+	}
+	return r.ArrivalTime
+}
+
+// IdempotencyKey identifies the record to downstream systems that dedupe, e.g. a JetStream
+// Nats-Msg-Id: "shardId-000000000000:49590338271490256608559692538361571095921575989136588898",
+// with ":" and the SubSequenceNumber after it for the user records of an aggregated record. It
+// stays the same when the record is delivered again after a restart or replay, and for a record
+// from the retry stream it is the key of the record it retries, from Header["retry-origin"].
+func (r *Record) IdempotencyKey() string {
+	if origin := r.Header["retry-origin"]; origin != "" {
+		parts := strings.Split(origin, "/")
+		if n := len(parts); n >= 3 {
+			return parts[n-2] + ":" + parts[n-1]
+		}
+	}
+	if r.Aggregated {
+		return r.ShardID + ":" + r.SequenceNumber + ":" + strconv.Itoa(r.SubSequenceNumber)
+	}
+	return r.ShardID + ":" + r.SequenceNumber
+}
+
+// HandlerFunc processes a single record.
+type HandlerFunc func(ctx context.Context, r *Record) error
+
+// HandlerFactory builds a handler from the "handler_config" section of the config file,
+// for handlers that need settings or state. The closer, if not nil, is called when the handler
+// is replaced by a config reload or the consumer shuts down.
+type HandlerFactory func(config json.RawMessage) (HandlerFunc, io.Closer, error)
+
+var (
+	handlersMu sync.RWMutex
+	handlers   = make(map[string]HandlerFunc)
+	factories  = make(map[string]HandlerFactory)
+	ordered    = make(map[string]bool)
+)
+
+// RegisterHandler makes a handler available under name.
+// It panics if fn is nil or a handler with the same name is already registered.
+func RegisterHandler(name string, fn HandlerFunc) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+
+	if fn == nil {
+		panic("consumer: RegisterHandler handler is nil")
+	}
+	if registered(name) {
+		panic(fmt.Sprintf("consumer: RegisterHandler called twice for handler %q", name))
+	}
+	handlers[name] = fn
+}
+
+// RegisterOrderedHandler is RegisterHandler for handlers that keep state per partition key and
+// need that key's records in order. The consumer then always sends all records of a partition key
+// to the same worker, also when records are handled by several workers in parallel.
+func RegisterOrderedHandler(name string, fn HandlerFunc) {
+	RegisterHandler(name, fn)
+
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	ordered[name] = true
+}
+
+// IsOrdered reports whether name was registered with RegisterOrderedHandler.
+func IsOrdered(name string) bool {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	return ordered[name]
+}
+
+// RegisterHandlerFactory makes a configurable handler available under name.
+// It panics if f is nil or a handler with the same name is already registered.
+func RegisterHandlerFactory(name string, f HandlerFactory) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+
+	if f == nil {
+		panic("consumer: RegisterHandlerFactory factory is nil")
+	}
+	if registered(name) {
+		panic(fmt.Sprintf("consumer: RegisterHandlerFactory called twice for handler %q", name))
+	}
+	factories[name] = f
+}
+
+func registered(name string) bool {
+	_, isHandler := handlers[name]
+	_, isFactory := factories[name]
+	return isHandler || isFactory
+}
+
+// LookupHandler returns the handler registered under name.
+func LookupHandler(name string) (HandlerFunc, bool) {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+
+	fn, ok := handlers[name]
+	return fn, ok
+}
+
+// NewHandler returns the handler registered under name, building it with config
+// if it was registered with RegisterHandlerFactory.
+func NewHandler(name string, config json.RawMessage) (HandlerFunc, io.Closer, error) {
+	handlersMu.RLock()
+	fn, isHandler := handlers[name]
+	f, isFactory := factories[name]
+	handlersMu.RUnlock()
+
+	switch {
+	case isHandler:
+		return fn, nil, nil
+	case isFactory:
+		return f(config)
+	default:
+		return nil, nil, fmt.Errorf("unknown handler %q, registered handlers are %v", name, HandlerNames())
+	}
+}
+
+// HandlerNames returns the names of all registered handlers, sorted.
+func HandlerNames() []string {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+
+	names := make([]string, 0, len(handlers)+len(factories))
+	for name := range handlers {
+		names = append(names, name)
+	}
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type asyncKey struct{}
+
+type asyncRecord struct {
+	mu    sync.Mutex
+	async bool
+	once  sync.Once
+	ack   func(error)
+}
+
+// Async tells the consumer that the handler finishes with the record later, e.g. once a write it
+// started asynchronously has been confirmed, and returns the function to call then, once, from any
+// goroutine. Until it is called neither the record nor any later record of the shard is
+// checkpointed. Passing an error counts the record as failed and hands it to the poison policy,
+// which puts it into the retry stream or skips it to the DLQ; the handler isn't called on it again.
+//
+// A handler that calls Async must return nil. What it needs of the record after returning it must
+// copy, e.g. with Record.Retain. Async returns nil when ctx isn't the context a record is handled in.
+func Async(ctx context.Context) func(err error) {
+	a, _ := ctx.Value(asyncKey{}).(*asyncRecord)
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	a.async = true
+	a.mu.Unlock()
+	hooks, _ := ctx.Value(ackHooksKey{}).([]*ackHook)
+	for _, h := range hooks {
+		h.used.Store(true)
+	}
+	return func(err error) {
+		a.once.Do(func() {
+			// the innermost wrapper hears first
+			for i := len(hooks) - 1; i >= 0; i-- {
+				hooks[i].fn(err)
+			}
+			a.ack(err)
+		})
+	}
+}
+
+type ackHooksKey struct{}
+
+type ackHook struct {
+	fn   func(error)
+	used atomic.Bool
+}
+
+// WithAckHook is for handlers that wrap others: it returns the context to call the wrapped handler
+// with, in which an acknowledgement (Async) calls hook with its error before the consumer gets it,
+// and a function that reports, once the handler returned, whether it used Async, so the wrapper
+// knows whether the returned nil is the outcome or the hook will bring it.
+func WithAckHook(ctx context.Context, hook func(err error)) (context.Context, func() bool) {
+	hooks, _ := ctx.Value(ackHooksKey{}).([]*ackHook)
+	h := &ackHook{fn: hook}
+	ctx = context.WithValue(ctx, ackHooksKey{}, append(slices.Clip(hooks), h))
+	return ctx, h.used.Load
+}
+
+// NewAsyncContext returns the context to call a handler with so it can use Async, and a function
+// that reports, once the handler returned, whether it did. ack is called when the handler acks.
+func NewAsyncContext(ctx context.Context, ack func(error)) (context.Context, func() bool) {
+	a := &asyncRecord{ack: ack}
+	return context.WithValue(ctx, asyncKey{}, a), func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.async
+	}
+}
@@ -0,0 +1,107 @@
+package consumer
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RawRecord is a record as fetched from Kinesis, before it's decoded.
+type RawRecord struct {
+	ShardID        string
+	SequenceNumber string
+	PartitionKey   string
+	ArrivalTime    time.Time
+	EncryptionType string
+	Data           []byte
+}
+
+// FetchFunc returns the records of a shard's next GetRecords call, or fan-out event.
+type FetchFunc func(ctx context.Context, shardID string) ([]RawRecord, error)
+
+// DecodeFunc decodes a record: it cuts off the footer and header and decompresses the rest. It
+// may return data along with an error, the record as well as it could be decoded.
+type DecodeFunc func(r *RawRecord) ([]byte, error)
+
+// CheckpointFunc stores sequenceNumber as the position of a shard. Returning an error stops the shard.
+type CheckpointFunc func(stream, shardID, sequenceNumber string) error
+
+var (
+	middlewareMu sync.RWMutex
+	fetchMW      []func(FetchFunc) FetchFunc
+	decodeMW     []func(DecodeFunc) DecodeFunc
+	handleMW     []func(HandlerFunc) HandlerFunc
+	checkpointMW []func(CheckpointFunc) CheckpointFunc
+)
+
+// UseFetch adds middleware around fetching records. It sees the records before anything else
+// does, so it can drop or change them. It must call next, or return an error, which stops the shard.
+func UseFetch(mw func(next FetchFunc) FetchFunc) {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+	fetchMW = append(fetchMW, mw)
+}
+
+// UseDecode adds middleware around decoding a record.
+func UseDecode(mw func(next DecodeFunc) DecodeFunc) {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+	decodeMW = append(decodeMW, mw)
+}
+
+// UseHandle adds middleware around the handler. It runs for every attempt the poison policy
+// makes, and for handlers that use Async it returns before the record is acknowledged.
+func UseHandle(mw func(next HandlerFunc) HandlerFunc) {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+	handleMW = append(handleMW, mw)
+}
+
+// UseCheckpoint adds middleware around storing a checkpoint. It only runs for consumers that
+// checkpoint, not for tail and replay.
+func UseCheckpoint(mw func(next CheckpointFunc) CheckpointFunc) {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+	checkpointMW = append(checkpointMW, mw)
+}
+
+// WrapFetch returns next wrapped in the fetch middleware, nil when there is none.
+func WrapFetch(next FetchFunc) FetchFunc {
+	middlewareMu.RLock()
+	defer middlewareMu.RUnlock()
+	if len(fetchMW) == 0 {
+		return nil
+	}
+	return wrap(next, fetchMW)
+}
+
+// WrapDecode returns next wrapped in the decode middleware, nil when there is none.
+func WrapDecode(next DecodeFunc) DecodeFunc {
+	middlewareMu.RLock()
+	defer middlewareMu.RUnlock()
+	if len(decodeMW) == 0 {
+		return nil
+	}
+	return wrap(next, decodeMW)
+}
+
+// WrapHandle returns next wrapped in the handle middleware.
+func WrapHandle(next HandlerFunc) HandlerFunc {
+	middlewareMu.RLock()
+	defer middlewareMu.RUnlock()
+	return wrap(next, handleMW)
+}
+
+// WrapCheckpoint returns next wrapped in the checkpoint middleware.
+func WrapCheckpoint(next CheckpointFunc) CheckpointFunc {
+	middlewareMu.RLock()
+	defer middlewareMu.RUnlock()
+	return wrap(next, checkpointMW)
+}
+
+func wrap[F any](next F, mws []func(F) F) F {
+	for i := len(mws) - 1; i >= 0; i-- {
+		next = mws[i](next)
+	}
+	return next
+}
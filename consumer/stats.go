@@ -0,0 +1,89 @@
+package consumer
+
+import "sync"
+
+// Stats counts records on their way through the consumer. It must be safe for concurrent use,
+// shards and handler workers report to it in parallel.
+type Stats interface {
+	// RecordRead counts a record read from a shard and decoded with codec, and returns how many
+	// records have been read in total.
+	RecordRead(shardID, codec string) int64
+	// RecordHandled counts a record a handler is done with; failed means it gave up on the record.
+	RecordHandled(handler string, failed bool)
+	// Snapshot returns a copy of the counts so far.
+	Snapshot() StatsSnapshot
+}
+
+// StatsSnapshot is a copy of the counts of a Stats: the records read in total, by shard and by
+// codec, and what each handler did with them.
+type StatsSnapshot struct {
+	Records   int64
+	ByShard   map[string]int64
+	ByCodec   map[string]int64
+	ByHandler map[string]HandlerCounts
+}
+
+// HandlerCounts are the records a handler is done with, and how many of them it gave up on.
+type HandlerCounts struct {
+	Handled int64 `json:"handled"`
+	Failed  int64 `json:"failed"`
+}
+
+// NewStats returns an in-memory Stats.
+func NewStats() Stats {
+	return &memStats{
+		byShard:   make(map[string]int64),
+		byCodec:   make(map[string]int64),
+		byHandler: make(map[string]HandlerCounts),
+	}
+}
+
+type memStats struct {
+	mu        sync.Mutex
+	records   int64
+	byShard   map[string]int64
+	byCodec   map[string]int64
+	byHandler map[string]HandlerCounts
+}
+
+func (s *memStats) RecordRead(shardID, codec string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records++
+	s.byShard[shardID]++
+	s.byCodec[codec]++
+	return s.records
+}
+
+func (s *memStats) RecordHandled(handler string, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.byHandler[handler]
+	if failed {
+		c.Failed++
+	} else {
+		c.Handled++
+	}
+	s.byHandler[handler] = c
+}
+
+func (s *memStats) Snapshot() StatsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := StatsSnapshot{
+		Records:   s.records,
+		ByShard:   make(map[string]int64, len(s.byShard)),
+		ByCodec:   make(map[string]int64, len(s.byCodec)),
+		ByHandler: make(map[string]HandlerCounts, len(s.byHandler)),
+	}
+	for k, v := range s.byShard {
+		snap.ByShard[k] = v
+	}
+	for k, v := range s.byCodec {
+		snap.ByCodec[k] = v
+	}
+	for k, v := range s.byHandler {
+		snap.ByHandler[k] = v
+	}
+	return snap
+}
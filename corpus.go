@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// A corpusEntry is one record in testdata/corpus: the raw record as Kinesis returns it, how it is
+// decoded, and a golden file with the bytes it must decode to.
+type corpusEntry struct {
+	File string `json:"file"`
+	// Codec pins the codec like a decode.codecs rule, empty means sniffed.
+	Codec  string       `json:"codec"`
+	Footer FooterConfig `json:"footer"`
+	// WantCodec is the codec the record must be decoded with.
+	WantCodec string `json:"want_codec"`
+}
+
+// decode decodes the entry's record, read from dir, the way the consumer would.
+func (e corpusEntry) decode(dir string) (decodeResult, error) {
+	data, err := os.ReadFile(filepath.Join(dir, e.File))
+	if err != nil {
+		return decodeResult{}, err
+	}
+	dc := DecodeConfig{Footer: e.Footer}
+	if e.Codec != "" {
+		dc.Codecs = []CodecRule{{Codec: e.Codec}}
+	}
+	if err := dc.validate(); err != nil {
+		return decodeResult{}, err
+	}
+	d := newDecoderPool(dc, "corpus")
+	_, results := d.decodeBatch("", []types.Record{{Data: data, PartitionKey: aws.String("corpus")}})
+	return results[0], nil
+}
+
+// runCorpus is the "corpus" subcommand. It decodes every record of the fixture corpus through the
+// decode path the consumer uses and compares the output with the golden files, so a refactor
+// that changes how records are decoded doesn't go unnoticed. -update rewrites the golden files.
+func runCorpus(args []string) {
+	fs := flag.NewFlagSet("corpus", flag.ExitOnError)
+	dir := fs.String("dir", filepath.Join("testdata", "corpus"), "corpus directory")
+	update := fs.Bool("update", false, "write the current output as the golden files")
+	fs.Parse(args)
+
+	manifest, err := os.ReadFile(filepath.Join(*dir, "corpus.json"))
+	if err != nil {
+		fatalf("%v", err)
+	}
+	var entries []corpusEntry
+	if err := json.Unmarshal(manifest, &entries); err != nil {
+		fatalf("invalid corpus.json: %v", err)
+	}
+
+	failed := 0
+	for _, e := range entries {
+		res, err := e.decode(*dir)
+		if err != nil {
+			fatalf("%s: %v", e.File, err)
+		}
+
+		golden := filepath.Join(*dir, e.File+".golden")
+		if *update {
+			if err := os.WriteFile(golden, res.data, 0644); err != nil {
+				fatalf("%v", err)
+			}
+			fmt.Printf("updated  %s\n", golden)
+			continue
+		}
+
+		want, err := os.ReadFile(golden)
+		switch {
+		case err != nil:
+			fmt.Printf("FAILED   %s: %v\n", e.File, err)
+		case res.err != nil && res.expected != "":
+			// sniffed records that aren't zstd come with an error saying why, that's expected
+			fmt.Printf("FAILED   %s: %v\n", e.File, res.err)
+		case res.codec != e.WantCodec:
+			fmt.Printf("FAILED   %s: decoded as %s, want %s\n", e.File, res.codec, e.WantCodec)
+		case !bytes.Equal(res.data, want):
+			fmt.Printf("FAILED   %s: output differs from %s\n", e.File, golden)
+		default:
+			fmt.Printf("ok       %s\n", e.File)
+			continue
+		}
+		failed++
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d record(s) failed\n", failed, len(entries))
+		os.Exit(1)
+	}
+	if !*update {
+		fmt.Println("all records decode as before")
+	}
+}
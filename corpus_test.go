@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestCorpus is the corpus subcommand as a test: every record of testdata/corpus must decode with
+// its codec to its golden file.
+func TestCorpus(t *testing.T) {
+	dir := filepath.Join("testdata", "corpus")
+	manifest, err := os.ReadFile(filepath.Join(dir, "corpus.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []corpusEntry
+	if err := json.Unmarshal(manifest, &entries); err != nil {
+		t.Fatalf("invalid corpus.json: %v", err)
+	}
+	if len(entries) == 0 {
+		t.Fatal("empty corpus")
+	}
+
+	for _, e := range entries {
+		t.Run(e.File, func(t *testing.T) {
+			res, err := e.decode(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := os.ReadFile(filepath.Join(dir, e.File+".golden"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.err != nil && res.expected != "" {
+				t.Fatal(res.err)
+			}
+			if res.codec != e.WantCodec {
+				t.Errorf("decoded as %s, want %s", res.codec, e.WantCodec)
+			}
+			if !bytes.Equal(res.data, want) {
+				t.Errorf("output differs from the golden file:\n got %q\nwant %q", res.data, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+const (
+	hoursPerMonth = 730
+	// a polling consumer's share of a shard: 2 MB/s and 5 GetRecords calls/s between all of them
+	shardReadBytesPerSec = 2 << 20
+	shardReadCallsPerSec = 5
+)
+
+// CostConfig prices reading the stream with Consumers polling consumers against as many enhanced
+// fan-out ones. Prices are in USD, the defaults are the us-east-1 on-demand list prices.
+type CostConfig struct {
+	Consumers       int     `json:"consumers"`
+	OpenShards      int     `json:"open_shards"`
+	ShardHour       float64 `json:"shard_hour"`
+	FanOutShardHour float64 `json:"fan_out_shard_hour"`
+	FanOutPerGB     float64 `json:"fan_out_per_gb"`
+}
+
+// report prints the monthly cost of both modes at bytesPerSec written to the stream.
+func (cc CostConfig) report(bytesPerSec float64) {
+	gbPerMonth := bytesPerSec * hoursPerMonth * 3600 / (1 << 30)
+	fmt.Printf("monthly cost for %d consumer(s) of %d shard(s) at %.1f KB/s (%.1f GB/month), USD\n",
+		cc.Consumers, cc.OpenShards, bytesPerSec/1024, gbPerMonth)
+
+	// polling is free, but the consumers share each shard's read limits and may need more shards
+	readShards := int(math.Ceil(float64(cc.Consumers) * bytesPerSec / shardReadBytesPerSec))
+	extra := max(0, readShards-cc.OpenShards)
+	polling := float64(extra) * cc.ShardHour * hoursPerMonth
+	fmt.Printf("\tpolling GetRecords   %10.2f", polling)
+	if extra > 0 {
+		fmt.Printf("  for %d more shard(s) to share 2 MB/s per shard between the consumers", extra)
+	}
+	fmt.Println()
+	if cc.Consumers > shardReadCallsPerSec {
+		fmt.Printf("\t                       more than %d polling consumers get throttled by the GetRecords limit per shard\n", shardReadCallsPerSec)
+	}
+
+	shardHours := float64(cc.Consumers*cc.OpenShards) * cc.FanOutShardHour * hoursPerMonth
+	retrieval := float64(cc.Consumers) * gbPerMonth * cc.FanOutPerGB
+	fmt.Printf("\tenhanced fan-out     %10.2f  (%.2f consumer-shard hours + %.2f data retrieval)\n",
+		shardHours+retrieval, shardHours, retrieval)
+	fmt.Printf("\tdifference           %10.2f  more for enhanced fan-out\n", shardHours+retrieval-polling)
+	fmt.Println("shard hours and PUT payload units are the same either way and not included")
+}
+
+// runCost is the "cost" command. It measures the stream's throughput like analyze throughput and
+// prices reading it by polling against enhanced fan-out.
+func runCost(configPath string, opts consumeOptions, args []string) {
+	fs := flag.NewFlagSet("cost", flag.ExitOnError)
+	sample := fs.Duration("for", time.Minute, "how long to measure the stream's throughput")
+	cc := CostConfig{}
+	fs.IntVar(&cc.Consumers, "consumers", 1, "how many applications read the stream")
+	fs.Float64Var(&cc.ShardHour, "shard-hour", 0.015, "price of a shard hour")
+	fs.Float64Var(&cc.FanOutShardHour, "fan-out-shard-hour", 0.015, "price of an enhanced fan-out consumer-shard hour")
+	fs.Float64Var(&cc.FanOutPerGB, "fan-out-per-gb", 0.013, "price of a GB retrieved with enhanced fan-out")
+	fs.Parse(args)
+
+	cfg, client := commandClient(configPath)
+	name, streamARN := cfg.streamRef()
+	resp, err := client.DescribeStreamSummary(context.Background(), &kinesis.DescribeStreamSummaryInput{StreamName: name, StreamARN: streamARN})
+	if err != nil {
+		fatalf("DescribeStreamSummary failed: %v", err)
+	}
+	cc.OpenShards = int(aws.ToInt32(resp.StreamDescriptionSummary.OpenShardCount))
+
+	opts.iteratorType = string(types.ShardIteratorTypeLatest)
+	opts.noCheckpoints = true
+	opts.handler = "throughput"
+	opts.handlerConfig, _ = json.Marshal(ThroughputConfig{Target: 0.7, Cost: &cc})
+	opts.stopAfter = *sample
+	fmt.Fprintln(os.Stderr, "measuring the stream for", *sample, "(Ctrl-C stops early)")
+	runConsume(configPath, opts)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"kinesis_consumer/consumer"
+)
+
+type DecodeConfig struct {
+	// Workers decode the records of a GetRecords batch in parallel. 0 or 1 decodes inline.
+	Workers int `json:"workers"`
+	// ZstdConcurrency is how many zstd frames can be decoded at once, 0 keeps the library default.
+	ZstdConcurrency int `json:"zstd_concurrency"`
+	// Codecs pins the codec for some records instead of sniffing it, the first matching rule wins.
+	Codecs []CodecRule  `json:"codecs"`
+	Footer FooterConfig `json:"footer"`
+	// FailureSamples is how many records that fail to decode are logged a minute, with their first
+	// bytes in hex. 10 when 0, none when negative.
+	FailureSamples int `json:"failure_samples"`
+	// AutoTune times decoding records sampled from the stream at startup and sets Workers and
+	// ZstdConcurrency for the host's cores and the payload mix, where they are 0.
+	AutoTune bool `json:"auto_tune"`
+	// Headers honors the header producers can put in front of a record, see header.go.
+	Headers bool `json:"headers"`
+}
+
+// CodecRule says records of a stream and/or partition key are compressed with Codec ("zstd", "gzip"
+// or "none"). Stream and PartitionKey are path.Match patterns such as "logs-*"; empty matches anything.
+// A matching record that doesn't decode as Codec is reported as a producer misconfiguration.
+type CodecRule struct {
+	Stream       string `json:"stream"`
+	PartitionKey string `json:"partition_key"`
+	Codec        string `json:"codec"`
+}
+
+func (dc DecodeConfig) validate() error {
+	if _, err := newFooter(dc.Footer); err != nil {
+		return err
+	}
+	for _, rule := range dc.Codecs {
+		switch rule.Codec {
+		case "zstd", "gzip", "none":
+		default:
+			return fmt.Errorf("decode codec %q is not one of zstd, gzip or none", rule.Codec)
+		}
+		for _, pattern := range []string{rule.Stream, rule.PartitionKey} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid decode codec pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// expectedCodec returns the codec the rules pin for a record, or "" to sniff it.
+func (dc DecodeConfig) expectedCodec(stream, partitionKey string) string {
+	for _, rule := range dc.Codecs {
+		if ok, _ := path.Match(rule.Stream, stream); rule.Stream != "" && !ok {
+			continue
+		}
+		if ok, _ := path.Match(rule.PartitionKey, partitionKey); rule.PartitionKey != "" && !ok {
+			continue
+		}
+		return rule.Codec
+	}
+	return ""
+}
+
+var codecMismatches = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "codec_mismatches_total",
+	Help:      "Records that didn't decode with the codec configured for them.",
+}, []string{"expected"})
+
+// decodeRecordAs decodes a record (footer already cut off) with a known codec, failing if it
+// isn't encoded that way.
+func decodeRecordAs(buf, data []byte, codec string) ([]byte, error) {
+	switch codec {
+	case "zstd":
+		return zstdDecompressTo(buf, data)
+	case "gzip":
+		start := bytes.Index(data, gzipMagic)
+		if start < 0 {
+			return nil, fmt.Errorf("no gzip header in record")
+		}
+		return gzipDecompress(data[start:])
+	default:
+		start := bytes.IndexByte(data, '{')
+		if start < 0 || !json.Valid(data[start:]) {
+			return nil, fmt.Errorf("record is not uncompressed JSON")
+		}
+		return data[start:], nil
+	}
+}
+
+type decodeResult struct {
+	data  []byte
+	codec string
+	err   error
+	// expected is the codec pinned by a rule, err then means the record wasn't encoded with it
+	expected string
+	noFooter bool
+	// header is the producer header (decode.headers), headerErr why it couldn't be read
+	header    map[string]string
+	headerErr error
+}
+
+// decoderPool decodes batches of records, in parallel when configured with more than one worker.
+// Results come back in record order, so handlers still see a shard's records in sequence.
+type decoderPool struct {
+	stream string
+	codecs DecodeConfig
+	footer footer
+	jobs   chan func()
+	// one reusable output buffer per slot in the batch
+	bufs [][]byte
+}
+
+// configureZstd replaces the shared zstd decoder with one for decode.zstd_concurrency. It's called
+// once at startup, before records are decoded, so a reload doesn't change it.
+func configureZstd(dc DecodeConfig) error {
+	if dc.ZstdConcurrency <= 0 {
+		return nil
+	}
+	d, err := zstd.NewReader(nil, zstd.WithDecoderLowmem(false), zstd.WithDecoderConcurrency(dc.ZstdConcurrency))
+	if err != nil {
+		return fmt.Errorf("invalid decode zstd_concurrency: %w", err)
+	}
+	zstdDecoder.Close()
+	zstdDecoder = d
+	return nil
+}
+
+func newDecoderPool(dc DecodeConfig, stream string) *decoderPool {
+	// validated with the config
+	f, _ := newFooter(dc.Footer)
+	d := &decoderPool{stream: stream, codecs: dc, footer: f}
+	if dc.Workers > 1 {
+		d.jobs = make(chan func(), dc.Workers*4)
+		for i := 0; i < dc.Workers; i++ {
+			go func() {
+				for job := range d.jobs {
+					job()
+				}
+			}()
+		}
+	}
+	return d
+}
+
+// close stops the workers. The pool must not be used after.
+func (d *decoderPool) close() {
+	if d.jobs != nil {
+		close(d.jobs)
+	}
+}
+
+// decodeBatch expands the KPL aggregated records among records into their user records and decodes
+// them, those of shardID through the decode middleware; records without a shard (corpus, autotune)
+// skip it. The results line up with the records it returns.
+func (d *decoderPool) decodeBatch(shardID string, fetched []types.Record) ([]kplRecord, []decodeResult) {
+	records := deaggregate(fetched)
+	for len(d.bufs) < len(records) {
+		d.bufs = append(d.bufs, nil)
+	}
+	results := make([]decodeResult, len(records))
+
+	decode := func(i int) {
+		r := &results[i]
+		if shardID != "" {
+			wrapped := consumer.WrapDecode(func(raw *consumer.RawRecord) ([]byte, error) {
+				d.decode(r, i, raw.Data, raw.PartitionKey, records[i].aggregated)
+				return r.data, r.err
+			})
+			if wrapped != nil {
+				raw := rawRecord(shardID, records[i].Record)
+				r.data, r.err = wrapped(&raw)
+				return
+			}
+		}
+		d.decode(r, i, records[i].Data, aws.ToString(records[i].PartitionKey), records[i].aggregated)
+	}
+
+	if d.jobs == nil {
+		for i := range records {
+			decode(i)
+		}
+		return records, results
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(records))
+	decodeQueueDepth.Add(float64(len(records)))
+	for i := range records {
+		d.jobs <- func() {
+			defer wg.Done()
+			defer decodeQueueDepth.Dec()
+			decode(i)
+		}
+	}
+	wg.Wait()
+	return records, results
+}
+
+// decode decodes the data of a record into r, using the output buffer of slot i. The user records
+// of an aggregated record have no footer of their own.
+func (d *decoderPool) decode(r *decodeResult, i int, data []byte, partitionKey string, aggregated bool) {
+	if !aggregated {
+		var ok bool
+		if data, ok = d.footer.strip(data); !ok {
+			r.noFooter = true
+			footersMissing.Inc()
+		}
+	}
+	if d.codecs.Headers {
+		r.header, data, r.headerErr = parseHeader(data)
+	}
+	if r.expected = headerCodec(r.header); r.expected == "" {
+		r.expected = d.codecs.expectedCodec(d.stream, partitionKey)
+	}
+	if r.expected != "" {
+		if r.data, r.err = decodeRecordAs(d.bufs[i], data, r.expected); r.err == nil {
+			r.codec = r.expected
+		} else {
+			// still hand the record on, decoded as well as sniffing allows
+			mismatch := fmt.Errorf("%w: %w", consumer.ErrDecompression, r.err)
+			r.data, r.codec, _ = decodeRecord(d.bufs[i], data)
+			r.err = mismatch
+		}
+	} else {
+		r.data, r.codec, r.err = decodeRecord(d.bufs[i], data)
+	}
+	if r.codec == "zstd" && cap(r.data) <= smallRecordSize {
+		d.bufs[i] = r.data[:0]
+	}
+}
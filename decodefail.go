@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var decodeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "decode_failures_total",
+	Help:      "Records that looked compressed, or were pinned to a codec, but didn't decode, by the magic they start with.",
+}, []string{"magic"})
+
+var magics = []struct {
+	name  string
+	bytes []byte
+}{
+	{"zstd", []byte{0x28, 0xB5, 0x2F, 0xFD}},
+	{"gzip", gzipMagic},
+	{"kpl", kplMagic},
+	{"lz4", []byte{0x04, 0x22, 0x4D, 0x18}},
+	{"xz", []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}},
+	{"snappy", []byte{0xFF, 0x06, 0x00, 0x00, 's', 'N', 'a', 'P', 'p', 'Y'}},
+}
+
+// detectMagic names the format data starts with, going by its first bytes only.
+func detectMagic(data []byte) string {
+	for _, m := range magics {
+		if bytes.HasPrefix(data, m.bytes) {
+			return m.name
+		}
+	}
+	if trimmed := bytes.TrimLeft(data, " \t\r\n"); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		return "json"
+	}
+	return "unknown"
+}
+
+// decodeFailed tells a record that didn't decode from one that simply isn't compressed: sniffing
+// reports an error for every record that isn't zstd, which is only a failure when it looks like zstd.
+func decodeFailed(res decodeResult, data []byte) bool {
+	if res.err == nil {
+		return false
+	}
+	return res.expected != "" || detectMagic(data) == "zstd"
+}
+
+// failureSampler logs at most limit decode failures a minute, with the start of the record in hex,
+// and says how many it left out.
+type failureSampler struct {
+	mu         sync.Mutex
+	minute     time.Time
+	logged     int
+	suppressed int
+}
+
+var decodeFailureSamples failureSampler
+
+func (s *failureSampler) sample(limit int, shardID string, record types.Record, err error) {
+	magic := detectMagic(record.Data)
+	decodeFailures.WithLabelValues(magic).Inc()
+	if limit < 0 {
+		return
+	}
+	if limit == 0 {
+		limit = 10
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now := time.Now().Truncate(time.Minute); !now.Equal(s.minute) {
+		if s.suppressed > 0 {
+			fmt.Printf("\t%d more decode failures weren't logged\n", s.suppressed)
+		}
+		s.minute, s.logged, s.suppressed = now, 0, 0
+	}
+	if s.logged >= limit {
+		s.suppressed++
+		return
+	}
+	s.logged++
+
+	head := record.Data[:min(64, len(record.Data))]
+	fmt.Printf("\tdecode failure sample: %s %s partition key %s, %d bytes, magic %s, err=%v\n\t\tfirst %d bytes: % x\n",
+		shardID, aws.ToString(record.SequenceNumber), aws.ToString(record.PartitionKey), len(record.Data), magic, err,
+		len(head), head)
+}
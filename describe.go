@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+)
+
+// runDescribe is the "describe" command.
+func runDescribe(configPath string) {
+	cfg, client := commandClient(configPath)
+	name, streamARN := cfg.streamRef()
+
+	resp, err := client.DescribeStreamSummary(context.Background(), &kinesis.DescribeStreamSummaryInput{StreamName: name, StreamARN: streamARN})
+	if err != nil {
+		fatalf("DescribeStreamSummary failed: %v", err)
+	}
+
+	s := resp.StreamDescriptionSummary
+	fmt.Printf("%-20s %s\n", "stream", aws.ToString(s.StreamName))
+	fmt.Printf("%-20s %s\n", "arn", aws.ToString(s.StreamARN))
+	fmt.Printf("%-20s %s\n", "status", s.StreamStatus)
+	if s.StreamModeDetails != nil {
+		fmt.Printf("%-20s %s\n", "mode", s.StreamModeDetails.StreamMode)
+	}
+	fmt.Printf("%-20s %s\n", "created", aws.ToTime(s.StreamCreationTimestamp).UTC().Format("2006-01-02 15:04:05"))
+	fmt.Printf("%-20s %dh\n", "retention", aws.ToInt32(s.RetentionPeriodHours))
+	fmt.Printf("%-20s %d\n", "open shards", aws.ToInt32(s.OpenShardCount))
+	fmt.Printf("%-20s %d\n", "consumers", aws.ToInt32(s.ConsumerCount))
+	encryption := encryptionTypeLabel(s.EncryptionType)
+	if s.KeyId != nil {
+		encryption += " " + aws.ToString(s.KeyId)
+	}
+	fmt.Printf("%-20s %s\n", "encryption", encryption)
+}
+
+// runShards is the "shards" command. It lists every shard still within retention, closed ones
+// included, whatever shard_filter says.
+func runShards(configPath string) {
+	cfg, client := commandClient(configPath)
+	all := *cfg
+	all.ShardFilter = ShardFilterConfig{}
+	shards, err := listShards(context.Background(), client, &all)
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	fmt.Printf("%-24s %-6s %-24s %-40s %s\n", "shard", "state", "parent", "starting hash key", "ending hash key")
+	for _, s := range shards {
+		state := "open"
+		if s.SequenceNumberRange != nil && s.SequenceNumberRange.EndingSequenceNumber != nil {
+			state = "closed"
+		}
+		parent := aws.ToString(s.ParentShardId)
+		if s.AdjacentParentShardId != nil {
+			parent += "+" + aws.ToString(s.AdjacentParentShardId)
+		}
+		var start, end string
+		if s.HashKeyRange != nil {
+			start, end = aws.ToString(s.HashKeyRange.StartingHashKey), aws.ToString(s.HashKeyRange.EndingHashKey)
+		}
+		fmt.Printf("%-24s %-6s %-24s %-40s %s\n", aws.ToString(s.ShardId), state, parent, start, end)
+	}
+}
+
+// commandClient loads the config and builds a Kinesis client for a command, exiting on failure.
+func commandClient(configPath string) (*Config, *kinesis.Client) {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	awsCfg, err := loadAWSConfig(context.Background(), cfg)
+	if err != nil {
+		fatalf("unable to load SDK config, %v", err)
+	}
+	return cfg, kinesis.NewFromConfig(awsCfg)
+}
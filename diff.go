@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+const diffUsage = `usage: kinesis_consumer diff -key field -a from..to [-b from..to] [-a-stream s] [-b-stream s] [-ignore f,g] [-show 10] [-json]
+
+reads two windows of arrival times, of the configured stream or of -a-stream and -b-stream, and
+matches their JSON records by the -key field: records only in b are added, only in a removed, and
+in both but with other payloads (without the -ignore fields) changed. Window ends are a duration
+ago (2h), an RFC 3339 time or now; -b defaults to -a, for comparing two streams. Exits 1 when the
+windows differ.
+`
+
+// diffSide is one of the two things diff compares, a window of a stream. payloads holds each key's
+// payload, normalized; for a key that comes up more than once the last record to arrive counts.
+type diffSide struct {
+	cfg      *Config
+	client   *kinesis.Client
+	from, to time.Time
+
+	mu       sync.Mutex
+	records  int
+	unkeyed  int
+	repeated int
+	payloads map[string]diffPayload
+}
+
+type diffPayload struct {
+	arrival   time.Time
+	canonical string
+}
+
+type diffSideReport struct {
+	Stream       string    `json:"stream"`
+	From         time.Time `json:"from"`
+	To           time.Time `json:"to"`
+	Records      int       `json:"records"`
+	Keys         int       `json:"keys"`
+	Unkeyed      int       `json:"unkeyed"`
+	RepeatedKeys int       `json:"repeated_keys"`
+}
+
+type diffChange struct {
+	Key    string   `json:"key"`
+	Fields []string `json:"fields"`
+}
+
+type diffReport struct {
+	A       diffSideReport `json:"a"`
+	B       diffSideReport `json:"b"`
+	Same    int            `json:"same"`
+	Changed int            `json:"changed"`
+	Added   int            `json:"added"`
+	Removed int            `json:"removed"`
+	// the first -show of each, by key
+	ChangedKeys []diffChange `json:"changed_keys"`
+	AddedKeys   []string     `json:"added_keys"`
+	RemovedKeys []string     `json:"removed_keys"`
+}
+
+// runDiff is the "diff" command.
+func runDiff(configPath string, args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, diffUsage) }
+	key := fs.String("key", "", "dotted path of the field that identifies a record, e.g. order.id")
+	windowA := fs.String("a", "", "the first window, from..to")
+	windowB := fs.String("b", "", "the second window, the first one when not set")
+	streamA := fs.String("a-stream", "", "stream name or ARN of the first window, the configured stream when not set")
+	streamB := fs.String("b-stream", "", "stream name or ARN of the second window, the configured stream when not set")
+	ignore := fs.String("ignore", "", "comma separated dotted paths of fields not to compare, e.g. sent_at,trace.id")
+	show := fs.Int("show", 10, "how many keys of each kind of difference to list")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Parse(args)
+	if *key == "" || *windowA == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *windowB == "" {
+		if *streamA == *streamB {
+			fatalf("diff compares two windows or two streams, give -b or -a-stream and -b-stream")
+		}
+		*windowB = *windowA
+	}
+	var ignored []string
+	if *ignore != "" {
+		ignored = strings.Split(*ignore, ",")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), shutdownSignals...)
+	defer stop()
+	now := time.Now()
+	a := newDiffSide(ctx, configPath, *streamA, *windowA, now)
+	b := newDiffSide(ctx, configPath, *streamB, *windowB, now)
+
+	var wg sync.WaitGroup
+	var errA, errB error
+	wg.Add(2)
+	go func() { defer wg.Done(); errA = a.read(ctx, *key, ignored) }()
+	go func() { defer wg.Done(); errB = b.read(ctx, *key, ignored) }()
+	wg.Wait()
+	if err := errors.Join(errA, errB); err != nil {
+		fatalf("%v", err)
+	}
+
+	report := compareDiffSides(a, b, *show)
+	if *asJSON {
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		printDiffReport(report, *show)
+	}
+	if report.Changed+report.Added+report.Removed > 0 {
+		os.Exit(1)
+	}
+}
+
+func newDiffSide(ctx context.Context, configPath, stream, window string, now time.Time) *diffSide {
+	cfg, client := commandStream(ctx, configPath, stream)
+	from, to, err := parseDiffWindow(window, now)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	return &diffSide{cfg: cfg, client: client, from: from, to: to, payloads: make(map[string]diffPayload)}
+}
+
+// commandStream is commandClient for stream, a stream name or ARN, instead of the configured one
+// unless it's empty.
+func commandStream(ctx context.Context, configPath, stream string) (*Config, *kinesis.Client) {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if strings.HasPrefix(stream, "arn:") {
+		cfg.StreamName, cfg.StreamARN = "", stream
+	} else if stream != "" {
+		cfg.StreamName, cfg.StreamARN = stream, ""
+	}
+	if err := cfg.resolveStreamARN(); err != nil {
+		fatalf("%v", err)
+	}
+	awsCfg, err := loadAWSConfig(ctx, cfg)
+	if err != nil {
+		fatalf("unable to load SDK config, %v", err)
+	}
+	return cfg, kinesis.NewFromConfig(awsCfg)
+}
+
+// parseDiffWindow reads "from..to", each end a duration ago, an RFC 3339 time or "now".
+func parseDiffWindow(s string, now time.Time) (from, to time.Time, err error) {
+	start, end, ok := strings.Cut(s, "..")
+	if !ok {
+		return from, to, fmt.Errorf("window %q is not from..to, e.g. 2h..1h", s)
+	}
+	at := func(s string) (time.Time, error) {
+		if s == "now" {
+			return now, nil
+		}
+		if d, err := time.ParseDuration(s); err == nil {
+			return now.Add(-d), nil
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return t, fmt.Errorf("window end %q is not a duration, an RFC 3339 time or now", s)
+		}
+		return t, nil
+	}
+	if from, err = at(start); err != nil {
+		return
+	}
+	if to, err = at(end); err != nil {
+		return
+	}
+	if !from.Before(to) {
+		err = fmt.Errorf("window %q ends before it starts", s)
+	}
+	return
+}
+
+// read reads every shard of the side's stream from its start to its end, or to the tip.
+func (s *diffSide) read(ctx context.Context, key string, ignore []string) error {
+	listCfg := *s.cfg
+	listCfg.ShardFilter = ShardFilterConfig{}
+	shards, err := listShards(ctx, s.client, &listCfg)
+	if err != nil {
+		return err
+	}
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.readShard(ctx, aws.ToString(shard.ShardId), key, ignore)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (s *diffSide) readShard(ctx context.Context, shardID, key string, ignore []string) error {
+	name, streamARN := s.cfg.streamRef()
+	it, err := s.client.GetShardIterator(ctx, &kinesis.GetShardIteratorInput{
+		StreamName:        name,
+		StreamARN:         streamARN,
+		ShardId:           aws.String(shardID),
+		ShardIteratorType: types.ShardIteratorTypeAtTimestamp,
+		Timestamp:         aws.Time(s.from),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to get a shard iterator for %s %s: %w", s.cfg.StreamName, shardID, err)
+	}
+
+	decoder := newDecoderPool(s.cfg.Decode, s.cfg.StreamName)
+	defer decoder.close()
+	for iterator := it.ShardIterator; iterator != nil; {
+		resp, err := s.client.GetRecords(ctx, &kinesis.GetRecordsInput{
+			ShardIterator: iterator,
+			StreamARN:     streamARN,
+			Limit:         aws.Int32(10000),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read %s %s: %w", s.cfg.StreamName, shardID, err)
+		}
+		records, decoded := decoder.decodeBatch("", resp.Records)
+		for i, record := range records {
+			arrival := aws.ToTime(record.ApproximateArrivalTimestamp)
+			if !arrival.Before(s.to) {
+				return nil
+			}
+			s.add(arrival, decoded[i].data, key, ignore)
+		}
+		// caught up with the tip before the end of the window
+		if len(resp.Records) == 0 && aws.ToInt64(resp.MillisBehindLatest) == 0 {
+			return nil
+		}
+		iterator = resp.NextShardIterator
+	}
+	return nil
+}
+
+func (s *diffSide) add(arrival time.Time, data []byte, key string, ignore []string) {
+	k, canonical, ok := diffNormalize(data, key, ignore)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records++
+	if !ok {
+		s.unkeyed++
+		return
+	}
+	if prev, seen := s.payloads[k]; seen {
+		s.repeated++
+		if arrival.Before(prev.arrival) {
+			return
+		}
+	}
+	s.payloads[k] = diffPayload{arrival: arrival, canonical: canonical}
+}
+
+// diffNormalize returns the key of a JSON object payload and the payload without the ignored
+// fields, encoded with sorted keys so equal payloads compare equal. Numbers compare as written.
+func diffNormalize(data []byte, key string, ignore []string) (k, canonical string, ok bool) {
+	fields, ok := decodeDiffPayload(data)
+	if !ok {
+		return "", "", false
+	}
+	v, found := jsonField(fields, key)
+	if !found || v == nil {
+		return "", "", false
+	}
+	switch v.(type) {
+	case map[string]any, []any:
+		return "", "", false
+	}
+	for _, path := range ignore {
+		deleteJSONField(fields, path)
+	}
+	out, _ := json.Marshal(fields)
+	return fmt.Sprint(v), string(out), true
+}
+
+func decodeDiffPayload(data []byte) (map[string]any, bool) {
+	var fields map[string]any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if dec.Decode(&fields) != nil || fields == nil {
+		return nil, false
+	}
+	return fields, true
+}
+
+func deleteJSONField(fields map[string]any, path string) {
+	parent, name := fields, path
+	if i := strings.LastIndexByte(path, '.'); i >= 0 {
+		v, _ := jsonField(fields, path[:i])
+		m, ok := v.(map[string]any)
+		if !ok {
+			return
+		}
+		parent, name = m, path[i+1:]
+	}
+	delete(parent, name)
+}
+
+// diffFields appends the dotted paths under which a and b differ; lists are compared whole.
+func diffFields(prefix string, a, b any, out *[]string) {
+	ma, okA := a.(map[string]any)
+	mb, okB := b.(map[string]any)
+	if !okA || !okB {
+		if !reflect.DeepEqual(a, b) {
+			*out = append(*out, prefix)
+		}
+		return
+	}
+	names := make(map[string]bool)
+	for name := range ma {
+		names[name] = true
+	}
+	for name := range mb {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+		diffFields(path, ma[name], mb[name], out)
+	}
+}
+
+func compareDiffSides(a, b *diffSide, show int) diffReport {
+	side := func(s *diffSide) diffSideReport {
+		return diffSideReport{Stream: s.cfg.StreamName, From: s.from, To: s.to, Records: s.records,
+			Keys: len(s.payloads), Unkeyed: s.unkeyed, RepeatedKeys: s.repeated}
+	}
+	report := diffReport{A: side(a), B: side(b)}
+
+	keys := make([]string, 0, len(a.payloads))
+	for k := range a.payloads {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		pb, ok := b.payloads[k]
+		switch {
+		case !ok:
+			report.Removed++
+			if len(report.RemovedKeys) < show {
+				report.RemovedKeys = append(report.RemovedKeys, k)
+			}
+		case pb.canonical == a.payloads[k].canonical:
+			report.Same++
+		default:
+			report.Changed++
+			if len(report.ChangedKeys) < show {
+				fa, _ := decodeDiffPayload([]byte(a.payloads[k].canonical))
+				fb, _ := decodeDiffPayload([]byte(pb.canonical))
+				var fields []string
+				diffFields("", fa, fb, &fields)
+				report.ChangedKeys = append(report.ChangedKeys, diffChange{Key: k, Fields: fields})
+			}
+		}
+	}
+
+	added := make([]string, 0)
+	for k := range b.payloads {
+		if _, ok := a.payloads[k]; !ok {
+			added = append(added, k)
+		}
+	}
+	sort.Strings(added)
+	report.Added = len(added)
+	report.AddedKeys = added[:min(show, len(added))]
+	return report
+}
+
+func printDiffReport(r diffReport, show int) {
+	for _, s := range []struct {
+		name string
+		diffSideReport
+	}{{"a", r.A}, {"b", r.B}} {
+		fmt.Printf("%s  %s %s..%s  %d records, %d keys", s.name, s.Stream,
+			s.From.UTC().Format(time.RFC3339), s.To.UTC().Format(time.RFC3339), s.Records, s.Keys)
+		if s.Unkeyed > 0 || s.RepeatedKeys > 0 {
+			fmt.Printf(" (%d without a key, %d repeated)", s.Unkeyed, s.RepeatedKeys)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("same     %d\nchanged  %d\nadded    %d\nremoved  %d\n", r.Same, r.Changed, r.Added, r.Removed)
+	if len(r.ChangedKeys) > 0 {
+		fmt.Printf("changed (first %d):\n", show)
+		for _, c := range r.ChangedKeys {
+			fmt.Printf("\t%s\t%s\n", c.Key, strings.Join(c.Fields, ", "))
+		}
+	}
+	if len(r.AddedKeys) > 0 {
+		fmt.Printf("added (first %d):\n\t%s\n", show, strings.Join(r.AddedKeys, "\n\t"))
+	}
+	if len(r.RemovedKeys) > 0 {
+		fmt.Printf("removed (first %d):\n\t%s\n", show, strings.Join(r.RemovedKeys, "\n\t"))
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+)
+
+// runDoctor is the "doctor" subcommand. It makes the calls the consumer will make, with the
+// credentials it will use, and reports which permissions are missing before it starts failing.
+func runDoctor(configPath string) {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	ctx := context.Background()
+	awsCfg, err := loadAWSConfig(ctx, cfg)
+	if err != nil {
+		fatalf("unable to load SDK config, %v", err)
+	}
+	client := kinesis.NewFromConfig(awsCfg)
+	name, streamARN := cfg.streamRef()
+
+	failed := 0
+	check := func(what string, err error) {
+		if err == nil {
+			fmt.Printf("ok       %s\n", what)
+			return
+		}
+		failed++
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			fmt.Printf("FAILED   %s: %s: %s\n", what, apiErr.ErrorCode(), apiErr.ErrorMessage())
+		} else {
+			fmt.Printf("FAILED   %s: %v\n", what, err)
+		}
+	}
+
+	endpoint, err := resolveKinesisEndpoint(ctx, awsCfg, cfg)
+	if err == nil && cfg.AWS.RequirePrivateEndpoint && !endpoint.private {
+		err = fmt.Errorf("require_private_endpoint is set but the endpoint is public")
+	}
+	check("kinesis endpoint "+endpoint.url, err)
+	if endpoint.host != "" && len(endpoint.addrs) > 0 {
+		fmt.Printf("         %s\n", endpoint)
+	}
+
+	identity, err := sts.NewFromConfig(awsCfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	check("credentials (sts:GetCallerIdentity)", err)
+	if err == nil {
+		fmt.Printf("         running as %s in %s\n", aws.ToString(identity.Arn), cfg.Region)
+	}
+
+	summary, err := client.DescribeStreamSummary(ctx, &kinesis.DescribeStreamSummaryInput{StreamName: name, StreamARN: streamARN})
+	check("kinesis:DescribeStreamSummary on "+cfg.StreamName, err)
+
+	shards, err := listShards(ctx, client, cfg)
+	check("kinesis:ListShards on "+cfg.StreamName, err)
+
+	shardID := cfg.ShardID
+	if shardID == allShards && len(shards) > 0 {
+		shardID = aws.ToString(shards[0].ShardId)
+	}
+	it, err := client.GetShardIterator(ctx, &kinesis.GetShardIteratorInput{
+		StreamName:        name,
+		StreamARN:         streamARN,
+		ShardId:           aws.String(shardID),
+		ShardIteratorType: types.ShardIteratorTypeTrimHorizon,
+	})
+	check("kinesis:GetShardIterator on "+shardID, err)
+
+	if err == nil {
+		_, err = client.GetRecords(ctx, &kinesis.GetRecordsInput{ShardIterator: it.ShardIterator, StreamARN: streamARN, Limit: aws.Int32(1)})
+		what := "kinesis:GetRecords on " + shardID
+		if summary != nil && summary.StreamDescriptionSummary.EncryptionType == types.EncryptionTypeKms {
+			what += " (and kms:Decrypt on " + aws.ToString(summary.StreamDescriptionSummary.KeyId) + ")"
+		}
+		if kerr := kmsError(err); kerr != nil {
+			err = kerr
+		}
+		check(what, err)
+	}
+
+	if cfg.Checkpoint.Path != "" {
+		store, err := openBoltStore(cfg.Checkpoint.Path)
+		if err == nil {
+			store.Close()
+		}
+		check("checkpoint store "+cfg.Checkpoint.Path+" (must not be open by a running consumer)", err)
+	}
+	if cfg.Lease.Backend != "" {
+		store, err := openLeaseStore(cfg)
+		if err == nil {
+			_, err = store.List()
+		}
+		check("lease backend "+cfg.Lease.Backend+" (lists the leases)", err)
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d check(s) failed\n", failed)
+		os.Exit(1)
+	}
+	fmt.Println("all checks passed")
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"kinesis_consumer/consumer"
+)
+
+// DuplicatesConfig is the handler_config of the "duplicates" handler.
+//
+//	"handler": "duplicates",
+//	"handler_config": {"window": "10m"}
+type DuplicatesConfig struct {
+	// Window is how long a payload is remembered, by arrival time.
+	Window Duration `json:"window"`
+}
+
+func init() {
+	consumer.RegisterHandlerFactory("duplicates", newDuplicateDetector)
+}
+
+type keyDuplicates struct {
+	records    int64
+	duplicates int64
+}
+
+type fingerprint [sha256.Size]byte
+
+type seenPayload struct {
+	sum     fingerprint
+	arrived time.Time
+}
+
+// duplicatesState is the window as saved in state_dir.
+type duplicatesState struct {
+	Sum     []byte    `json:"sum"`
+	Arrived time.Time `json:"arrived"`
+}
+
+const duplicatesStateFile = "duplicates.json"
+
+// duplicateDetector fingerprints payloads and counts, per partition key, how many were seen before
+// within the window: producers that retry too eagerly show up as keys with a high duplicate rate.
+// The report is printed on close.
+type duplicateDetector struct {
+	cfg DuplicatesConfig
+
+	mu sync.Mutex
+	// seen holds the fingerprints in the window, order has them by arrival for expiry
+	seen  map[fingerprint]int
+	order *list.List
+	keys  map[string]*keyDuplicates
+}
+
+func newDuplicateDetector(raw json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+	cfg := DuplicatesConfig{Window: Duration{10 * time.Minute}}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("invalid duplicates handler_config: %w", err)
+		}
+	}
+	if cfg.Window.Duration <= 0 {
+		return nil, nil, fmt.Errorf("duplicates window must be positive, got %s", cfg.Window)
+	}
+	d := &duplicateDetector{
+		cfg:   cfg,
+		seen:  make(map[fingerprint]int),
+		order: list.New(),
+		keys:  make(map[string]*keyDuplicates),
+	}
+	// the window of the last run, what fell out of it is forgotten with the first record
+	var state []duplicatesState
+	if err := loadState(duplicatesStateFile, &state); err != nil {
+		fmt.Printf("starting with an empty duplicates window, err=%+v\n", err)
+	}
+	for _, p := range state {
+		var sum fingerprint
+		if copy(sum[:], p.Sum) == len(sum) {
+			d.seen[sum]++
+			d.order.PushBack(seenPayload{sum: sum, arrived: p.Arrived})
+		}
+	}
+	return d.handle, d, nil
+}
+
+func (d *duplicateDetector) handle(_ context.Context, r *consumer.Record) error {
+	sum := fingerprint(sha256.Sum256(r.Data))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// forget what fell out of the window
+	for e := d.order.Front(); e != nil; e = d.order.Front() {
+		p := e.Value.(seenPayload)
+		if r.ArrivalTime.Sub(p.arrived) <= d.cfg.Window.Duration {
+			break
+		}
+		d.order.Remove(e)
+		if d.seen[p.sum]--; d.seen[p.sum] <= 0 {
+			delete(d.seen, p.sum)
+		}
+	}
+
+	k := d.keys[r.PartitionKey]
+	if k == nil {
+		k = &keyDuplicates{}
+		d.keys[r.PartitionKey] = k
+	}
+	k.records++
+	if d.seen[sum] > 0 {
+		k.duplicates++
+	}
+	d.seen[sum]++
+	d.order.PushBack(seenPayload{sum: sum, arrived: r.ArrivalTime})
+	return nil
+}
+
+// Close prints the partition keys with the most duplicates and saves the window.
+func (d *duplicateDetector) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state := make([]duplicatesState, 0, d.order.Len())
+	for e := d.order.Front(); e != nil; e = e.Next() {
+		p := e.Value.(seenPayload)
+		state = append(state, duplicatesState{Sum: p.sum[:], Arrived: p.arrived})
+	}
+	if err := saveState(duplicatesStateFile, state); err != nil {
+		fmt.Printf("saving the duplicates window failed, err=%+v\n", err)
+	}
+
+	var records, duplicates int64
+	keys := make([]string, 0, len(d.keys))
+	for key, k := range d.keys {
+		records += k.records
+		duplicates += k.duplicates
+		if k.duplicates > 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := d.keys[keys[i]], d.keys[keys[j]]
+		if a.duplicates != b.duplicates {
+			return a.duplicates > b.duplicates
+		}
+		return keys[i] < keys[j]
+	})
+
+	fmt.Printf("duplicates within %s\n", d.cfg.Window)
+	fmt.Printf("\t%d of %d records (%.2f%%) in %d of %d partition keys\n",
+		duplicates, records, percent(duplicates, records), len(keys), len(d.keys))
+	for i, key := range keys {
+		if i == 20 {
+			fmt.Printf("\t... %d more partition keys with duplicates\n", len(keys)-i)
+			break
+		}
+		k := d.keys[key]
+		fmt.Printf("\t%-40s %10d of %10d %7.2f%%\n", key, k.duplicates, k.records, percent(k.duplicates, k.records))
+	}
+	return nil
+}
+
+func percent(n, of int64) float64 {
+	if of == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(of)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+
+	"kinesis_consumer/consumer"
+)
+
+// FanOutConfig switches from polling GetRecords to enhanced fan-out: records are pushed over
+// SubscribeToShard to a consumer registered on the stream, with 2 MB/s per shard of its own.
+//
+//	"fan_out": {"consumer_name": "billing-archiver", "owner": "billing"}
+//
+// The registered consumer is created if missing and reused if it exists. Stream consumers are
+// shared by everyone with access to the stream, so the owner is kept in a stream tag: a consumer
+// tagged for another owner, or one that isn't tagged at all, is never used or deregistered.
+type FanOutConfig struct {
+	ConsumerName string `json:"consumer_name"`
+	// Owner identifies the team or service, "kinesis_consumer" when empty.
+	Owner string `json:"owner"`
+	// Adopt takes over an existing consumer that has no owner tag yet, e.g. one registered by hand.
+	Adopt bool `json:"adopt"`
+}
+
+// fanOutConsumerARN is set at startup when fan_out is configured.
+var fanOutConsumerARN string
+
+func (fc FanOutConfig) ownerTag() (key, owner string) {
+	owner = fc.Owner
+	if owner == "" {
+		owner = "kinesis_consumer"
+	}
+	return "kinesis_consumer:fan_out:" + fc.ConsumerName, owner
+}
+
+// registerFanOutConsumer creates the stream consumer or checks that the existing one is ours,
+// and waits until it is active.
+func registerFanOutConsumer(ctx context.Context, client *kinesis.Client, cfg *Config) (string, error) {
+	fc := cfg.FanOut
+	name, streamARN := cfg.streamRef()
+	summary, err := client.DescribeStreamSummary(ctx, &kinesis.DescribeStreamSummaryInput{StreamName: name, StreamARN: streamARN})
+	if err != nil {
+		return "", fmt.Errorf("DescribeStreamSummary failed: %w", err)
+	}
+	arn := summary.StreamDescriptionSummary.StreamARN
+
+	tagKey, owner := fc.ownerTag()
+	tagged, err := streamTag(ctx, client, cfg, tagKey)
+	if err != nil {
+		return "", err
+	}
+
+	desc, err := client.DescribeStreamConsumer(ctx, &kinesis.DescribeStreamConsumerInput{StreamARN: arn, ConsumerName: aws.String(fc.ConsumerName)})
+	var notFound *types.ResourceNotFoundException
+	switch {
+	case errors.As(err, &notFound):
+		reg, err := client.RegisterStreamConsumer(ctx, &kinesis.RegisterStreamConsumerInput{StreamARN: arn, ConsumerName: aws.String(fc.ConsumerName)})
+		if err != nil {
+			return "", fmt.Errorf("RegisterStreamConsumer failed: %w", err)
+		}
+		fmt.Println("registered stream consumer", fc.ConsumerName, "for", owner)
+		if err := tagStream(ctx, client, cfg, tagKey, owner); err != nil {
+			return "", err
+		}
+		return waitForConsumer(ctx, client, aws.ToString(reg.Consumer.ConsumerARN))
+	case err != nil:
+		return "", fmt.Errorf("DescribeStreamConsumer failed: %w", err)
+	case tagged == owner:
+		fmt.Println("reusing stream consumer", fc.ConsumerName)
+	case tagged == "" && fc.Adopt:
+		fmt.Println("adopting stream consumer", fc.ConsumerName, "for", owner)
+		if err := tagStream(ctx, client, cfg, tagKey, owner); err != nil {
+			return "", err
+		}
+	case tagged == "":
+		return "", fmt.Errorf("stream consumer %s exists but wasn't registered by kinesis_consumer, pick another consumer_name or set fan_out.adopt", fc.ConsumerName)
+	default:
+		return "", fmt.Errorf("stream consumer %s belongs to %s, not %s; pick another consumer_name", fc.ConsumerName, tagged, owner)
+	}
+	return waitForConsumer(ctx, client, aws.ToString(desc.ConsumerDescription.ConsumerARN))
+}
+
+func waitForConsumer(ctx context.Context, client *kinesis.Client, consumerARN string) (string, error) {
+	for {
+		desc, err := client.DescribeStreamConsumer(ctx, &kinesis.DescribeStreamConsumerInput{ConsumerARN: aws.String(consumerARN)})
+		if err != nil {
+			return "", fmt.Errorf("DescribeStreamConsumer failed: %w", err)
+		}
+		switch desc.ConsumerDescription.ConsumerStatus {
+		case types.ConsumerStatusActive:
+			return consumerARN, nil
+		case types.ConsumerStatusDeleting:
+			return "", fmt.Errorf("stream consumer %s is being deleted", consumerARN)
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// deregisterFanOutConsumer removes the stream consumer, if it's still ours, and its owner tag.
+func deregisterFanOutConsumer(ctx context.Context, client *kinesis.Client, cfg *Config) error {
+	tagKey, owner := cfg.FanOut.ownerTag()
+	tagged, err := streamTag(ctx, client, cfg, tagKey)
+	if err != nil {
+		return err
+	}
+	if tagged != owner {
+		return fmt.Errorf("not deregistering stream consumer %s, it is tagged for %q", cfg.FanOut.ConsumerName, tagged)
+	}
+	if _, err := client.DeregisterStreamConsumer(ctx, &kinesis.DeregisterStreamConsumerInput{ConsumerARN: aws.String(fanOutConsumerARN)}); err != nil {
+		return fmt.Errorf("DeregisterStreamConsumer failed: %w", err)
+	}
+	name, streamARN := cfg.streamRef()
+	_, err = client.RemoveTagsFromStream(ctx, &kinesis.RemoveTagsFromStreamInput{StreamName: name, StreamARN: streamARN, TagKeys: []string{tagKey}})
+	if err != nil {
+		return fmt.Errorf("RemoveTagsFromStream failed: %w", err)
+	}
+	fmt.Println("deregistered stream consumer", cfg.FanOut.ConsumerName)
+	return nil
+}
+
+func streamTag(ctx context.Context, client *kinesis.Client, cfg *Config, key string) (string, error) {
+	name, streamARN := cfg.streamRef()
+	in := &kinesis.ListTagsForStreamInput{StreamName: name, StreamARN: streamARN}
+	for {
+		resp, err := client.ListTagsForStream(ctx, in)
+		if err != nil {
+			return "", fmt.Errorf("ListTagsForStream failed: %w", err)
+		}
+		for _, t := range resp.Tags {
+			if aws.ToString(t.Key) == key {
+				return aws.ToString(t.Value), nil
+			}
+		}
+		if !aws.ToBool(resp.HasMoreTags) || len(resp.Tags) == 0 {
+			return "", nil
+		}
+		in.ExclusiveStartTagKey = resp.Tags[len(resp.Tags)-1].Key
+	}
+}
+
+func tagStream(ctx context.Context, client *kinesis.Client, cfg *Config, key, value string) error {
+	name, streamARN := cfg.streamRef()
+	_, err := client.AddTagsToStream(ctx, &kinesis.AddTagsToStreamInput{StreamName: name, StreamARN: streamARN, Tags: map[string]string{key: value}})
+	if err != nil {
+		return fmt.Errorf("AddTagsToStream failed: %w", err)
+	}
+	return nil
+}
+
+// startingPosition turns where shardStart says to begin into a SubscribeToShard position.
+func startingPosition(in *kinesis.GetShardIteratorInput) *types.StartingPosition {
+	return &types.StartingPosition{
+		Type:           in.ShardIteratorType,
+		SequenceNumber: in.StartingSequenceNumber,
+		Timestamp:      in.Timestamp,
+	}
+}
+
+// processFanOutShard is processKinesisRecords for enhanced fan-out. A subscription lasts five
+// minutes at most, after which it is renewed from the last record received.
+func processFanOutShard(ctx context.Context, client *kinesis.Client, pipes *pipelineRef, store checkpointStore, shardID string) error {
+	cfg := pipes.config()
+	fail := func(format string, args ...any) {
+		panic(&consumer.ShardError{Stream: cfg.StreamName, ShardID: shardID, Err: fmt.Errorf(format, args...)})
+	}
+
+	start, err := shardStart(cfg, store, shardID)
+	if err != nil {
+		fail("%w", err)
+	}
+	pos := startingPosition(start)
+
+	decoder := newDecoderPool(cfg.Decode, cfg.StreamName)
+	defer decoder.close()
+	pool := newHandlerPool(cfg.Handle.Workers)
+	defer pool.close()
+	acks := newAckTracker(ctx, cfg.Handle.MaxUnacked)
+	defer acks.close()
+	defer func() {
+		if ctx.Err() != nil {
+			acks.drain(ackShutdownTimeout)
+			if err := acks.checkpoint(store, cfg.StreamName, shardID); err != nil {
+				fail("failed to checkpoint: %w", err)
+			}
+		}
+	}()
+
+	for ctx.Err() == nil {
+		pauses.wait(ctx, shardID)
+		if ctx.Err() != nil {
+			break
+		}
+
+		out, err := client.SubscribeToShard(ctx, &kinesis.SubscribeToShardInput{
+			ConsumerARN:      aws.String(fanOutConsumerARN),
+			ShardId:          aws.String(shardID),
+			StartingPosition: pos,
+		})
+		var inUse *types.ResourceInUseException
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.As(err, &inUse):
+			// the previous subscription hasn't been torn down yet, it takes a few seconds
+			fmt.Println(shardID, "subscription still in use, retrying")
+			time.Sleep(5 * time.Second)
+			continue
+		case kmsError(err) != nil:
+			fail("%w", kmsError(err))
+		case err != nil:
+			fail("failed to subscribe to shard: %w", err)
+		}
+
+		stream := out.GetStream()
+		closed, err := pipeFanOutEvents(ctx, stream, pipes, decoder, pool, acks, store, shardID, pos)
+		stream.Close()
+		if err != nil {
+			return err
+		}
+		if closed {
+			acks.drain(ackShutdownTimeout)
+			if err := acks.checkpoint(store, cfg.StreamName, shardID); err != nil {
+				fail("failed to checkpoint: %w", err)
+			}
+			fmt.Println(shardID, "is closed")
+			return &consumer.ShardError{Stream: cfg.StreamName, ShardID: shardID, Err: consumer.ErrShardClosed}
+		}
+		if serr := stream.Err(); serr != nil && ctx.Err() == nil {
+			fmt.Printf("%s subscription ended, err=%+v, resubscribing\n", shardID, serr)
+		}
+	}
+	return ctx.Err()
+}
+
+// pipeFanOutEvents handles the events of one subscription and moves pos past what was received.
+// It returns when the subscription ends, the shard is closed or the shard gets paused.
+func pipeFanOutEvents(ctx context.Context, stream *kinesis.SubscribeToShardEventStream, pipes *pipelineRef,
+	decoder *decoderPool, pool *handlerPool, acks *ackTracker, store checkpointStore, shardID string, pos *types.StartingPosition) (closed bool, err error) {
+	cfg := pipes.config()
+	for ev := range stream.Events() {
+		e, ok := ev.(*types.SubscribeToShardEventStreamMemberSubscribeToShardEvent)
+		if !ok {
+			continue
+		}
+		records, err := fetchThrough(ctx, shardID, func(context.Context) ([]types.Record, error) { return e.Value.Records, nil })
+		if err != nil {
+			panic(&consumer.ShardError{Stream: cfg.StreamName, ShardID: shardID, Err: fmt.Errorf("failed to fetch records: %w", err)})
+		}
+		e.Value.Records = records
+
+		recordLag(shardID, e.Value.MillisBehindLatest)
+		recordIteratorAge(shardID, e.Value.Records, e.Value.MillisBehindLatest)
+		recordRates.add(shardID, len(e.Value.Records))
+		if cfg.SkipAhead.due(e.Value.MillisBehindLatest) && e.Value.ContinuationSequenceNumber != nil {
+			cfg.SkipAhead.skipAhead(shardID, *e.Value.MillisBehindLatest, e.Value.Records)
+			pos.Type, pos.Timestamp = cfg.SkipAhead.target()
+			pos.SequenceNumber = nil
+			// resubscribe from there
+			return false, nil
+		}
+		// holding the event back slows the subscription down
+		priorities.wait(ctx, shardID)
+		// the event is already received, waiting for the budget holds the next one back
+		var size int64
+		for _, record := range e.Value.Records {
+			size += int64(len(record.Data))
+		}
+		if err := memoryBudget.acquire(ctx, size); err != nil {
+			return false, err
+		}
+		p := pipes.acquire()
+		last, err := p.processBatch(ctx, decoder, pool, acks, shardID, e.Value.Records, size)
+		pipes.release(p)
+		if last != "" {
+			pos.Type, pos.SequenceNumber, pos.Timestamp = types.ShardIteratorTypeAfterSequenceNumber, aws.String(last), nil
+		}
+		if err := acks.checkpoint(store, cfg.StreamName, shardID); err != nil {
+			panic(&consumer.ShardError{Stream: cfg.StreamName, ShardID: shardID, Err: fmt.Errorf("failed to checkpoint: %w", err)})
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if e.Value.ContinuationSequenceNumber == nil {
+			return true, nil
+		}
+		// the continuation also moves past stretches without records
+		pos.Type, pos.SequenceNumber, pos.Timestamp = types.ShardIteratorTypeAfterSequenceNumber, e.Value.ContinuationSequenceNumber, nil
+		if pauses.wait(ctx, shardID) {
+			return false, ctx.Err()
+		}
+	}
+	return false, nil
+}
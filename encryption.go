@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	streamEncryption = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "stream_encryption_info",
+		Help:      "Always 1, labelled with the stream's server-side encryption type and KMS key.",
+	}, []string{"encryption_type", "key_id"})
+	recordsByEncryption = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "records_by_encryption_total",
+		Help:      "Records read, by the encryption type Kinesis reports for each of them.",
+	}, []string{"encryption_type"})
+)
+
+// streamKMSKey is the stream's KMS key, "" for unencrypted streams. Used in KMS error messages.
+var streamKMSKey string
+
+// describeEncryption logs and exports how the stream is encrypted at rest.
+func describeEncryption(ctx context.Context, client *kinesis.Client, cfg *Config) {
+	name, streamARN := cfg.streamRef()
+	summary, err := client.DescribeStreamSummary(ctx, &kinesis.DescribeStreamSummaryInput{
+		StreamName: name,
+		StreamARN:  streamARN,
+	})
+	if err != nil {
+		fmt.Printf("DescribeStreamSummary failed, stream encryption unknown, err=%+v\n", err)
+		return
+	}
+
+	s := summary.StreamDescriptionSummary
+	encryptionType := encryptionTypeLabel(s.EncryptionType)
+	streamKMSKey = aws.ToString(s.KeyId)
+	streamEncryption.WithLabelValues(encryptionType, streamKMSKey).Set(1)
+
+	if s.EncryptionType == types.EncryptionTypeKms {
+		fmt.Println("stream", cfg.StreamName, "is encrypted with KMS key", streamKMSKey)
+	} else {
+		fmt.Println("stream", cfg.StreamName, "is not encrypted at rest")
+	}
+}
+
+func encryptionTypeLabel(t types.EncryptionType) string {
+	if t == "" {
+		return string(types.EncryptionTypeNone)
+	}
+	return string(t)
+}
+
+// kmsError turns the KMS failures GetRecords reports for SSE-KMS streams into an actionable message.
+// It returns nil for other errors.
+func kmsError(err error) error {
+	var accessDenied *types.KMSAccessDeniedException
+	var disabled *types.KMSDisabledException
+	var notFound *types.KMSNotFoundException
+	var invalidState *types.KMSInvalidStateException
+	var optIn *types.KMSOptInRequired
+
+	switch {
+	case errors.As(err, &accessDenied):
+		return fmt.Errorf("the stream is encrypted with KMS key %q and these credentials lack kms:Decrypt on it: %w", streamKMSKey, err)
+	case errors.As(err, &disabled), errors.As(err, &notFound), errors.As(err, &invalidState):
+		return fmt.Errorf("the stream's KMS key %q can't be used to decrypt records: %w", streamKMSKey, err)
+	case errors.As(err, &optIn):
+		return fmt.Errorf("the account isn't subscribed to KMS, records of the encrypted stream can't be decrypted: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+)
+
+// kinesisEndpoint is where the Kinesis client sends data plane calls and what the host resolves to.
+type kinesisEndpoint struct {
+	url     string
+	host    string
+	addrs   []netip.Addr
+	private bool
+}
+
+func (e kinesisEndpoint) String() string {
+	kind := "public endpoint"
+	if e.private {
+		kind = "private addresses (VPC interface endpoint or custom endpoint)"
+	}
+	return fmt.Sprintf("%s resolves to %s: %s", e.host, kind, joinAddrs(e.addrs))
+}
+
+// resolveKinesisEndpoint works out the endpoint the SDK picks for the stream and looks its host
+// up. With private DNS enabled on an interface VPC endpoint, the regular hostname resolves to the
+// endpoint's private addresses; anything public means calls leave the VPC.
+func resolveKinesisEndpoint(ctx context.Context, awsCfg aws.Config, cfg *Config) (kinesisEndpoint, error) {
+	params := kinesis.EndpointParameters{
+		Region:        aws.String(awsCfg.Region),
+		UseFIPS:       aws.Bool(cfg.AWS.UseFIPSEndpoint),
+		UseDualStack:  aws.Bool(cfg.AWS.UseDualStackEndpoint),
+		Endpoint:      awsCfg.BaseEndpoint,
+		OperationType: aws.String("data"),
+	}
+	if cfg.StreamARN != "" {
+		params.StreamARN = aws.String(cfg.StreamARN)
+	}
+	ep, err := kinesis.NewDefaultEndpointResolverV2().ResolveEndpoint(ctx, params)
+	if err != nil {
+		return kinesisEndpoint{}, fmt.Errorf("unable to resolve the Kinesis endpoint: %w", err)
+	}
+
+	e := kinesisEndpoint{url: ep.URI.String(), host: ep.URI.Hostname()}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", e.host)
+	if err != nil {
+		return e, fmt.Errorf("unable to resolve %s: %w", e.host, err)
+	}
+	e.private = true
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		e.addrs = append(e.addrs, ip)
+		if !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() {
+			e.private = false
+		}
+	}
+	return e, nil
+}
+
+// checkKinesisEndpoint logs which endpoint is used and, with aws.require_private_endpoint, fails
+// when it isn't private.
+func checkKinesisEndpoint(ctx context.Context, awsCfg aws.Config, cfg *Config) error {
+	e, err := resolveKinesisEndpoint(ctx, awsCfg, cfg)
+	if err != nil {
+		if cfg.AWS.RequirePrivateEndpoint {
+			return err
+		}
+		fmt.Println(err)
+		return nil
+	}
+	fmt.Println("kinesis endpoint", e.url, "-", e)
+	if cfg.AWS.HTTP.Proxy != "" || proxyFlag != "" {
+		fmt.Println("a proxy is configured, it does its own DNS resolution")
+	}
+	if cfg.AWS.RequirePrivateEndpoint && !e.private {
+		return fmt.Errorf("require_private_endpoint is set but %s; enable private DNS on the kinesis-streams interface endpoint or set endpoint_url to it", e)
+	}
+	return nil
+}
+
+func joinAddrs(addrs []netip.Addr) string {
+	s := make([]string, len(addrs))
+	for i, a := range addrs {
+		s[i] = a.String()
+	}
+	return strings.Join(s, ", ")
+}
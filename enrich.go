@@ -0,0 +1,320 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// EnrichConfig joins records against reference data before they are handled, e.g. to add the
+// customer a device id belongs to. The value of Key in the record is looked up in one of CSV, HTTP
+// or DynamoDB, and the matching row is stored under Target.
+//
+//	"enrich": {"key": "device_id", "target": "customer", "csv": "devices.csv"}
+//	"enrich": {"key": "device_id", "target": "customer", "http": "https://inventory/devices/{key}"}
+//	"enrich": {"key": "device_id", "target": "customer", "dynamodb": {"table": "devices", "key_attribute": "id"}}
+type EnrichConfig struct {
+	Key    string `json:"key"`
+	Target string `json:"target"`
+
+	// CSV is loaded once; its header names the fields and the first column is the key.
+	CSV string `json:"csv"`
+	// HTTP is a URL with {key} in it, answering 200 with a JSON object or 404.
+	HTTP     string         `json:"http"`
+	DynamoDB DynamoDBLookup `json:"dynamodb"`
+
+	// HTTP and DynamoDB lookups are cached, misses included. Default 10m and 10000 keys.
+	CacheTTL  Duration `json:"cache_ttl"`
+	CacheSize int      `json:"cache_size"`
+}
+
+type DynamoDBLookup struct {
+	Table        string `json:"table"`
+	KeyAttribute string `json:"key_attribute"`
+}
+
+// lookupFunc returns the reference row for key, or nil if there is none.
+type lookupFunc func(ctx context.Context, key string) (map[string]any, error)
+
+type enricher struct {
+	cfg    EnrichConfig
+	lookup lookupFunc
+	// cache is nil for CSV, which is in memory anyway
+	cache *lookupCache
+}
+
+func newEnricher(ctx context.Context, cfg *Config) (*enricher, error) {
+	ec := cfg.Enrich
+	if ec.Key == "" {
+		return nil, nil
+	}
+	if ec.Target == "" {
+		return nil, fmt.Errorf("enrich needs a target field")
+	}
+	if ec.CacheTTL.Duration <= 0 {
+		ec.CacheTTL.Duration = 10 * time.Minute
+	}
+	if ec.CacheSize <= 0 {
+		ec.CacheSize = 10000
+	}
+
+	e := &enricher{cfg: ec}
+	switch {
+	case ec.CSV != "":
+		rows, err := loadCSV(ec.CSV)
+		if err != nil {
+			return nil, err
+		}
+		e.lookup = func(_ context.Context, key string) (map[string]any, error) {
+			return rows[key], nil
+		}
+	case ec.HTTP != "":
+		e.cache = newLookupCache(ec, httpLookup(ec.HTTP))
+		e.lookup = e.cache.get
+	case ec.DynamoDB.Table != "":
+		awsCfg, err := loadAWSConfig(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		e.cache = newLookupCache(ec, dynamoDBLookup(dynamodb.NewFromConfig(awsCfg), ec.DynamoDB))
+		e.lookup = e.cache.get
+	default:
+		return nil, fmt.Errorf("enrich needs one of csv, http or dynamodb")
+	}
+	if e.cache != nil {
+		if err := e.cache.load(); err != nil {
+			fmt.Printf("starting with an empty enrich cache, err=%+v\n", err)
+		}
+	}
+	return e, nil
+}
+
+// close saves the lookup cache.
+func (e *enricher) close() {
+	if e == nil || e.cache == nil {
+		return
+	}
+	if err := e.cache.save(); err != nil {
+		fmt.Printf("saving the enrich cache failed, err=%+v\n", err)
+	}
+}
+
+// apply adds the reference row to the record. Records that aren't JSON objects,
+// don't have the key or whose key isn't found are passed through untouched.
+func (e *enricher) apply(ctx context.Context, data []byte) ([]byte, error) {
+	if e == nil {
+		return data, nil
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return data, nil
+	}
+	v, ok := jsonField(fields, e.cfg.Key)
+	if !ok {
+		return data, nil
+	}
+
+	row, err := e.lookup(ctx, fmt.Sprint(v))
+	if err != nil {
+		return nil, fmt.Errorf("lookup of %s %v failed: %w", e.cfg.Key, v, err)
+	}
+	if row == nil {
+		return data, nil
+	}
+	fields[e.cfg.Target] = row
+	return json.Marshal(fields)
+}
+
+func loadCSV(path string) (map[string]map[string]any, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open enrich csv %s: %w", path, err)
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read enrich csv %s: %w", path, err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("enrich csv %s is empty", path)
+	}
+
+	header := records[0]
+	rows := make(map[string]map[string]any, len(records)-1)
+	for _, rec := range records[1:] {
+		row := make(map[string]any, len(header))
+		for i, name := range header {
+			if i < len(rec) {
+				row[name] = rec[i]
+			}
+		}
+		rows[rec[0]] = row
+	}
+	return rows, nil
+}
+
+func httpLookup(template string) lookupFunc {
+	client := &http.Client{Timeout: 5 * time.Second}
+	return func(ctx context.Context, key string) (map[string]any, error) {
+		u := strings.ReplaceAll(template, "{key}", url.PathEscape(key))
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			var row map[string]any
+			if err := json.NewDecoder(resp.Body).Decode(&row); err != nil {
+				return nil, fmt.Errorf("invalid JSON from %s: %w", u, err)
+			}
+			return row, nil
+		case http.StatusNotFound:
+			return nil, nil
+		default:
+			return nil, fmt.Errorf("%s returned %s", u, resp.Status)
+		}
+	}
+}
+
+func dynamoDBLookup(client *dynamodb.Client, dl DynamoDBLookup) lookupFunc {
+	return func(ctx context.Context, key string) (map[string]any, error) {
+		out, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName: &dl.Table,
+			Key:       map[string]ddbtypes.AttributeValue{dl.KeyAttribute: &ddbtypes.AttributeValueMemberS{Value: key}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if out.Item == nil {
+			return nil, nil
+		}
+		var row map[string]any
+		if err := attributevalue.UnmarshalMap(out.Item, &row); err != nil {
+			return nil, err
+		}
+		return row, nil
+	}
+}
+
+type cacheEntry struct {
+	key     string
+	row     map[string]any
+	expires time.Time
+}
+
+// cacheState is a cache entry as saved in state_dir.
+type cacheState struct {
+	Key     string         `json:"key"`
+	Row     map[string]any `json:"row"`
+	Expires time.Time      `json:"expires"`
+}
+
+const enrichCacheStateFile = "enrich-cache.json"
+
+// lookupCache is a small LRU in front of a remote lookup, so each key is fetched
+// at most once per TTL instead of once per record.
+type lookupCache struct {
+	ttl    time.Duration
+	size   int
+	lookup lookupFunc
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+func newLookupCache(ec EnrichConfig, lookup lookupFunc) *lookupCache {
+	return &lookupCache{
+		ttl:     ec.CacheTTL.Duration,
+		size:    ec.CacheSize,
+		lookup:  lookup,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *lookupCache) get(ctx context.Context, key string) (map[string]any, error) {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*cacheEntry)
+		if time.Now().Before(e.expires) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			return e.row, nil
+		}
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+
+	row, err := c.lookup(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		// another shard looked it up meanwhile
+		c.lru.Remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, row: row, expires: time.Now().Add(c.ttl)})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+	return row, nil
+}
+
+// save writes the entries that haven't expired to state_dir, most recently used first.
+func (c *lookupCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	state := make([]cacheState, 0, c.lru.Len())
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		if e := el.Value.(*cacheEntry); now.Before(e.expires) {
+			state = append(state, cacheState{Key: e.key, Row: e.row, Expires: e.expires})
+		}
+	}
+	return saveState(enrichCacheStateFile, state)
+}
+
+// load fills the cache with what save wrote, keeping the entries' expiry.
+func (c *lookupCache) load() error {
+	var state []cacheState
+	if err := loadState(enrichCacheStateFile, &state); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for _, s := range state {
+		if _, ok := c.entries[s.Key]; ok || !now.Before(s.Expires) || c.lru.Len() >= c.size {
+			continue
+		}
+		c.entries[s.Key] = c.lru.PushBack(&cacheEntry{key: s.Key, row: s.Row, expires: s.Expires})
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kinesis_consumer/consumer"
+)
+
+// EventHubsConfig is the handler_config of the "eventhubs" handler.
+//
+//	"handler": "eventhubs",
+//	"handler_config": {"connection_string": "Endpoint=sb://ns.servicebus.windows.net/;SharedAccessKeyName=send;SharedAccessKey=...;EntityPath=orders"}
+type EventHubsConfig struct {
+	// ConnectionString is a shared access policy's, EVENTHUB_CONNECTION_STRING when not set.
+	ConnectionString string `json:"connection_string"`
+	// Hub is the event hub, when the connection string has no EntityPath.
+	Hub string `json:"hub"`
+	// Timeout bounds each send, 30s when not set.
+	Timeout Duration `json:"timeout"`
+	// PartitionKey re-keys records, which keep their Kinesis partition key otherwise.
+	PartitionKey PartitionKeyConfig `json:"partition_key"`
+}
+
+// eventHubsTokenLifetime is how long a SAS token is signed for; it's renewed halfway.
+const eventHubsTokenLifetime = time.Hour
+
+func init() {
+	consumer.RegisterHandlerFactory("eventhubs", newEventHubsSender)
+}
+
+// eventHubsSender mirrors records into an Azure event hub through its REST API, one send per
+// record with the Kinesis partition key (or the one partition_key computes) as the event's
+// partition key, so records of a key land in the same partition in order.
+type eventHubsSender struct {
+	keyer    *partitionKeyer
+	url      string
+	resource string
+	keyName  string
+	key      []byte
+	client   *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func newEventHubsSender(raw json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+	var cfg EventHubsConfig
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("invalid eventhubs handler_config: %w", err)
+		}
+	}
+	if cfg.ConnectionString == "" {
+		cfg.ConnectionString = os.Getenv("EVENTHUB_CONNECTION_STRING")
+	}
+	if cfg.Timeout.Duration <= 0 {
+		cfg.Timeout.Duration = 30 * time.Second
+	}
+
+	parts := make(map[string]string)
+	for _, part := range strings.Split(cfg.ConnectionString, ";") {
+		if k, v, ok := strings.Cut(part, "="); ok {
+			parts[k] = v
+		}
+	}
+	hub := parts["EntityPath"]
+	if hub == "" {
+		hub = cfg.Hub
+	}
+	endpoint, err := url.Parse(parts["Endpoint"])
+	if err != nil || endpoint.Host == "" || parts["SharedAccessKeyName"] == "" || parts["SharedAccessKey"] == "" || hub == "" {
+		return nil, nil, fmt.Errorf("the eventhubs handler needs a connection string with Endpoint, SharedAccessKeyName, SharedAccessKey and EntityPath (or a hub)")
+	}
+
+	keyer, err := newPartitionKeyer(cfg.PartitionKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resource := "https://" + endpoint.Host + "/" + hub
+	s := &eventHubsSender{
+		keyer:    keyer,
+		url:      resource + "/messages?timeout=60&api-version=2014-01",
+		resource: resource,
+		keyName:  parts["SharedAccessKeyName"],
+		key:      []byte(parts["SharedAccessKey"]),
+		client:   &http.Client{Timeout: cfg.Timeout.Duration},
+	}
+	return s.handle, s, nil
+}
+
+// sasToken returns a shared access signature for the hub, signing a new one when the current
+// one is past half its lifetime.
+func (s *eventHubsSender) sasToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Until(s.expires) > eventHubsTokenLifetime/2 {
+		return s.token
+	}
+
+	s.expires = time.Now().Add(eventHubsTokenLifetime)
+	resource := url.QueryEscape(s.resource)
+	expiry := strconv.FormatInt(s.expires.Unix(), 10)
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(resource + "\n" + expiry))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	s.token = fmt.Sprintf("SharedAccessSignature sr=%s&sig=%s&se=%s&skn=%s", resource, url.QueryEscape(sig), expiry, s.keyName)
+	return s.token
+}
+
+func (s *eventHubsSender) handle(ctx context.Context, r *consumer.Record) error {
+	key, err := s.keyer.key(r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(r.Data))
+	if err != nil {
+		return err
+	}
+	// MessageId lets consumers of the hub dedupe what is sent again after a restart
+	props, _ := json.Marshal(map[string]string{"PartitionKey": key, "MessageId": r.IdempotencyKey()})
+	req.Header.Set("Authorization", s.sasToken())
+	req.Header.Set("Content-Type", "application/atom+xml;type=entry;charset=utf-8")
+	req.Header.Set("BrokerProperties", string(props))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("event hubs send returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (s *eventHubsSender) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
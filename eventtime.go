@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// EventTimeConfig takes each record's event time from a field of its JSON payload, for handlers
+// that group records by time (consumer.Record.Time).
+//
+//	"event_time": {"field": "meta.ts", "layout": "unix_ms"}
+type EventTimeConfig struct {
+	// Field is a dotted path into the payload. Event times are off when empty.
+	Field string `json:"field"`
+	// Layout is "rfc3339" (the default), "unix", "unix_ms" or a Go time layout such as
+	// "2006-01-02 15:04:05". Go layouts without a zone are read as UTC.
+	Layout string `json:"layout"`
+}
+
+var eventTimesMissing = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "event_times_missing_total",
+	Help:      "Records whose event_time field is missing or unreadable, their arrival time is used instead.",
+})
+
+func (ec EventTimeConfig) validate() error {
+	switch ec.Layout {
+	case "", "rfc3339", "unix", "unix_ms":
+		return nil
+	}
+	if ec.Field == "" {
+		return fmt.Errorf("event_time layout is set without a field")
+	}
+	if _, err := time.Parse(ec.Layout, time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC).Format(ec.Layout)); err != nil {
+		return fmt.Errorf("event_time layout %q can't be parsed back: %w", ec.Layout, err)
+	}
+	return nil
+}
+
+// extract returns the event time of a payload, the zero time when there is none.
+func (ec EventTimeConfig) extract(data []byte) time.Time {
+	if ec.Field == "" {
+		return time.Time{}
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		eventTimesMissing.Inc()
+		return time.Time{}
+	}
+	v, ok := jsonField(fields, ec.Field)
+	if !ok {
+		eventTimesMissing.Inc()
+		return time.Time{}
+	}
+	t, err := ec.parse(v)
+	if err != nil {
+		eventTimesMissing.Inc()
+		return time.Time{}
+	}
+	return t
+}
+
+func (ec EventTimeConfig) parse(v any) (time.Time, error) {
+	switch ec.Layout {
+	case "unix", "unix_ms":
+		var n float64
+		switch v := v.(type) {
+		case float64:
+			n = v
+		case string:
+			var err error
+			if n, err = strconv.ParseFloat(v, 64); err != nil {
+				return time.Time{}, err
+			}
+		default:
+			return time.Time{}, fmt.Errorf("%v is not a number", v)
+		}
+		if ec.Layout == "unix_ms" {
+			return time.UnixMilli(int64(n)), nil
+		}
+		sec, frac := math.Modf(n)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("%v is not a string", v)
+	}
+	if ec.Layout == "" || ec.Layout == "rfc3339" {
+		return time.Parse(time.RFC3339Nano, s)
+	}
+	return time.Parse(ec.Layout, s)
+}
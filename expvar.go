@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// The consumer's counters are also served as expvar JSON under /debug/vars on metrics_addr,
+// for environments that scrape expvar instead of Prometheus.
+func init() {
+	expvar.Publish("kinesis_consumer", expvar.Func(func() any {
+		snap := stats.Snapshot()
+		return map[string]any{
+			"records":          snap.Records,
+			"records_by_shard": snap.ByShard,
+			"records_by_codec": snap.ByCodec,
+			"handlers":         snap.ByHandler,
+			"goroutines":       runtime.NumGoroutine(),
+			"shard_goroutines": shardGoroutines(),
+			"metrics":          gatherMetrics(),
+		}
+	}))
+}
+
+// labelShard labels the calling goroutine with its shard. Goroutines it starts inherit the label,
+// which is how shardGoroutines counts them.
+func labelShard(shardID string) {
+	pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), pprof.Labels("shard", shardID)))
+}
+
+// shardGoroutines counts the running goroutines labelled by labelShard, per shard.
+func shardGoroutines() map[string]int {
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 1)
+
+	// debug=1 groups identical stacks as "<count> @ <pcs>", followed by "# labels: {...}" if they have any
+	counts := make(map[string]int)
+	n := 0
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if count, _, ok := strings.Cut(line, " @ "); ok {
+			n, _ = strconv.Atoi(count)
+			continue
+		}
+		if labels, ok := strings.CutPrefix(line, "# labels: "); ok {
+			var l map[string]string
+			if json.Unmarshal([]byte(labels), &l) == nil && l["shard"] != "" {
+				counts[l["shard"]] += n
+			}
+		}
+	}
+	return counts
+}
+
+// gatherMetrics flattens this consumer's Prometheus metrics to "name{label="value",...}" keys.
+// Histograms and summaries show up as their _sum and _count.
+func gatherMetrics() map[string]float64 {
+	out := make(map[string]float64)
+	eachMetric(func(name string, labels []*dto.LabelPair, _ bool, value float64) {
+		out[name+labelString(labels)] = value
+	})
+	return out
+}
+
+// eachMetric calls fn with every series of this consumer's Prometheus metrics, histograms and
+// summaries as their _sum and _count, which are cumulative like counters.
+func eachMetric(fn func(name string, labels []*dto.LabelPair, cumulative bool, value float64)) {
+	families, _ := prometheus.DefaultGatherer.Gather()
+	for _, mf := range families {
+		if !strings.HasPrefix(mf.GetName(), metricsNamespace+"_") {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			name, labels := mf.GetName(), m.GetLabel()
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				fn(name, labels, true, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				fn(name, labels, false, m.GetGauge().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				fn(name+"_sum", labels, true, m.GetHistogram().GetSampleSum())
+				fn(name+"_count", labels, true, float64(m.GetHistogram().GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				fn(name+"_sum", labels, true, m.GetSummary().GetSampleSum())
+				fn(name+"_count", labels, true, float64(m.GetSummary().GetSampleCount()))
+			}
+		}
+	}
+}
+
+func labelString(pairs []*dto.LabelPair) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	labels := make([]string, len(pairs))
+	for i, p := range pairs {
+		labels[i] = p.GetName() + "=" + strconv.Quote(p.GetValue())
+	}
+	sort.Strings(labels)
+	return "{" + strings.Join(labels, ",") + "}"
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"kinesis_consumer/consumer"
+)
+
+// plainIdentifier is a table or column name that is safe to put in SQL unquoted.
+var plainIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// jsonField looks up a dotted path such as "device.id" in a decoded JSON object.
+func jsonField(fields map[string]any, path string) (any, bool) {
+	var v any = fields
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// columnValues maps r onto columns, each a field of its JSON payload or @partition_key, @shard,
+// @sequence_number, @arrival_time (formatted with layout) or @data (the whole payload as a
+// string); fields the payload lacks are left out, for the column default. Without columns the
+// payload's own fields are the columns, and a payload that isn't a JSON object fails.
+func columnValues(r *consumer.Record, columns map[string]string, layout string) (map[string]any, error) {
+	var fields map[string]any
+	dec := json.NewDecoder(bytes.NewReader(r.Data))
+	// numbers as written, 64 bit integers and decimals don't survive float64
+	dec.UseNumber()
+	if err := dec.Decode(&fields); err != nil && len(columns) == 0 {
+		return nil, fmt.Errorf("record is not a JSON object: %w", err)
+	}
+	if len(columns) == 0 {
+		return fields, nil
+	}
+
+	row := make(map[string]any, len(columns))
+	for column, source := range columns {
+		switch source {
+		case "@partition_key":
+			row[column] = r.PartitionKey
+		case "@shard":
+			row[column] = r.ShardID
+		case "@sequence_number":
+			row[column] = r.SequenceNumber
+		case "@arrival_time":
+			row[column] = r.ArrivalTime.UTC().Format(layout)
+		case "@data":
+			row[column] = string(r.Data)
+		default:
+			if v, ok := jsonField(fields, source); ok {
+				row[column] = v
+			}
+		}
+	}
+	return row, nil
+}
+
+// recordTemplate fills a string such as "devices/{device.id}/events" from a record:
+// {path} is a field of its JSON payload, {@partition_key} and {@shard} are the record's own, and
+// {@yyyy}, {@mm}, {@dd} and {@hh} are the UTC year, month, day and hour of its event time
+// (Record.Time), to partition sink output by when records happened rather than arrived.
+type recordTemplate struct {
+	// literal text and placeholders alternate, starting with literal text
+	parts []string
+}
+
+func newRecordTemplate(s string) (recordTemplate, error) {
+	var t recordTemplate
+	for {
+		open := strings.IndexByte(s, '{')
+		if open < 0 {
+			t.parts = append(t.parts, s)
+			return t, nil
+		}
+		end := strings.IndexByte(s[open:], '}')
+		if end < 0 {
+			return t, fmt.Errorf("unclosed { in %q", s)
+		}
+		name := s[open+1 : open+end]
+		if name == "" {
+			return t, fmt.Errorf("empty {} in %q", s)
+		}
+		t.parts = append(t.parts, s[:open], name)
+		s = s[open+end+1:]
+	}
+}
+
+// render fills in the placeholders, passing each value through escape. It fails when the payload
+// isn't a JSON object or lacks a field, so the record goes through the poison policy.
+func (t recordTemplate) render(r *consumer.Record, escape func(string) string) (string, error) {
+	if len(t.parts) == 1 {
+		return t.parts[0], nil
+	}
+
+	var fields map[string]any
+	var b strings.Builder
+	for i, part := range t.parts {
+		if i%2 == 0 {
+			b.WriteString(part)
+			continue
+		}
+		var v string
+		switch part {
+		case "@partition_key":
+			v = r.PartitionKey
+		case "@shard":
+			v = r.ShardID
+		case "@yyyy":
+			v = r.Time().UTC().Format("2006")
+		case "@mm":
+			v = r.Time().UTC().Format("01")
+		case "@dd":
+			v = r.Time().UTC().Format("02")
+		case "@hh":
+			v = r.Time().UTC().Format("15")
+		default:
+			if fields == nil {
+				// numbers as written, not as float64
+				dec := json.NewDecoder(bytes.NewReader(r.Data))
+				dec.UseNumber()
+				if err := dec.Decode(&fields); err != nil {
+					return "", fmt.Errorf("record is not a JSON object, can't fill in {%s}", part)
+				}
+			}
+			field, ok := jsonField(fields, part)
+			if !ok {
+				return "", fmt.Errorf("record has no %s", part)
+			}
+			v = fmt.Sprint(field)
+		}
+		b.WriteString(escape(v))
+	}
+	return b.String(), nil
+}
+
+// pathSegment escapes a template value for a file path or object key: a / or \ becomes _, and so
+// does a value that is . or .., so a record can't pick a path outside the template's directory.
+func pathSegment(s string) string {
+	if s == "." || s == ".." {
+		return "_"
+	}
+	return strings.NewReplacer("/", "_", "\\", "_").Replace(s)
+}
+
+// PartitionKeyConfig computes the partition key a handler forwards a record with, to re-partition
+// it on the way; without a template the record keeps its own key.
+//
+//	"partition_key": {"template": "{customer.id}"}
+//	"partition_key": {"template": "{@partition_key}", "buckets": 16}
+type PartitionKeyConfig struct {
+	// Template is a recordTemplate such as "{tenant}/{device.id}".
+	Template string `json:"template"`
+	// Hash replaces the key with its "md5" or "sha256" as hex, to spread keys that hash badly.
+	Hash string `json:"hash"`
+	// Buckets replaces the key with its FNV-1a hash modulo Buckets, so records spread over that
+	// many keys, e.g. one per shard of the destination.
+	Buckets int `json:"buckets"`
+}
+
+// maxPartitionKeyLength is what Kinesis takes, in unicode characters.
+const maxPartitionKeyLength = 256
+
+type partitionKeyer struct {
+	cfg      PartitionKeyConfig
+	template recordTemplate
+}
+
+func newPartitionKeyer(pc PartitionKeyConfig) (*partitionKeyer, error) {
+	k := &partitionKeyer{cfg: pc}
+	switch pc.Hash {
+	case "", "md5", "sha256":
+	default:
+		return nil, fmt.Errorf("partition_key hash %q is not one of md5 or sha256", pc.Hash)
+	}
+	if pc.Buckets < 0 {
+		return nil, fmt.Errorf("partition_key buckets must not be negative, got %d", pc.Buckets)
+	}
+	var err error
+	if pc.Template != "" {
+		if k.template, err = newRecordTemplate(pc.Template); err != nil {
+			return nil, fmt.Errorf("invalid partition_key template: %w", err)
+		}
+	}
+	return k, nil
+}
+
+// key computes r's new partition key. It fails when the template can't be filled in, so the
+// record goes through the poison policy instead of being forwarded with the wrong key.
+func (k *partitionKeyer) key(r *consumer.Record) (string, error) {
+	key := r.PartitionKey
+	if k.cfg.Template != "" {
+		var err error
+		if key, err = k.template.render(r, func(s string) string { return s }); err != nil {
+			return "", err
+		}
+	}
+	switch k.cfg.Hash {
+	case "md5":
+		sum := md5.Sum([]byte(key))
+		key = hex.EncodeToString(sum[:])
+	case "sha256":
+		sum := sha256.Sum256([]byte(key))
+		key = hex.EncodeToString(sum[:])
+	}
+	if k.cfg.Buckets > 0 {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		key = strconv.Itoa(int(h.Sum32() % uint32(k.cfg.Buckets)))
+	}
+	if key == "" || utf8.RuneCountInString(key) > maxPartitionKeyLength {
+		return "", fmt.Errorf("partition key %q is empty or longer than %d characters", key, maxPartitionKeyLength)
+	}
+	return key, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"kinesis_consumer/consumer"
+)
+
+func TestRecordTemplate(t *testing.T) {
+	arrival := time.Date(2024, 3, 9, 23, 59, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		template  string
+		data      string
+		eventTime time.Time
+		want      string
+		wantErr   bool
+	}{
+		{"literal", "events", `{}`, time.Time{}, "events", false},
+		{"fields", "{@shard}/{tenant.id}/{n}", `{"tenant":{"id":"acme"},"n":12345678901}`, time.Time{}, "shardId-000000000000/acme/12345678901", false},
+		{"escaped", "{@partition_key}/{tenant}", `{"tenant":"../x"}`, time.Time{}, "a_b/.._x", false},
+		{"arrival time", "{@yyyy}/{@mm}/{@dd}/{@hh}", `{}`, time.Time{}, "2024/03/09/23", false},
+		// event time wins, in UTC
+		{"event time", "dt={@yyyy}-{@mm}-{@dd}/hour={@hh}", `{}`, time.Date(2024, 3, 10, 1, 30, 0, 0, time.FixedZone("CET", 3600)), "dt=2024-03-10/hour=00", false},
+		{"missing field", "{tenant}", `{}`, time.Time{}, "", true},
+		{"not json", "{tenant}", `tenant`, time.Time{}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := newRecordTemplate(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := &consumer.Record{ShardID: "shardId-000000000000", PartitionKey: "a/b", Data: []byte(tt.data),
+				ArrivalTime: arrival, EventTime: tt.eventTime}
+			got, err := tmpl.render(r, pathSegment)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("render = %q, %v, want %q (error %v)", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"kinesis_consumer/consumer"
+)
+
+// FileConfig is the handler_config of the "file" handler.
+//
+//	"handler": "file",
+//	"handler_config": {"path": "archive/{@shard}.jsonl.zst", "compression": {"codec": "zstd", "level": 3}}
+type FileConfig struct {
+	// Path is a recordTemplate naming the file a record is appended to, e.g. "out/{tenant}.jsonl".
+	Path        string            `json:"path"`
+	Compression CompressionConfig `json:"compression"`
+	// Flush is 1000 records, 4MB, 1s and 1 write in flight when not set; with more in flight,
+	// batches may land in a file out of order.
+	Flush FlushConfig `json:"flush"`
+}
+
+// fileMaxWriteBytes is the most a batch holds in memory before it is written.
+const fileMaxWriteBytes = 64 << 20
+
+func init() {
+	consumer.RegisterHandlerFactory("file", newFileWriter)
+}
+
+// fileWriter appends decoded payloads as lines to local files, created with their directories.
+// Records are batched, and a batch is written to each of its files as one gzip member or zstd
+// frame and synced before its records are acknowledged, like the pubsub handler's.
+type fileWriter struct {
+	cfg   FileConfig
+	path  recordTemplate
+	batch *asyncBatcher
+}
+
+func newFileWriter(raw json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+	var cfg FileConfig
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("invalid file handler_config: %w", err)
+		}
+	}
+	if cfg.Path == "" {
+		return nil, nil, fmt.Errorf("the file handler needs a path")
+	}
+	if err := cfg.Compression.validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid file compression: %w", err)
+	}
+	path, err := newRecordTemplate(cfg.Path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid file path: %w", err)
+	}
+
+	w := &fileWriter{cfg: cfg, path: path}
+	w.batch = cfg.Flush.batcher("file", FlushConfig{MaxRecords: 1000, MaxBytes: 4 << 20, MaxLatency: Duration{time.Second}, MaxInFlight: 1},
+		0, fileMaxWriteBytes, w.write)
+	return w.handle, w, nil
+}
+
+// handle queues the record as the path it goes to followed by its line.
+func (w *fileWriter) handle(ctx context.Context, r *consumer.Record) error {
+	path, err := w.path.render(r, pathSegment)
+	if err != nil {
+		return err
+	}
+	item := appendField(nil, path)
+	item = append(item, r.Data...)
+	return w.batch.add(ctx, append(item, '\n'))
+}
+
+// write appends a batch's lines to their files, in the order they were handled.
+func (w *fileWriter) write(items [][]byte) error {
+	var paths []string
+	lines := make(map[string][]byte)
+	for _, item := range items {
+		path, line := cutField(item)
+		if _, ok := lines[path]; !ok {
+			paths = append(paths, path)
+		}
+		lines[path] = append(lines[path], line...)
+	}
+	for _, path := range paths {
+		if err := w.append(path, lines[path]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *fileWriter) append(path string, data []byte) error {
+	out, err := w.cfg.Compression.compress(data)
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(out); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Close writes what is still pending.
+func (w *fileWriter) Close() error {
+	w.batch.close()
+	return nil
+}
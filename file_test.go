@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"kinesis_consumer/consumer"
+)
+
+// decompressAll undoes what compression wrote, any number of gzip members or zstd frames.
+func decompressAll(t *testing.T, codec string, data []byte) string {
+	t.Helper()
+	var err error
+	switch codec {
+	case "gzip":
+		data, err = gzipDecompress(data)
+	case "zstd":
+		data, err = zstdDecompress(data)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFileWriter(t *testing.T) {
+	tests := []struct {
+		codec string
+		level int
+	}{
+		{"", 0},
+		{"gzip", 0},
+		{"gzip", 9},
+		{"zstd", 0},
+		{"zstd", 19},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s-%d", tt.codec, tt.level), func(t *testing.T) {
+			dir := t.TempDir()
+			config := fmt.Sprintf(`{"path": %q, "compression": {"codec": %q, "level": %d}, "flush": {"max_records": 2}}`,
+				filepath.Join(dir, "{tenant}", "{@shard}.jsonl"), tt.codec, tt.level)
+			handle, closer, err := newFileWriter([]byte(config))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			acked := make(chan error, 5)
+			for i, tenant := range []string{"acme", "globex", "acme", "../etc", "acme"} {
+				ctx, _ := consumer.NewAsyncContext(context.Background(), func(err error) { acked <- err })
+				r := &consumer.Record{ShardID: "shardId-000000000000", SequenceNumber: fmt.Sprint(i),
+					Data: []byte(fmt.Sprintf(`{"tenant":%q,"n":%d}`, tenant, i))}
+				if err := handle(ctx, r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			closer.Close()
+			for range 5 {
+				if err := <-acked; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for path, want := range map[string]string{
+				"acme/shardId-000000000000.jsonl":   "{\"tenant\":\"acme\",\"n\":0}\n{\"tenant\":\"acme\",\"n\":2}\n{\"tenant\":\"acme\",\"n\":4}\n",
+				"globex/shardId-000000000000.jsonl": "{\"tenant\":\"globex\",\"n\":1}\n",
+				".._etc/shardId-000000000000.jsonl": "{\"tenant\":\"../etc\",\"n\":3}\n",
+			} {
+				data, err := os.ReadFile(filepath.Join(dir, path))
+				if err != nil {
+					t.Fatal(err)
+				}
+				// the batches are appended as members or frames of their own
+				if got := decompressAll(t, tt.codec, data); got != want {
+					t.Errorf("%s is %q, want %q", path, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFileWriterConfig(t *testing.T) {
+	tests := []struct {
+		config string
+		ok     bool
+	}{
+		{`{"path": "out.jsonl"}`, true},
+		{`{}`, false},
+		{`{"path": "out/{"}`, false},
+		{`{"path": "out.jsonl", "compression": {"codec": "lz4"}}`, false},
+		{`{"path": "out.jsonl", "compression": {"codec": "gzip", "level": 10}}`, false},
+	}
+	for _, tt := range tests {
+		_, closer, err := newFileWriter([]byte(tt.config))
+		if (err == nil) != tt.ok {
+			t.Errorf("newFileWriter(%s) err=%v, want ok %v", tt.config, err, tt.ok)
+		}
+		if closer != nil {
+			closer.Close()
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// FooterConfig describes the bytes producers append after the payload. By default every record is
+// assumed to end in 16 bytes that are cut off unchecked, which is what the KPL and
+// a8m/kinesis_producer write.
+//
+//	"footer": {"length": 0}                   -- records have no footer
+//	"footer": {"format": "md5"}               -- KPL: 16 byte MD5 of what's in front of it
+//	"footer": {"length": 4, "format": "crc32"} -- big-endian CRC-32 (IEEE) of what's in front of it
+type FooterConfig struct {
+	// Length in bytes, 16 when not set.
+	Length *int `json:"length"`
+	// Format, when set, is checked before the footer is cut off. A record whose footer doesn't
+	// check out is taken to have none and is decoded whole.
+	Format string `json:"format"`
+}
+
+// kplMagic starts KPL aggregated records; it isn't covered by their MD5 footer.
+var kplMagic = []byte{0xF3, 0x89, 0x9A, 0xC2}
+
+var footersMissing = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "footers_missing_total",
+	Help:      "Records without the footer decode.footer says they end with.",
+})
+
+type footer struct {
+	length int
+	format string
+}
+
+func newFooter(fc FooterConfig) (footer, error) {
+	f := footer{length: 16, format: fc.Format}
+	if fc.Length != nil {
+		f.length = *fc.Length
+	}
+	switch {
+	case f.length < 0:
+		return f, fmt.Errorf("footer length must not be negative")
+	case f.format == "md5" && f.length != md5.Size:
+		return f, fmt.Errorf("md5 footers are %d bytes, not %d", md5.Size, f.length)
+	case f.format == "crc32" && f.length != 4:
+		return f, fmt.Errorf("crc32 footers are 4 bytes, not %d", f.length)
+	case f.format != "" && f.format != "md5" && f.format != "crc32":
+		return f, fmt.Errorf("footer format %q is not one of md5 or crc32", f.format)
+	}
+	return f, nil
+}
+
+// strip returns the record without its footer. ok is false when the record has no valid footer,
+// the record is then returned whole.
+func (f footer) strip(data []byte) (payload []byte, ok bool) {
+	if f.length == 0 {
+		return data, true
+	}
+	if len(data) < f.length {
+		return data, false
+	}
+
+	body, tail := data[:len(data)-f.length], data[len(data)-f.length:]
+	switch f.format {
+	case "md5":
+		sum := md5.Sum(bytes.TrimPrefix(body, kplMagic))
+		ok = bytes.Equal(sum[:], tail)
+	case "crc32":
+		ok = crc32.ChecksumIEEE(body) == binary.BigEndian.Uint32(tail)
+	default:
+		ok = true
+	}
+	if !ok {
+		return data, false
+	}
+	return body, true
+}
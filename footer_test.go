@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+func TestNewFooter(t *testing.T) {
+	length := func(n int) *int { return &n }
+	tests := []struct {
+		name    string
+		config  FooterConfig
+		want    footer
+		wantErr bool
+	}{
+		{"default", FooterConfig{}, footer{length: 16}, false},
+		{"none", FooterConfig{Length: length(0)}, footer{length: 0}, false},
+		{"md5", FooterConfig{Format: "md5"}, footer{length: 16, format: "md5"}, false},
+		{"crc32", FooterConfig{Length: length(4), Format: "crc32"}, footer{length: 4, format: "crc32"}, false},
+		{"negative", FooterConfig{Length: length(-1)}, footer{}, true},
+		{"md5 of the wrong length", FooterConfig{Length: length(8), Format: "md5"}, footer{}, true},
+		{"crc32 of the default length", FooterConfig{Format: "crc32"}, footer{}, true},
+		{"unknown format", FooterConfig{Format: "sha1"}, footer{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newFooter(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFooterStrip(t *testing.T) {
+	payload := []byte(`{"id": 1}`)
+	sum := md5.Sum(payload)
+	withMD5 := append(append([]byte{}, payload...), sum[:]...)
+	aggregated := append(append([]byte{}, kplMagic...), payload...)
+	aggregatedSum := md5.Sum(payload)
+	withKPLMagic := append(append([]byte{}, aggregated...), aggregatedSum[:]...)
+	withCRC := binary.BigEndian.AppendUint32(append([]byte{}, payload...), crc32.ChecksumIEEE(payload))
+	badMD5 := append(append([]byte{}, payload...), make([]byte, 16)...)
+	badCRC := binary.BigEndian.AppendUint32(append([]byte{}, payload...), 1)
+
+	tests := []struct {
+		name   string
+		footer footer
+		in     []byte
+		want   []byte
+		ok     bool
+	}{
+		{"no footer", footer{length: 0}, payload, payload, true},
+		{"unchecked", footer{length: 16}, withMD5, payload, true},
+		{"shorter than the footer", footer{length: 16}, []byte("short"), []byte("short"), false},
+		{"md5", footer{length: 16, format: "md5"}, withMD5, payload, true},
+		{"md5 not covering the KPL magic", footer{length: 16, format: "md5"}, withKPLMagic, aggregated, true},
+		{"md5 mismatch", footer{length: 16, format: "md5"}, badMD5, badMD5, false},
+		{"crc32", footer{length: 4, format: "crc32"}, withCRC, payload, true},
+		{"crc32 mismatch", footer{length: 4, format: "crc32"}, badCRC, badCRC, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.footer.strip(tt.in)
+			if ok != tt.ok {
+				t.Errorf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+
+	"kinesis_consumer/consumer"
+)
+
+// KinesisForwardConfig is the handler_config of the "kinesis" handler, which replicates records
+// into another stream, re-keyed with PartitionKey if set.
+//
+//	"handler": "kinesis",
+//	"handler_config": {"stream_name": "orders-by-customer", "region": "eu-west-1",
+//		"partition_key": {"template": "{customer.id}"}}
+type KinesisForwardConfig struct {
+	StreamName string `json:"stream_name"`
+	// StreamARN takes precedence over StreamName, for streams in other accounts.
+	StreamARN string `json:"stream_arn"`
+	// Region is AWS_REGION, or the consumer's default region, when not set.
+	Region string `json:"region"`
+	// EndpointURL is for LocalStack and the like.
+	EndpointURL  string             `json:"endpoint_url"`
+	PartitionKey PartitionKeyConfig `json:"partition_key"`
+	// Raw forwards the payload without the 16 byte MD5 footer that is appended by default, which
+	// readers with the default decode.footer expect.
+	Raw bool `json:"raw"`
+	// Header puts a record header (see decode.headers) in front of the payload, with the record's
+	// idempotency key as idempotency-key, for readers of the stream that dedupe.
+	Header bool `json:"header"`
+	// Flush is 500 records, 5MB and 100ms when not set.
+	Flush FlushConfig `json:"flush"`
+}
+
+const (
+	// PutRecords takes at most 5MB a call, partition keys included, and 1MB a record
+	kinesisMaxPutBytes    = 5 << 20
+	kinesisMaxRecordBytes = 1 << 20
+	// kinesisPutAttempts is how often records PutRecords throttles are sent before giving up
+	kinesisPutAttempts = 5
+)
+
+func init() {
+	consumer.RegisterHandlerFactory("kinesis", newKinesisForwarder)
+}
+
+// kinesisForwarder puts the decoded payloads into a stream with PutRecords. Records are batched
+// and acknowledged like the pubsub handler's; the records of a call Kinesis rejects (throttled)
+// are sent again with backoff.
+type kinesisForwarder struct {
+	cfg KinesisForwardConfig
+	// dest has the stream's name, ARN and region
+	dest   *Config
+	client *kinesis.Client
+	keyer  *partitionKeyer
+	batch  *asyncBatcher
+}
+
+func newKinesisForwarder(raw json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+	var cfg KinesisForwardConfig
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("invalid kinesis handler_config: %w", err)
+		}
+	}
+	if cfg.StreamName == "" && cfg.StreamARN == "" {
+		return nil, nil, fmt.Errorf("the kinesis handler needs a stream_name or stream_arn")
+	}
+	keyer, err := newPartitionKeyer(cfg.PartitionKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the destination's settings, with the consumer's own -proxy and -ca-bundle
+	dest := &Config{Region: cfg.Region, StreamName: cfg.StreamName, StreamARN: cfg.StreamARN}
+	if dest.Region == "" {
+		dest.Region = os.Getenv("AWS_REGION")
+	}
+	if dest.Region == "" {
+		dest.Region = region
+	}
+	dest.AWS.EndpointURL = cfg.EndpointURL
+	if err := dest.resolveStreamARN(); err != nil {
+		return nil, nil, err
+	}
+	awsCfg, err := loadAWSConfig(context.TODO(), dest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to load SDK config for the kinesis handler, %v", err)
+	}
+
+	f := &kinesisForwarder{cfg: cfg, dest: dest, client: kinesis.NewFromConfig(awsCfg), keyer: keyer}
+	f.batch = cfg.Flush.batcher("kinesis", FlushConfig{MaxRecords: 500, MaxLatency: Duration{100 * time.Millisecond}},
+		putRecordsBatch, kinesisMaxPutBytes, f.put)
+	return f.handle, f, nil
+}
+
+// handle queues the record as its partition key, with a length prefix, followed by its data.
+func (f *kinesisForwarder) handle(ctx context.Context, r *consumer.Record) error {
+	key, err := f.keyer.key(r)
+	if err != nil {
+		return err
+	}
+	item := appendField(nil, key)
+	start := len(item)
+	if f.cfg.Header {
+		if item, err = appendHeader(item, map[string]string{"codec": "none", "idempotency-key": r.IdempotencyKey()}); err != nil {
+			return err
+		}
+	}
+	item = append(item, r.Data...)
+	if !f.cfg.Raw {
+		sum := md5.Sum(item[start:])
+		item = append(item, sum[:]...)
+	}
+	if len(item) > kinesisMaxRecordBytes {
+		return fmt.Errorf("record is %d bytes with its partition key, more than the 1MB Kinesis takes", len(item))
+	}
+	return f.batch.add(ctx, item)
+}
+
+// put sends items in one PutRecords call, and again the ones that failed.
+func (f *kinesisForwarder) put(items [][]byte) error {
+	entries := make([]types.PutRecordsRequestEntry, len(items))
+	for i, item := range items {
+		key, data := cutField(item)
+		entries[i] = types.PutRecordsRequestEntry{PartitionKey: aws.String(key), Data: data}
+	}
+
+	name, streamARN := f.dest.streamRef()
+	backoff := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		resp, err := f.client.PutRecords(context.TODO(), &kinesis.PutRecordsInput{
+			StreamName: name,
+			StreamARN:  streamARN,
+			Records:    entries,
+		})
+		if err != nil {
+			return err
+		}
+		if aws.ToInt32(resp.FailedRecordCount) == 0 {
+			return nil
+		}
+
+		var failed []types.PutRecordsRequestEntry
+		var last string
+		for i, res := range resp.Records {
+			if res.ErrorCode != nil {
+				failed = append(failed, entries[i])
+				last = aws.ToString(res.ErrorCode) + ": " + aws.ToString(res.ErrorMessage)
+			}
+		}
+		if attempt == kinesisPutAttempts {
+			return fmt.Errorf("%d of %d records still failed after %d attempts, last %s", len(failed), len(entries), attempt, last)
+		}
+		entries = failed
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Close puts what is still pending.
+func (f *kinesisForwarder) Close() error {
+	f.batch.close()
+	return nil
+}
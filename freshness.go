@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// FreshnessSLOConfig sets a freshness objective per shard, e.g. 99% of records processed within
+// 30s of arrival, and warns when a shard burns through its error budget too fast: the burn rate
+// is the share of late records over a window divided by the share the target allows, 1 uses up
+// the budget exactly. An alert fires while the burn rate is at least BurnRate over both its long
+// and its short window.
+//
+//	"freshness_slo": {"threshold": "30s", "target": 0.99}
+type FreshnessSLOConfig struct {
+	// Threshold is how soon after arrival a record has to be processed (handled and acknowledged).
+	// The SLO is off when not set.
+	Threshold Duration `json:"threshold"`
+	// Target is the share of records that have to make it, 0.99 when not set.
+	Target float64 `json:"target"`
+	// Alerts are "fast" (14.4 over 1h and 5m) and "slow" (6 over 6h and 30m) when not set.
+	Alerts []BurnRateAlert `json:"alerts"`
+}
+
+// BurnRateAlert fires when the burn rate over both windows reaches BurnRate.
+type BurnRateAlert struct {
+	Name     string   `json:"name"`
+	BurnRate float64  `json:"burn_rate"`
+	Long     Duration `json:"long"`
+	Short    Duration `json:"short"`
+}
+
+var defaultBurnRateAlerts = []BurnRateAlert{
+	{Name: "fast", BurnRate: 14.4, Long: Duration{time.Hour}, Short: Duration{5 * time.Minute}},
+	{Name: "slow", BurnRate: 6, Long: Duration{6 * time.Hour}, Short: Duration{30 * time.Minute}},
+}
+
+var (
+	freshRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "freshness_records_total",
+		Help:      "Records processed per shard, by whether they made the freshness_slo threshold (fresh or late).",
+	}, []string{"shard", "outcome"})
+	freshnessBurnRate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "freshness_slo_burn_rate",
+		Help:      "How fast a shard uses up its freshness error budget over a window, 1 uses it up exactly.",
+	}, []string{"shard", "window"})
+	freshnessAlert = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "freshness_slo_alert",
+		Help:      "1 while a freshness burn rate alert fires for a shard.",
+	}, []string{"shard", "alert"})
+)
+
+// shardFreshness counts a shard's records and late records in a ring of time buckets.
+type shardFreshness struct {
+	// stamps holds the bucket number each slot counts, slots of older buckets are stale
+	stamps      []int64
+	total, late []int64
+	firing      map[string]bool
+}
+
+func (s *shardFreshness) add(bucket int64, late bool) {
+	i := bucket % int64(len(s.stamps))
+	if s.stamps[i] != bucket {
+		s.stamps[i], s.total[i], s.late[i] = bucket, 0, 0
+	}
+	s.total[i]++
+	if late {
+		s.late[i]++
+	}
+}
+
+// sum counts the records of the n buckets up to bucket.
+func (s *shardFreshness) sum(bucket int64, n int) (total, late int64) {
+	for b := bucket; b > bucket-int64(n) && b >= 0; b-- {
+		if i := b % int64(len(s.stamps)); s.stamps[i] == b {
+			total += s.total[i]
+			late += s.late[i]
+		}
+	}
+	return total, late
+}
+
+// freshnessSLO tracks every shard's freshness against the configured objective.
+type freshnessSLO struct {
+	mu     sync.Mutex
+	cfg    FreshnessSLOConfig
+	bucket time.Duration
+	slots  int
+	shards map[string]*shardFreshness
+}
+
+var freshness = &freshnessSLO{}
+
+func (f *freshnessSLO) configure(cfg *Config) error {
+	fc := cfg.FreshnessSLO
+	if fc.Threshold.Duration <= 0 {
+		return nil
+	}
+	if fc.Target == 0 {
+		fc.Target = 0.99
+	}
+	if fc.Target <= 0 || fc.Target >= 1 {
+		return fmt.Errorf("freshness_slo target %v is not between 0 and 1", fc.Target)
+	}
+	if len(fc.Alerts) == 0 {
+		fc.Alerts = defaultBurnRateAlerts
+	}
+	shortest, longest := time.Duration(0), time.Duration(0)
+	for i, a := range fc.Alerts {
+		if a.BurnRate <= 0 || a.Short.Duration <= 0 || a.Long.Duration < a.Short.Duration {
+			return fmt.Errorf("freshness_slo alert %d needs a burn_rate and a short window no longer than its long one", i)
+		}
+		if a.Name == "" {
+			fc.Alerts[i].Name = fmt.Sprint(i)
+		}
+		if shortest == 0 || a.Short.Duration < shortest {
+			shortest = a.Short.Duration
+		}
+		longest = max(longest, a.Long.Duration)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cfg = fc
+	// ten buckets to the shortest window keeps windows accurate to a tenth
+	f.bucket = max(shortest/10, time.Second)
+	f.slots = int(longest/f.bucket) + 1
+	f.shards = make(map[string]*shardFreshness)
+	return nil
+}
+
+// observe counts a record of shardID that is done with, against the time it arrived.
+func (f *freshnessSLO) observe(shardID string, arrival time.Time) {
+	if arrival.IsZero() {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.shards == nil {
+		return
+	}
+	now := clock.Now()
+	late := now.Sub(arrival) > f.cfg.Threshold.Duration
+	s := f.shards[shardID]
+	if s == nil {
+		s = &shardFreshness{
+			stamps: make([]int64, f.slots),
+			total:  make([]int64, f.slots),
+			late:   make([]int64, f.slots),
+			firing: make(map[string]bool),
+		}
+		for i := range s.stamps {
+			s.stamps[i] = -1
+		}
+		f.shards[shardID] = s
+	}
+	s.add(now.UnixNano()/int64(f.bucket), late)
+
+	if late {
+		freshRecords.WithLabelValues(shardID, "late").Inc()
+	} else {
+		freshRecords.WithLabelValues(shardID, "fresh").Inc()
+	}
+}
+
+// evaluate updates the burn rates and returns the warnings for alerts that started or stopped firing.
+func (f *freshnessSLO) evaluate(now time.Time) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	bucket := now.UnixNano() / int64(f.bucket)
+	shards := make([]string, 0, len(f.shards))
+	for shard := range f.shards {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+
+	var warnings []string
+	for _, shard := range shards {
+		s := f.shards[shard]
+		burnRate := func(window time.Duration) float64 {
+			total, late := s.sum(bucket, int(window/f.bucket))
+			rate := 0.0
+			if total > 0 {
+				rate = float64(late) / float64(total) / (1 - f.cfg.Target)
+			}
+			freshnessBurnRate.WithLabelValues(shard, windowLabel(window)).Set(rate)
+			return rate
+		}
+		for _, a := range f.cfg.Alerts {
+			long, short := burnRate(a.Long.Duration), burnRate(a.Short.Duration)
+			firing := long >= a.BurnRate && short >= a.BurnRate
+			if firing == s.firing[a.Name] {
+				continue
+			}
+			s.firing[a.Name] = firing
+			if firing {
+				freshnessAlert.WithLabelValues(shard, a.Name).Set(1)
+				warnings = append(warnings, fmt.Sprintf("%s %s burn: %.1fx over %s, %.1fx over %s, at most %.1fx keeps %v%% of records within %s",
+					shard, a.Name, long, windowLabel(a.Long.Duration), short, windowLabel(a.Short.Duration), a.BurnRate, f.cfg.Target*100, f.cfg.Threshold.Duration))
+			} else {
+				freshnessAlert.WithLabelValues(shard, a.Name).Set(0)
+				warnings = append(warnings, fmt.Sprintf("%s %s burn recovered: %.1fx over %s, %.1fx over %s",
+					shard, a.Name, long, windowLabel(a.Long.Duration), short, windowLabel(a.Short.Duration)))
+			}
+		}
+	}
+	return warnings
+}
+
+// windowLabel is d without trailing zero units, "1h" rather than "1h0m0s".
+func windowLabel(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// watchFreshness evaluates the freshness SLO of every shard until ctx is done.
+func watchFreshness(ctx context.Context) {
+	freshness.mu.Lock()
+	interval := freshness.bucket
+	freshness.mu.Unlock()
+	if interval == 0 {
+		return
+	}
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C():
+			for _, w := range freshness.evaluate(now) {
+				fmt.Println("freshness slo:", w)
+			}
+		}
+	}
+}
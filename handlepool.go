@@ -0,0 +1,102 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+type HandleConfig struct {
+	// Workers handle the records of a batch in parallel. 0 or 1 handles them one by one, in order.
+	Workers int `json:"workers"`
+	// Ordered keeps each partition key's records in order for every handler,
+	// not just the ones registered with consumer.RegisterOrderedHandler.
+	Ordered bool `json:"ordered"`
+	// MaxUnacked is how many records of a shard can wait for a handler to acknowledge them
+	// (consumer.Async) before reading the shard stops, 10000 when not set.
+	MaxUnacked int `json:"max_unacked"`
+	// CheckOwnership catches handlers that change Record.Data or use it after returning, see
+	// checkOwnership. It costs a checksum and a write over every record, for testing handlers.
+	CheckOwnership bool `json:"check_ownership"`
+	// Timeout cancels the context of a handler call that takes longer, BatchTimeout that of the
+	// calls still running or to come once the records of one GetRecords call took longer, see
+	// timeoutHandler. Not set, handlers take as long as they take.
+	Timeout      Duration `json:"timeout"`
+	BatchTimeout Duration `json:"batch_timeout"`
+}
+
+// handlerPool runs handler calls on a fixed set of workers. Ordered calls are queued to the worker
+// picked by hashing the partition key, so one key's records are handled one after the other;
+// unordered calls go to whichever worker is free.
+type handlerPool struct {
+	own    []chan func()
+	shared chan func()
+	wg     sync.WaitGroup
+}
+
+func newHandlerPool(workers int) *handlerPool {
+	if workers <= 1 {
+		return nil
+	}
+
+	hp := &handlerPool{own: make([]chan func(), workers), shared: make(chan func())}
+	for i := range hp.own {
+		hp.own[i] = make(chan func(), 16)
+		go func(own chan func()) {
+			for {
+				select {
+				case job, ok := <-own:
+					if !ok {
+						return
+					}
+					job()
+				case job, ok := <-hp.shared:
+					if !ok {
+						return
+					}
+					job()
+				}
+			}
+		}(hp.own[i])
+	}
+	return hp
+}
+
+// run calls fn inline without a pool, otherwise on a worker.
+func (hp *handlerPool) run(ordered bool, partitionKey string, fn func()) {
+	if hp == nil {
+		fn()
+		return
+	}
+
+	hp.wg.Add(1)
+	job := func() {
+		defer hp.wg.Done()
+		fn()
+	}
+	if ordered {
+		h := fnv.New32a()
+		h.Write([]byte(partitionKey))
+		hp.own[h.Sum32()%uint32(len(hp.own))] <- job
+	} else {
+		hp.shared <- job
+	}
+}
+
+// wait blocks until every call passed to run has returned.
+func (hp *handlerPool) wait() {
+	if hp != nil {
+		hp.wg.Wait()
+	}
+}
+
+// close waits for the calls passed to run and stops the workers. The pool must not be used after.
+func (hp *handlerPool) close() {
+	if hp == nil {
+		return
+	}
+	hp.wg.Wait()
+	close(hp.shared)
+	for _, own := range hp.own {
+		close(own)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandlerPoolCloseStopsWorkers(t *testing.T) {
+	before := runtime.NumGoroutine()
+	pool := newHandlerPool(4)
+
+	var mu sync.Mutex
+	got := map[string][]int{}
+	for i := 0; i < 100; i++ {
+		key := []string{"a", "b", "c"}[i%3]
+		pool.run(true, key, func() {
+			mu.Lock()
+			got[key] = append(got[key], i)
+			mu.Unlock()
+		})
+		pool.run(false, "", func() {})
+	}
+	pool.close()
+
+	for key, seen := range got {
+		for j := 1; j < len(seen); j++ {
+			if seen[j] < seen[j-1] {
+				t.Fatalf("records of %s handled out of order: %v", key, seen)
+			}
+		}
+	}
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left after close, %d before the pool", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestProcessBatchEmptyWithPool(t *testing.T) {
+	// idle shards return batches without records, which must not be taken for a batch handled up to
+	// a last record
+	pool := newHandlerPool(2)
+	defer pool.close()
+	ctx := context.Background()
+	p := &pipeline{cfg: &Config{}}
+
+	last, err := p.processBatch(ctx, nil, pool, newAckTracker(ctx, 0), "shardId-000000000000", nil, 0)
+	if err != nil || last != "" {
+		t.Errorf("got %q, %v for an empty batch", last, err)
+	}
+}
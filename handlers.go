@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"kinesis_consumer/consumer"
+)
+
+// Built-in handlers. Forks can add their own with consumer.RegisterHandler from a new file.
+func init() {
+	consumer.RegisterHandler("print", printHandler)
+}
+
+func printHandler(_ context.Context, r *consumer.Record) error {
+	fmt.Println("\tDecompressed message", printable(r.Data))
+	return nil
+}
+
+// maxPayloadPrint caps how much of a payload gets printed, 0 prints all of it (-max-payload-print).
+var maxPayloadPrint byteSize
+
+// payloadFormat is how payloads are printed (-print-format): "auto" prints text as is and
+// anything that isn't valid UTF-8 as a hex dump, "text", "hex" and "base64" force one.
+var payloadFormat = "auto"
+
+// printable renders data in payloadFormat, cut to maxPayloadPrint bytes of it on a rune
+// boundary, saying how big it really is when cut.
+func printable(data []byte) string {
+	format := payloadFormat
+	if format == "auto" {
+		format = "text"
+		if !utf8.Valid(data) {
+			format = "hex"
+		}
+	}
+
+	shown, suffix := data, ""
+	if limit := int(maxPayloadPrint); limit > 0 && len(data) > limit {
+		if format == "text" {
+			for limit > 0 && !utf8.RuneStart(data[limit]) {
+				limit--
+			}
+		}
+		shown, suffix = data[:limit], fmt.Sprintf("... (%d bytes)", len(data))
+	}
+
+	switch format {
+	case "hex":
+		dump := strings.TrimSuffix(hex.Dump(shown), "\n")
+		if suffix != "" {
+			dump += "\n" + suffix
+		}
+		return fmt.Sprintf("(%d bytes, hex)\n%s", len(data), dump)
+	case "base64":
+		return base64.StdEncoding.EncodeToString(shown) + suffix
+	}
+	return string(shown) + suffix
+}
+
+func setPayloadFormat(s string) error {
+	switch s {
+	case "auto", "text", "hex", "base64":
+		payloadFormat = s
+		return nil
+	}
+	return fmt.Errorf("print format %q is not one of auto, text, hex or base64", s)
+}
+
+// byteSize is a flag taking sizes such as 512, 2KB or 1MB; KB and MB are 1024 and 1024*1024 bytes.
+type byteSize int
+
+func (b *byteSize) String() string { return strconv.Itoa(int(*b)) }
+
+func (b *byteSize) Set(s string) error {
+	units := []struct {
+		suffix string
+		n      int
+	}{{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"KB", 1 << 10}, {"MB", 1 << 20}, {"K", 1 << 10}, {"M", 1 << 20}, {"B", 1}}
+	v, mult := strings.ToUpper(strings.TrimSpace(s)), 1
+	for _, u := range units {
+		if strings.HasSuffix(v, u.suffix) {
+			v, mult = strings.TrimSpace(strings.TrimSuffix(v, u.suffix)), u.n
+			break
+		}
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q, want e.g. 512, 2KB or 1MB", s)
+	}
+	*b = byteSize(n * mult)
+	return nil
+}
+
+// UnmarshalJSON reads a size from a config file, as a number of bytes or a string such as "4MB".
+func (b *byteSize) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		s = string(data)
+	}
+	return b.Set(s)
+}
+
+// dryRunHandler stands in for the configured handler with -dry-run.
+func dryRunHandler(name string) consumer.HandlerFunc {
+	return func(_ context.Context, r *consumer.Record) error {
+		fmt.Printf("\tdry-run: would hand %s/%s to %s: %s\n", r.ShardID, r.SequenceNumber, name, printable(r.Data))
+		return nil
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// With "decode": {"headers": true} producers can say how a record is encoded instead of leaving it
+// to sniffing, by putting a header in front of its data:
+//
+//	"KCH1" | 2 byte big-endian length | "codec=zstd;content-type=application/json" | payload
+//
+// codec (zstd, gzip or none) is honored like a "codecs" rule; every pair, codec included, is handed
+// to handlers in Record.Header. Records without the magic are sniffed as usual.
+var headerMagic = []byte("KCH1")
+
+// parseHeader splits data into its header and the payload after it. header is nil when data
+// doesn't start with one.
+func parseHeader(data []byte) (header map[string]string, payload []byte, err error) {
+	if !bytes.HasPrefix(data, headerMagic) {
+		return nil, data, nil
+	}
+	rest := data[len(headerMagic):]
+	if len(rest) < 2 {
+		return nil, data, fmt.Errorf("record header is cut off")
+	}
+	n := int(binary.BigEndian.Uint16(rest))
+	if len(rest) < 2+n {
+		return nil, data, fmt.Errorf("record header says it is %d bytes, the record has %d left", n, len(rest)-2)
+	}
+
+	header = make(map[string]string)
+	for _, pair := range strings.Split(string(rest[2:2+n]), ";") {
+		if pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, data, fmt.Errorf("record header entry %q is not key=value", pair)
+		}
+		header[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+	}
+	return header, rest[2+n:], nil
+}
+
+// headerCodec is the codec a header declares, "" when it declares none this consumer knows.
+func headerCodec(header map[string]string) string {
+	switch codec := header["codec"]; codec {
+	case "zstd", "gzip", "none":
+		return codec
+	}
+	return ""
+}
+
+// appendHeader appends header in the form parseHeader reads, keys sorted.
+func appendHeader(dst []byte, header map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		if strings.ContainsAny(k, ";=") || strings.Contains(header[k], ";") {
+			return nil, fmt.Errorf("record header entry %s=%s can't be written", k, header[k])
+		}
+		pairs[i] = k + "=" + header[k]
+	}
+	text := strings.Join(pairs, ";")
+	if len(text) > 0xffff {
+		return nil, fmt.Errorf("record header is %d bytes, at most 65535 fit", len(text))
+	}
+	dst = append(dst, headerMagic...)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(text)))
+	return append(dst, text...), nil
+}
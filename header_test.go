@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseHeader(t *testing.T) {
+	tests := []struct {
+		name        string
+		in          string
+		wantHeader  map[string]string
+		wantPayload string
+		wantErr     bool
+	}{
+		{"no header", `{"id": 1}`, nil, `{"id": 1}`, false},
+		{"codec and content type", "KCH1\x00\x28codec=zstd;content-type=application/json" + "payload",
+			map[string]string{"codec": "zstd", "content-type": "application/json"}, "payload", false},
+		{"keys lowercased and trimmed", "KCH1\x00\x0f Codec = gzip ;payload",
+			map[string]string{"codec": "gzip"}, "payload", false},
+		{"empty", "KCH1\x00\x00payload", map[string]string{}, "payload", false},
+		{"length cut off", "KCH1\x00", nil, "KCH1\x00", true},
+		{"longer than the record", "KCH1\x00\x10codec", nil, "KCH1\x00\x10codec", true},
+		{"not key=value", "KCH1\x00\x05codecpayload", nil, "KCH1\x00\x05codecpayload", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, payload, err := parseHeader([]byte(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(header, tt.wantHeader) {
+				t.Errorf("got header %v, want %v", header, tt.wantHeader)
+			}
+			if string(payload) != tt.wantPayload {
+				t.Errorf("got payload %q, want %q", payload, tt.wantPayload)
+			}
+		})
+	}
+}
+
+func TestHeaderCodec(t *testing.T) {
+	tests := []struct {
+		header map[string]string
+		want   string
+	}{
+		{map[string]string{"codec": "zstd"}, "zstd"},
+		{map[string]string{"codec": "gzip"}, "gzip"},
+		{map[string]string{"codec": "none"}, "none"},
+		{map[string]string{"codec": "snappy"}, ""},
+		{map[string]string{"content-type": "application/json"}, ""},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if got := headerCodec(tt.header); got != tt.want {
+			t.Errorf("headerCodec(%v) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestAppendHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  map[string]string
+		want    string
+		wantErr bool
+	}{
+		{"sorted", map[string]string{"content-type": "text/plain", "codec": "none"}, "KCH1\x00\x22codec=none;content-type=text/plain", false},
+		{"empty", map[string]string{}, "KCH1\x00\x00", false},
+		{"semicolon in a value", map[string]string{"a": "b;c"}, "", true},
+		{"equals sign in a key", map[string]string{"a=b": "c"}, "", true},
+		{"too long", map[string]string{"a": strings.Repeat("x", 0xffff)}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := appendHeader(nil, tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			// what appendHeader writes, parseHeader reads back
+			header, payload, err := parseHeader(append(got, "payload"...))
+			if err != nil || !reflect.DeepEqual(header, tt.header) || string(payload) != "payload" {
+				t.Errorf("read back %v, %q, %v", header, payload, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"kinesis_consumer/consumer"
+)
+
+// HTTPSinkConfig is the handler_config of the "http" handler.
+//
+//	"handler": "http",
+//	"handler_config": {"url": "https://ingest.example.com/events",
+//		"headers": {"Authorization": "Bearer ..."}, "compression": {"codec": "gzip", "level": 6}}
+type HTTPSinkConfig struct {
+	URL string `json:"url"`
+	// Headers are sent with every request.
+	Headers     map[string]string `json:"headers"`
+	Compression CompressionConfig `json:"compression"`
+	// Envelope posts every record as {"idempotency_key": ..., "data": ...} instead of its payload,
+	// so the server can drop records it has seen; data is the payload, or a string of it when the
+	// payload isn't JSON.
+	Envelope bool `json:"envelope"`
+	// Timeout of one request, 30s when not set.
+	Timeout Duration `json:"timeout"`
+	// Flush is 500 records, 4MB, 1s and 4 requests in flight when not set.
+	Flush FlushConfig `json:"flush"`
+}
+
+const (
+	httpMaxPostBytes = 16 << 20
+	// httpPostAttempts is how often a request the server throttles or fails (429, 5xx) is tried
+	httpPostAttempts = 5
+)
+
+func init() {
+	consumer.RegisterHandlerFactory("http", newHTTPPoster)
+}
+
+// httpPoster posts batches of decoded payloads to a URL as newline delimited JSON, compressed
+// with Content-Encoding when compression is set. Batches are acknowledged like the pubsub
+// handler's and retried with backoff like the logs handler's pushes. Every request has an
+// Idempotency-Key header derived from the idempotency keys of its records, so a retried post
+// can be told from a new one.
+type httpPoster struct {
+	cfg    HTTPSinkConfig
+	client *http.Client
+	batch  *asyncBatcher
+}
+
+func newHTTPPoster(raw json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+	cfg := HTTPSinkConfig{Timeout: Duration{30 * time.Second}}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("invalid http handler_config: %w", err)
+		}
+	}
+	if cfg.URL == "" {
+		return nil, nil, fmt.Errorf("the http handler needs a url")
+	}
+	if err := cfg.Compression.validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid http compression: %w", err)
+	}
+
+	p := &httpPoster{cfg: cfg, client: &http.Client{Timeout: cfg.Timeout.Duration}}
+	p.batch = cfg.Flush.batcher("http", FlushConfig{MaxRecords: 500, MaxBytes: 4 << 20, MaxLatency: Duration{time.Second}, MaxInFlight: 4},
+		0, httpMaxPostBytes, p.send)
+	return p.handle, p, nil
+}
+
+// httpEnvelope is a line of the http handler with "envelope".
+type httpEnvelope struct {
+	IdempotencyKey string          `json:"idempotency_key"`
+	Data           json.RawMessage `json:"data"`
+}
+
+// handle queues the record as its idempotency key followed by its line.
+func (p *httpPoster) handle(ctx context.Context, r *consumer.Record) error {
+	key := r.IdempotencyKey()
+	item := appendField(nil, key)
+	if p.cfg.Envelope {
+		data := json.RawMessage(r.Data)
+		if !json.Valid(data) {
+			data, _ = json.Marshal(string(r.Data))
+		}
+		line, err := json.Marshal(httpEnvelope{IdempotencyKey: key, Data: data})
+		if err != nil {
+			return err
+		}
+		item = append(item, line...)
+	} else {
+		item = append(item, r.Data...)
+	}
+	return p.batch.add(ctx, append(item, '\n'))
+}
+
+// send posts a batch, retrying with backoff while the server throttles or fails.
+func (p *httpPoster) send(items [][]byte) error {
+	var lines []byte
+	keys := sha256.New()
+	for _, item := range items {
+		key, line := cutField(item)
+		lines = append(lines, line...)
+		io.WriteString(keys, key+"\n")
+	}
+	// the record's own key for one record, a digest of the keys for more
+	idempotencyKey := hex.EncodeToString(keys.Sum(nil))
+	if len(items) == 1 {
+		idempotencyKey, _ = cutField(items[0])
+	}
+	body, err := p.cfg.Compression.compress(lines)
+	if err != nil {
+		return err
+	}
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		retry, err := p.post(body, idempotencyKey)
+		if err == nil || !retry || attempt == httpPostAttempts {
+			return err
+		}
+		fmt.Printf("\thttp post failed, retrying in %v, err=%+v\n", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post sends one request and says whether a failure is worth retrying.
+func (p *httpPoster) post(body []byte, idempotencyKey string) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, p.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Idempotency-Key", idempotencyKey)
+	if p.cfg.Compression.Codec != "" {
+		req.Header.Set("Content-Encoding", p.cfg.Compression.Codec)
+	}
+	for name, value := range p.cfg.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retry, fmt.Errorf("http post returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return false, nil
+}
+
+// Close posts what is still pending.
+func (p *httpPoster) Close() error {
+	p.batch.close()
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"kinesis_consumer/consumer"
+)
+
+func TestHTTPPoster(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression string
+		// statuses are returned in turn before the server takes a request
+		statuses []int
+		wantErr  bool
+	}{
+		{"plain", `{}`, nil, false},
+		{"gzip", `{"codec": "gzip", "level": 1}`, nil, false},
+		{"zstd", `{"codec": "zstd", "level": 3}`, nil, false},
+		{"retried", `{"codec": "gzip"}`, []int{http.StatusServiceUnavailable}, false},
+		{"rejected", `{}`, []int{http.StatusBadRequest}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var bodies []string
+			// keys has the Idempotency-Key of every request, retried ones included
+			keys := make(map[string]bool)
+			statuses := tt.statuses
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				keys[req.Header.Get("Idempotency-Key")] = true
+				if len(statuses) > 0 {
+					w.WriteHeader(statuses[0])
+					statuses = statuses[1:]
+					return
+				}
+				if got := req.Header.Get("X-Tenant"); got != "acme" {
+					t.Errorf("X-Tenant is %q", got)
+				}
+				body, _ := io.ReadAll(req.Body)
+				bodies = append(bodies, decompressAll(t, req.Header.Get("Content-Encoding"), body))
+			}))
+			defer srv.Close()
+
+			config := fmt.Sprintf(`{"url": %q, "headers": {"X-Tenant": "acme"}, "compression": %s, "flush": {"max_records": 3}}`,
+				srv.URL, tt.compression)
+			handle, closer, err := newHTTPPoster([]byte(config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			acked := make(chan error, 3)
+			for i := range 3 {
+				ctx, _ := consumer.NewAsyncContext(context.Background(), func(err error) { acked <- err })
+				r := &consumer.Record{ShardID: "shardId-000000000000", SequenceNumber: fmt.Sprint(i), Data: []byte(fmt.Sprintf(`{"n":%d}`, i))}
+				if err := handle(ctx, r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			closer.Close()
+			for range 3 {
+				if err := <-acked; (err != nil) != tt.wantErr {
+					t.Fatalf("ack err=%v, want error %v", err, tt.wantErr)
+				}
+			}
+			if tt.wantErr {
+				return
+			}
+			if want := "{\"n\":0}\n{\"n\":1}\n{\"n\":2}\n"; strings.Join(bodies, "") != want || len(bodies) != 1 {
+				t.Errorf("got bodies %q, want one %q", bodies, want)
+			}
+			if len(keys) != 1 || keys[""] {
+				t.Errorf("got Idempotency-Keys %v, want the same one on every attempt", keys)
+			}
+		})
+	}
+}
+
+func TestHTTPPosterEnvelope(t *testing.T) {
+	var body, key string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		body, key = string(b), req.Header.Get("Idempotency-Key")
+	}))
+	defer srv.Close()
+
+	handle, closer, err := newHTTPPoster([]byte(fmt.Sprintf(`{"url": %q, "envelope": true, "flush": {"max_records": 2}}`, srv.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, data := range []string{`{"n":0}`, `not json`} {
+		ctx, _ := consumer.NewAsyncContext(context.Background(), func(error) {})
+		r := &consumer.Record{ShardID: "shardId-000000000000", SequenceNumber: fmt.Sprint(i), Data: []byte(data)}
+		if err := handle(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closer.Close()
+	want := `{"idempotency_key":"shardId-000000000000:0","data":{"n":0}}` + "\n" +
+		`{"idempotency_key":"shardId-000000000000:1","data":"not json"}` + "\n"
+	if body != want {
+		t.Errorf("got body %q, want %q", body, want)
+	}
+	if len(key) != 64 {
+		t.Errorf("got Idempotency-Key %q, want the sha256 of the batch's keys", key)
+	}
+}
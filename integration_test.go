@@ -0,0 +1,436 @@
+//go:build integration
+
+// The integration suite runs the consumer against LocalStack:
+//
+//	go test -tags integration -run Integration -v .
+//
+// It starts localstack/localstack with docker, or uses the one at LOCALSTACK_ENDPOINT.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/klauspost/compress/zstd"
+
+	"kinesis_consumer/consumer"
+)
+
+func init() {
+	consumer.RegisterHandlerFactory("integration-capture", newCaptureHandler)
+}
+
+// captured is a record as the integration-capture handler writes it, one JSON line each.
+type captured struct {
+	Shard          string `json:"shard"`
+	SequenceNumber string `json:"sequence_number"`
+	SubSequence    int    `json:"sub_sequence"`
+	PartitionKey   string `json:"partition_key"`
+	Data           string `json:"data"`
+}
+
+// newCaptureHandler appends every record to the file handler_config names, {"path": ...}.
+func newCaptureHandler(raw json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+	var cfg struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, nil, err
+	}
+	f, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	var mu sync.Mutex
+	return func(_ context.Context, r *consumer.Record) error {
+		line, err := json.Marshal(captured{r.ShardID, r.SequenceNumber, r.SubSequenceNumber, r.PartitionKey, string(r.Data)})
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		_, err = f.Write(append(line, '\n'))
+		return err
+	}, f, nil
+}
+
+// TestIntegrationConsumerProcess isn't a test: run by the integration tests as the consumer, it
+// consumes with the config file named by INTEGRATION_CONSUMER_CONFIG until interrupted.
+func TestIntegrationConsumerProcess(t *testing.T) {
+	path := os.Getenv("INTEGRATION_CONSUMER_CONFIG")
+	if path == "" {
+		t.Skip("only run by the integration tests")
+	}
+	runConsume(path, consumeOptions{})
+}
+
+// localstack returns the endpoint of a running LocalStack, started for the test if
+// LOCALSTACK_ENDPOINT isn't set.
+func localstack(t *testing.T) string {
+	t.Helper()
+	endpoint := os.Getenv("LOCALSTACK_ENDPOINT")
+	if endpoint == "" {
+		if _, err := exec.LookPath("docker"); err != nil {
+			t.Skip("needs docker or LOCALSTACK_ENDPOINT")
+		}
+		out, err := exec.Command("docker", "run", "-d", "--rm", "-p", "127.0.0.1::4566", "-e", "SERVICES=kinesis", "localstack/localstack").Output()
+		if err != nil {
+			t.Fatalf("starting localstack failed: %v", err)
+		}
+		container := strings.TrimSpace(string(out))
+		t.Cleanup(func() { exec.Command("docker", "stop", container).Run() })
+		out, err = exec.Command("docker", "port", container, "4566/tcp").Output()
+		if err != nil {
+			t.Fatalf("no port for localstack: %v", err)
+		}
+		endpoint = "http://" + strings.TrimSpace(strings.Split(string(out), "\n")[0])
+	}
+
+	// wait until kinesis is up
+	for deadline := time.Now().Add(2 * time.Minute); ; time.Sleep(time.Second) {
+		resp, err := http.Get(endpoint + "/_localstack/health")
+		if err == nil {
+			var health struct {
+				Services map[string]string `json:"services"`
+			}
+			json.NewDecoder(resp.Body).Decode(&health)
+			resp.Body.Close()
+			if s := health.Services["kinesis"]; s == "available" || s == "running" {
+				return endpoint
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("localstack at %s not ready: %v", endpoint, err)
+		}
+	}
+}
+
+// integrationStream creates a stream with one shard and returns a client and the consumer
+// config for it.
+func integrationStream(t *testing.T, endpoint string) (*kinesis.Client, *Config) {
+	t.Helper()
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	cfg := &Config{Region: "us-east-1", StreamName: fmt.Sprintf("integration-%d", time.Now().UnixNano())}
+	cfg.AWS.EndpointURL = endpoint
+	awsCfg, err := loadAWSConfig(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := kinesis.NewFromConfig(awsCfg)
+
+	ctx := context.Background()
+	if _, err := client.CreateStream(ctx, &kinesis.CreateStreamInput{StreamName: aws.String(cfg.StreamName), ShardCount: aws.Int32(1)}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.DeleteStream(context.Background(), &kinesis.DeleteStreamInput{StreamName: aws.String(cfg.StreamName)})
+	})
+	waitActive(t, client, cfg.StreamName)
+	return client, cfg
+}
+
+func waitActive(t *testing.T, client *kinesis.Client, stream string) {
+	t.Helper()
+	err := kinesis.NewStreamExistsWaiter(client).Wait(context.Background(), &kinesis.DescribeStreamInput{StreamName: aws.String(stream)}, 2*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(2 * time.Minute); ; time.Sleep(time.Second) {
+		out, err := client.DescribeStreamSummary(context.Background(), &kinesis.DescribeStreamSummaryInput{StreamName: aws.String(stream)})
+		if err == nil && out.StreamDescriptionSummary.StreamStatus == types.StreamStatusActive {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stream %s not active: %v", stream, err)
+		}
+	}
+}
+
+// withFooter appends the MD5 footer the consumer cuts off by default.
+func withFooter(data []byte) []byte {
+	sum := md5.Sum(data)
+	return append(data, sum[:]...)
+}
+
+func zstdRecord(t *testing.T, payload string) []byte {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+	return withFooter(enc.EncodeAll([]byte(payload), nil))
+}
+
+// gzipRecord is gzip, which isn't sniffed, declared by a record header.
+func gzipRecord(t *testing.T, payload string) []byte {
+	data, err := appendHeader(nil, map[string]string{"codec": "gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(payload))
+	zw.Close()
+	return withFooter(append(data, buf.Bytes()...))
+}
+
+func put(t *testing.T, client *kinesis.Client, stream, key string, data []byte) string {
+	t.Helper()
+	out, err := client.PutRecord(context.Background(), &kinesis.PutRecordInput{
+		StreamName:   aws.String(stream),
+		PartitionKey: aws.String(key),
+		Data:         data,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aws.ToString(out.ShardId)
+}
+
+// consumerProcess is the consumer running with cfg, capturing to out.
+type consumerProcess struct {
+	cmd *exec.Cmd
+	log *os.File
+}
+
+func startConsumer(t *testing.T, cfg *Config, dir, out string) *consumerProcess {
+	t.Helper()
+	file := map[string]any{
+		"region":              cfg.Region,
+		"stream_name":         cfg.StreamName,
+		"shard_id":            "*",
+		"shard_iterator_type": "TRIM_HORIZON",
+		"aws":                 map[string]any{"endpoint_url": cfg.AWS.EndpointURL},
+		"checkpoint":          map[string]any{"path": filepath.Join(dir, "checkpoints.db")},
+		"decode":              map[string]any{"headers": true},
+		"handler":             "integration-capture",
+		"handler_config":      map[string]any{"path": out},
+	}
+	data, _ := json.Marshal(file)
+	path := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := os.OpenFile(filepath.Join(dir, "consumer.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestIntegrationConsumerProcess$")
+	cmd.Env = append(os.Environ(), "INTEGRATION_CONSUMER_CONFIG="+path)
+	cmd.Stdout, cmd.Stderr = log, log
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	p := &consumerProcess{cmd: cmd, log: log}
+	t.Cleanup(func() { p.stop(t) })
+	return p
+}
+
+// stop interrupts the consumer, which checkpoints what it handled, and waits for it to exit.
+func (p *consumerProcess) stop(t *testing.T) {
+	if p.cmd.ProcessState != nil {
+		return
+	}
+	p.cmd.Process.Signal(os.Interrupt)
+	done := make(chan error, 1)
+	go func() { done <- p.cmd.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		p.cmd.Process.Kill()
+		<-done
+		t.Error("consumer didn't stop on interrupt")
+	}
+	p.log.Close()
+	if t.Failed() {
+		log, _ := os.ReadFile(p.log.Name())
+		t.Logf("consumer output:\n%s", log)
+	}
+}
+
+// waitCaptured waits until out has n records and returns them.
+func waitCaptured(t *testing.T, out string, n int) []captured {
+	t.Helper()
+	var records []captured
+	for deadline := time.Now().Add(2 * time.Minute); ; time.Sleep(500 * time.Millisecond) {
+		records = readCaptured(t, out)
+		if len(records) >= n {
+			return records
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("captured %d records, want %d", len(records), n)
+		}
+	}
+}
+
+func readCaptured(t *testing.T, out string) []captured {
+	f, err := os.Open(out)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []captured
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var c captured
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			t.Fatalf("bad captured line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, c)
+	}
+	return records
+}
+
+func payloads(records []captured) map[string]int {
+	m := make(map[string]int)
+	for _, r := range records {
+		m[r.Data]++
+	}
+	return m
+}
+
+func TestIntegrationPipelineAndCheckpoints(t *testing.T) {
+	client, cfg := integrationStream(t, localstack(t))
+	dir := t.TempDir()
+	out := filepath.Join(dir, "captured.jsonl")
+
+	want := map[string]int{`{"codec":"zstd"}`: 1, `{"codec":"gzip"}`: 1, `{"user":1}`: 1, `{"user":2}`: 1, `{"user":3}`: 1}
+	shard := put(t, client, cfg.StreamName, "a", zstdRecord(t, `{"codec":"zstd"}`))
+	put(t, client, cfg.StreamName, "b", gzipRecord(t, `{"codec":"gzip"}`))
+	aggregated := kplAggregate("", []string{"k1", "k2"}, []byte(`{"user":1}`), []byte(`{"user":2}`), []byte(`{"user":3}`))
+	put(t, client, cfg.StreamName, "aggregate", aggregated.Data)
+
+	p := startConsumer(t, cfg, dir, out)
+	records := waitCaptured(t, out, len(want))
+	p.stop(t)
+
+	if got := payloads(records); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("consumed %v, want %v", got, want)
+	}
+	var subSequences []int
+	for _, r := range records {
+		if strings.HasPrefix(r.Data, `{"user"`) {
+			subSequences = append(subSequences, r.SubSequence)
+		}
+	}
+	if fmt.Sprint(subSequences) != "[0 1 2]" {
+		t.Errorf("user records of the aggregated record have sub-sequence numbers %v", subSequences)
+	}
+
+	// the last record handled is checkpointed on shutdown
+	store, err := openBoltStore(filepath.Join(dir, "checkpoints.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, err := store.Get(cfg.StreamName, shard)
+	store.Close()
+	if last := records[len(records)-1].SequenceNumber; err != nil || seq != last {
+		t.Errorf("checkpoint of %s is %q (%v), want %s", shard, seq, err, last)
+	}
+
+	// a restart resumes after the checkpoint: only the new record comes
+	put(t, client, cfg.StreamName, "c", zstdRecord(t, `{"after":"restart"}`))
+	p = startConsumer(t, cfg, dir, out)
+	records = waitCaptured(t, out, len(want)+1)
+	time.Sleep(2 * time.Second)
+	p.stop(t)
+	records = readCaptured(t, out)
+	if len(records) != len(want)+1 || records[len(records)-1].Data != `{"after":"restart"}` {
+		t.Errorf("after the restart captured %v", records[len(want):])
+	}
+}
+
+func TestIntegrationResharding(t *testing.T) {
+	client, cfg := integrationStream(t, localstack(t))
+	dir := t.TempDir()
+	out := filepath.Join(dir, "captured.jsonl")
+
+	const before, after = 20, 20
+	for i := range before {
+		put(t, client, cfg.StreamName, fmt.Sprint("key-", i), zstdRecord(t, fmt.Sprintf(`{"before":%d}`, i)))
+	}
+	p := startConsumer(t, cfg, dir, out)
+	waitCaptured(t, out, before)
+
+	// split the shard while the consumer reads it
+	if _, err := client.UpdateShardCount(context.Background(), &kinesis.UpdateShardCountInput{
+		StreamName:       aws.String(cfg.StreamName),
+		TargetShardCount: aws.Int32(2),
+		ScalingType:      types.ScalingTypeUniformScaling,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	waitActive(t, client, cfg.StreamName)
+	children := make(map[string]bool)
+	for i := range after {
+		children[put(t, client, cfg.StreamName, fmt.Sprint("key-", i), zstdRecord(t, fmt.Sprintf(`{"after":%d}`, i)))] = true
+	}
+	records := waitCaptured(t, out, before+after)
+	p.stop(t)
+
+	if len(records) != before+after {
+		t.Errorf("captured %d records, want %d", len(records), before+after)
+	}
+	// every record of the parent comes before any of its children
+	lastParent, firstChild := -1, len(records)
+	for i, r := range records {
+		switch {
+		case children[r.Shard]:
+			firstChild = min(firstChild, i)
+		default:
+			lastParent = i
+		}
+	}
+	if lastParent > firstChild {
+		t.Errorf("record %d of the parent handled after record %d of a child", lastParent, firstChild)
+	}
+	if len(children) == 0 || firstChild == len(records) {
+		t.Error("no records of the child shards were handled")
+	}
+
+	// the parent's checkpoint is at its last record and each child has its own
+	store, err := openBoltStore(filepath.Join(dir, "checkpoints.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	checkpoints, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards := make(map[string]bool)
+	for _, c := range checkpoints {
+		shards[c.Shard] = true
+	}
+	for child := range children {
+		if !shards[child] {
+			t.Errorf("child shard %s has no checkpoint, checkpoints %v", child, checkpoints)
+		}
+	}
+	if !shards[records[0].Shard] {
+		t.Errorf("parent shard %s has no checkpoint, checkpoints %v", records[0].Shard, checkpoints)
+	}
+}
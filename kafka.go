@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+
+	"kinesis_consumer/consumer"
+)
+
+// KafkaConfig is the handler_config of the "kafka" handler, which forwards records to a Kafka
+// topic, re-keyed with PartitionKey if set.
+//
+//	"handler": "kafka",
+//	"handler_config": {"brokers": ["localhost:9092"], "topic": "orders",
+//		"partition_key": {"template": "{customer.id}"}}
+type KafkaConfig struct {
+	Brokers []string `json:"brokers"`
+	Topic   string   `json:"topic"`
+	// PartitionKey is the record key; records with the same key go to the same partition.
+	PartitionKey PartitionKeyConfig `json:"partition_key"`
+	// TLS connects with TLS, as managed clusters want.
+	TLS  bool            `json:"tls"`
+	SASL KafkaSASLConfig `json:"sasl"`
+	// Linger is how long records wait to be batched, 5ms when not set.
+	Linger Duration `json:"linger"`
+	// Timeout is how long a record may take to be delivered before it fails, 30s when not set.
+	Timeout Duration `json:"timeout"`
+}
+
+// KafkaSASLConfig authenticates to the brokers.
+type KafkaSASLConfig struct {
+	// Mechanism is "plain", "scram-sha-256", "scram-sha-512" or empty for none.
+	Mechanism string `json:"mechanism"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+}
+
+func init() {
+	consumer.RegisterHandlerFactory("kafka", newKafkaForwarder)
+}
+
+// kafkaForwarder produces the decoded payloads to a topic with franz-go, which batches them per
+// partition. Each record is acknowledged with consumer.Async once the brokers have it (all in-sync
+// replicas), so a shard is only checkpointed past records Kafka took or the poison policy has
+// moved on from. The producer is idempotent, so its own retries don't add copies; what a restart
+// or replay delivers again carries the record's idempotency key as the idempotency-key header.
+type kafkaForwarder struct {
+	cfg    KafkaConfig
+	keyer  *partitionKeyer
+	client *kgo.Client
+}
+
+func newKafkaForwarder(raw json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+	cfg := KafkaConfig{Linger: Duration{5 * time.Millisecond}, Timeout: Duration{30 * time.Second}}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("invalid kafka handler_config: %w", err)
+		}
+	}
+	if len(cfg.Brokers) == 0 || cfg.Topic == "" {
+		return nil, nil, fmt.Errorf("the kafka handler needs brokers and a topic")
+	}
+	keyer, err := newPartitionKeyer(cfg.PartitionKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(cfg.Brokers...),
+		kgo.ClientID("kinesis_consumer"),
+		kgo.DefaultProduceTopic(cfg.Topic),
+		kgo.ProducerLinger(cfg.Linger.Duration),
+		kgo.RecordDeliveryTimeout(cfg.Timeout.Duration),
+	}
+	if cfg.TLS {
+		opts = append(opts, kgo.DialTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12}))
+	}
+	switch s := cfg.SASL; s.Mechanism {
+	case "":
+	case "plain":
+		opts = append(opts, kgo.SASL(plain.Auth{User: s.Username, Pass: s.Password}.AsMechanism()))
+	case "scram-sha-256":
+		opts = append(opts, kgo.SASL(scram.Auth{User: s.Username, Pass: s.Password}.AsSha256Mechanism()))
+	case "scram-sha-512":
+		opts = append(opts, kgo.SASL(scram.Auth{User: s.Username, Pass: s.Password}.AsSha512Mechanism()))
+	default:
+		return nil, nil, fmt.Errorf("kafka sasl mechanism %q is not one of plain, scram-sha-256 or scram-sha-512", s.Mechanism)
+	}
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid kafka handler_config: %w", err)
+	}
+
+	f := &kafkaForwarder{cfg: cfg, keyer: keyer, client: client}
+	return f.handle, f, nil
+}
+
+func (f *kafkaForwarder) handle(ctx context.Context, r *consumer.Record) error {
+	rec, err := f.record(r)
+	if err != nil {
+		return err
+	}
+	ack := consumer.Async(ctx)
+	if ack == nil {
+		return f.client.ProduceSync(ctx, rec).FirstErr()
+	}
+	// not ctx: the record is delivered after the handler returned
+	f.client.Produce(context.Background(), rec, func(_ *kgo.Record, err error) { ack(err) })
+	return nil
+}
+
+// record builds the Kafka record of r, keyed by its new partition key, with its idempotency key.
+func (f *kafkaForwarder) record(r *consumer.Record) (*kgo.Record, error) {
+	key, err := f.keyer.key(r)
+	if err != nil {
+		return nil, err
+	}
+	return &kgo.Record{
+		Key:   []byte(key),
+		Value: append([]byte(nil), r.Data...),
+		Headers: []kgo.RecordHeader{
+			{Key: "idempotency-key", Value: []byte(r.IdempotencyKey())},
+		},
+	}, nil
+}
+
+// Close waits for what is still buffered to be delivered.
+func (f *kafkaForwarder) Close() error {
+	err := f.client.Flush(context.Background())
+	f.client.Close()
+	return err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"kinesis_consumer/consumer"
+)
+
+func TestKafkaRecordKey(t *testing.T) {
+	tests := []struct {
+		name         string
+		partitionKey string
+		data         string
+		want         string
+		wantErr      bool
+	}{
+		{"own key", `{}`, `{"customer":{"id":"c-7"}}`, "device-1", false},
+		{"template", `{"template": "{customer.id}"}`, `{"customer":{"id":"c-7"}}`, "c-7", false},
+		{"buckets", `{"template": "{customer.id}", "buckets": 4}`, `{"customer":{"id":"c-7"}}`, "2", false},
+		{"missing field", `{"template": "{customer.id}"}`, `{}`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, closer, err := newKafkaForwarder([]byte(`{"brokers": ["localhost:9092"], "topic": "orders", "partition_key": ` + tt.partitionKey + `}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closer.Close()
+			r := &consumer.Record{ShardID: "shardId-000000000000", SequenceNumber: "1", PartitionKey: "device-1", Data: []byte(tt.data)}
+			rec, err := closer.(*kafkaForwarder).record(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err=%v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if string(rec.Key) != tt.want || string(rec.Value) != tt.data {
+				t.Errorf("got key %q value %q, want %q %q", rec.Key, rec.Value, tt.want, tt.data)
+			}
+			if len(rec.Headers) != 1 || rec.Headers[0].Key != "idempotency-key" || string(rec.Headers[0].Value) != r.IdempotencyKey() {
+				t.Errorf("got headers %+v, want idempotency-key %s", rec.Headers, r.IdempotencyKey())
+			}
+		})
+	}
+}
+
+func TestKafkaConfig(t *testing.T) {
+	for _, config := range []string{
+		`{}`,
+		`{"brokers": ["localhost:9092"]}`,
+		`{"brokers": ["localhost:9092"], "topic": "orders", "sasl": {"mechanism": "gssapi"}}`,
+		`{"brokers": ["localhost:9092"], "topic": "orders", "partition_key": {"hash": "crc32"}}`,
+	} {
+		if _, _, err := newKafkaForwarder([]byte(config)); err == nil {
+			t.Errorf("newKafkaForwarder(%s) succeeded", config)
+		}
+	}
+}
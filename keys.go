@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"kinesis_consumer/consumer"
+)
+
+// KeysConfig is the handler_config of the "keys" handler.
+//
+//	"handler": "keys",
+//	"handler_config": {"hot_factor": 2}
+type KeysConfig struct {
+	// HotFactor flags a shard as hot when it gets this many times its even share of records.
+	HotFactor float64 `json:"hot_factor"`
+}
+
+func init() {
+	consumer.RegisterHandlerFactory("keys", newKeyAnalyzer)
+}
+
+// keyAnalyzer counts records per partition key and per shard and reports, on close, the key
+// cardinality, the heaviest keys and how evenly the shards are loaded.
+type keyAnalyzer struct {
+	cfg KeysConfig
+
+	mu     sync.Mutex
+	total  int64
+	keys   map[string]int64
+	shards map[string]int64
+}
+
+func newKeyAnalyzer(raw json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+	cfg := KeysConfig{HotFactor: 2}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("invalid keys handler_config: %w", err)
+		}
+	}
+	if cfg.HotFactor <= 1 {
+		return nil, nil, fmt.Errorf("keys hot_factor must be above 1, got %g", cfg.HotFactor)
+	}
+	a := &keyAnalyzer{cfg: cfg, keys: make(map[string]int64), shards: make(map[string]int64)}
+	return a.handle, a, nil
+}
+
+func (a *keyAnalyzer) handle(_ context.Context, r *consumer.Record) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.total++
+	a.keys[r.PartitionKey]++
+	a.shards[r.ShardID]++
+	return nil
+}
+
+// Close prints the report.
+func (a *keyAnalyzer) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	fmt.Println("partition keys")
+	fmt.Printf("\t%d distinct keys in %d records\n", len(a.keys), a.total)
+	if a.total == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(a.keys))
+	for key := range a.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if a.keys[keys[i]] != a.keys[keys[j]] {
+			return a.keys[keys[i]] > a.keys[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	fmt.Println("\theaviest keys")
+	for _, key := range keys[:min(10, len(keys))] {
+		fmt.Printf("\t%-40s %10d %7.2f%%\n", key, a.keys[key], percent(a.keys[key], a.total))
+	}
+
+	// records per key, in powers of ten
+	var buckets []int64
+	for _, n := range a.keys {
+		b := 0
+		for limit := int64(1); n > limit; limit *= 10 {
+			b++
+		}
+		for len(buckets) <= b {
+			buckets = append(buckets, 0)
+		}
+		buckets[b]++
+	}
+	fmt.Println("\tkeys by records per key")
+	for b, n := range buckets {
+		label := "1"
+		if b > 0 {
+			hi := int64(1)
+			for i := 0; i < b; i++ {
+				hi *= 10
+			}
+			label = fmt.Sprintf("%d-%d", hi/10+1, hi)
+		}
+		fmt.Printf("\t%-16s %10d %s\n", label, n, bar(n, int64(len(a.keys))))
+	}
+
+	shards := make([]string, 0, len(a.shards))
+	for shard := range a.shards {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+	even := float64(a.total) / float64(len(shards))
+	fmt.Printf("shards (%d with records, even share %.0f records)\n", len(shards), even)
+	for _, shard := range shards {
+		n := a.shards[shard]
+		hot := ""
+		if float64(n) >= a.cfg.HotFactor*even {
+			hot = " HOT"
+		}
+		fmt.Printf("\t%-24s %10d %7.2f%% %s%s\n", shard, n, percent(n, a.total), bar(n, a.total), hot)
+	}
+	return nil
+}
+
+// bar draws n of total as up to 40 #s.
+func bar(n, total int64) string {
+	if total == 0 {
+		return ""
+	}
+	return strings.Repeat("#", int(40*n/total))
+}
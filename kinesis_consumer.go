@@ -4,17 +4,26 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"sync/atomic"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
 	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
 	"github.com/klauspost/compress/zstd"
 	"github.com/pierrec/lz4"
 	"github.com/ulikunitz/xz/lzma"
+
+	"kinesis_consumer/consumer"
 )
 
 const (
@@ -27,7 +36,11 @@ const (
 	// shardIteratorType = types.ShardIteratorTypeLatest
 )
 
-var count int64
+// memoryBudget bounds the bytes held by batches in flight, nil means no limit.
+var memoryBudget *byteBudget
+
+// maxGetRecordsBytes is the most a GetRecords call returns, reserved in memoryBudget before the call.
+const maxGetRecordsBytes = 10 << 20
 
 func basicTest() {
 	var testStr = `
@@ -63,19 +76,34 @@ func lz4Decompress(compressedData []byte) (decompressedData []byte, err error) {
 	return decompressedData[:decompressedSize], err
 }
 
+// gzipMagic starts every gzip member (the third byte is the deflate method).
+var gzipMagic = []byte{0x1f, 0x8b, 0x08}
+
+// gzipDecompress decodes every gzip member in compressedData, since producers sometimes concatenate
+// several into one record. Bytes after the last member that don't start another one are ignored.
 func gzipDecompress(compressedData []byte) (decompressedData []byte, err error) {
-	b := bytes.NewBuffer(compressedData)
+	// a bytes.Reader is an io.ByteReader, so gzip doesn't read ahead and b.Len() is exact
+	b := bytes.NewReader(compressedData)
 
-	var r io.Reader
+	var r *gzip.Reader
 	r, err = gzip.NewReader(b)
 	if err != nil {
 		return
 	}
 
 	var resB bytes.Buffer
-	_, err = resB.ReadFrom(r)
-	if err != nil {
-		return
+	for {
+		r.Multistream(false)
+		_, err = resB.ReadFrom(r)
+		if err != nil {
+			return
+		}
+		if !bytes.HasPrefix(compressedData[len(compressedData)-b.Len():], gzipMagic) {
+			break
+		}
+		if err = r.Reset(b); err != nil {
+			return
+		}
 	}
 
 	decompressedData = resB.Bytes()
@@ -102,9 +130,19 @@ func lzmaDecompress(compressedData []byte) ([]byte, error) {
 	return decompressedData.Bytes(), nil
 }
 
+// Records up to this size decode into a buffer that is reused for the next record
+// instead of a fresh allocation.
+const smallRecordSize = 64 << 10
+
+// zstdDecoder is shared by all records; DecodeAll is safe for concurrent use and keeps its state between calls.
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderLowmem(false))
+
 func zstdDecompress(compressedData []byte) ([]byte, error) {
-	zstdDec, _ := zstd.NewReader(nil)
+	return zstdDecompressTo(nil, compressedData)
+}
 
+// zstdDecompressTo decodes into dst[:0], growing it only if the record doesn't fit.
+func zstdDecompressTo(dst, compressedData []byte) ([]byte, error) {
 	// This is a hack, just traverse the byte stream until we find the zstd magic number sequence
 	var start int
 	for i, b := range compressedData {
@@ -116,14 +154,34 @@ func zstdDecompress(compressedData []byte) ([]byte, error) {
 				if compressedData[i-1] == 0x2F {
 					if b == 0xFD {
 						start = i-3
-						fmt.Println("\tzstd found at", i)
 						break
 					}
 				}
 			}
 		}
 	}
-	return zstdDec.DecodeAll(compressedData[start:len(compressedData)-16], nil)
+	return zstdDecoder.DecodeAll(compressedData[start:], dst[:0])
+}
+
+// decodeRecord strips the producer framing and decompresses the payload. The footer must already
+// be cut off.
+// Records that aren't zstd are assumed to be uncompressed JSON; err then says why zstd didn't work.
+// zstd output goes into buf when it's big enough.
+func decodeRecord(buf, data []byte) (decoded []byte, codec string, err error) {
+	if decoded, err = zstdDecompressTo(buf, data); err == nil {
+		return decoded, "zstd", nil
+	}
+	err = fmt.Errorf("%w: %w", consumer.ErrDecompression, err)
+
+	// This is a hack, just traverse the byte stream until we hit a starting brace "{" char
+	var start int
+	for i, b := range data {
+		if b == '{' {
+			start = i
+			break
+		}
+	}
+	return data[start:], "none", err
 }
 
 // Check if data is likely Zstd-compressed by checking for the magic bytes.
@@ -134,73 +192,790 @@ func isZstdCompressed(data []byte) bool {
 	return data[0] == 0x28 && data[1] == 0xB5 && data[2] == 0x2F && data[3] == 0xFD
 }
 
-func processKinesisRecords(client *kinesis.Client) {
-	// Get a shard iterator
-	shardIteratorResp, err := client.GetShardIterator(context.TODO(), &kinesis.GetShardIteratorInput{
-		StreamName:        aws.String(streamName),
-		ShardId:           aws.String(shardID),
-		ShardIteratorType: shardIteratorType,
+// pipeline is everything a decoded record goes through before it's done with.
+type pipeline struct {
+	cfg       *Config
+	transform *transformer
+	enrich    *enricher
+	plugin    *wasmPlugin
+	handler   consumer.HandlerFunc
+	closer    io.Closer
+	poison    *poisonPolicy
+	tracer    *tracer
+	sentry    *sentryReporter
+	// ref is the pipelineRef sharing the pipeline, which pending acks hold it open in
+	ref *pipelineRef
+}
+
+func newPipeline(cfg *Config) (*pipeline, error) {
+	p := &pipeline{cfg: cfg}
+
+	var err error
+	if p.transform, err = newTransformer(cfg.Transform); err != nil {
+		return nil, err
+	}
+	if p.enrich, err = newEnricher(context.TODO(), cfg); err != nil {
+		return nil, err
+	}
+	if p.plugin, err = loadWasmPlugin(context.TODO(), cfg.WasmModule); err != nil {
+		return nil, err
+	}
+
+	if p.handler, p.closer, err = consumer.NewHandler(cfg.Handler, cfg.HandlerConfig); err != nil {
+		p.plugin.close(context.TODO())
+		return nil, err
+	}
+	poison := cfg.Poison
+	if cfg.DryRun {
+		// the real handler is still built, so its config gets validated
+		p.handler = dryRunHandler(cfg.Handler)
+		poison.DLQPath = ""
+	}
+	p.handler = recoverHandler(cfg.Handler, consumer.WrapHandle(p.handler))
+	p.handler = timeoutHandler(cfg.Handler, cfg.Handle.Timeout.Duration, p.handler)
+	if p.poison, err = newPoisonPolicy(poison); err != nil {
+		p.close()
+		return nil, err
+	}
+	if !cfg.DryRun {
+		if p.poison.retry, err = newRetryPublisher(cfg); err != nil {
+			p.close()
+			return nil, err
+		}
+	}
+	if p.sentry, err = newSentryReporter(cfg); err != nil {
+		p.close()
+		return nil, err
+	}
+	p.tracer = newTracer(cfg)
+	return p, nil
+}
+
+func (p *pipeline) close() {
+	if p.closer != nil {
+		if err := p.closer.Close(); err != nil {
+			fmt.Printf("closing handler %s failed, err=%+v\n", p.cfg.Handler, err)
+		}
+	}
+	p.plugin.close(context.TODO())
+	p.enrich.close()
+	if p.poison != nil {
+		p.poison.close()
+	}
+	p.tracer.close()
+	p.sentry.close()
+}
+
+// handle runs the handler on r and calls done once the record is done with, which is later if the
+// handler acknowledges it asynchronously. A failed acknowledgement goes through the poison policy
+// like a failed call. done isn't called for a record interrupted by shutdown.
+func (p *pipeline) handle(ctx context.Context, r *consumer.Record, done func()) error {
+	handler := p.cfg.Handler
+	trace := p.tracer.start(r, handler)
+	sink := p.sentry.retainedErrorRecord(r)
+	// acked is the record a failed acknowledgement hands to the poison policy, a copy once the
+	// handler returned and r's buffers may be reused; the lock keeps them until it's made
+	var mu sync.Mutex
+	acked := r
+	// the pipeline stays open until the ack, which can come before the handler returns
+	p.ref.hold(p)
+	unhold := sync.OnceFunc(func() { p.ref.release(p) })
+	actx, async := consumer.NewAsyncContext(ctx, func(err error) {
+		defer unhold()
+		if err != nil {
+			fmt.Printf("handler %s failed to acknowledge %s %s, err=%+v\n", handler, r.ShardID, r.SequenceNumber, err)
+			if ctx.Err() != nil {
+				// interrupted, not skipped: leave it for the next run
+				return
+			}
+			mu.Lock()
+			err = p.poison.giveUp(ctx, p.cfg.StreamName, acked, 1, err)
+			mu.Unlock()
+		}
+		trace.finish(err, true)
+		p.sentry.report("sink", handler, sink, err)
+		stats.RecordHandled(handler, err != nil)
+		done()
 	})
+	if p.cfg.Handle.CheckOwnership {
+		defer checkOwnership(handler, r)()
+	}
+	err := p.poison.handle(actx, p.cfg.StreamName, p.handler, r)
+	trace.handlerReturned()
+	if err == nil && async() {
+		mu.Lock()
+		acked = p.poison.retain(r)
+		mu.Unlock()
+		return nil
+	}
+	unhold()
+	if err == nil || ctx.Err() == nil {
+		trace.finish(err, false)
+		p.sentry.report("handler", handler, errorRecordOf(r), err)
+		stats.RecordHandled(handler, err != nil)
+		done()
+	}
+	return err
+}
+
+// processBatch decodes and handles the records of one GetRecords call and returns the sequence
+// number of the last record it got through. It stops early when ctx is done. Without a pool
+// records are handled in order, with one they're handled in parallel and the call returns
+// once they're all done. Records are added to acks, which tells how far it is safe to checkpoint.
+// reserved is what the caller acquired from memoryBudget for the batch, which processBatch
+// releases: the records take their compressed and decompressed sizes out of it, and what's left
+// is given back once they're decoded.
+func (p *pipeline) processBatch(ctx context.Context, decoder *decoderPool, pool *handlerPool, acks *ackTracker, shardID string, records []types.Record, reserved int64) (last string, err error) {
+	cfg := p.cfg
+	// GetRecords calls and fan-out events without records are common while a shard is idle
+	if len(records) == 0 {
+		memoryBudget.release(reserved)
+		return "", nil
+	}
+
+	var compressed int64
+	for _, record := range records {
+		compressed += int64(len(record.Data))
+	}
+	stageFetched.add(len(records), compressed)
+	// grow rather than acquire: waiting for more while holding the reservation could deadlock
+	memoryBudget.grow(compressed - reserved)
+	spare := max(reserved-compressed, 0)
+	defer memoryBudget.release(compressed)
+
+	users, decoded := decoder.decodeBatch(shardID, records)
+	var decompressed, decodedSize int64
+	for _, d := range decoded {
+		if d.codec != "none" { // uncompressed records are slices of the compressed data
+			decompressed += int64(len(d.data))
+		}
+		decodedSize += int64(len(d.data))
+	}
+	stageFetched.add(-len(records), -compressed)
+	stageDecoded.add(len(decoded), decodedSize)
+	// records the acks don't track yet are taken out of the decoded stage here when it stops early
+	tracked := 0
+	defer func() {
+		for _, d := range decoded[tracked:] {
+			stageDecoded.add(-1, -int64(len(d.data)))
+		}
+	}()
+	// the decompressed records use up the spare reservation first
+	memoryBudget.grow(decompressed - spare)
+	memoryBudget.release(spare - decompressed)
+	defer memoryBudget.release(decompressed)
+
+	ordered := cfg.Handle.Ordered || consumer.IsOrdered(cfg.Handler)
+	hctx := withBatchDeadline(ctx, cfg.Handle.BatchTimeout.Duration)
+	for i, record := range users {
+		pacer.wait(ctx, aws.ToTime(record.ApproximateArrivalTimestamp))
+		if err := ctx.Err(); err != nil {
+			if pool != nil {
+				pool.wait()
+				return "", err
+			}
+			return last, err
+		}
+		advanceClock(aws.ToTime(record.ApproximateArrivalTimestamp))
+
+		// the checkpoint only moves past an aggregated record once all its user records are done
+		seq := aws.ToString(record.SequenceNumber)
+		if !record.last {
+			seq = ""
+		}
+		entry := acks.add(ctx, seq, int64(len(decoded[i].data)))
+		tracked++
+		done := func() {
+			acks.ack(entry)
+			freshness.observe(shardID, aws.ToTime(record.ApproximateArrivalTimestamp))
+		}
+
+		fmt.Println("message #", stats.RecordRead(shardID, decoded[i].codec))
+		fmt.Printf("\tcompressed message len %d\n", len(record.Data))
+		if record.EncryptionType != "" && record.EncryptionType != types.EncryptionTypeNone {
+			fmt.Println("\tencryption", record.EncryptionType)
+		}
+		recordsByEncryption.WithLabelValues(encryptionTypeLabel(record.EncryptionType)).Inc()
+		// fmt.Println("\tzstd compression", isZstdCompressed(record.Data))
+
+		decompressedData, codec, err := decoded[i].data, decoded[i].codec, decoded[i].err
+		if decoded[i].noFooter {
+			fmt.Println("\tno valid footer, decoding the whole record")
+		}
+		if err := decoded[i].headerErr; err != nil {
+			fmt.Printf("\tinvalid record header, err=%+v, sniffing the codec\n", err)
+		}
+		if decoded[i].header != nil {
+			fmt.Println("\theader", decoded[i].header)
+		}
+		if expected := decoded[i].expected; err != nil && expected != "" {
+			fmt.Printf("\texpected %s compression for partition key %s, err=%+v, check the producer\n",
+				expected, aws.ToString(record.PartitionKey), err)
+			codecMismatches.WithLabelValues(expected).Inc()
+		} else if err != nil {
+			fmt.Printf("\tzstd decompression didn't work, err=%+v, assuming no compression\n", err)
+		}
+		if decodeFailed(decoded[i], record.Data) {
+			decodeFailureSamples.sample(cfg.Decode.FailureSamples, shardID, record.Record, err)
+			p.sentry.report("decode", cfg.Handler, errorRecord{shardID, aws.ToString(record.SequenceNumber), aws.ToString(record.PartitionKey), record.Data, len(record.Data)}, err)
+		}
+		if codec == "none" {
+			fmt.Println("\tno compression")
+		} else {
+			fmt.Println("\t" + codec + " compression")
+		}
+		recordSizes.observe(codec, len(record.Data), len(decompressedData))
+
+		if transformed, err := p.transform.apply(decompressedData); err != nil {
+			fmt.Printf("\ttransform failed, err=%+v, handling the untransformed message\n", err)
+		} else {
+			decompressedData = transformed
+		}
+		if enriched, err := p.enrich.apply(ctx, decompressedData); err != nil {
+			fmt.Printf("\tenrichment failed, err=%+v, handling the message without it\n", err)
+		} else {
+			decompressedData = enriched
+		}
+		if processed, err := p.plugin.apply(ctx, decompressedData); err == errWasmDrop {
+			fmt.Println("\tdropped by wasm plugin")
+			done()
+			if record.last {
+				last = seq
+			}
+			continue
+		} else if err != nil {
+			fmt.Printf("\twasm plugin failed, err=%+v, handling the unprocessed message\n", err)
+		} else {
+			decompressedData = processed
+		}
+
+		schemaDrifts.observe(shardID, aws.ToString(record.SequenceNumber), decompressedData)
+		r := &consumer.Record{
+			ShardID:           shardID,
+			SequenceNumber:    aws.ToString(record.SequenceNumber),
+			Aggregated:        record.aggregated,
+			SubSequenceNumber: record.sub,
+			PartitionKey:      aws.ToString(record.PartitionKey),
+			ArrivalTime:       aws.ToTime(record.ApproximateArrivalTimestamp),
+			EventTime:         cfg.EventTime.extract(decompressedData),
+			EncryptionType:    string(record.EncryptionType),
+			Size:              len(aws.ToString(record.PartitionKey)) + len(record.Data),
+			Header:            decoded[i].header,
+			Data:              decompressedData,
+		}
+		if pool != nil {
+			pool.run(ordered, r.PartitionKey, func() {
+				err := p.handle(hctx, r, done)
+				acks.returned(entry)
+				if err != nil && ctx.Err() == nil {
+					fmt.Printf("\thandler %s failed, err=%+v\n", cfg.Handler, err)
+				}
+			})
+			continue
+		}
+		err = p.handle(hctx, r, done)
+		acks.returned(entry)
+		if err != nil {
+			if ctx.Err() != nil {
+				// interrupted, not skipped: leave it for the next run
+				return last, ctx.Err()
+			}
+			fmt.Printf("\thandler %s failed, err=%+v\n", cfg.Handler, err)
+		}
+		if record.last {
+			last = seq
+		}
+	}
+
+	if pool != nil {
+		// records finish out of order, so only a batch that was handled completely counts as got through
+		pool.wait()
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		last = aws.ToString(records[len(records)-1].SequenceNumber)
+	}
+	return last, nil
+}
+
+// shardStart works out where reading a shard starts: at -start-sequence if given, else after its
+// checkpoint if there is one, otherwise at the configured iterator type, bounded by max_age.
+func shardStart(cfg *Config, store checkpointStore, shardID string) (*kinesis.GetShardIteratorInput, error) {
+	name, streamARN := cfg.streamRef()
+	iteratorInput := &kinesis.GetShardIteratorInput{
+		StreamName:        name,
+		StreamARN:         streamARN,
+		ShardId:           aws.String(shardID),
+		ShardIteratorType: cfg.iteratorType(),
+	}
+	if cfg.StartingSequenceNumber != "" {
+		// a position given on the command line wins over the checkpoint
+		iteratorInput.StartingSequenceNumber = aws.String(cfg.StartingSequenceNumber)
+		fmt.Println("starting", shardID, "at sequence number", cfg.StartingSequenceNumber)
+		return iteratorInput, nil
+	}
+	if store != nil {
+		seq, err := store.Get(cfg.StreamName, shardID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read checkpoint: %w", err)
+		}
+		if seq == string(types.ShardIteratorTypeLatest) {
+			// pin a LATEST checkpoint (imported, or reset by an older version) to now, so a restart
+			// before the first checkpoint doesn't skip what was written in between
+			seq = atTimestampPrefix + wallClock.Now().UTC().Format(time.RFC3339Nano)
+			if err := store.Set(cfg.StreamName, shardID, seq); err != nil {
+				return nil, fmt.Errorf("unable to pin LATEST checkpoint: %w", err)
+			}
+		}
+		if seq != "" {
+			// a checkpoint reset to TRIM_HORIZON on purpose isn't bounded by max_age
+			fmt.Println("resuming", shardID, "from checkpoint", seq)
+			if err := applyCheckpoint(iteratorInput, seq); err != nil {
+				return nil, fmt.Errorf("unable to resume from checkpoint: %w", err)
+			}
+			return iteratorInput, nil
+		}
+	}
+	// Without a checkpoint, don't go further back than max_age
+	if iteratorInput.ShardIteratorType == types.ShardIteratorTypeTrimHorizon && cfg.MaxAge.Duration > 0 {
+		iteratorInput.ShardIteratorType = types.ShardIteratorTypeAtTimestamp
+		iteratorInput.Timestamp = aws.Time(time.Now().Add(-cfg.MaxAge.Duration))
+		fmt.Println("starting", shardID, "at", *iteratorInput.Timestamp, "because of max_age", cfg.MaxAge)
+	}
+	return iteratorInput, nil
+}
+
+// processKinesisRecords reads one shard until ctx is cancelled or the shard is closed, and returns
+// ctx's error or a *consumer.ShardError wrapping consumer.ErrShardClosed. Failures panic with a
+// *consumer.ShardError.
+func processKinesisRecords(ctx context.Context, client *kinesis.Client, pipes *pipelineRef, store checkpointStore, shardID string) error {
+	labelShard(shardID)
+	if fanOutConsumerARN != "" {
+		return processFanOutShard(ctx, client, pipes, store, shardID)
+	}
+	cfg := pipes.config()
+	fail := func(format string, args ...any) {
+		panic(&consumer.ShardError{Stream: cfg.StreamName, ShardID: shardID, Err: fmt.Errorf(format, args...)})
+	}
+
+	// Get a shard iterator, resuming after the last checkpoint if there is one
+	_, streamARN := cfg.streamRef()
+	iteratorInput, err := shardStart(cfg, store, shardID)
 	if err != nil {
-		panic(fmt.Sprintf("Unable to get shard iterator: %v", err))
+		fail("%w", err)
+	}
+	shardIteratorResp, err := client.GetShardIterator(ctx, iteratorInput)
+	if err != nil {
+		if ctx.Err() != nil {
+			// shutting down, or the shard's lease was lost
+			return ctx.Err()
+		}
+		fail("unable to get shard iterator: %w", err)
 	}
 
 	shardIterator := shardIteratorResp.ShardIterator
 
+	// decoded small records reuse the pool's buffers, handlers must not hold on to Record.Data
+	decoder := newDecoderPool(cfg.Decode, cfg.StreamName)
+	defer decoder.close()
+	pool := newHandlerPool(cfg.Handle.Workers)
+	defer pool.close()
+	acks := newAckTracker(ctx, cfg.Handle.MaxUnacked)
+	defer acks.close()
+	checkpoint := func() {
+		if err := acks.checkpoint(store, cfg.StreamName, shardID); err != nil {
+			fail("failed to checkpoint: %w", err)
+		}
+	}
+	defer func() {
+		// on shutdown give records acknowledged asynchronously a chance to be checkpointed
+		if ctx.Err() != nil {
+			acks.drain(ackShutdownTimeout)
+			checkpoint()
+		}
+	}()
+
 	// Fetch records from the stream
-	for {
-		// Get records from the Kinesis stream
-		resp, err := client.GetRecords(context.TODO(), &kinesis.GetRecordsInput{
-			ShardIterator: shardIterator,
-			Limit: aws.Int32(100),
+	var handled string
+	var fetched time.Time
+	for ctx.Err() == nil {
+		paused := pauses.wait(ctx, shardID)
+		if paused || pacer.outlived(fetched) {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// the iterator has most likely expired while paused or pacing, start over from the last
+			// record handled
+			if handled != "" {
+				iteratorInput.ShardIteratorType = types.ShardIteratorTypeAfterSequenceNumber
+				iteratorInput.StartingSequenceNumber = aws.String(handled)
+				iteratorInput.Timestamp = nil
+			}
+			shardIteratorResp, err := client.GetShardIterator(ctx, iteratorInput)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				fail("unable to get shard iterator: %w", err)
+			}
+			shardIterator = shardIteratorResp.ShardIterator
+			if paused {
+				fmt.Println(shardID, "resumed")
+			}
+		}
+		priorities.wait(ctx, shardID)
+
+		// Get records from the Kinesis stream, with room for the most it can return reserved
+		// first, so the budget holds before the records are in memory
+		if err := memoryBudget.acquire(ctx, maxGetRecordsBytes); err != nil {
+			return err
+		}
+		var resp *kinesis.GetRecordsOutput
+		records, err := fetchThrough(ctx, shardID, func(ctx context.Context) ([]types.Record, error) {
+			var err error
+			resp, err = client.GetRecords(ctx, &kinesis.GetRecordsInput{
+				ShardIterator: shardIterator,
+				StreamARN:     streamARN,
+				Limit: aws.Int32(100),
+			})
+			if err != nil {
+				return nil, err
+			}
+			return resp.Records, nil
 		})
+		if err == nil && resp == nil {
+			err = errors.New("fetch middleware returned without fetching")
+		}
+		fetched = time.Now()
+		if ctx.Err() != nil {
+			memoryBudget.release(maxGetRecordsBytes)
+			return ctx.Err()
+		}
+		if kerr := kmsError(err); kerr != nil {
+			fail("%w", kerr)
+		}
+		var expired *types.ExpiredIteratorException
+		if errors.As(err, &expired) {
+			fail("%w: %w", consumer.ErrIteratorExpired, err)
+		}
 		if err != nil {
-			panic(fmt.Sprintf("Failed to fetch records from Kinesis: %v", err))
+			fail("failed to fetch records from Kinesis: %w", err)
 		}
+		resp.Records = records
 
-		// Process each record
-		for _, record := range resp.Records {
-			atomic.AddInt64(&count, 1)
-			fmt.Println("message #", atomic.LoadInt64(&count))
-			fmt.Printf("\tcompressed message len %d\n", len(record.Data))
-			// fmt.Println("\tzstd compression", isZstdCompressed(record.Data))
+		recordLag(shardID, resp.MillisBehindLatest)
+		recordIteratorAge(shardID, resp.Records, resp.MillisBehindLatest)
+		recordRates.add(shardID, len(resp.Records))
 
-			var err error
-			var decompressedData []byte
-			if decompressedData, err = zstdDecompress(record.Data); err != nil {
-				fmt.Printf("\tzstd decompression didn't work, err=%+v, assuming no compression\n", err)
-				// This is a hack, just traverse the byte stream until we hit a starting brace "{" char
-				var start int
-				for i, b := range record.Data {
-					if b == '{' {
-						start = i
-						break
-					}
-				}
-				decompressedData = record.Data[start:len(record.Data)-16]
-				fmt.Println("\tno compression")
-				err = nil
+		// Too far behind to catch up in time: drop the backlog and start again near the tip
+		if cfg.SkipAhead.due(resp.MillisBehindLatest) && resp.NextShardIterator != nil {
+			cfg.SkipAhead.skipAhead(shardID, *resp.MillisBehindLatest, resp.Records)
+			iteratorInput.ShardIteratorType, iteratorInput.Timestamp = cfg.SkipAhead.target()
+			iteratorInput.StartingSequenceNumber = nil
+			shardIteratorResp, err := client.GetShardIterator(ctx, iteratorInput)
+			if err != nil {
+				fail("unable to get shard iterator: %w", err)
 			}
-			fmt.Println("\tDecompressed message", string(decompressedData))
+			shardIterator = shardIteratorResp.ShardIterator
+			handled = ""
+			memoryBudget.release(maxGetRecordsBytes)
+			continue
+		}
+
+		// Process each record, on shutdown checkpoint whatever got through before returning
+		p := pipes.acquire()
+		last, err := p.processBatch(ctx, decoder, pool, acks, shardID, resp.Records, maxGetRecordsBytes)
+		pipes.release(p)
+		if last != "" {
+			handled = last
+		}
+		checkpoint()
+		if err != nil {
+			return err
+		}
+
+		// A closed shard (after a reshard) has no next iterator, its children take over
+		if resp.NextShardIterator == nil {
+			acks.drain(ackShutdownTimeout)
+			checkpoint()
+			fmt.Println(shardID, "is closed")
+			return &consumer.ShardError{Stream: cfg.StreamName, ShardID: shardID, Err: consumer.ErrShardClosed}
 		}
 
 		// Update the shard iterator for the next call
 		shardIterator = resp.NextShardIterator
 	}
+	return ctx.Err()
 }
 
-func main() {
+// consumeOptions are the command line settings of consume, tail and replay.
+type consumeOptions struct {
+	dryRun       bool
+	maxAge       time.Duration
+	partitionKey string
+	// tail and replay read without touching the checkpoints
+	noCheckpoints bool
+	iteratorType  string
+	handler       string
+	handlerConfig json.RawMessage
+	// stopAfter shuts down after this long, for analyze
+	stopAfter time.Duration
+	// cleanup deregisters the fan_out consumer on shutdown
+	cleanup bool
+	// report is where the JSON shutdown report goes, "-" for stdout
+	report string
+	// -start-sequence, read only this shard from this sequence number on
+	startShard, startSequence string
+	// virtualFrom starts a virtual clock at this time, for replay -virtual-time
+	virtualFrom time.Time
+	// speed paces records by their arrival times, for replay -speed; 0 doesn't
+	speed float64
+}
+
+// setStartSequence parses -start-sequence <shard>:<sequence number>.
+func (o *consumeOptions) setStartSequence(s string) error {
+	shard, seq, ok := strings.Cut(s, ":")
+	if !ok || shard == "" || seq == "" || strings.Trim(seq, "0123456789") != "" {
+		return fmt.Errorf("start sequence %q is not <shard>:<sequence number>", s)
+	}
+	o.startShard, o.startSequence = shard, seq
+	return nil
+}
+
+// runConsume is the "consume" command, what runs without one.
+func runConsume(configPath string, opts consumeOptions) {
 	basicTest()
+	started := time.Now()
+	if !opts.virtualFrom.IsZero() {
+		useVirtualTime(opts.virtualFrom)
+	}
+	if opts.speed > 0 {
+		pacer = &replayPacer{speed: opts.speed}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), shutdownSignals...)
+	defer stop()
+	if opts.stopAfter > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.stopAfter)
+		defer cancel()
+	}
+
+	// command line flags win over the config file, also when it's reloaded
+	var keyShard string
+	var tuned *decodeTuning
+	configOverrides = func(cfg *Config) {
+		if opts.maxAge > 0 {
+			cfg.MaxAge.Duration = opts.maxAge
+		}
+		cfg.DryRun = cfg.DryRun || opts.dryRun
+		if keyShard != "" {
+			cfg.ShardID = keyShard
+		}
+		if opts.noCheckpoints {
+			cfg.Checkpoint.Path = ""
+			cfg.Lease.Backend = ""
+			cfg.StateDir = ""
+		}
+		if opts.iteratorType != "" {
+			cfg.ShardIteratorType = opts.iteratorType
+		}
+		tuned.apply(&cfg.Decode)
+		if opts.startSequence != "" {
+			cfg.ShardID, cfg.StartingSequenceNumber = opts.startShard, opts.startSequence
+			cfg.ShardIteratorType = string(types.ShardIteratorTypeAtSequenceNumber)
+		}
+		if opts.handler != "" {
+			cfg.Handler, cfg.HandlerConfig = opts.handler, opts.handlerConfig
+		}
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		panic(err)
+	}
+	if cfg.StateDir != "" && !cfg.DryRun {
+		if err := os.MkdirAll(cfg.StateDir, 0755); err != nil {
+			panic(err)
+		}
+		stateDir = cfg.StateDir
+	}
+
+	p, err := newPipeline(cfg)
+	if err != nil {
+		panic(err)
+	}
+	pipes := newPipelineRef(p)
+	defer pipes.close()
+
+	var store checkpointStore
+	switch {
+	case cfg.DryRun:
+		ds := dryRunStore{}
+		if cfg.Lease.Backend != "" {
+			// reads the checkpoints without taking leases
+			if ds.store, err = openLeaseStore(cfg); err != nil {
+				panic(err)
+			}
+		} else if _, err := os.Stat(cfg.Checkpoint.Path); cfg.Checkpoint.Path != "" && err == nil {
+			if ds.store, err = openBoltStoreReadOnly(cfg.Checkpoint.Path); err != nil {
+				panic(err)
+			}
+		}
+		defer ds.Close()
+		store = ds
+	case cfg.Lease.Backend != "":
+		ls, err := openLeaseStore(cfg)
+		if err != nil {
+			panic(err)
+		}
+		defer ls.Close()
+		// -partition-key and -start-sequence read one shard, checkpointed without a lease
+		if cfg.ShardID == allShards {
+			ls.start()
+			shardLeases = ls
+		}
+		store = ls
+	case cfg.Checkpoint.Path != "":
+		bs, err := openBoltStore(cfg.Checkpoint.Path)
+		if err != nil {
+			panic(err)
+		}
+		defer bs.Close()
+		store = bs
+	}
+
+	if err := operatorAudit.open(cfg); err != nil {
+		panic(err)
+	}
+	defer operatorAudit.close()
+	if err := schemaDrifts.configure(cfg); err != nil {
+		panic(err)
+	}
+	if err := priorities.configure(cfg); err != nil {
+		panic(err)
+	}
+	if err := freshness.configure(cfg); err != nil {
+		panic(err)
+	}
+	if cfg.StartingSequenceNumber != "" {
+		operatorAudit.record("start_sequence", localOperator(), map[string]any{
+			"shard": cfg.ShardID, "to": cfg.StartingSequenceNumber,
+		})
+	}
+
+	serveMetrics(cfg.MetricsAddr)
+	serveAdmin(cfg.AdminAddr)
+	memoryBudget = newByteBudget(cfg.MaxInflightBytes)
 
 	// Load AWS config
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(region))
+	awsCfg, err := loadAWSConfig(ctx, cfg)
 	if err != nil {
 		panic(fmt.Sprintf("unable to load SDK config, %v", err))
 	}
 
+	if err := checkKinesisEndpoint(ctx, awsCfg, cfg); err != nil {
+		panic(err)
+	}
+
 	// Create a Kinesis client
-	client := kinesis.NewFromConfig(cfg)
+	client := kinesis.NewFromConfig(awsCfg)
 
-	// Start processing records from Kinesis
-	processKinesisRecords(client)
+	if opts.partitionKey != "" && opts.startSequence != "" {
+		panic("-partition-key and -start-sequence both pick the shard, use one of them")
+	}
+	if opts.partitionKey != "" {
+		if keyShard, err = shardForPartitionKey(ctx, client, cfg, opts.partitionKey); err != nil {
+			panic(err)
+		}
+		fmt.Println("partition key", opts.partitionKey, "is in", keyShard)
+		cfg.ShardID = keyShard
+	}
+
+	if cfg.Decode.AutoTune {
+		if tuned, err = autoTuneDecode(ctx, client, cfg); err != nil {
+			fmt.Printf("auto_tune failed, keeping the decode settings, err=%+v\n", err)
+		}
+		tuned.apply(&cfg.Decode)
+	}
+	if err := configureZstd(cfg.Decode); err != nil {
+		panic(err)
+	}
+
+	if cfg.FanOut.ConsumerName != "" {
+		if fanOutConsumerARN, err = registerFanOutConsumer(ctx, client, cfg); err != nil {
+			panic(err)
+		}
+		if opts.cleanup {
+			defer func() {
+				// ctx is cancelled by now
+				if err := deregisterFanOutConsumer(context.Background(), client, cfg); err != nil {
+					fmt.Println(err)
+				}
+			}()
+		}
+	}
+
+	go watchConfig(configPath, cfg, pipes)
+
+	describeEncryption(ctx, client, cfg)
+	go watchScaling(ctx, client, cfg)
+	go watchRetention(ctx, client, sns.NewFromConfig(awsCfg), cfg)
+	go watchRecordRate(ctx, sns.NewFromConfig(awsCfg), cfg)
+	go watchFreshness(ctx)
+	go emitStatsD(ctx, cfg.StatsD)
+
+	// Start processing records from Kinesis, and from the retry stream if there is one
+	retryCfg, err := retryStreamConfig(cfg)
+	if err != nil {
+		panic(err)
+	}
+	retryCtx, stopRetries := context.WithCancel(ctx)
+	var retries sync.WaitGroup
+	if retryCfg != nil {
+		retries.Add(1)
+		go func() {
+			defer retries.Done()
+			consumeRetries(retryCtx, retryCfg, pipes, store)
+		}()
+	}
+	consumeShards(ctx, client, pipes, store)
+	stopRetries()
+	retries.Wait()
+	printSummary()
+	schemaDrifts.close()
+	if opts.report != "" {
+		if err := writeReport(opts.report, cfg, store, started); err != nil {
+			fmt.Printf("writing the report failed, err=%+v\n", err)
+		}
+	}
+}
+
+func main() {
+	configPath := flag.String("config", "", "path to a JSON config file")
+	var opts consumeOptions
+	flag.BoolVar(&opts.dryRun, "dry-run", false, "decode and print what would be handled and checkpointed, without doing it")
+	flag.StringVar(&opts.partitionKey, "partition-key", "", "consume only the shard this partition key is hashed to (overrides shard_id)")
+	flag.BoolVar(&opts.cleanup, "cleanup", false, "deregister the fan_out stream consumer on shutdown")
+	flag.Func("start-sequence", "read only this shard, starting at this sequence number, e.g. shardId-000000000001:4959... (ignores its checkpoint)", opts.setStartSequence)
+	flag.StringVar(&opts.report, "report", "", "on exit, write a JSON report of what was read, handled and checkpointed to this file (- for stdout)")
+	flag.DurationVar(&opts.maxAge, "max-age", 0, "without a checkpoint, start this far back instead of at TRIM_HORIZON (overrides max_age)")
+	flag.StringVar(&proxyFlag, "proxy", "", "proxy for AWS API calls, http://, https:// or socks5:// (overrides aws.http.proxy and HTTPS_PROXY)")
+	flag.StringVar(&caBundleFlag, "ca-bundle", "", "PEM file of extra CAs to trust for AWS API calls (overrides aws.http.ca_bundle)")
+	flag.Var(&maxPayloadPrint, "max-payload-print", "print at most this much of each payload, e.g. 2KB (0 prints it all)")
+	flag.Func("print-format", "how payloads are printed: auto (text, or hex when not UTF-8), text, hex or base64", setPayloadFormat)
+	flag.Usage = usage
+	flag.Parse()
+
+	name := flag.Arg(0)
+	if name == "" {
+		name = "consume"
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+	cmd.run(*configPath, opts, flag.Args()[min(1, flag.NArg()):])
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// kplRecord is a user record taken out of a KPL aggregated record. Its Data and PartitionKey are
+// the user record's, the rest is the aggregated record's; the user records of an aggregated record
+// share its sequence number and are told apart by sub.
+type kplRecord struct {
+	types.Record
+	aggregated bool
+	sub        int
+	// last is false for all user records of an aggregated record but its last one
+	last bool
+}
+
+// deaggregate expands the KPL aggregated records among records into their user records:
+//
+//	magic | AggregatedRecord protobuf | MD5 of the protobuf
+//
+// A record that doesn't start with the magic, or whose MD5 or protobuf doesn't check out, is
+// passed on as it is.
+func deaggregate(records []types.Record) []kplRecord {
+	out := make([]kplRecord, 0, len(records))
+	for _, record := range records {
+		users, err := parseAggregated(record)
+		if err != nil || len(users) == 0 {
+			out = append(out, kplRecord{Record: record, last: true})
+			continue
+		}
+		for i, user := range users {
+			out = append(out, kplRecord{Record: user, aggregated: true, sub: i, last: i == len(users)-1})
+		}
+	}
+	return out
+}
+
+// parseAggregated returns the user records of a KPL aggregated record, nil if it isn't one.
+func parseAggregated(record types.Record) ([]types.Record, error) {
+	data := record.Data
+	if !bytes.HasPrefix(data, kplMagic) || len(data) < len(kplMagic)+md5.Size {
+		return nil, nil
+	}
+	body := data[len(kplMagic) : len(data)-md5.Size]
+	if sum := md5.Sum(body); !bytes.Equal(sum[:], data[len(data)-md5.Size:]) {
+		return nil, fmt.Errorf("aggregated record MD5 mismatch")
+	}
+
+	var keys []string
+	var entries [][]byte
+	for len(body) > 0 {
+		num, typ, n := protowire.ConsumeTag(body)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		body = body[n:]
+		if typ != protowire.BytesType {
+			if n = protowire.ConsumeFieldValue(num, typ, body); n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			body = body[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(body)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		body = body[n:]
+		switch num {
+		case 1: // partition_key_table
+			keys = append(keys, string(v))
+		case 3: // records
+			entries = append(entries, v)
+		}
+	}
+
+	users := make([]types.Record, 0, len(entries))
+	for _, entry := range entries {
+		keyIndex, userData, err := parseAggregatedEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		if keyIndex >= uint64(len(keys)) {
+			return nil, fmt.Errorf("partition key index %d out of %d", keyIndex, len(keys))
+		}
+		user := record
+		user.Data = userData
+		user.PartitionKey = aws.String(keys[keyIndex])
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// parseAggregatedEntry reads the partition_key_index and data of a Record message.
+func parseAggregatedEntry(b []byte) (keyIndex uint64, data []byte, err error) {
+	data = []byte{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return 0, nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.VarintType: // partition_key_index
+			keyIndex, n = protowire.ConsumeVarint(b)
+		case num == 3 && typ == protowire.BytesType: // data
+			data, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return 0, nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return keyIndex, data, nil
+}
+
+// kplAggregate builds a KPL aggregated record of data, the user records, put with partition keys
+// taken from keys in turn. The consumer never aggregates, it's for the benchmarks and tests.
+func kplAggregate(seq string, keys []string, data ...[]byte) types.Record {
+	var msg []byte
+	for _, key := range keys {
+		msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+		msg = protowire.AppendString(msg, key)
+	}
+	for i, d := range data {
+		var user []byte
+		user = protowire.AppendTag(user, 1, protowire.VarintType)
+		user = protowire.AppendVarint(user, uint64(i%len(keys)))
+		user = protowire.AppendTag(user, 3, protowire.BytesType)
+		user = protowire.AppendBytes(user, d)
+		msg = protowire.AppendTag(msg, 3, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, user)
+	}
+	sum := md5.Sum(msg)
+	record := append(append(bytes.Clone(kplMagic), msg...), sum[:]...)
+	return types.Record{Data: record, PartitionKey: aws.String("aggregate"), SequenceNumber: aws.String(seq)}
+}
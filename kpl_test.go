@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+func TestDeaggregate(t *testing.T) {
+	plain := types.Record{Data: []byte(`{"a":1}`), PartitionKey: aws.String("p"), SequenceNumber: aws.String("1")}
+	aggregated := kplAggregate("2", []string{"k0", "k1"}, []byte(`{"b":1}`), []byte(`{"b":2}`), []byte(`{"b":3}`))
+	corrupt := kplAggregate("3", []string{"k0"}, []byte(`{"c":1}`))
+	corrupt.Data[len(kplMagic)+2] ^= 0xff
+
+	got := deaggregate([]types.Record{plain, aggregated, corrupt})
+	want := []struct {
+		seq, key, data string
+		aggregated     bool
+		sub            int
+		last           bool
+	}{
+		{"1", "p", `{"a":1}`, false, 0, true},
+		{"2", "k0", `{"b":1}`, true, 0, false},
+		{"2", "k1", `{"b":2}`, true, 1, false},
+		{"2", "k0", `{"b":3}`, true, 2, true},
+		{"3", "aggregate", string(corrupt.Data), false, 0, true},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d records, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		g := got[i]
+		if aws.ToString(g.SequenceNumber) != w.seq || aws.ToString(g.PartitionKey) != w.key || string(g.Data) != w.data ||
+			g.aggregated != w.aggregated || g.sub != w.sub || g.last != w.last {
+			t.Errorf("record %d: got seq %s key %s data %q aggregated %v sub %d last %v, want %+v",
+				i, aws.ToString(g.SequenceNumber), aws.ToString(g.PartitionKey), g.Data, g.aggregated, g.sub, g.last, w)
+		}
+	}
+}
+
+func TestDecodeBatchAggregatedSkipsFooter(t *testing.T) {
+	// the user records of an aggregated record have no footer, even when the stream's records do
+	d := newDecoderPool(DecodeConfig{}, "test")
+	defer d.close()
+	records, decoded := d.decodeBatch("", []types.Record{kplAggregate("1", []string{"k"}, []byte(`{"x":1}`))})
+	if len(records) != 1 || string(decoded[0].data) != `{"x":1}` || decoded[0].noFooter {
+		t.Fatalf("got %d records, first decoded to %q (no footer %v)", len(records), decoded[0].data, decoded[0].noFooter)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// KubernetesLeaseConfig is lease.kubernetes, for the "kubernetes" lease backend. It keeps a Lease
+// object (coordination.k8s.io/v1) per shard, with the checkpoint in an annotation, so there is no
+// state outside the cluster beyond the stream itself. The service account needs get, list, create
+// and update on leases in the namespace.
+type KubernetesLeaseConfig struct {
+	// Namespace of the Lease objects, the pod's own when not set.
+	Namespace string `json:"namespace"`
+	// NamePrefix starts the Lease objects' names, followed by the stream and the shard; "kinesis"
+	// when not set.
+	NamePrefix string `json:"name_prefix"`
+	// APIServer is the cluster's own when not set; an http:// one, such as kubectl proxy's, is
+	// called without credentials.
+	APIServer string `json:"api_server"`
+}
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	leaseManagedByLabel  = "app.kubernetes.io/managed-by"
+	leaseManagedBy       = "kinesis-consumer"
+	leaseStreamAnnot     = "kinesis-consumer/stream"
+	leaseShardAnnot      = "kinesis-consumer/shard"
+	leaseCheckpointAnnot = "kinesis-consumer/checkpoint"
+	leaseFinishedAnnot   = "kinesis-consumer/finished"
+	leaseReleasedAnnot   = "kinesis-consumer/released"
+)
+
+// kubernetesLeases is the "kubernetes" leaseBackend. A lease's version is its Lease object's
+// resourceVersion, which the API server checks on update.
+type kubernetesLeases struct {
+	prefix   string
+	duration time.Duration
+	// url of the namespace's leases
+	url    string
+	client *http.Client
+	// tokenFile is read for every request, service account tokens are rotated
+	tokenFile string
+}
+
+// kubeLease is the part of a Lease object the backend reads and writes.
+type kubeLease struct {
+	APIVersion string         `json:"apiVersion"`
+	Kind       string         `json:"kind"`
+	Metadata   kubeObjectMeta `json:"metadata"`
+	Spec       kubeLeaseSpec  `json:"spec"`
+}
+
+type kubeObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+type kubeLeaseSpec struct {
+	HolderIdentity       *string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds *int32  `json:"leaseDurationSeconds,omitempty"`
+	RenewTime            string  `json:"renewTime,omitempty"`
+}
+
+// kubeMicroTime is the layout of a Lease's times.
+const kubeMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+func newKubernetesLeases(lc LeaseConfig) (*kubernetesLeases, error) {
+	kc := lc.Kubernetes
+	if kc.NamePrefix == "" {
+		kc.NamePrefix = "kinesis"
+	}
+	k := &kubernetesLeases{prefix: kc.NamePrefix, duration: lc.Duration.Duration, client: &http.Client{Timeout: 30 * time.Second}}
+
+	if kc.Namespace == "" {
+		ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("lease.kubernetes.namespace isn't set and there is no service account namespace: %w", err)
+		}
+		kc.Namespace = strings.TrimSpace(string(ns))
+	}
+	if kc.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("not running in a Kubernetes pod, set lease.kubernetes.api_server")
+		}
+		kc.APIServer = "https://" + net.JoinHostPort(host, port)
+	}
+	if !strings.HasPrefix(kc.APIServer, "http://") {
+		k.tokenFile = serviceAccountDir + "/token"
+		if pem, err := os.ReadFile(serviceAccountDir + "/ca.crt"); err == nil {
+			pool := x509.NewCertPool()
+			pool.AppendCertsFromPEM(pem)
+			k.client.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: &tls.Config{RootCAs: pool}}
+		}
+	}
+	k.url = fmt.Sprintf("%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", strings.TrimSuffix(kc.APIServer, "/"), url.PathEscape(kc.Namespace))
+	return k, nil
+}
+
+var notInObjectName = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// name is the Lease object of a shard: the prefix, stream and shard, lowercased with what an
+// object name can't have replaced by "-".
+func (k *kubernetesLeases) name(stream, shard string) string {
+	return notInObjectName.ReplaceAllString(strings.ToLower(k.prefix+"-"+stream+"-"+shard), "-")
+}
+
+func (k *kubernetesLeases) list(ctx context.Context, stream string) ([]shardLease, error) {
+	var out struct {
+		Items []kubeLease `json:"items"`
+	}
+	query := url.Values{"labelSelector": {leaseManagedByLabel + "=" + leaseManagedBy}}
+	if err := k.do(ctx, http.MethodGet, k.url+"?"+query.Encode(), nil, &out); err != nil {
+		return nil, err
+	}
+	var leases []shardLease
+	for _, item := range out.Items {
+		l := item.lease()
+		// other consumers' leases in the namespace have another prefix
+		if l.Shard != "" && (stream == "" || l.Stream == stream) && item.Metadata.Name == k.name(l.Stream, l.Shard) {
+			leases = append(leases, l)
+		}
+	}
+	return leases, nil
+}
+
+func (k *kubernetesLeases) get(ctx context.Context, stream, shard string) (shardLease, error) {
+	var item kubeLease
+	err := k.do(ctx, http.MethodGet, k.url+"/"+k.name(stream, shard), nil, &item)
+	if err != nil {
+		if errors.Is(err, errLeaseNotFound) {
+			return shardLease{Stream: stream, Shard: shard}, nil
+		}
+		return shardLease{}, err
+	}
+	if l := item.lease(); l.Stream == stream && l.Shard == shard {
+		return l, nil
+	}
+	return shardLease{}, fmt.Errorf("Lease %s isn't the lease of %s %s", item.Metadata.Name, stream, shard)
+}
+
+func (k *kubernetesLeases) put(ctx context.Context, l shardLease) (shardLease, error) {
+	item := kubeLease{
+		APIVersion: "coordination.k8s.io/v1",
+		Kind:       "Lease",
+		Metadata: kubeObjectMeta{
+			Name:            k.name(l.Stream, l.Shard),
+			ResourceVersion: l.version,
+			Labels:          map[string]string{leaseManagedByLabel: leaseManagedBy},
+			Annotations:     map[string]string{leaseStreamAnnot: l.Stream, leaseShardAnnot: l.Shard},
+		},
+	}
+	if l.Checkpoint != "" {
+		item.Metadata.Annotations[leaseCheckpointAnnot] = l.Checkpoint
+	}
+	if l.Finished {
+		item.Metadata.Annotations[leaseFinishedAnnot] = "true"
+	}
+	if l.Released {
+		item.Metadata.Annotations[leaseReleasedAnnot] = "true"
+	}
+	if l.Owner != "" {
+		seconds := int32(k.duration.Seconds())
+		item.Spec = kubeLeaseSpec{HolderIdentity: &l.Owner, LeaseDurationSeconds: &seconds, RenewTime: wallClock.Now().UTC().Format(kubeMicroTime)}
+	}
+
+	method, u := http.MethodPut, k.url+"/"+item.Metadata.Name
+	if l.version == "" {
+		method, u = http.MethodPost, k.url
+	}
+	var written kubeLease
+	if err := k.do(ctx, method, u, item, &written); err != nil {
+		if errors.Is(err, errLeaseNotFound) {
+			// deleted since it was read
+			return shardLease{}, errLeaseConflict
+		}
+		return shardLease{}, err
+	}
+	return written.lease(), nil
+}
+
+// lease reads the shardLease of a Lease object.
+func (item kubeLease) lease() shardLease {
+	a := item.Metadata.Annotations
+	l := shardLease{
+		Stream:     a[leaseStreamAnnot],
+		Shard:      a[leaseShardAnnot],
+		Checkpoint: a[leaseCheckpointAnnot],
+		Finished:   a[leaseFinishedAnnot] == "true",
+		Released:   a[leaseReleasedAnnot] == "true",
+		version:    item.Metadata.ResourceVersion,
+	}
+	if item.Spec.HolderIdentity != nil {
+		l.Owner = *item.Spec.HolderIdentity
+	}
+	return l
+}
+
+var errLeaseNotFound = errors.New("no such lease")
+
+// do makes an API server request, decoding the response into out. 409 Conflict fails with
+// errLeaseConflict and 404 Not Found with errLeaseNotFound.
+func (k *kubernetesLeases) do(ctx context.Context, method, u string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if k.tokenFile != "" {
+		token, err := os.ReadFile(k.tokenFile)
+		if err != nil {
+			return fmt.Errorf("reading the service account token failed: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		return errLeaseConflict
+	case resp.StatusCode == http.StatusNotFound:
+		return errLeaseNotFound
+	case resp.StatusCode/100 != 2:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("kubernetes %s %s returned %s: %s", method, u, resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
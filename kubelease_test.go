@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLeaseAPI is the part of the Kubernetes API server the kubernetes lease backend uses, for
+// the namespace "streaming".
+func fakeLeaseAPI(t *testing.T) *httptest.Server {
+	var mu sync.Mutex
+	objects := make(map[string]kubeLease)
+	version := 0
+	const prefix = "/apis/coordination.k8s.io/v1/namespaces/streaming/leases"
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		name := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, prefix), "/")
+		if !strings.HasPrefix(req.URL.Path, prefix) {
+			http.NotFound(w, req)
+			return
+		}
+		switch {
+		case req.Method == http.MethodGet && name == "":
+			if got := req.URL.Query().Get("labelSelector"); got != "app.kubernetes.io/managed-by=kinesis-consumer" {
+				t.Errorf("got labelSelector %q", got)
+			}
+			var items []kubeLease
+			for _, item := range objects {
+				items = append(items, item)
+			}
+			json.NewEncoder(w).Encode(map[string]any{"kind": "LeaseList", "items": items})
+			return
+		case req.Method == http.MethodGet:
+			item, ok := objects[name]
+			if !ok {
+				http.Error(w, `{"kind": "Status", "reason": "NotFound"}`, http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(item)
+			return
+		}
+
+		var item kubeLease
+		if err := json.NewDecoder(req.Body).Decode(&item); err != nil || item.Kind != "Lease" {
+			t.Errorf("bad lease %+v, err=%v", item, err)
+		}
+		existing, exists := objects[item.Metadata.Name]
+		switch {
+		case req.Method == http.MethodPost && exists:
+			http.Error(w, `{"kind": "Status", "reason": "AlreadyExists"}`, http.StatusConflict)
+			return
+		case req.Method == http.MethodPut && (!exists || name != item.Metadata.Name):
+			http.Error(w, `{"kind": "Status", "reason": "NotFound"}`, http.StatusNotFound)
+			return
+		case req.Method == http.MethodPut && existing.Metadata.ResourceVersion != item.Metadata.ResourceVersion:
+			http.Error(w, `{"kind": "Status", "reason": "Conflict"}`, http.StatusConflict)
+			return
+		}
+		version++
+		item.Metadata.ResourceVersion = strconv.Itoa(version)
+		objects[item.Metadata.Name] = item
+		json.NewEncoder(w).Encode(item)
+	}))
+}
+
+func TestKubernetesLeases(t *testing.T) {
+	srv := fakeLeaseAPI(t)
+	defer srv.Close()
+	k, err := newKubernetesLeases(LeaseConfig{Duration: Duration{30 * time.Second},
+		Kubernetes: KubernetesLeaseConfig{Namespace: "streaming", APIServer: srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := k.name("Orders_v2", "shardId-000000000001"); name != "kinesis-orders-v2-shardid-000000000001" {
+		t.Errorf("got lease name %s", name)
+	}
+	ctx := context.Background()
+
+	l, err := k.get(ctx, "orders", "shardId-000000000001")
+	if err != nil || l.version != "" {
+		t.Fatalf("got lease %+v before it was created, err=%v", l, err)
+	}
+	l.Owner = "pod-a"
+	created, err := k.put(ctx, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pod-b read it before it was created
+	if _, err := k.put(ctx, shardLease{Stream: "orders", Shard: "shardId-000000000001", Owner: "pod-b"}); !errors.Is(err, errLeaseConflict) {
+		t.Fatalf("creating a lease twice returned %v, want errLeaseConflict", err)
+	}
+
+	created.Checkpoint = "49590338271490256608559692538361571095921575989136588898"
+	renewed, err := k.put(ctx, created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.put(ctx, created); !errors.Is(err, errLeaseConflict) {
+		t.Fatalf("writing an old version returned %v, want errLeaseConflict", err)
+	}
+
+	renewed.Owner, renewed.Finished = "", true
+	if _, err := k.put(ctx, renewed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.put(ctx, shardLease{Stream: "payments", Shard: "shardId-000000000000"}); err != nil {
+		t.Fatal(err)
+	}
+	leases, err := k.list(ctx, "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 1 || leases[0].Checkpoint != created.Checkpoint || leases[0].Owner != "" || !leases[0].Finished {
+		t.Errorf("listed %+v", leases)
+	}
+	if all, _ := k.list(ctx, ""); len(all) != 2 {
+		t.Errorf("listed %d leases of all streams, want 2", len(all))
+	}
+}
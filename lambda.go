@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"kinesis_consumer/consumer"
+)
+
+// LambdaConfig is the handler_config of the "lambda" handler.
+//
+//	"handler": "lambda",
+//	"handler_config": {"path": "events.jsonl", "batch_size": 10,
+//		"event_source_arn": "arn:aws:kinesis:us-east-1:123456789012:stream/orders", "aws_region": "us-east-1"}
+type LambdaConfig struct {
+	// Path gets one event per line, stdout when empty.
+	Path string `json:"path"`
+	// BatchSize is how many records go into one event, 1 when not set.
+	BatchSize      int    `json:"batch_size"`
+	EventSourceARN string `json:"event_source_arn"`
+	AWSRegion      string `json:"aws_region"`
+}
+
+func init() {
+	consumer.RegisterHandlerFactory("lambda", newLambdaWriter)
+}
+
+// The Kinesis event a Lambda function gets, see
+// https://docs.aws.amazon.com/lambda/latest/dg/with-kinesis.html
+type lambdaEvent struct {
+	Records []lambdaRecord `json:"Records"`
+}
+
+type lambdaRecord struct {
+	Kinesis           lambdaKinesis `json:"kinesis"`
+	EventSource       string        `json:"eventSource"`
+	EventVersion      string        `json:"eventVersion"`
+	EventID           string        `json:"eventID"`
+	EventName         string        `json:"eventName"`
+	InvokeIdentityArn string        `json:"invokeIdentityArn"`
+	AWSRegion         string        `json:"awsRegion"`
+	EventSourceARN    string        `json:"eventSourceARN"`
+}
+
+type lambdaKinesis struct {
+	KinesisSchemaVersion        string  `json:"kinesisSchemaVersion"`
+	PartitionKey                string  `json:"partitionKey"`
+	SequenceNumber              string  `json:"sequenceNumber"`
+	Data                        []byte  `json:"data"` // base64
+	ApproximateArrivalTimestamp float64 `json:"approximateArrivalTimestamp"`
+}
+
+// lambdaWriter writes records as Lambda Kinesis events, one JSON event per line, so they can be
+// fed to sam local invoke. Data is the decoded payload, what the handler sees.
+type lambdaWriter struct {
+	cfg LambdaConfig
+
+	mu      sync.Mutex
+	file    *os.File
+	out     *bufio.Writer
+	pending []lambdaRecord
+}
+
+func newLambdaWriter(raw json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+	cfg := LambdaConfig{BatchSize: 1}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("invalid lambda handler_config: %w", err)
+		}
+	}
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = 1
+	}
+
+	w := &lambdaWriter{cfg: cfg}
+	if cfg.Path != "" {
+		f, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open %s: %w", cfg.Path, err)
+		}
+		w.file = f
+		w.out = bufio.NewWriter(f)
+	} else {
+		w.out = bufio.NewWriter(os.Stdout)
+	}
+	return w.handle, w, nil
+}
+
+func (w *lambdaWriter) handle(_ context.Context, r *consumer.Record) error {
+	rec := lambdaRecord{
+		Kinesis: lambdaKinesis{
+			KinesisSchemaVersion:        "1.0",
+			PartitionKey:                r.PartitionKey,
+			SequenceNumber:              r.SequenceNumber,
+			Data:                        append([]byte(nil), r.Data...),
+			ApproximateArrivalTimestamp: float64(r.ArrivalTime.UnixMilli()) / 1000,
+		},
+		EventSource:    "aws:kinesis",
+		EventVersion:   "1.0",
+		EventID:        r.IdempotencyKey(),
+		EventName:      "aws:kinesis:record",
+		AWSRegion:      w.cfg.AWSRegion,
+		EventSourceARN: w.cfg.EventSourceARN,
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = append(w.pending, rec)
+	if len(w.pending) < w.cfg.BatchSize {
+		return nil
+	}
+	return w.flush()
+}
+
+// flush writes the pending records as one event. w.mu must be held.
+func (w *lambdaWriter) flush() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	line, err := json.Marshal(lambdaEvent{Records: w.pending})
+	if err != nil {
+		return err
+	}
+	w.pending = w.pending[:0]
+	w.out.Write(line)
+	w.out.WriteByte('\n')
+	return w.out.Flush()
+}
+
+// Close writes what's left as a last, smaller event.
+func (w *lambdaWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.flush()
+	if w.file != nil {
+		if cerr := w.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
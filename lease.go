@@ -0,0 +1,563 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// LeaseConfig has the consumers running with the same config share the shards of shard_id "*":
+// each one holds the leases of some of them, renewed while it reads them, and the checkpoints are
+// kept with the leases, so a shard another consumer takes over continues where it was.
+//
+//	"lease": {"backend": "kubernetes", "kubernetes": {"namespace": "streaming"}}
+type LeaseConfig struct {
+	// Backend keeps the leases, "kubernetes" for Lease objects. Leases are off when empty.
+	Backend string `json:"backend"`
+	// WorkerID names this consumer in the leases, the host name (a pod's name) when not set.
+	WorkerID string `json:"worker_id"`
+	// Duration is how long a lease that isn't renewed anymore holds before another consumer takes
+	// it, 30s when not set. Leases are renewed, and checkpoints written, every third of it.
+	Duration Duration `json:"duration"`
+	// StickyFor keeps the leases a consumer holds on shutdown reserved for it this long, so its
+	// replacement with the same worker_id, such as a restarted StatefulSet pod, reads the same
+	// shards. When not set they are released to anyone.
+	StickyFor Duration `json:"sticky_for"`
+	// Balancer tunes how quickly shards move between consumers.
+	Balancer LeaseBalancerConfig `json:"balancer"`
+	// Kubernetes configures the kubernetes backend.
+	Kubernetes KubernetesLeaseConfig `json:"kubernetes"`
+}
+
+// LeaseBalancerConfig is lease.balancer. A consumer's share of the shards is an even split among
+// the consumers holding leases, at most MaxLeasesPerWorker; every RebalanceInterval it takes free
+// and expired leases up to its share, and steals up to MaxLeasesToSteal from consumers holding
+// more than that when there are none.
+//
+//	"balancer": {"max_leases_per_worker": 16, "max_leases_to_steal": 2, "rebalance_interval": "30s"}
+type LeaseBalancerConfig struct {
+	// MaxLeasesPerWorker caps the leases a consumer holds, 0 for no cap. Shards beyond what all
+	// consumers together can hold aren't read until more consumers start.
+	MaxLeasesPerWorker int `json:"max_leases_per_worker"`
+	// MaxLeasesToSteal is how many leases a consumer takes from busier ones per rebalance, 1 when
+	// not set; 0 never steals, a new consumer then only gets leases that are released or expire.
+	MaxLeasesToSteal *int `json:"max_leases_to_steal"`
+	// RebalanceInterval is how often a consumer looks for leases to take, the renewal interval (a
+	// third of the lease duration) when not set.
+	RebalanceInterval Duration `json:"rebalance_interval"`
+}
+
+func (lc LeaseConfig) validate(cfg *Config) error {
+	switch lc.Backend {
+	case "":
+		return nil
+	case "kubernetes":
+	default:
+		return fmt.Errorf("unknown lease.backend %q, want kubernetes", lc.Backend)
+	}
+	if cfg.Checkpoint.Path != "" {
+		return fmt.Errorf("with lease.backend the checkpoints are kept with the leases, checkpoint.path must not be set")
+	}
+	if cfg.ShardID != allShards {
+		return fmt.Errorf("lease.backend shares the shards of shard_id \"*\", not of %q", cfg.ShardID)
+	}
+	bc := lc.Balancer
+	if bc.MaxLeasesPerWorker < 0 || (bc.MaxLeasesToSteal != nil && *bc.MaxLeasesToSteal < 0) || bc.RebalanceInterval.Duration < 0 {
+		return fmt.Errorf("lease.balancer settings can't be negative")
+	}
+	if lc.StickyFor.Duration < 0 {
+		return fmt.Errorf("lease.sticky_for can't be negative, got %s", lc.StickyFor)
+	}
+	return nil
+}
+
+var (
+	leasesHeld = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "leases_held",
+		Help:      "Shard leases this consumer holds.",
+	}, []string{"stream"})
+	leasesTaken = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "leases_taken_total",
+		Help:      "Shard leases this consumer took, by whether they were free, expired, released by a consumer that shut down or taken from a busier one.",
+	}, []string{"stream", "from"})
+	leasesLost = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "leases_lost_total",
+		Help:      "Shard leases this consumer lost to another one, or couldn't renew in time.",
+	}, []string{"stream"})
+)
+
+// shardLease is a shard's lease as a leaseBackend keeps it.
+type shardLease struct {
+	Stream string
+	Shard  string
+	// Owner is the worker holding the lease, "" when it is free.
+	Owner string
+	// Checkpoint is the shard's checkpoint.
+	Checkpoint string
+	// Finished is set once the shard was read to its end; its lease isn't taken again.
+	Finished bool
+	// Released is set when Owner shut down, with lease.sticky_for; the lease waits for it.
+	Released bool
+	// version changes with every write, "" for a lease that doesn't exist yet
+	version string
+}
+
+// errLeaseConflict is what a leaseBackend fails with when a lease was written since it was read.
+var errLeaseConflict = errors.New("the lease was changed in the meantime")
+
+// leaseBackend keeps the shards' leases. Writes are conditional on the version read, so two
+// consumers can't both take a lease.
+type leaseBackend interface {
+	// list returns the leases of stream, of every stream when it is "".
+	list(ctx context.Context, stream string) ([]shardLease, error)
+	// get returns the lease of a shard, without a version when there is none.
+	get(ctx context.Context, stream, shard string) (shardLease, error)
+	// put writes l, creating it when it has no version, and returns it with its new version. It
+	// fails with errLeaseConflict when the lease was written since l was read.
+	put(ctx context.Context, l shardLease) (shardLease, error)
+}
+
+// shardLeases is the lease store while the consumer runs with lease.backend, nil otherwise.
+var shardLeases *leaseStore
+
+// leaseStore hands out the shards of the consumers sharing a lease backend, and is their
+// checkpoint store. Whether the holder of a lease is still alive is told by its version: one that
+// hasn't changed for the lease duration, as seen by this consumer's clock, has expired, so clocks
+// that disagree don't matter.
+//
+// The checkpoints of the shards this consumer holds are kept in memory and written with the
+// renewals, so a crash reads up to a third of the lease duration again, like a consumer that
+// stopped before its last checkpoint.
+type leaseStore struct {
+	backend   leaseBackend
+	worker    string
+	duration  time.Duration
+	stickyFor time.Duration
+	// maxLeases is 0 for no cap
+	maxLeases int
+	steal     int
+	rebalance time.Duration
+
+	mu   sync.Mutex
+	held map[leaseKey]*heldLease
+	// seen is the version of each lease listed and since when it was seen
+	seen map[leaseKey]seenLease
+	// leasing is set once the store renews its leases; checkpoints of shards it doesn't hold are
+	// then another consumer's and not written
+	leasing bool
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+type leaseKey struct {
+	stream, shard string
+}
+
+type heldLease struct {
+	lease shardLease
+	// ctx is cancelled once the lease is lost
+	ctx    context.Context
+	cancel context.CancelFunc
+	// renewed is when the lease was last written
+	renewed time.Time
+}
+
+type seenLease struct {
+	version string
+	since   time.Time
+}
+
+// leaseListing is a stream's leases as listed by leaseStore.list.
+type leaseListing struct {
+	stream string
+	leases map[string]shardLease
+	// finished are the shards read to their end, by any consumer
+	finished map[string]bool
+}
+
+// openLeaseStore opens the lease backend of cfg. It is a checkpoint store right away, for the
+// checkpoint commands; the consumer takes leases once it started the store.
+func openLeaseStore(cfg *Config) (*leaseStore, error) {
+	lc := cfg.Lease
+	if lc.WorkerID == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("lease.worker_id isn't set and there is no host name: %w", err)
+		}
+		lc.WorkerID = host
+	}
+	if lc.Duration.Duration <= 0 {
+		lc.Duration.Duration = 30 * time.Second
+	}
+	backend, err := newKubernetesLeases(lc)
+	if err != nil {
+		return nil, err
+	}
+	s := newLeaseStore(backend, lc.WorkerID, lc.Duration.Duration, lc.Balancer)
+	s.stickyFor = lc.StickyFor.Duration
+	return s, nil
+}
+
+func newLeaseStore(backend leaseBackend, worker string, duration time.Duration, bc LeaseBalancerConfig) *leaseStore {
+	s := &leaseStore{
+		backend:   backend,
+		worker:    worker,
+		duration:  duration,
+		maxLeases: bc.MaxLeasesPerWorker,
+		steal:     1,
+		rebalance: bc.RebalanceInterval.Duration,
+		held:      make(map[leaseKey]*heldLease),
+		seen:      make(map[leaseKey]seenLease),
+	}
+	if bc.MaxLeasesToSteal != nil {
+		s.steal = *bc.MaxLeasesToSteal
+	}
+	if s.rebalance <= 0 {
+		s.rebalance = s.interval()
+	}
+	return s
+}
+
+// interval is how often leases are renewed.
+func (s *leaseStore) interval() time.Duration {
+	return s.duration / 3
+}
+
+// rebalanceInterval is how often leases are taken.
+func (s *leaseStore) rebalanceInterval() time.Duration {
+	return s.rebalance
+}
+
+// start renews the leases held every interval until the store is closed.
+func (s *leaseStore) start() {
+	s.mu.Lock()
+	s.leasing = true
+	s.mu.Unlock()
+	s.stop, s.stopped = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(s.stopped)
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-wallClock.After(s.interval()):
+				s.renew()
+			}
+		}
+	}()
+}
+
+// list reads the leases of stream.
+func (s *leaseStore) list(ctx context.Context, stream string) (*leaseListing, error) {
+	leases, err := s.backend.list(ctx, stream)
+	if err != nil {
+		return nil, err
+	}
+	listing := &leaseListing{stream: stream, leases: make(map[string]shardLease), finished: make(map[string]bool)}
+	now := wallClock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, l := range leases {
+		listing.leases[l.Shard] = l
+		if l.Finished {
+			listing.finished[l.Shard] = true
+		}
+		k := leaseKey{stream, l.Shard}
+		if seen, ok := s.seen[k]; !ok || seen.version != l.version {
+			s.seen[k] = seenLease{l.version, now}
+		}
+	}
+	return listing, nil
+}
+
+// expired tells whether the lease l of a listing wasn't written for d. s.mu must be held.
+func (s *leaseStore) expired(l shardLease, now time.Time, d time.Duration) bool {
+	seen := s.seen[leaseKey{l.Stream, l.Shard}]
+	return seen.version == l.version && now.Sub(seen.since) >= d
+}
+
+// claim takes the leases of shards, the listed stream's shards that are ready to be read, this
+// consumer should hold: its own from before a restart, free ones, expired ones and those released
+// more than lease.sticky_for ago, up to its share of the shards among the consumers whose leases
+// are alive; and when there are none of those left while it has less than its share, up to
+// lease.balancer.max_leases_to_steal of the busiest consumers'. It returns the shards it holds,
+// each with a context, derived from ctx, that is cancelled once their lease is lost.
+func (s *leaseStore) claim(ctx context.Context, listing *leaseListing, shards []string) map[string]context.Context {
+	stream := listing.stream
+	now := wallClock.Now()
+
+	s.mu.Lock()
+	// what each live consumer holds of shards
+	holding := map[string][]string{s.worker: nil}
+	// own are this consumer's from before a restart
+	var own, free, expired, released []string
+	for _, id := range shards {
+		if _, ok := s.held[leaseKey{stream, id}]; ok {
+			holding[s.worker] = append(holding[s.worker], id)
+			continue
+		}
+		l, ok := listing.leases[id]
+		switch {
+		case ok && l.Owner == s.worker:
+			own = append(own, id)
+		case !ok || l.Owner == "":
+			free = append(free, id)
+		case l.Released:
+			// kept for its owner's replacement for a while
+			if s.expired(l, now, s.stickyFor) {
+				released = append(released, id)
+			}
+		case s.expired(l, now, s.duration):
+			expired = append(expired, id)
+		default:
+			holding[l.Owner] = append(holding[l.Owner], id)
+		}
+	}
+	s.mu.Unlock()
+
+	share := (len(shards) + len(holding) - 1) / len(holding)
+	if s.maxLeases > 0 {
+		share = min(share, s.maxLeases)
+	}
+	mine := len(holding[s.worker])
+	for _, id := range slices.Concat(own, free, expired, released) {
+		if mine >= share {
+			break
+		}
+		from := "free"
+		switch {
+		case slices.Contains(expired, id):
+			from = "expired"
+		case slices.Contains(released, id):
+			from = "released"
+		}
+		if s.take(ctx, listing, id, from) {
+			mine++
+		}
+	}
+	for stolen := 0; mine < share && stolen < s.steal; stolen++ {
+		// the busiest consumer gives up a shard; it notices with its next renewal
+		var busiest string
+		for worker, ids := range holding {
+			if worker != s.worker && len(ids) > share && (busiest == "" || len(ids) > len(holding[busiest])) {
+				busiest = worker
+			}
+		}
+		if busiest == "" {
+			break
+		}
+		ids := holding[busiest]
+		holding[busiest] = ids[1:]
+		if s.take(ctx, listing, ids[0], "stolen") {
+			mine++
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	held := make(map[string]context.Context)
+	for k, h := range s.held {
+		if k.stream == stream {
+			held[k.shard] = h.ctx
+		}
+	}
+	leasesHeld.WithLabelValues(stream).Set(float64(len(held)))
+	return held
+}
+
+// take writes this consumer into the lease of shard. It returns false when another consumer
+// wrote the lease first.
+func (s *leaseStore) take(ctx context.Context, listing *leaseListing, shard, from string) bool {
+	l, ok := listing.leases[shard]
+	if !ok {
+		l = shardLease{Stream: listing.stream, Shard: shard}
+	}
+	previous := l.Owner
+	l.Owner, l.Released = s.worker, false
+	l, err := s.backend.put(ctx, l)
+	if err != nil {
+		if !errors.Is(err, errLeaseConflict) && ctx.Err() == nil {
+			fmt.Printf("taking the lease of %s failed, err=%+v\n", shard, err)
+		}
+		return false
+	}
+	if previous != "" && previous != s.worker {
+		fmt.Printf("took the lease of %s from %s (%s)\n", shard, previous, from)
+	} else {
+		fmt.Println("took the lease of", shard)
+	}
+	leasesTaken.WithLabelValues(listing.stream, from).Inc()
+
+	leaseCtx, cancel := context.WithCancel(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.held[leaseKey{listing.stream, shard}] = &heldLease{lease: l, ctx: leaseCtx, cancel: cancel, renewed: wallClock.Now()}
+	return true
+}
+
+// renew writes the leases held, with their checkpoints. A lease another consumer wrote in the
+// meantime, or that couldn't be written for the lease duration, is lost.
+func (s *leaseStore) renew() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.interval())
+	defer cancel()
+	s.mu.Lock()
+	keys := make([]leaseKey, 0, len(s.held))
+	for k := range s.held {
+		keys = append(keys, k)
+	}
+	s.mu.Unlock()
+
+	for _, k := range keys {
+		s.mu.Lock()
+		h, ok := s.held[k]
+		if !ok {
+			s.mu.Unlock()
+			continue
+		}
+		l := h.lease
+		s.mu.Unlock()
+
+		renewed, err := s.backend.put(ctx, l)
+		s.mu.Lock()
+		switch {
+		case s.held[k] != h:
+			// finished in the meantime
+		case err == nil:
+			// a checkpoint set while writing goes with the next renewal
+			h.lease.version = renewed.version
+			h.renewed = wallClock.Now()
+		case errors.Is(err, errLeaseConflict):
+			s.lose(k, "it was taken by another consumer")
+		default:
+			fmt.Printf("renewing the lease of %s failed, err=%+v\n", k.shard, err)
+			if wallClock.Now().Sub(h.renewed) >= s.duration {
+				s.lose(k, "it couldn't be renewed in time")
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// lose stops reading a shard whose lease is gone. s.mu must be held.
+func (s *leaseStore) lose(k leaseKey, why string) {
+	fmt.Printf("lost the lease of %s, %s\n", k.shard, why)
+	leasesLost.WithLabelValues(k.stream).Inc()
+	s.held[k].cancel()
+	delete(s.held, k)
+}
+
+// finish marks the lease of a shard read to its end, so its children can be read, and releases it.
+func (s *leaseStore) finish(ctx context.Context, stream, shard string) error {
+	s.mu.Lock()
+	h, ok := s.held[leaseKey{stream, shard}]
+	if !ok {
+		s.mu.Unlock()
+		return nil
+	}
+	delete(s.held, leaseKey{stream, shard})
+	l := h.lease
+	s.mu.Unlock()
+	h.cancel()
+
+	l.Owner, l.Finished = "", true
+	_, err := s.backend.put(ctx, l)
+	return err
+}
+
+func (s *leaseStore) Get(stream, shard string) (string, error) {
+	s.mu.Lock()
+	if h, ok := s.held[leaseKey{stream, shard}]; ok {
+		defer s.mu.Unlock()
+		return h.lease.Checkpoint, nil
+	}
+	s.mu.Unlock()
+	l, err := s.backend.get(context.TODO(), stream, shard)
+	return l.Checkpoint, err
+}
+
+// Set keeps the checkpoint of a shard held until its next renewal. Without leases, as for the
+// checkpoint commands, it writes it right away.
+func (s *leaseStore) Set(stream, shard, seq string) error {
+	s.mu.Lock()
+	if h, ok := s.held[leaseKey{stream, shard}]; ok {
+		h.lease.Checkpoint = seq
+		s.mu.Unlock()
+		return nil
+	}
+	leasing := s.leasing
+	s.mu.Unlock()
+	if leasing {
+		// the lease was lost, its new holder checkpoints the shard
+		return nil
+	}
+
+	ctx := context.TODO()
+	for {
+		l, err := s.backend.get(ctx, stream, shard)
+		if err != nil {
+			return err
+		}
+		l.Stream, l.Shard, l.Checkpoint = stream, shard, seq
+		if _, err = s.backend.put(ctx, l); !errors.Is(err, errLeaseConflict) {
+			return err
+		}
+	}
+}
+
+func (s *leaseStore) List() ([]checkpoint, error) {
+	leases, err := s.backend.list(context.TODO(), "")
+	if err != nil {
+		return nil, err
+	}
+	var checkpoints []checkpoint
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, l := range leases {
+		if h, ok := s.held[leaseKey{l.Stream, l.Shard}]; ok {
+			l = h.lease
+		}
+		if l.Checkpoint != "" {
+			checkpoints = append(checkpoints, checkpoint{Stream: l.Stream, Shard: l.Shard, SequenceNumber: l.Checkpoint})
+		}
+	}
+	return checkpoints, nil
+}
+
+// Close stops renewing and releases the leases held, with their last checkpoints, so other
+// consumers take them over right away, or with lease.sticky_for after that long unless this
+// consumer's replacement takes them back first.
+func (s *leaseStore) Close() error {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.stopped
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.duration)
+	defer cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for k, h := range s.held {
+		h.cancel()
+		l := h.lease
+		if s.stickyFor > 0 {
+			l.Released = true
+		} else {
+			l.Owner = ""
+		}
+		if _, err := s.backend.put(ctx, l); err != nil {
+			errs = append(errs, fmt.Errorf("releasing the lease of %s: %w", k.shard, err))
+		}
+		delete(s.held, k)
+	}
+	return errors.Join(errs...)
+}
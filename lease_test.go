@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memLeases is a leaseBackend in memory.
+type memLeases struct {
+	mu      sync.Mutex
+	leases  map[leaseKey]shardLease
+	version int
+}
+
+func newMemLeases() *memLeases {
+	return &memLeases{leases: make(map[leaseKey]shardLease)}
+}
+
+func (m *memLeases) list(ctx context.Context, stream string) ([]shardLease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var leases []shardLease
+	for _, l := range m.leases {
+		if stream == "" || l.Stream == stream {
+			leases = append(leases, l)
+		}
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].Shard < leases[j].Shard })
+	return leases, nil
+}
+
+func (m *memLeases) get(ctx context.Context, stream, shard string) (shardLease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l, ok := m.leases[leaseKey{stream, shard}]; ok {
+		return l, nil
+	}
+	return shardLease{Stream: stream, Shard: shard}, nil
+}
+
+func (m *memLeases) put(ctx context.Context, l shardLease) (shardLease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.leases[leaseKey{l.Stream, l.Shard}].version != l.version {
+		return shardLease{}, errLeaseConflict
+	}
+	m.version++
+	l.version = strconv.Itoa(m.version)
+	m.leases[leaseKey{l.Stream, l.Shard}] = l
+	return l, nil
+}
+
+// owners returns the shards each worker holds in the backend.
+func (m *memLeases) owners() map[string][]string {
+	leases, _ := m.list(context.Background(), "orders")
+	owners := make(map[string][]string)
+	for _, l := range leases {
+		if l.Owner != "" {
+			owners[l.Owner] = append(owners[l.Owner], l.Shard)
+		}
+	}
+	return owners
+}
+
+var testShards = []string{"shardId-000000000000", "shardId-000000000001", "shardId-000000000002", "shardId-000000000003"}
+
+// claimAll lists the leases of the test stream and claims testShards for s.
+func claimAll(t *testing.T, s *leaseStore) []string {
+	t.Helper()
+	listing, err := s.list(context.Background(), "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var held []string
+	for id := range s.claim(context.Background(), listing, testShards) {
+		held = append(held, id)
+	}
+	slices.Sort(held)
+	return held
+}
+
+func TestLeaseStoreBalances(t *testing.T) {
+	fake := useFakeWallClock(t)
+	backend := newMemLeases()
+	a := newLeaseStore(backend, "a", 30*time.Second, LeaseBalancerConfig{})
+	b := newLeaseStore(backend, "b", 30*time.Second, LeaseBalancerConfig{})
+
+	// alone, a takes every shard
+	if held := claimAll(t, a); len(held) != 4 {
+		t.Fatalf("a holds %v, want all 4 shards", held)
+	}
+	// b's share is 2: it takes one from a with each claim, and a notices when it renews
+	for i := 1; i <= 2; i++ {
+		if held := claimAll(t, b); len(held) != i {
+			t.Fatalf("b holds %v, want %d shards", held, i)
+		}
+		a.renew()
+		fake.Advance(10 * time.Second)
+	}
+	if held := claimAll(t, b); len(held) != 2 {
+		t.Errorf("b holds %v after balancing, want 2", held)
+	}
+	owners := backend.owners()
+	if len(owners["a"]) != 2 || len(owners["b"]) != 2 {
+		t.Errorf("leases are held %v, want 2 each", owners)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.held) != 2 {
+		t.Errorf("a thinks it holds %d leases, want 2", len(a.held))
+	}
+}
+
+func TestLeaseStoreExpiry(t *testing.T) {
+	fake := useFakeWallClock(t)
+	backend := newMemLeases()
+	a := newLeaseStore(backend, "a", 30*time.Second, LeaseBalancerConfig{})
+	claimAll(t, a)
+	a.Set("orders", testShards[0], "49590338271490256608559692538361571095921575989136588898")
+	a.renew()
+
+	// a crashed: b leaves its leases alone until it saw them unchanged for the lease duration
+	b := newLeaseStore(backend, "b", 30*time.Second, LeaseBalancerConfig{})
+	if held := claimAll(t, b); len(held) != 1 {
+		t.Fatalf("b holds %v while a is alive, want the one stolen", held)
+	}
+	fake.Advance(30 * time.Second)
+	if held := claimAll(t, b); len(held) != 4 {
+		t.Fatalf("b holds %v after a's leases expired, want all 4", held)
+	}
+	if seq, _ := b.Get("orders", testShards[0]); seq != "49590338271490256608559692538361571095921575989136588898" {
+		t.Errorf("b resumes %s from %q, want a's checkpoint", testShards[0], seq)
+	}
+}
+
+func TestLeaseStoreCheckpoints(t *testing.T) {
+	useFakeWallClock(t)
+	backend := newMemLeases()
+	a := newLeaseStore(backend, "a", 30*time.Second, LeaseBalancerConfig{})
+	a.start()
+	listing, _ := a.list(context.Background(), "orders")
+	held := a.claim(context.Background(), listing, testShards[:1])
+	if held[testShards[0]] == nil {
+		t.Fatalf("a holds %v", held)
+	}
+
+	// held checkpoints are written with the renewals
+	a.Set("orders", testShards[0], "1")
+	if l, _ := backend.get(context.Background(), "orders", testShards[0]); l.Checkpoint != "" {
+		t.Errorf("checkpoint %q written before the renewal", l.Checkpoint)
+	}
+	a.renew()
+	if l, _ := backend.get(context.Background(), "orders", testShards[0]); l.Checkpoint != "1" {
+		t.Errorf("checkpoint %q after the renewal, want 1", l.Checkpoint)
+	}
+
+	// another consumer took the lease: a stops reading and doesn't write checkpoints anymore
+	l, _ := backend.get(context.Background(), "orders", testShards[0])
+	l.Owner = "b"
+	backend.put(context.Background(), l)
+	a.renew()
+	if held[testShards[0]].Err() == nil {
+		t.Error("the shard's context isn't cancelled after losing its lease")
+	}
+	a.Set("orders", testShards[0], "2")
+	if l, _ := backend.get(context.Background(), "orders", testShards[0]); l.Checkpoint != "1" || l.Owner != "b" {
+		t.Errorf("lease is %+v after a lost it", l)
+	}
+
+	// closing releases the leases with their checkpoints
+	listing, _ = a.list(context.Background(), "orders")
+	a.claim(context.Background(), listing, testShards[1:2])
+	a.Set("orders", testShards[1], "3")
+	a.Close()
+	if l, _ := backend.get(context.Background(), "orders", testShards[1]); l.Checkpoint != "3" || l.Owner != "" {
+		t.Errorf("lease is %+v after closing, want it free with checkpoint 3", l)
+	}
+}
+
+func TestLeaseStoreFinish(t *testing.T) {
+	useFakeWallClock(t)
+	backend := newMemLeases()
+	a := newLeaseStore(backend, "a", 30*time.Second, LeaseBalancerConfig{})
+	claimAll(t, a)
+	if err := a.finish(context.Background(), "orders", testShards[0]); err != nil {
+		t.Fatal(err)
+	}
+	listing, _ := a.list(context.Background(), "orders")
+	if !listing.finished[testShards[0]] {
+		t.Errorf("%s isn't finished", testShards[0])
+	}
+
+	// a restarted with the same worker id takes its leases back right away
+	restarted := newLeaseStore(backend, "a", 30*time.Second, LeaseBalancerConfig{})
+	held := restarted.claim(context.Background(), listing, testShards[1:])
+	if len(held) != 3 {
+		t.Errorf("restarted a holds %v, want the 3 unfinished shards", held)
+	}
+}
+
+func TestLeaseConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{"off", Config{ShardID: "shardId-000000000000"}, false},
+		{"kubernetes", Config{ShardID: allShards, Lease: LeaseConfig{Backend: "kubernetes"}}, false},
+		{"unknown backend", Config{ShardID: allShards, Lease: LeaseConfig{Backend: "zookeeper"}}, true},
+		{"one shard", Config{ShardID: "shardId-000000000000", Lease: LeaseConfig{Backend: "kubernetes"}}, true},
+		{"checkpoint file", Config{ShardID: allShards, Checkpoint: CheckpointConfig{Path: "c.db"}, Lease: LeaseConfig{Backend: "kubernetes"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.Lease.validate(&tt.cfg); (err != nil) != tt.wantErr {
+				t.Errorf("got err=%v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLeaseBalancer(t *testing.T) {
+	steal := func(n int) *int { return &n }
+	tests := []struct {
+		name     string
+		balancer LeaseBalancerConfig
+		// wantA and wantB are what a and b hold after a took its share alone, then b claimed once
+		wantA, wantB int
+	}{
+		{"defaults", LeaseBalancerConfig{}, 4, 1},
+		{"steals two at once", LeaseBalancerConfig{MaxLeasesToSteal: steal(2)}, 4, 2},
+		{"never steals", LeaseBalancerConfig{MaxLeasesToSteal: steal(0)}, 4, 0},
+		{"capped", LeaseBalancerConfig{MaxLeasesPerWorker: 3}, 3, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeWallClock(t)
+			backend := newMemLeases()
+			a := newLeaseStore(backend, "a", 30*time.Second, tt.balancer)
+			b := newLeaseStore(backend, "b", 30*time.Second, tt.balancer)
+			if held := claimAll(t, a); len(held) != tt.wantA {
+				t.Errorf("a holds %v, want %d shards", held, tt.wantA)
+			}
+			if held := claimAll(t, b); len(held) != tt.wantB {
+				t.Errorf("b holds %v, want %d shards", held, tt.wantB)
+			}
+		})
+	}
+}
+
+func TestLeaseStoreSticky(t *testing.T) {
+	fake := useFakeWallClock(t)
+	backend := newMemLeases()
+	newSticky := func(worker string) *leaseStore {
+		s := newLeaseStore(backend, worker, 30*time.Second, LeaseBalancerConfig{})
+		s.stickyFor = 5 * time.Minute
+		return s
+	}
+	a := newSticky("a")
+	claimAll(t, a)
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if owners := backend.owners(); len(owners["a"]) != 4 {
+		t.Fatalf("leases are held %v after a shut down, want a's 4 kept for it", owners)
+	}
+
+	// b leaves the released leases to a's replacement, which takes them back right away
+	b := newSticky("b")
+	if held := claimAll(t, b); len(held) != 0 {
+		t.Fatalf("b holds %v within sticky_for, want none", held)
+	}
+	fake.Advance(time.Minute)
+	restarted := newSticky("a")
+	if held := claimAll(t, restarted); len(held) != 4 {
+		t.Fatalf("restarted a holds %v, want its 4 shards", held)
+	}
+
+	// when no replacement comes, b takes them once sticky_for passed
+	if err := restarted.Close(); err != nil {
+		t.Fatal(err)
+	}
+	claimAll(t, b)
+	fake.Advance(5 * time.Minute)
+	if held := claimAll(t, b); len(held) != 4 {
+		t.Errorf("b holds %v after sticky_for, want all 4", held)
+	}
+	if owners := backend.owners(); len(owners["b"]) != 4 {
+		t.Errorf("leases are held %v, want b's 4", owners)
+	}
+}
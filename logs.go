@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"kinesis_consumer/consumer"
+)
+
+// LogsConfig is the handler_config of the "logs" handler.
+//
+//	"handler": "logs",
+//	"handler_config": {"target": "loki", "url": "http://localhost:3100",
+//		"labels": {"log_group": "@log_group", "level": "level"}, "static_labels": {"env": "prod"}}
+type LogsConfig struct {
+	// Target is "loki" or "elasticsearch".
+	Target string `json:"target"`
+	// URL of Loki or of the Elasticsearch cluster.
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Index is the Elasticsearch index or data stream, "logs-kinesis-default" when not set.
+	Index string `json:"index"`
+	// Labels maps each label to a field of the log line when it's JSON, or to @log_group,
+	// @log_stream, @shard or @partition_key. Lines without the field don't get the label.
+	Labels map[string]string `json:"labels"`
+	// StaticLabels are put on every line.
+	StaticLabels map[string]string `json:"static_labels"`
+	// Flush is 500 records, 8MB, 1s and 4 pushes in flight when not set.
+	Flush FlushConfig `json:"flush"`
+	legacyFlush
+}
+
+const (
+	logsMaxPushBytes = 8 << 20
+	// logsPushAttempts is how often a push the server throttles or fails (429, 5xx) is tried
+	logsPushAttempts = 5
+)
+
+func init() {
+	consumer.RegisterHandlerFactory("logs", newLogShipper)
+}
+
+// cloudWatchLogs is what a CloudWatch Logs subscription filter puts into a stream, gzipped.
+type cloudWatchLogs struct {
+	MessageType string `json:"messageType"`
+	LogGroup    string `json:"logGroup"`
+	LogStream   string `json:"logStream"`
+	LogEvents   []struct {
+		ID        string `json:"id"`
+		Timestamp int64  `json:"timestamp"`
+		Message   string `json:"message"`
+	} `json:"logEvents"`
+}
+
+// logLine is one log line of a record with what its labels are taken from.
+type logLine struct {
+	id        string
+	time      time.Time
+	line      string
+	fields    map[string]any // nil when the line isn't a JSON object
+	logGroup  string
+	logStream string
+}
+
+// logShipper pushes log records to Loki or the Elasticsearch bulk API. A record is either a
+// CloudWatch Logs subscription envelope, whose log events become the lines, or one line, JSON or
+// not. Pushes are batched and acknowledged like the pubsub handler's, with at most
+// flush.max_in_flight outstanding, and retried with backoff while the server throttles.
+type logShipper struct {
+	cfg    LogsConfig
+	url    string
+	client *http.Client
+	batch  *asyncBatcher
+	// sep joins encoded records in a push body
+	sep  []byte
+	wrap func(body []byte) []byte
+}
+
+func newLogShipper(raw json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+	cfg := LogsConfig{Index: "logs-kinesis-default"}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("invalid logs handler_config: %w", err)
+		}
+	}
+	if cfg.URL == "" {
+		return nil, nil, fmt.Errorf("the logs handler needs a url")
+	}
+
+	s := &logShipper{cfg: cfg, client: &http.Client{Timeout: time.Minute}}
+	base := strings.TrimSuffix(cfg.URL, "/")
+	switch cfg.Target {
+	case "loki":
+		s.url = base + "/loki/api/v1/push"
+		s.sep = []byte(",")
+		s.wrap = func(body []byte) []byte {
+			return append(append([]byte(`{"streams":[`), body...), "]}"...)
+		}
+	case "elasticsearch":
+		s.url = base + "/_bulk"
+		s.wrap = func(body []byte) []byte { return body }
+	default:
+		return nil, nil, fmt.Errorf("logs target %q is not one of loki or elasticsearch", cfg.Target)
+	}
+	s.batch = cfg.flush("logs", cfg.Flush).batcher(cfg.Target, FlushConfig{MaxRecords: 500, MaxLatency: Duration{time.Second}, MaxInFlight: 4},
+		0, logsMaxPushBytes, s.push)
+	return s.handle, s, nil
+}
+
+func (s *logShipper) handle(ctx context.Context, r *consumer.Record) error {
+	lines, err := s.lines(r)
+	if err != nil || len(lines) == 0 {
+		return err
+	}
+	var item []byte
+	if s.cfg.Target == "loki" {
+		item, err = s.lokiStreams(r, lines)
+	} else {
+		item, err = s.bulkActions(r, lines)
+	}
+	if err != nil {
+		return err
+	}
+	return s.batch.add(ctx, item)
+}
+
+// lines splits a record into its log lines; CloudWatch Logs control messages have none.
+func (s *logShipper) lines(r *consumer.Record) ([]logLine, error) {
+	data := r.Data
+	if bytes.HasPrefix(data, gzipMagic) {
+		// subscription records that no codecs rule decompressed
+		var err error
+		if data, err = gzipDecompress(data); err != nil {
+			return nil, err
+		}
+	}
+
+	var cw cloudWatchLogs
+	if json.Unmarshal(data, &cw) == nil && cw.MessageType != "" {
+		if cw.MessageType != "DATA_MESSAGE" {
+			return nil, nil
+		}
+		lines := make([]logLine, len(cw.LogEvents))
+		for i, e := range cw.LogEvents {
+			lines[i] = logLine{
+				id:        e.ID,
+				time:      time.UnixMilli(e.Timestamp),
+				line:      e.Message,
+				logGroup:  cw.LogGroup,
+				logStream: cw.LogStream,
+			}
+			json.Unmarshal([]byte(e.Message), &lines[i].fields)
+		}
+		return lines, nil
+	}
+
+	// ids keep the <shard>-<sequence number> form documents already indexed have
+	l := logLine{id: strings.Replace(r.IdempotencyKey(), ":", "-", 1), time: r.Time(), line: string(data)}
+	json.Unmarshal(data, &l.fields)
+	return []logLine{l}, nil
+}
+
+// labels returns the labels of a line.
+func (s *logShipper) labels(r *consumer.Record, l logLine) map[string]string {
+	labels := make(map[string]string, len(s.cfg.StaticLabels)+len(s.cfg.Labels))
+	for name, value := range s.cfg.StaticLabels {
+		labels[name] = value
+	}
+	for name, source := range s.cfg.Labels {
+		var value string
+		switch source {
+		case "@log_group":
+			value = l.logGroup
+		case "@log_stream":
+			value = l.logStream
+		case "@shard":
+			value = r.ShardID
+		case "@partition_key":
+			value = r.PartitionKey
+		default:
+			if v, ok := jsonField(l.fields, source); ok {
+				value = fmt.Sprint(v)
+			}
+		}
+		if value != "" {
+			labels[name] = value
+		}
+	}
+	return labels
+}
+
+// lokiStreams encodes a record's lines as comma separated Loki streams, one per label set.
+func (s *logShipper) lokiStreams(r *consumer.Record, lines []logLine) ([]byte, error) {
+	type stream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	var streams []*stream
+	byLabels := make(map[string]*stream)
+	for _, l := range lines {
+		labels := s.labels(r, l)
+		key, _ := json.Marshal(labels) // maps marshal with sorted keys
+		st := byLabels[string(key)]
+		if st == nil {
+			st = &stream{Stream: labels}
+			byLabels[string(key)] = st
+			streams = append(streams, st)
+		}
+		st.Values = append(st.Values, [2]string{strconv.FormatInt(l.time.UnixNano(), 10), l.line})
+	}
+
+	var item []byte
+	for i, st := range streams {
+		b, err := json.Marshal(st)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			item = append(item, ',')
+		}
+		item = append(item, b...)
+	}
+	return item, nil
+}
+
+// bulkActions encodes a record's lines as bulk API create actions. Documents get their line's
+// id, so a batch that is pushed again doesn't index anything twice.
+func (s *logShipper) bulkActions(r *consumer.Record, lines []logLine) ([]byte, error) {
+	var item []byte
+	for _, l := range lines {
+		doc := l.fields
+		if doc == nil {
+			doc = map[string]any{"message": l.line}
+		}
+		if _, ok := doc["@timestamp"]; !ok {
+			doc["@timestamp"] = l.time.UTC().Format(time.RFC3339Nano)
+		}
+		for name, value := range s.labels(r, l) {
+			if _, ok := doc[name]; !ok {
+				doc[name] = value
+			}
+		}
+		action, _ := json.Marshal(map[string]any{"create": map[string]string{"_index": s.cfg.Index, "_id": l.id}})
+		b, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		item = append(item, action...)
+		item = append(item, '\n')
+		item = append(item, b...)
+		item = append(item, '\n')
+	}
+	return item, nil
+}
+
+// push sends a batch, retrying with backoff while the server throttles or fails.
+func (s *logShipper) push(items [][]byte) error {
+	body := s.wrap(bytes.Join(items, s.sep))
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		retry, err := s.post(body)
+		if err == nil || !retry || attempt == logsPushAttempts {
+			return err
+		}
+		fmt.Printf("\t%s push failed, retrying in %v, err=%+v\n", s.cfg.Target, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post sends one push and says whether a failure is worth retrying.
+func (s *logShipper) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	if s.cfg.Target == "loki" {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	}
+	if s.cfg.Username != "" {
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retry, fmt.Errorf("%s push returned %s: %s", s.cfg.Target, resp.Status, bytes.TrimSpace(msg))
+	}
+	if s.cfg.Target == "elasticsearch" {
+		return bulkErrors(resp.Body)
+	}
+	return false, nil
+}
+
+// bulkErrors reads a bulk API response, which is 200 even when documents failed. Documents that
+// already exist (409) were written by an earlier push and aren't failures.
+func bulkErrors(body io.Reader) (retry bool, err error) {
+	var resp struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(body).Decode(&resp); err != nil {
+		return true, fmt.Errorf("unreadable bulk response: %w", err)
+	}
+	if !resp.Errors {
+		return false, nil
+	}
+	throttled := 0
+	for _, item := range resp.Items {
+		for _, result := range item {
+			switch {
+			case result.Status < 300 || result.Status == http.StatusConflict:
+			case result.Status == http.StatusTooManyRequests:
+				throttled++
+			case err == nil:
+				err = fmt.Errorf("bulk document failed with %d: %s", result.Status, result.Error)
+			}
+		}
+	}
+	// a document that failed for other reasons fails again, so only a throttled push is retried
+	if err != nil {
+		return false, err
+	}
+	if throttled > 0 {
+		return true, fmt.Errorf("%d bulk documents were rejected with 429", throttled)
+	}
+	return false, nil
+}
+
+// Close pushes what is still pending.
+func (s *logShipper) Close() error {
+	s.batch.close()
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "kinesis_consumer"
+
+var decodeQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "decode_queue_depth",
+	Help:      "Records waiting for or being decoded by the decode workers.",
+})
+
+var (
+	stageRecords = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "pipeline_stage_records",
+		Help:      "Records in each stage of the pipeline: fetched (being decoded), decoded (waiting for or in the handler), awaiting_sink (handler returned, not acknowledged yet) and awaiting_checkpoint.",
+	}, []string{"stage"})
+	stageBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "pipeline_stage_bytes",
+		Help:      "Bytes of the records in each stage of the pipeline, as fetched for fetched and decoded for the others.",
+	}, []string{"stage"})
+)
+
+// inFlightStage counts the records in one stage of the pipeline. The stage records pile up in is
+// where the pipeline is slow.
+type inFlightStage struct {
+	records, bytes prometheus.Gauge
+}
+
+func newInFlightStage(stage string) *inFlightStage {
+	return &inFlightStage{stageRecords.WithLabelValues(stage), stageBytes.WithLabelValues(stage)}
+}
+
+var (
+	stageFetched            = newInFlightStage("fetched")
+	stageDecoded            = newInFlightStage("decoded")
+	stageAwaitingSink       = newInFlightStage("awaiting_sink")
+	stageAwaitingCheckpoint = newInFlightStage("awaiting_checkpoint")
+)
+
+// add counts records that entered the stage, or left it when negative.
+func (s *inFlightStage) add(records int, bytes int64) {
+	s.records.Add(float64(records))
+	s.bytes.Add(float64(bytes))
+}
+
+var (
+	iteratorAge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "iterator_age_milliseconds",
+		Help:      "Age of the last record of the latest GetRecords call (or fan-out event), 0 when it had none, like CloudWatch's GetRecords.IteratorAgeMilliseconds.",
+	}, []string{"shard"})
+	millisBehindLatest = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "millis_behind_latest",
+		Help:      "MillisBehindLatest of the latest GetRecords call (or fan-out event).",
+	}, []string{"shard"})
+)
+
+// recordIteratorAge updates the lag metrics after a GetRecords call or fan-out event.
+func recordIteratorAge(shardID string, records []types.Record, millisBehind *int64) {
+	age := 0.0
+	if len(records) > 0 {
+		arrived := aws.ToTime(records[len(records)-1].ApproximateArrivalTimestamp)
+		age = float64(max(0, time.Since(arrived).Milliseconds()))
+	}
+	iteratorAge.WithLabelValues(shardID).Set(age)
+	if millisBehind != nil {
+		millisBehindLatest.WithLabelValues(shardID).Set(float64(*millisBehind))
+	}
+}
+
+// serveMetrics exposes Prometheus metrics on addr under /metrics, and expvar under /debug/vars.
+func serveMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/debug/vars", expvar.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fmt.Printf("metrics server on %s stopped, err=%+v\n", addr, err)
+		}
+	}()
+}
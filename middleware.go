@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+
+	"kinesis_consumer/consumer"
+)
+
+// fetchThrough runs fetch, the records of a GetRecords call or fan-out event, through the fetch
+// middleware registered with consumer.UseFetch.
+func fetchThrough(ctx context.Context, shardID string, fetch func(context.Context) ([]types.Record, error)) ([]types.Record, error) {
+	wrapped := consumer.WrapFetch(func(ctx context.Context, shardID string) ([]consumer.RawRecord, error) {
+		records, err := fetch(ctx)
+		raw := make([]consumer.RawRecord, len(records))
+		for i, r := range records {
+			raw[i] = rawRecord(shardID, r)
+		}
+		return raw, err
+	})
+	if wrapped == nil {
+		return fetch(ctx)
+	}
+
+	raw, err := wrapped(ctx, shardID)
+	records := make([]types.Record, len(raw))
+	for i, r := range raw {
+		records[i] = types.Record{
+			SequenceNumber: aws.String(r.SequenceNumber),
+			PartitionKey:   aws.String(r.PartitionKey),
+			EncryptionType: types.EncryptionType(r.EncryptionType),
+			Data:           r.Data,
+		}
+		if !r.ArrivalTime.IsZero() {
+			records[i].ApproximateArrivalTimestamp = aws.Time(r.ArrivalTime)
+		}
+	}
+	return records, err
+}
+
+func rawRecord(shardID string, r types.Record) consumer.RawRecord {
+	var arrival time.Time
+	if r.ApproximateArrivalTimestamp != nil {
+		arrival = *r.ApproximateArrivalTimestamp
+	}
+	return consumer.RawRecord{
+		ShardID:        shardID,
+		SequenceNumber: aws.ToString(r.SequenceNumber),
+		PartitionKey:   aws.ToString(r.PartitionKey),
+		ArrivalTime:    arrival,
+		EncryptionType: string(r.EncryptionType),
+		Data:           r.Data,
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+const verifyMigrationUsage = `usage: kinesis_consumer verify-migration -old stream -new stream -key field [-since 0] [-for 0] [-grace 1m] [-interval 30s] [-ignore f,g] [-json]
+
+reads an old and a new stream in parallel, from -since ago (from now by default) until -for has
+passed or Ctrl-C, and checks that every JSON record of one turns up in the other within -grace,
+matched by the -key field, with the same payload (without the -ignore fields). Prints the counts
+every -interval and exits 1 when the streams didn't match.
+`
+
+// migrationSide tells which stream a record came from.
+type migrationSide int
+
+const (
+	migrationOld migrationSide = iota
+	migrationNew
+)
+
+// migrationRecord is a record waiting for its counterpart from the other stream.
+type migrationRecord struct {
+	side migrationSide
+	hash [sha256.Size]byte
+	seen time.Time
+}
+
+// migrationReport is the parity of the two streams so far. Matched keys had the same payload in
+// both; mismatched ones didn't. Missing keys came from the old stream and didn't show up in the
+// new one within the grace period, extra keys the other way around.
+type migrationReport struct {
+	Old        string `json:"old"`
+	New        string `json:"new"`
+	OldRecords int    `json:"old_records"`
+	NewRecords int    `json:"new_records"`
+	// Unkeyed counts the records of the old and the new stream that aren't JSON or lack the key
+	Unkeyed    [2]int   `json:"unkeyed"`
+	Matched    int      `json:"matched"`
+	Mismatched int      `json:"mismatched"`
+	Missing    int      `json:"missing"`
+	Extra      int      `json:"extra"`
+	Pending    int      `json:"pending"`
+	Examples   []string `json:"examples,omitempty"`
+}
+
+// migrationVerifier pairs up the records of the old and the new stream by key.
+type migrationVerifier struct {
+	key    string
+	ignore []string
+	grace  time.Duration
+
+	mu      sync.Mutex
+	pending map[string]migrationRecord
+	report  migrationReport
+}
+
+func (v *migrationVerifier) example(format string, args ...any) {
+	if len(v.report.Examples) < 20 {
+		v.report.Examples = append(v.report.Examples, fmt.Sprintf(format, args...))
+	}
+}
+
+// add takes a decoded record of side.
+func (v *migrationVerifier) add(side migrationSide, data []byte, now time.Time) {
+	k, canonical, ok := diffNormalize(data, v.key, v.ignore)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if side == migrationOld {
+		v.report.OldRecords++
+	} else {
+		v.report.NewRecords++
+	}
+	if !ok {
+		v.report.Unkeyed[side]++
+		return
+	}
+
+	hash := sha256.Sum256([]byte(canonical))
+	other, waiting := v.pending[k]
+	if !waiting || other.side == side {
+		// the first of a key, or the same stream again (a retry), which replaces it
+		v.pending[k] = migrationRecord{side: side, hash: hash, seen: now}
+		return
+	}
+	delete(v.pending, k)
+	if other.hash == hash {
+		v.report.Matched++
+		return
+	}
+	v.report.Mismatched++
+	v.example("%s: payloads differ", k)
+}
+
+// expire counts the records that waited longer than the grace period as missing or extra.
+func (v *migrationVerifier) expire(now time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	keys := make([]string, 0)
+	for k, r := range v.pending {
+		if now.Sub(r.seen) > v.grace {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if v.pending[k].side == migrationOld {
+			v.report.Missing++
+			v.example("%s: only in %s", k, v.report.Old)
+		} else {
+			v.report.Extra++
+			v.example("%s: only in %s", k, v.report.New)
+		}
+		delete(v.pending, k)
+	}
+}
+
+func (v *migrationVerifier) snapshot() migrationReport {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	r := v.report
+	r.Pending = len(v.pending)
+	r.Examples = append([]string(nil), r.Examples...)
+	return r
+}
+
+func (r migrationReport) String() string {
+	return fmt.Sprintf("%s %d records, %s %d: matched %d, mismatched %d, only in %s %d, only in %s %d, waiting %d",
+		r.Old, r.OldRecords, r.New, r.NewRecords, r.Matched, r.Mismatched, r.Old, r.Missing, r.New, r.Extra, r.Pending)
+}
+
+// runVerifyMigration is the "verify-migration" command.
+func runVerifyMigration(configPath string, args []string) {
+	fs := flag.NewFlagSet("verify-migration", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, verifyMigrationUsage) }
+	oldStream := fs.String("old", "", "stream name or ARN the producer is moving away from, the configured stream when not set")
+	newStream := fs.String("new", "", "stream name or ARN the producer is moving to")
+	key := fs.String("key", "", "dotted path of the field that identifies a record, e.g. order.id")
+	since := fs.Duration("since", 0, "start this long ago instead of now")
+	runFor := fs.Duration("for", 0, "stop after this long, 0 runs until Ctrl-C")
+	grace := fs.Duration("grace", time.Minute, "how long a record may wait for its counterpart in the other stream")
+	interval := fs.Duration("interval", 30*time.Second, "how often to print the counts")
+	ignore := fs.String("ignore", "", "comma separated dotted paths of fields not to compare, e.g. sent_at,trace.id")
+	asJSON := fs.Bool("json", false, "print the final report as JSON")
+	fs.Parse(args)
+	if *newStream == "" || *key == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), shutdownSignals...)
+	defer stop()
+	if *runFor > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *runFor)
+		defer cancel()
+	}
+	from := time.Now().Add(-*since)
+	oldCfg, oldClient := commandStream(ctx, configPath, *oldStream)
+	newCfg, newClient := commandStream(ctx, configPath, *newStream)
+
+	v := &migrationVerifier{key: *key, grace: *grace, pending: make(map[string]migrationRecord)}
+	v.report.Old, v.report.New = oldCfg.StreamName, newCfg.StreamName
+	if *ignore != "" {
+		v.ignore = strings.Split(*ignore, ",")
+	}
+
+	var wg sync.WaitGroup
+	follow := func(side migrationSide, cfg *Config, client *kinesis.Client) {
+		defer wg.Done()
+		followShards(ctx, client, cfg, from, func(data []byte) { v.add(side, data, time.Now()) })
+	}
+	wg.Add(2)
+	go follow(migrationOld, oldCfg, oldClient)
+	go follow(migrationNew, newCfg, newClient)
+	fmt.Fprintln(os.Stderr, "verifying", v.report.Old, "against", v.report.New, "from", from.Format(time.RFC3339), "(Ctrl-C stops)")
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case now := <-ticker.C:
+			v.expire(now)
+			fmt.Println(v.snapshot())
+		}
+	}
+	wg.Wait()
+
+	report := v.snapshot()
+	if *asJSON {
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		fmt.Println(report)
+		for _, e := range report.Examples {
+			fmt.Println("\t" + e)
+		}
+		if report.Unkeyed != [2]int{} {
+			fmt.Printf("without a key: %d in %s, %d in %s\n", report.Unkeyed[migrationOld], report.Old, report.Unkeyed[migrationNew], report.New)
+		}
+		if report.Pending > 0 {
+			fmt.Println("records still waiting for their counterpart aren't counted as missing")
+		}
+	}
+	if report.Mismatched+report.Missing+report.Extra > 0 {
+		os.Exit(1)
+	}
+}
+
+// followShards reads every shard of the stream from the time from on, and keeps reading at the
+// tip until ctx is done, calling fn with each record's decoded payload. The shard list is
+// refreshed every minute, so the children of a reshard are picked up.
+func followShards(ctx context.Context, client *kinesis.Client, cfg *Config, from time.Time, fn func(data []byte)) {
+	listCfg := *cfg
+	listCfg.ShardFilter = ShardFilterConfig{}
+	var wg sync.WaitGroup
+	started := make(map[string]bool)
+	ticker := time.NewTicker(shardListInterval)
+	defer ticker.Stop()
+	for {
+		shards, err := listShards(ctx, client, &listCfg)
+		if err != nil && ctx.Err() == nil {
+			fmt.Printf("listing %s shards failed, err=%+v\n", cfg.StreamName, err)
+		}
+		for _, shard := range shards {
+			id := aws.ToString(shard.ShardId)
+			if started[id] {
+				continue
+			}
+			started[id] = true
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := followShard(ctx, client, cfg, id, from, fn); err != nil && ctx.Err() == nil {
+					fmt.Printf("reading %s %s failed, err=%+v\n", cfg.StreamName, id, err)
+				}
+			}()
+		}
+
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func followShard(ctx context.Context, client *kinesis.Client, cfg *Config, shardID string, from time.Time, fn func(data []byte)) error {
+	name, streamARN := cfg.streamRef()
+	it, err := client.GetShardIterator(ctx, &kinesis.GetShardIteratorInput{
+		StreamName:        name,
+		StreamARN:         streamARN,
+		ShardId:           aws.String(shardID),
+		ShardIteratorType: types.ShardIteratorTypeAtTimestamp,
+		Timestamp:         aws.Time(from),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to get shard iterator: %w", err)
+	}
+
+	decoder := newDecoderPool(cfg.Decode, cfg.StreamName)
+	defer decoder.close()
+	for iterator := it.ShardIterator; iterator != nil && ctx.Err() == nil; {
+		resp, err := client.GetRecords(ctx, &kinesis.GetRecordsInput{
+			ShardIterator: iterator,
+			StreamARN:     streamARN,
+			Limit:         aws.Int32(10000),
+		})
+		if err != nil {
+			return err
+		}
+		_, decoded := decoder.decodeBatch("", resp.Records)
+		for _, d := range decoded {
+			fn(d.data)
+		}
+		iterator = resp.NextShardIterator
+		if len(resp.Records) == 0 && aws.ToInt64(resp.MillisBehindLatest) == 0 {
+			// at the tip, don't spend the shard's GetRecords calls
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"kinesis_consumer/consumer"
+)
+
+// MQTTConfig is the handler_config of the "mqtt" handler.
+//
+//	"handler": "mqtt",
+//	"handler_config": {"broker": "tcp://localhost:1883", "topic": "devices/{device.id}/events", "qos": 1}
+type MQTTConfig struct {
+	// Broker is tcp://, ssl://, ws:// or wss:// host:port.
+	Broker   string `json:"broker"`
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Topic is filled in per record, see recordTemplate.
+	Topic  string `json:"topic"`
+	QoS    byte   `json:"qos"`
+	Retain bool   `json:"retain"`
+	// Timeout bounds connecting and each publish, 10s when not set.
+	Timeout Duration `json:"timeout"`
+}
+
+func init() {
+	consumer.RegisterHandlerFactory("mqtt", newMQTTPublisher)
+}
+
+// mqttPublisher publishes each record's decoded payload to a topic made from its fields, to push
+// stream data out to devices or a local broker.
+type mqttPublisher struct {
+	cfg    MQTTConfig
+	topic  recordTemplate
+	client mqtt.Client
+}
+
+// mqttTopicEscape keeps field values from adding topic levels or wildcards.
+var mqttTopicEscape = strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace
+
+func newMQTTPublisher(raw json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+	var cfg MQTTConfig
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("invalid mqtt handler_config: %w", err)
+		}
+	}
+	if cfg.Broker == "" || cfg.Topic == "" {
+		return nil, nil, fmt.Errorf("the mqtt handler needs a broker and a topic")
+	}
+	if cfg.QoS > 2 {
+		return nil, nil, fmt.Errorf("mqtt qos must be 0, 1 or 2, not %d", cfg.QoS)
+	}
+	if cfg.Timeout.Duration <= 0 {
+		cfg.Timeout.Duration = 10 * time.Second
+	}
+	topic, err := newRecordTemplate(cfg.Topic)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid mqtt topic: %w", err)
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetConnectTimeout(cfg.Timeout.Duration).
+		SetAutoReconnect(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			fmt.Printf("mqtt connection to %s lost, reconnecting, err=%+v\n", cfg.Broker, err)
+		})
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(cfg.Timeout.Duration) {
+		client.Disconnect(0)
+		return nil, nil, fmt.Errorf("connecting to mqtt broker %s timed out", cfg.Broker)
+	}
+	if err := token.Error(); err != nil {
+		return nil, nil, fmt.Errorf("connecting to mqtt broker %s failed: %w", cfg.Broker, err)
+	}
+
+	p := &mqttPublisher{cfg: cfg, topic: topic, client: client}
+	return p.handle, p, nil
+}
+
+func (p *mqttPublisher) handle(ctx context.Context, r *consumer.Record) error {
+	topic, err := p.topic.render(r, mqttTopicEscape)
+	if err != nil {
+		return err
+	}
+	// the client may still hold the payload for a resend after Publish returns
+	token := p.client.Publish(topic, p.cfg.QoS, p.cfg.Retain, append([]byte(nil), r.Data...))
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-time.After(p.cfg.Timeout.Duration):
+		return fmt.Errorf("publishing to mqtt topic %s timed out", topic)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *mqttPublisher) Close() error {
+	// give in-flight publishes a moment to finish
+	p.client.Disconnect(250)
+	return nil
+}
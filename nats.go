@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"kinesis_consumer/consumer"
+)
+
+// NATSConfig is the handler_config of the "nats" handler.
+//
+//	"handler": "nats",
+//	"handler_config": {"url": "nats://localhost:4222", "subject": "orders.{region}", "jetstream": true}
+type NATSConfig struct {
+	// URL is one or more comma separated server URLs, nats://localhost:4222 when not set.
+	URL string `json:"url"`
+	// Credentials is a .creds file, for servers that need one.
+	Credentials string `json:"credentials"`
+	// Subject is filled in per record, see recordTemplate.
+	Subject string `json:"subject"`
+	// JetStream waits for the stream to acknowledge each record; without it records are published
+	// fire and forget.
+	JetStream bool `json:"jetstream"`
+	// Timeout bounds connecting and each JetStream publish, 10s when not set.
+	Timeout Duration `json:"timeout"`
+}
+
+func init() {
+	consumer.RegisterHandlerFactory("nats", newNATSPublisher)
+}
+
+// natsPublisher publishes each record's decoded payload to a NATS subject made from its fields.
+// Every message carries the record's idempotency key as Nats-Msg-Id, so a JetStream stream drops
+// the copies a replay or a retry publishes again, within its duplicate window.
+type natsPublisher struct {
+	cfg     NATSConfig
+	subject recordTemplate
+	nc      *nats.Conn
+	js      nats.JetStreamContext
+}
+
+// natsSubjectEscape keeps field values from adding subject tokens or wildcards.
+var natsSubjectEscape = strings.NewReplacer(".", "_", " ", "_", "*", "_", ">", "_").Replace
+
+func newNATSPublisher(raw json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+	var cfg NATSConfig
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("invalid nats handler_config: %w", err)
+		}
+	}
+	if cfg.Subject == "" {
+		return nil, nil, fmt.Errorf("the nats handler needs a subject")
+	}
+	if cfg.URL == "" {
+		cfg.URL = nats.DefaultURL
+	}
+	if cfg.Timeout.Duration <= 0 {
+		cfg.Timeout.Duration = 10 * time.Second
+	}
+	subject, err := newRecordTemplate(cfg.Subject)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid nats subject: %w", err)
+	}
+
+	opts := []nats.Option{
+		nats.Name("kinesis_consumer"),
+		nats.Timeout(cfg.Timeout.Duration),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				fmt.Printf("nats connection lost, reconnecting, err=%+v\n", err)
+			}
+		}),
+	}
+	if cfg.Credentials != "" {
+		opts = append(opts, nats.UserCredentials(cfg.Credentials))
+	}
+	nc, err := nats.Connect(cfg.URL, opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connecting to nats %s failed: %w", cfg.URL, err)
+	}
+
+	p := &natsPublisher{cfg: cfg, subject: subject, nc: nc}
+	if cfg.JetStream {
+		if p.js, err = nc.JetStream(); err != nil {
+			nc.Close()
+			return nil, nil, err
+		}
+	}
+	return p.handle, p, nil
+}
+
+func (p *natsPublisher) handle(ctx context.Context, r *consumer.Record) error {
+	subject, err := p.subject.render(r, natsSubjectEscape)
+	if err != nil {
+		return err
+	}
+
+	m := nats.NewMsg(subject)
+	// the client buffers the message, Data may be reused once the handler returns
+	m.Data = append([]byte(nil), r.Data...)
+	m.Header.Set(nats.MsgIdHdr, r.IdempotencyKey())
+	m.Header.Set("Kinesis-Partition-Key", r.PartitionKey)
+	m.Header.Set("Kinesis-Shard-Id", r.ShardID)
+	m.Header.Set("Kinesis-Sequence-Number", r.SequenceNumber)
+
+	if p.js == nil {
+		return p.nc.PublishMsg(m)
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout.Duration)
+	defer cancel()
+	_, err = p.js.PublishMsg(m, nats.Context(ctx))
+	return err
+}
+
+// Close sends what's buffered before disconnecting.
+func (p *natsPublisher) Close() error {
+	err := p.nc.FlushTimeout(p.cfg.Timeout.Duration)
+	p.nc.Close()
+	return err
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"kinesis_consumer/consumer"
+)
+
+var recordDataChanged = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "record_data_changed_total",
+	Help:      "Records whose Data a handler changed although it belongs to the consumer, with handle.check_ownership.",
+}, []string{"handler"})
+
+// scribble is what checkOwnership overwrites Record.Data with.
+const scribble = 0xdb
+
+// checkOwnership enforces the Record.Data ownership rules for handle.check_ownership: it's called
+// before the handler, and the function it returns once the consumer is done with the record. That
+// reports a handler that changed Data, then overwrites it, so a handler that keeps Data without
+// Record.Retain reads garbage right away instead of another record's data once in a while.
+func checkOwnership(handler string, r *consumer.Record) func() {
+	data := r.Data
+	sum := crc32.ChecksumIEEE(data)
+	return func() {
+		if crc32.ChecksumIEEE(data) != sum {
+			fmt.Printf("\thandler %s changed the data of %s %s, use Record.Retain for a copy it can change\n", handler, r.ShardID, r.SequenceNumber)
+			recordDataChanged.WithLabelValues(handler).Inc()
+		}
+		for i := range data {
+			data[i] = scribble
+		}
+	}
+}
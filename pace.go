@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pacedIteratorAge is how old a shard iterator may get while a paced replay holds records back
+// before it's replaced; Kinesis expires them after 5 minutes.
+const pacedIteratorAge = 4 * time.Minute
+
+// replayPacer is replay -speed: it holds each record back until its arrival time, relative to the
+// first record's, has come at speed times the pace the records came in. Records of all shards go
+// by the same start, so they are handled interleaved as they arrived.
+type replayPacer struct {
+	speed float64
+
+	mu sync.Mutex
+	// first is the arrival time of the first record, handled at started
+	first   time.Time
+	started time.Time
+}
+
+// pacer is nil when records are handled as fast as they are read.
+var pacer *replayPacer
+
+// parseSpeed parses 1x, 10x, 0.5x or max, which is 0.
+func parseSpeed(s string) (float64, error) {
+	if s == "max" {
+		return 0, nil
+	}
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(s, "x"), 64)
+	if err != nil || !strings.HasSuffix(s, "x") || speed <= 0 {
+		return 0, fmt.Errorf("speed %q is not max or a positive factor such as 1x or 10x", s)
+	}
+	return speed, nil
+}
+
+// wait returns once the record that arrived at arrival is due, or ctx is done.
+func (rp *replayPacer) wait(ctx context.Context, arrival time.Time) {
+	if rp == nil || arrival.IsZero() {
+		return
+	}
+	rp.mu.Lock()
+	if rp.first.IsZero() {
+		rp.first, rp.started = arrival, wallClock.Now()
+	}
+	due := rp.started.Add(time.Duration(float64(arrival.Sub(rp.first)) / rp.speed))
+	rp.mu.Unlock()
+
+	wait := due.Sub(wallClock.Now())
+	if wait <= 0 {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-wallClock.After(wait):
+	}
+}
+
+// outlived tells whether the shard iterator that came with records fetched at fetched has to be
+// replaced after pacing them.
+func (rp *replayPacer) outlived(fetched time.Time) bool {
+	return rp != nil && !fetched.IsZero() && wallClock.Now().Sub(fetched) > pacedIteratorAge
+}
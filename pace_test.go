@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReplayPacer(t *testing.T) {
+	tests := []struct {
+		name  string
+		speed float64
+		// the second record arrived this long after the first
+		gap      time.Duration
+		wantWait time.Duration
+	}{
+		{"same time", 1, 0, 0},
+		{"real time", 1, 10 * time.Second, 10 * time.Second},
+		{"ten times faster", 10, 10 * time.Second, time.Second},
+		{"half speed", 0.5, 10 * time.Second, 20 * time.Second},
+		{"out of order", 1, -time.Minute, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeWallClock(t)
+			rp := &replayPacer{speed: tt.speed}
+			first := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+			rp.wait(context.Background(), first)
+
+			waited := make(chan struct{})
+			go func() {
+				rp.wait(context.Background(), first.Add(tt.gap))
+				close(waited)
+			}()
+			if tt.wantWait > 0 {
+				waitForWaiters(t, fake, 1)
+				fake.Advance(tt.wantWait - time.Millisecond)
+				select {
+				case <-waited:
+					t.Fatal("record handled before it was due")
+				case <-time.After(10 * time.Millisecond):
+				}
+				fake.Advance(time.Millisecond)
+			}
+			select {
+			case <-waited:
+			case <-time.After(5 * time.Second):
+				t.Fatal("record still waiting once due")
+			}
+		})
+	}
+}
+
+func TestReplayPacerOutlived(t *testing.T) {
+	tests := []struct {
+		name    string
+		pacer   *replayPacer
+		fetched time.Duration
+		want    bool
+	}{
+		{"not pacing", nil, -time.Hour, false},
+		{"fresh", &replayPacer{speed: 1}, -time.Minute, false},
+		{"old", &replayPacer{speed: 1}, -pacedIteratorAge - time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeWallClock(t)
+			if got := tt.pacer.outlived(fake.Now().Add(tt.fetched)); got != tt.want {
+				t.Errorf("outlived = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"kinesis_consumer/consumer"
+)
+
+var handlerPanics = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "handler_panics_total",
+	Help:      "Handler calls that panicked and were recovered.",
+}, []string{"handler"})
+
+// recoverHandler turns a panic in h, or in the handle middleware around it, into an error, so the
+// poison policy retries and skips the record like any other failure instead of the panic taking
+// down the consumer.
+func recoverHandler(name string, h consumer.HandlerFunc) consumer.HandlerFunc {
+	return func(ctx context.Context, r *consumer.Record) (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				handlerPanics.WithLabelValues(name).Inc()
+				cause := fmt.Errorf("%w: %v", consumer.ErrHandlerPanic, v)
+				if e, ok := v.(error); ok {
+					cause = fmt.Errorf("%w: %w", consumer.ErrHandlerPanic, e)
+				}
+				err = &consumer.RecordError{
+					ShardID:        r.ShardID,
+					SequenceNumber: r.SequenceNumber,
+					PartitionKey:   r.PartitionKey,
+					Err:            cause,
+				}
+				fmt.Printf("\thandler %s panicked, err=%+v\n%s", name, err, debug.Stack())
+			}
+		}()
+		return h(ctx, r)
+	}
+}
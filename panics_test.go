@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"kinesis_consumer/consumer"
+)
+
+func TestRecoverHandler(t *testing.T) {
+	failed := errors.New("failed")
+	tests := []struct {
+		name       string
+		handler    consumer.HandlerFunc
+		wantErr    error
+		wantPanic  bool
+		wantRecord bool
+	}{
+		{"returns", func(context.Context, *consumer.Record) error { return nil }, nil, false, false},
+		{"fails", func(context.Context, *consumer.Record) error { return failed }, failed, false, false},
+		{"panics with a string", func(context.Context, *consumer.Record) error { panic("boom") }, consumer.ErrHandlerPanic, true, true},
+		{"panics with an error", func(context.Context, *consumer.Record) error { panic(io.ErrUnexpectedEOF) }, io.ErrUnexpectedEOF, true, true},
+		{"nil map write", func(context.Context, *consumer.Record) error {
+			var m map[string]int
+			m["a"] = 1
+			return nil
+		}, consumer.ErrHandlerPanic, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			panics := testutil.ToFloat64(handlerPanics.WithLabelValues("test"))
+			r := &consumer.Record{ShardID: "shardId-000000000000", SequenceNumber: "7", PartitionKey: "key"}
+			err := recoverHandler("test", tt.handler)(context.Background(), r)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantPanic && !errors.Is(err, consumer.ErrHandlerPanic) {
+				t.Errorf("%v doesn't wrap ErrHandlerPanic", err)
+			}
+			var re *consumer.RecordError
+			if errors.As(err, &re) != tt.wantRecord {
+				t.Errorf("got %v, want a RecordError %v", err, tt.wantRecord)
+			} else if re != nil && (re.ShardID != r.ShardID || re.SequenceNumber != r.SequenceNumber || re.PartitionKey != r.PartitionKey) {
+				t.Errorf("RecordError for %+v", re)
+			}
+			want := panics
+			if tt.wantPanic {
+				want++
+			}
+			if got := testutil.ToFloat64(handlerPanics.WithLabelValues("test")); got != want {
+				t.Errorf("panic counter at %v, want %v", got, want)
+			}
+		})
+	}
+}
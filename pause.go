@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// pauseControl lets an operator stop reading some shards, or the whole stream, without
+// stopping the consumer, e.g. while a downstream system is under maintenance.
+type pauseControl struct {
+	mu     sync.Mutex
+	all    bool
+	shards map[string]bool
+	// closed and replaced whenever something is resumed, to wake up waiting shards
+	resumed chan struct{}
+}
+
+var pauses = &pauseControl{shards: make(map[string]bool), resumed: make(chan struct{})}
+
+func (pc *pauseControl) pause(shard string) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if shard == "" {
+		pc.all = true
+	} else {
+		pc.shards[shard] = true
+	}
+}
+
+func (pc *pauseControl) resume(shard string) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if shard == "" {
+		pc.all = false
+		clear(pc.shards)
+	} else {
+		delete(pc.shards, shard)
+	}
+	close(pc.resumed)
+	pc.resumed = make(chan struct{})
+}
+
+// wait blocks while shard is paused. It reports whether it had to wait, in which case the
+// shard iterator has probably expired (they last 5 minutes) and needs to be fetched again.
+func (pc *pauseControl) wait(ctx context.Context, shard string) (waited bool) {
+	for {
+		pc.mu.Lock()
+		paused := pc.all || pc.shards[shard]
+		resumed := pc.resumed
+		pc.mu.Unlock()
+
+		if !paused {
+			return waited
+		}
+		if !waited {
+			fmt.Println(shard, "paused")
+		}
+		waited = true
+
+		select {
+		case <-ctx.Done():
+			return waited
+		case <-resumed:
+		}
+	}
+}
+
+func (pc *pauseControl) status() map[string]any {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	shards := make([]string, 0, len(pc.shards))
+	for shard := range pc.shards {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+	return map[string]any{"all": pc.all, "shards": shards}
+}
+
+// serveAdmin exposes the runtime controls on addr:
+//
+//	POST /pause[?shard=id]    pause one shard, or all of them
+//	POST /resume[?shard=id]   resume one shard, or all of them
+//	GET  /status              what is paused
+func serveAdmin(addr string) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /pause", func(w http.ResponseWriter, r *http.Request) {
+		shard := r.URL.Query().Get("shard")
+		pauses.pause(shard)
+		operatorAudit.record("pause", requestOperator(r), shardDetails(shard))
+		writeStatus(w)
+	})
+	mux.HandleFunc("POST /resume", func(w http.ResponseWriter, r *http.Request) {
+		shard := r.URL.Query().Get("shard")
+		pauses.resume(shard)
+		operatorAudit.record("resume", requestOperator(r), shardDetails(shard))
+		writeStatus(w)
+	})
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w)
+	})
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fmt.Printf("admin server on %s stopped, err=%+v\n", addr, err)
+		}
+	}()
+}
+
+// shardDetails is the audit detail of a pause or resume, "all" for the whole stream.
+func shardDetails(shard string) map[string]any {
+	if shard == "" {
+		shard = "all"
+	}
+	return map[string]any{"shard": shard}
+}
+
+func writeStatus(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pauses.status())
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"kinesis_consumer/consumer"
+)
+
+// PoisonConfig decides what happens to a record its handler keeps failing on.
+type PoisonConfig struct {
+	// MaxAttempts is how often the handler is tried before the record is skipped. Defaults to 1.
+	MaxAttempts int      `json:"max_attempts"`
+	Backoff     Duration `json:"backoff"`
+	// DLQPath, if set, gets every skipped record as a JSON line.
+	DLQPath        string            `json:"dlq_path"`
+	DLQCompression CompressionConfig `json:"dlq_compression"`
+	// AuditLog gets a JSON line per skipped record, stdout if empty.
+	AuditLog       string               `json:"audit_log"`
+	CircuitBreaker CircuitBreakerConfig `json:"circuit_breaker"`
+	// Retry puts records into a retry stream before skipping them, see RetryConfig.
+	Retry RetryConfig `json:"retry"`
+}
+
+var skippedRecords = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "skipped_records_total",
+	Help:      "Records skipped after the handler failed on them max_attempts times.",
+})
+
+// poisonPolicy retries a failing handler and then moves on, so one malformed record
+// can't stall a shard forever.
+type poisonPolicy struct {
+	cfg     PoisonConfig
+	mu      sync.Mutex
+	dlq     *os.File
+	audit   *os.File
+	breaker *circuitBreaker
+	// retry is nil without a retry stream
+	retry *retryPublisher
+}
+
+func newPoisonPolicy(cfg PoisonConfig) (*poisonPolicy, error) {
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = 1
+	}
+	pp := &poisonPolicy{cfg: cfg}
+
+	if err := cfg.DLQCompression.validate(); err != nil {
+		return nil, fmt.Errorf("invalid dlq_compression: %w", err)
+	}
+
+	var err error
+	if pp.breaker, err = newCircuitBreaker(cfg.CircuitBreaker, cfg.MaxAttempts); err != nil {
+		return nil, err
+	}
+	if cfg.DLQPath != "" {
+		if pp.dlq, err = os.OpenFile(cfg.DLQPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+			return nil, fmt.Errorf("failed to open dlq %s: %w", cfg.DLQPath, err)
+		}
+	}
+	if cfg.AuditLog != "" {
+		if pp.audit, err = os.OpenFile(cfg.AuditLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+			pp.close()
+			return nil, fmt.Errorf("failed to open audit log %s: %w", cfg.AuditLog, err)
+		}
+	}
+	return pp, nil
+}
+
+// handle calls h until it succeeds or runs out of attempts. It returns the last error
+// when the record was skipped, after writing it to the DLQ and the audit log, and nil when it
+// was put into the retry stream instead. The failure that opens the circuit breaker doesn't count
+// as an attempt, the record waits for the handler to recover.
+func (pp *poisonPolicy) handle(ctx context.Context, stream string, h consumer.HandlerFunc, r *consumer.Record) error {
+	var err error
+	for attempt := 1; attempt <= pp.cfg.MaxAttempts; attempt++ {
+		if err = pp.breaker.acquire(ctx); err != nil {
+			return err
+		}
+		err = h(ctx, r)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if pp.breaker.done(err) {
+			attempt--
+			continue
+		}
+		if err == nil {
+			return nil
+		}
+		if attempt < pp.cfg.MaxAttempts {
+			fmt.Printf("\thandler failed, attempt %d of %d, err=%+v\n", attempt, pp.cfg.MaxAttempts, err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-wallClock.After(pp.cfg.Backoff.Duration):
+			}
+		}
+	}
+	return pp.giveUp(ctx, stream, r, pp.cfg.MaxAttempts, err)
+}
+
+// giveUp moves on from r, which failed with err after attempts tries: into the retry stream if
+// there is one, which returns nil, otherwise r is skipped to the DLQ and the audit log and err
+// returned. A handler's failed acknowledgement (consumer.Async) ends up here too.
+func (pp *poisonPolicy) giveUp(ctx context.Context, stream string, r *consumer.Record, attempts int, err error) error {
+	if pp.retry != nil {
+		rerr := pp.retry.publish(ctx, stream, r)
+		if rerr == nil {
+			return nil
+		}
+		if !errors.Is(rerr, errRetriesExhausted) {
+			fmt.Printf("\tputting the record into the retry stream failed, err=%+v\n", rerr)
+		}
+	}
+
+	skippedRecords.Inc()
+	pp.skip(stream, r, attempts, err)
+	return err
+}
+
+// retain copies what giveUp needs of r once its handler returned: the data only when it goes
+// to a DLQ or retry stream, the audit log needs just the metadata.
+func (pp *poisonPolicy) retain(r *consumer.Record) *consumer.Record {
+	if pp.dlq != nil || pp.retry != nil {
+		return r.Retain()
+	}
+	c := *r
+	c.Data, c.Header = nil, maps.Clone(r.Header)
+	return &c
+}
+
+func (pp *poisonPolicy) skip(stream string, r *consumer.Record, attempts int, cause error) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	if pp.dlq != nil {
+		line, _ := json.Marshal(map[string]any{
+			"stream":          stream,
+			"shard":           r.ShardID,
+			"sequence_number": r.SequenceNumber,
+			"partition_key":   r.PartitionKey,
+			"arrival_time":    r.ArrivalTime,
+			"data":            r.Data, // base64
+		})
+		out, err := pp.cfg.DLQCompression.compress(append(line, '\n'))
+		if err == nil {
+			_, err = pp.dlq.Write(out)
+		}
+		if err != nil {
+			fmt.Printf("\twriting to the dlq failed, err=%+v\n", err)
+		}
+	}
+
+	entry, _ := json.Marshal(map[string]any{
+		"time":            wallClock.Now().UTC(),
+		"action":          "skip",
+		"stream":          stream,
+		"shard":           r.ShardID,
+		"sequence_number": r.SequenceNumber,
+		"partition_key":   r.PartitionKey,
+		"attempts":        attempts,
+		"error":           cause.Error(),
+		"dlq":             pp.dlq != nil,
+	})
+	if pp.audit != nil {
+		pp.audit.Write(append(entry, '\n'))
+	} else {
+		fmt.Println("\tskipped", string(entry))
+	}
+}
+
+func (pp *poisonPolicy) close() {
+	if pp.dlq != nil {
+		pp.dlq.Close()
+	}
+	if pp.audit != nil {
+		pp.audit.Close()
+	}
+}
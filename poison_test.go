@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"kinesis_consumer/consumer"
+)
+
+func TestFailedAcknowledgementGoesToDLQ(t *testing.T) {
+	dir := t.TempDir()
+	dlq := filepath.Join(dir, "dlq.jsonl")
+	pp, err := newPoisonPolicy(PoisonConfig{DLQPath: dlq, AuditLog: filepath.Join(dir, "audit.jsonl")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pp.close()
+
+	var ack func(error)
+	p := &pipeline{
+		cfg:    &Config{StreamName: "stream", Handler: "async"},
+		poison: pp,
+		handler: func(ctx context.Context, r *consumer.Record) error {
+			ack = consumer.Async(ctx)
+			return nil
+		},
+	}
+	data := []byte("payload")
+	r := &consumer.Record{ShardID: "shardId-000000000000", SequenceNumber: "1", Data: data}
+	done := make(chan struct{})
+	if err := p.handle(context.Background(), r, func() { close(done) }); err != nil {
+		t.Fatal(err)
+	}
+	// the consumer reuses the buffer once the handler returned
+	copy(data, "XXXXXXX")
+	ack(errors.New("write failed"))
+	<-done
+
+	line, err := os.ReadFile(dlq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "payload" in base64
+	if !strings.Contains(string(line), `"data":"cGF5bG9hZA=="`) {
+		t.Errorf("dlq got %s", line)
+	}
+}
+
+func TestPoisonRecordAsProbeIsSkipped(t *testing.T) {
+	pp, err := newPoisonPolicy(PoisonConfig{
+		MaxAttempts:    2,
+		AuditLog:       filepath.Join(t.TempDir(), "audit.jsonl"),
+		CircuitBreaker: CircuitBreakerConfig{Failures: 3, OpenFor: Duration{time.Millisecond}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pp.close()
+	// other records opened the breaker, this one goes through as the probe
+	pp.breaker.setState(breakerOpen)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	calls := 0
+	poison := func(context.Context, *consumer.Record) error {
+		calls++
+		return errors.New("malformed")
+	}
+	err = pp.handle(ctx, "stream", poison, &consumer.Record{ShardID: "shardId-000000000000", SequenceNumber: "1"})
+	if err == nil || ctx.Err() != nil {
+		t.Fatalf("got %v after %d calls, want the record skipped", err, calls)
+	}
+	if calls != 2 {
+		t.Errorf("handler called %d times, want max_attempts", calls)
+	}
+}
+
+func TestPoisonBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		want     bool
+	}{
+		{"succeeds after one retry", 1, true},
+		{"succeeds after two retries", 2, true},
+		{"gives up", 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeWallClock(t)
+			pp, err := newPoisonPolicy(PoisonConfig{MaxAttempts: 3, Backoff: Duration{time.Minute}, AuditLog: filepath.Join(t.TempDir(), "audit.jsonl")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pp.close()
+
+			calls := 0
+			handler := func(context.Context, *consumer.Record) error {
+				if calls++; calls <= tt.failures {
+					return errors.New("failed")
+				}
+				return nil
+			}
+			result := make(chan error, 1)
+			go func() {
+				result <- pp.handle(context.Background(), "stream", handler, &consumer.Record{ShardID: "shardId-000000000000", SequenceNumber: "1"})
+			}()
+			for range min(tt.failures, 2) {
+				// each retry waits for the backoff on the clock
+				waitForWaiters(t, fake, 1)
+				select {
+				case err := <-result:
+					t.Fatalf("returned %v during the backoff", err)
+				case <-time.After(10 * time.Millisecond):
+				}
+				fake.Advance(time.Minute)
+			}
+			select {
+			case err := <-result:
+				if (err == nil) != tt.want {
+					t.Errorf("got %v after %d calls", err, calls)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("still backing off")
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"kinesis_consumer/consumer"
+)
+
+// PostgresConfig is the handler_config of the "postgres" handler.
+//
+//	"handler": "postgres",
+//	"handler_config": {"dsn": "postgres://bridge@db/analytics", "table": "events",
+//		"columns": {"ts": "timestamp", "device": "device.id", "payload": "@data"}}
+type PostgresConfig struct {
+	// DSN is a lib/pq connection string or URL; the PG* environment variables fill in what it leaves out.
+	DSN string `json:"dsn"`
+	// Table is created, with the record's idempotency key, metadata and payload as columns, if it
+	// doesn't exist and there are no Columns; "records" when not set.
+	Table string `json:"table"`
+	// Columns maps each column of an existing table to a field of the JSON payload, like the
+	// clickhouse handler's.
+	Columns map[string]string `json:"columns"`
+	// CheckpointTable keeps how far each shard was written, "kinesis_checkpoints" when not set.
+	CheckpointTable string `json:"checkpoint_table"`
+	// Consumer names this consumer's rows in CheckpointTable, for consumers of different streams
+	// sharing it; "kinesis_consumer" when not set.
+	Consumer string `json:"consumer"`
+	// Flush is 1000 records, 16MB and 1s when not set; batches are written one at a time.
+	Flush FlushConfig `json:"flush"`
+}
+
+const postgresMaxBatchBytes = 16 << 20
+
+func init() {
+	consumer.RegisterHandlerFactory("postgres", newPostgresWriter)
+}
+
+// postgresWriter inserts records into a Postgres table in batches, each in one transaction that
+// also moves the shards' rows in the checkpoint table past it. A batch is either written with its
+// checkpoints or not at all, so after a crash the records the consumer's own checkpoint hadn't
+// caught up with are read again and dropped as already written, instead of being inserted twice.
+// That needs a shard's records handled in order (no handle.workers), and batches written one at a
+// time. Records are acknowledged like the pubsub handler's once their transaction committed.
+type postgresWriter struct {
+	cfg     PostgresConfig
+	db      *sql.DB
+	columns []string
+	insert  string
+	// committed is how far each shard (prefixed with "retry/" for the retry stream's) was
+	// written, loaded from the checkpoint table on first use; only send touches it
+	committed map[string]string
+	batch     *asyncBatcher
+}
+
+func newPostgresWriter(raw json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+	cfg := PostgresConfig{Table: "records", CheckpointTable: "kinesis_checkpoints", Consumer: "kinesis_consumer"}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("invalid postgres handler_config: %w", err)
+		}
+	}
+	if !plainIdentifier.MatchString(cfg.Table) || !plainIdentifier.MatchString(cfg.CheckpointTable) {
+		return nil, nil, fmt.Errorf("postgres table %q and checkpoint_table %q must be plain identifiers", cfg.Table, cfg.CheckpointTable)
+	}
+	for column := range cfg.Columns {
+		if !plainIdentifier.MatchString(column) {
+			return nil, nil, fmt.Errorf("postgres column %q is not a plain identifier", column)
+		}
+	}
+	// checkpoints chain batch after batch
+	if cfg.Flush.MaxInFlight > 1 {
+		return nil, nil, fmt.Errorf("the postgres handler writes one batch at a time, flush.max_in_flight can't be %d", cfg.Flush.MaxInFlight)
+	}
+
+	db, err := sql.Open("postgres", cfg.DSN)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid postgres dsn: %w", err)
+	}
+	w, err := newPostgresWriterDB(cfg, db)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return w.handle, w, nil
+}
+
+// newPostgresWriterDB creates the tables the handler needs in db.
+func newPostgresWriterDB(cfg PostgresConfig, db *sql.DB) (*postgresWriter, error) {
+	w := &postgresWriter{cfg: cfg, db: db, committed: make(map[string]string)}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+pq.QuoteIdentifier(cfg.CheckpointTable)+` (
+		consumer        TEXT NOT NULL,
+		shard           TEXT NOT NULL,
+		position        TEXT NOT NULL,
+		updated_at      TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (consumer, shard)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create postgres table %s: %w", cfg.CheckpointTable, err)
+	}
+
+	if len(cfg.Columns) == 0 {
+		w.columns = []string{"idempotency_key", "shard", "sequence_number", "partition_key", "arrival_time", "event_time", "data"}
+		_, err = db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+pq.QuoteIdentifier(cfg.Table)+` (
+			idempotency_key TEXT PRIMARY KEY,
+			shard           TEXT NOT NULL,
+			sequence_number TEXT NOT NULL,
+			partition_key   TEXT NOT NULL,
+			arrival_time    TIMESTAMPTZ NOT NULL,
+			event_time      TIMESTAMPTZ,
+			data            BYTEA NOT NULL
+		)`)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create postgres table %s: %w", cfg.Table, err)
+		}
+	} else {
+		for column := range cfg.Columns {
+			w.columns = append(w.columns, column)
+		}
+		slices.Sort(w.columns)
+	}
+	quoted := make([]string, len(w.columns))
+	params := make([]string, len(w.columns))
+	for i, column := range w.columns {
+		quoted[i], params[i] = pq.QuoteIdentifier(column), fmt.Sprintf("$%d", i+1)
+	}
+	w.insert = `INSERT INTO ` + pq.QuoteIdentifier(cfg.Table) + ` (` + strings.Join(quoted, ", ") + `) VALUES (` + strings.Join(params, ", ") + `)`
+	if len(cfg.Columns) == 0 {
+		// a record already in the table, e.g. after the checkpoint table was reset, is left as it is
+		w.insert += ` ON CONFLICT (idempotency_key) DO NOTHING`
+	}
+
+	w.batch = cfg.Flush.batcher("postgres", FlushConfig{MaxRecords: 1000, MaxLatency: Duration{time.Second}, MaxInFlight: 1},
+		0, postgresMaxBatchBytes, w.send)
+	return w, nil
+}
+
+// handle queues the record as its checkpoint shard and position, followed by its row as a JSON
+// array of values in column order.
+func (w *postgresWriter) handle(ctx context.Context, r *consumer.Record) error {
+	values, err := w.row(r)
+	if err != nil {
+		return err
+	}
+	row, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	shard := r.ShardID
+	if r.Header[retryHeaderCount] != "" {
+		// the retry stream's shards are named like the stream's own
+		shard = "retry/" + shard
+	}
+	item := appendField(nil, shard)
+	item = appendField(item, recordPosition(r))
+	return w.batch.add(ctx, append(item, row...))
+}
+
+// row returns the values of r's columns.
+func (w *postgresWriter) row(r *consumer.Record) ([]any, error) {
+	if len(w.cfg.Columns) == 0 {
+		var eventTime any
+		if !r.EventTime.IsZero() {
+			eventTime = r.EventTime.UTC().Format(time.RFC3339Nano)
+		}
+		return []any{r.IdempotencyKey(), r.ShardID, r.SequenceNumber, r.PartitionKey,
+			r.ArrivalTime.UTC().Format(time.RFC3339Nano), eventTime, r.Data}, nil
+	}
+	values, err := columnValues(r, w.cfg.Columns, time.RFC3339Nano)
+	if err != nil {
+		return nil, err
+	}
+	row := make([]any, len(w.columns))
+	for i, column := range w.columns {
+		row[i] = values[column]
+	}
+	return row, nil
+}
+
+// send inserts a batch and moves its shards' checkpoints in one transaction. Records at or before
+// a shard's checkpoint were written by an earlier transaction and are left out.
+func (w *postgresWriter) send(items [][]byte) error {
+	ctx := context.TODO()
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("postgres begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	insert, err := tx.PrepareContext(ctx, w.insert)
+	if err != nil {
+		return fmt.Errorf("postgres prepare: %w", err)
+	}
+	defer insert.Close()
+
+	last := make(map[string]string)
+	var shards []string
+	for _, item := range items {
+		shard, rest := cutField(item)
+		position, row := cutField(rest)
+		committed, err := w.checkpoint(ctx, tx, shard)
+		if err != nil {
+			return err
+		}
+		if committed != "" && !positionLess(committed, position) {
+			continue
+		}
+		if prev, ok := last[shard]; !ok {
+			shards = append(shards, shard)
+		} else if positionLess(position, prev) {
+			position = prev
+		}
+		last[shard] = position
+
+		args, err := postgresArgs(row, len(w.cfg.Columns) > 0)
+		if err != nil {
+			return err
+		}
+		if _, err := insert.ExecContext(ctx, args...); err != nil {
+			return fmt.Errorf("postgres insert into %s: %w", w.cfg.Table, err)
+		}
+	}
+
+	for _, shard := range shards {
+		_, err := tx.ExecContext(ctx, `INSERT INTO `+pq.QuoteIdentifier(w.cfg.CheckpointTable)+` (consumer, shard, position, updated_at)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (consumer, shard) DO UPDATE SET position = EXCLUDED.position, updated_at = EXCLUDED.updated_at`,
+			w.cfg.Consumer, shard, last[shard], wallClock.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("postgres checkpoint of %s: %w", shard, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("postgres commit: %w", err)
+	}
+	for _, shard := range shards {
+		w.committed[shard] = last[shard]
+	}
+	return nil
+}
+
+// checkpoint returns how far shard was written, "" if it never was.
+func (w *postgresWriter) checkpoint(ctx context.Context, tx *sql.Tx, shard string) (string, error) {
+	if position, ok := w.committed[shard]; ok {
+		return position, nil
+	}
+	var position string
+	err := tx.QueryRowContext(ctx, `SELECT position FROM `+pq.QuoteIdentifier(w.cfg.CheckpointTable)+` WHERE consumer = $1 AND shard = $2`,
+		w.cfg.Consumer, shard).Scan(&position)
+	if err != nil && err != sql.ErrNoRows {
+		return "", fmt.Errorf("postgres checkpoint of %s: %w", shard, err)
+	}
+	w.committed[shard] = position
+	return position, nil
+}
+
+// postgresArgs decodes a queued row into the insert's arguments. Mapped columns get numbers as
+// written and objects and arrays as JSON, for numeric and jsonb columns; the default table's data
+// is the raw payload.
+func postgresArgs(row []byte, mapped bool) ([]any, error) {
+	var values []any
+	dec := json.NewDecoder(bytes.NewReader(row))
+	dec.UseNumber()
+	if err := dec.Decode(&values); err != nil {
+		return nil, err
+	}
+	for i, v := range values {
+		switch v := v.(type) {
+		case json.Number:
+			values[i] = v.String()
+		case map[string]any, []any:
+			b, _ := json.Marshal(v)
+			values[i] = string(b)
+		case string:
+			if !mapped && i == len(values)-1 {
+				// the default table's data, base64 in the queued row
+				data, err := base64.StdEncoding.DecodeString(v)
+				if err != nil {
+					return nil, err
+				}
+				values[i] = data
+			}
+		}
+	}
+	return values, nil
+}
+
+// Close writes what is still pending.
+func (w *postgresWriter) Close() error {
+	w.batch.close()
+	return w.db.Close()
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"kinesis_consumer/consumer"
+)
+
+// fakePostgres is a database/sql driver that keeps what the postgres handler inserts, rows and
+// checkpoints, and applies a transaction's writes only when it commits.
+type fakePostgres struct {
+	mu          sync.Mutex
+	rows        [][]driver.Value
+	checkpoints map[string]string
+	// failCommit fails the next commit
+	failCommit bool
+}
+
+var (
+	fakePostgresOnce sync.Once
+	fakePostgresDBs  sync.Map
+)
+
+func openFakePostgres(t *testing.T, fake *fakePostgres) *sql.DB {
+	fakePostgresOnce.Do(func() { sql.Register("fakepostgres", fakePostgresDriver{}) })
+	fakePostgresDBs.Store(t.Name(), fake)
+	db, err := sql.Open("fakepostgres", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+type fakePostgresDriver struct{}
+
+func (fakePostgresDriver) Open(name string) (driver.Conn, error) {
+	fake, _ := fakePostgresDBs.Load(name)
+	return &fakePostgresConn{db: fake.(*fakePostgres)}, nil
+}
+
+type fakePostgresConn struct {
+	db *fakePostgres
+	// pending are the writes of the open transaction
+	pending []func()
+	inTx    bool
+}
+
+func (c *fakePostgresConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakePostgresStmt{c: c, query: query}, nil
+}
+func (c *fakePostgresConn) Close() error { return nil }
+func (c *fakePostgresConn) Begin() (driver.Tx, error) {
+	c.inTx, c.pending = true, nil
+	return c, nil
+}
+
+func (c *fakePostgresConn) Commit() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.inTx = false
+	if c.db.failCommit {
+		c.db.failCommit = false
+		return errors.New("connection reset")
+	}
+	for _, write := range c.pending {
+		write()
+	}
+	return nil
+}
+
+func (c *fakePostgresConn) Rollback() error {
+	c.inTx, c.pending = false, nil
+	return nil
+}
+
+type fakePostgresStmt struct {
+	c     *fakePostgresConn
+	query string
+}
+
+func (s *fakePostgresStmt) Close() error  { return nil }
+func (s *fakePostgresStmt) NumInput() int { return -1 }
+
+func (s *fakePostgresStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db := s.c.db
+	var write func()
+	switch {
+	case strings.HasPrefix(s.query, "CREATE TABLE"):
+		return driver.ResultNoRows, nil
+	case strings.HasPrefix(s.query, `INSERT INTO "kinesis_checkpoints"`):
+		write = func() { db.checkpoints[args[0].(string)+" "+args[1].(string)] = args[2].(string) }
+	case strings.HasPrefix(s.query, "INSERT INTO"):
+		write = func() { db.rows = append(db.rows, args) }
+	default:
+		return nil, fmt.Errorf("unexpected exec %s", s.query)
+	}
+	if s.c.inTx {
+		s.c.pending = append(s.c.pending, write)
+	} else {
+		db.mu.Lock()
+		write()
+		db.mu.Unlock()
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakePostgresStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if !strings.HasPrefix(s.query, "SELECT position") {
+		return nil, fmt.Errorf("unexpected query %s", s.query)
+	}
+	s.c.db.mu.Lock()
+	defer s.c.db.mu.Unlock()
+	position, ok := s.c.db.checkpoints[args[0].(string)+" "+args[1].(string)]
+	return &fakePostgresRows{position: position, done: !ok}, nil
+}
+
+type fakePostgresRows struct {
+	position string
+	done     bool
+}
+
+func (r *fakePostgresRows) Columns() []string { return []string{"position"} }
+func (r *fakePostgresRows) Close() error      { return nil }
+func (r *fakePostgresRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	dest[0], r.done = r.position, true
+	return nil
+}
+
+func TestPostgresWriter(t *testing.T) {
+	fake := &fakePostgres{checkpoints: make(map[string]string)}
+	cfg := PostgresConfig{Table: "records", CheckpointTable: "kinesis_checkpoints", Consumer: "orders", Flush: FlushConfig{MaxRecords: 5}}
+
+	// write sends records first..last to a new writer, as a consumer started after a crash
+	write := func(first, last int) []error {
+		t.Helper()
+		w, err := newPostgresWriterDB(cfg, openFakePostgres(t, fake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		acked := make(chan error, last-first+1)
+		for i := first; i <= last; i++ {
+			ctx, _ := consumer.NewAsyncContext(context.Background(), func(err error) { acked <- err })
+			r := &consumer.Record{ShardID: "shardId-000000000000", SequenceNumber: fmt.Sprint(i), PartitionKey: "k", Data: []byte(fmt.Sprintf(`{"n":%d}`, i))}
+			if err := w.handle(ctx, r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		w.Close()
+		var errs []error
+		for i := first; i <= last; i++ {
+			errs = append(errs, <-acked)
+		}
+		return errs
+	}
+	check := func(rows int, checkpoint string) {
+		t.Helper()
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		if len(fake.rows) != rows || fake.checkpoints["orders shardId-000000000000"] != checkpoint {
+			t.Fatalf("got %d rows and checkpoint %q, want %d and %q", len(fake.rows), fake.checkpoints["orders shardId-000000000000"], rows, checkpoint)
+		}
+		seen := make(map[string]bool)
+		for _, row := range fake.rows {
+			if key := row[0].(string); seen[key] {
+				t.Fatalf("%s inserted twice", key)
+			} else {
+				seen[key] = true
+			}
+		}
+	}
+
+	write(0, 4)
+	check(5, "4")
+	if data := fake.rows[4][6]; string(data.([]byte)) != `{"n":4}` {
+		t.Errorf("got data %q", data)
+	}
+
+	// the consumer's checkpoint was at 1: 2..4 come again and are left out
+	write(2, 7)
+	check(8, "7")
+
+	// a commit that fails writes neither the rows nor the checkpoint
+	fake.failCommit = true
+	for _, err := range write(8, 9) {
+		if err == nil {
+			t.Fatal("record acked although its commit failed")
+		}
+	}
+	check(8, "7")
+	write(8, 9)
+	check(10, "9")
+}
+
+func TestPostgresArgs(t *testing.T) {
+	r := &consumer.Record{ShardID: "shardId-000000000000", SequenceNumber: "1",
+		Data: []byte(`{"id": 12345678901234567890, "tags": ["a"], "device": {"id": "d-1"}}`)}
+	w := &postgresWriter{cfg: PostgresConfig{Columns: map[string]string{"id": "id", "tags": "tags", "device": "device.id", "shard": "@shard"}},
+		columns: []string{"device", "id", "shard", "tags"}}
+	values, err := w.row(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	row, _ := json.Marshal(values)
+	args, err := postgresArgs(row, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []any{"d-1", "12345678901234567890", "shardId-000000000000", `["a"]`}
+	if fmt.Sprint(args) != fmt.Sprint(want) {
+		t.Errorf("got args %v, want %v", args, want)
+	}
+}
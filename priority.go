@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// PriorityConfig puts shards in priority classes: while a shard of a higher class is catching up,
+// the shards of lower classes slow down, so that after an outage e.g. billing events are read
+// ahead of telemetry. Only applies with shard_id "*".
+//
+//	"priority": {"classes": [
+//		{"name": "billing", "priority": 10, "partition_keys": ["billing"]},
+//		{"name": "telemetry", "priority": -1, "shards": ["shardId-000000000004"]}]}
+type PriorityConfig struct {
+	Classes []PriorityClass `json:"classes"`
+	// CatchUpLag is how far behind a shard has to be to count as catching up, 1m when not set.
+	CatchUpLag Duration `json:"catch_up_lag"`
+	// Delay is how long a lower priority shard waits before each read meanwhile, 1s when not set.
+	Delay Duration `json:"delay"`
+}
+
+// PriorityClass matches shards by id, by the hash keys they cover or by the partition keys whose
+// records they get; the first class that matches wins. Shards no class matches have priority 0.
+type PriorityClass struct {
+	Name     string   `json:"name"`
+	Priority int      `json:"priority"`
+	Shards   []string `json:"shards"`
+	// HashKeyRanges are "start-end" decimal hash keys, a shard overlapping one is in the class.
+	HashKeyRanges []string `json:"hash_key_ranges"`
+	// PartitionKeys match the shard each key hashes to, also after a reshard.
+	PartitionKeys []string `json:"partition_keys"`
+}
+
+var shardYielding = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "shard_yielding",
+	Help:      "1 while a shard slows down for a higher priority shard that is catching up.",
+}, []string{"shard"})
+
+type hashKeyRange struct{ start, end *big.Int }
+
+func (r hashKeyRange) overlaps(o hashKeyRange) bool {
+	return r.start.Cmp(o.end) <= 0 && o.start.Cmp(r.end) <= 0
+}
+
+type shardPriority struct {
+	class    string
+	priority int
+	yielding bool
+}
+
+// shardPriorities knows the priority of every shard being read.
+type shardPriorities struct {
+	mu     sync.Mutex
+	cfg    PriorityConfig
+	ranges [][]hashKeyRange // per class
+	shards map[string]*shardPriority
+}
+
+var priorities = &shardPriorities{}
+
+func (sp *shardPriorities) configure(cfg *Config) error {
+	pc := cfg.Priority
+	if pc.CatchUpLag.Duration <= 0 {
+		pc.CatchUpLag.Duration = time.Minute
+	}
+	if pc.Delay.Duration <= 0 {
+		pc.Delay.Duration = time.Second
+	}
+	ranges := make([][]hashKeyRange, len(pc.Classes))
+	for i, c := range pc.Classes {
+		for _, s := range c.HashKeyRanges {
+			from, to, _ := strings.Cut(s, "-")
+			start, ok1 := new(big.Int).SetString(strings.TrimSpace(from), 10)
+			end, ok2 := new(big.Int).SetString(strings.TrimSpace(to), 10)
+			if !ok1 || !ok2 || start.Cmp(end) > 0 {
+				return fmt.Errorf("priority class %s: invalid hash key range %q, want start-end", c.Name, s)
+			}
+			ranges[i] = append(ranges[i], hashKeyRange{start, end})
+		}
+		for _, key := range c.PartitionKeys {
+			hash := partitionKeyHash(key)
+			ranges[i] = append(ranges[i], hashKeyRange{hash, hash})
+		}
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.cfg, sp.ranges = pc, ranges
+	sp.shards = make(map[string]*shardPriority)
+	return nil
+}
+
+// assign gives a shard that starts being read its priority.
+func (sp *shardPriorities) assign(shard types.Shard) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if len(sp.cfg.Classes) == 0 {
+		return
+	}
+	id := aws.ToString(shard.ShardId)
+	var keys *hashKeyRange
+	if shard.HashKeyRange != nil {
+		start, ok1 := new(big.Int).SetString(aws.ToString(shard.HashKeyRange.StartingHashKey), 10)
+		end, ok2 := new(big.Int).SetString(aws.ToString(shard.HashKeyRange.EndingHashKey), 10)
+		if ok1 && ok2 {
+			keys = &hashKeyRange{start, end}
+		}
+	}
+
+	p := &shardPriority{}
+	for i, c := range sp.cfg.Classes {
+		match := false
+		for _, s := range c.Shards {
+			match = match || s == id
+		}
+		for _, r := range sp.ranges[i] {
+			match = match || keys != nil && keys.overlaps(r)
+		}
+		if match {
+			p.class, p.priority = c.Name, c.Priority
+			fmt.Println(id, "is in priority class", c.Name)
+			break
+		}
+	}
+	sp.shards[id] = p
+}
+
+// done forgets a shard that isn't read anymore.
+func (sp *shardPriorities) done(shardID string) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	delete(sp.shards, shardID)
+	shardYielding.DeleteLabelValues(shardID)
+}
+
+// wait slows shardID down before a read while a shard of a higher priority is catching up.
+func (sp *shardPriorities) wait(ctx context.Context, shardID string) {
+	sp.mu.Lock()
+	self := sp.shards[shardID]
+	if self == nil {
+		sp.mu.Unlock()
+		return
+	}
+	ahead := ""
+	for id, p := range sp.shards {
+		if p.priority <= self.priority {
+			continue
+		}
+		if lag, ok := shardLag.Load(id); ok && lag.(time.Duration) > sp.cfg.CatchUpLag.Duration {
+			ahead = id
+			break
+		}
+	}
+	yielded := self.yielding
+	self.yielding = ahead != ""
+	delay := sp.cfg.Delay.Duration
+	sp.mu.Unlock()
+
+	switch {
+	case ahead != "" && !yielded:
+		fmt.Println(shardID, "slows down while", ahead, "of a higher priority catches up")
+		shardYielding.WithLabelValues(shardID).Set(1)
+	case ahead == "" && yielded:
+		fmt.Println(shardID, "back to full speed")
+		shardYielding.WithLabelValues(shardID).Set(0)
+	}
+	if ahead == "" {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-clock.After(delay):
+	}
+}
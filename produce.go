@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/klauspost/compress/zstd"
+)
+
+// PutRecords takes at most 500 records per call.
+const putRecordsBatch = 500
+
+// runProduce is the "produce" command. It puts every line of stdin as one record, compressed with
+// -codec and followed by the 16 byte MD5 footer the consumer expects by default, so what it
+// writes reads back with the default config.
+func runProduce(configPath string, args []string) {
+	fs := flag.NewFlagSet("produce", flag.ExitOnError)
+	partitionKey := fs.String("partition-key", "", "partition key of every record, a line number by default")
+	codec := fs.String("codec", "zstd", "zstd, gzip or none")
+	fs.Parse(args)
+
+	var encode func([]byte) []byte
+	switch *codec {
+	case "zstd":
+		enc, _ := zstd.NewWriter(nil)
+		encode = func(b []byte) []byte { return enc.EncodeAll(b, nil) }
+	case "gzip":
+		encode = func(b []byte) []byte {
+			var buf bytes.Buffer
+			w := gzip.NewWriter(&buf)
+			w.Write(b)
+			w.Close()
+			return buf.Bytes()
+		}
+	case "none":
+		encode = func(b []byte) []byte { return append([]byte(nil), b...) }
+	default:
+		fatalf("codec %q is not one of zstd, gzip or none", *codec)
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	ctx := context.Background()
+	awsCfg, err := loadAWSConfig(ctx, cfg)
+	if err != nil {
+		fatalf("unable to load SDK config, %v", err)
+	}
+	client := kinesis.NewFromConfig(awsCfg)
+	name, streamARN := cfg.streamRef()
+
+	var batch []types.PutRecordsRequestEntry
+	put, failed := 0, 0
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		resp, err := client.PutRecords(ctx, &kinesis.PutRecordsInput{StreamName: name, StreamARN: streamARN, Records: batch})
+		if err != nil {
+			fatalf("PutRecords failed after %d records: %v", put, err)
+		}
+		failedInBatch := int(aws.ToInt32(resp.FailedRecordCount))
+		put += len(batch) - failedInBatch
+		failed += failedInBatch
+		batch = batch[:0]
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(nil, 1<<20) // Kinesis records are at most 1 MiB
+	for line := 1; scanner.Scan(); line++ {
+		data := encode(scanner.Bytes())
+		sum := md5.Sum(data)
+		key := *partitionKey
+		if key == "" {
+			key = fmt.Sprint(line)
+		}
+		batch = append(batch, types.PutRecordsRequestEntry{Data: append(data, sum[:]...), PartitionKey: aws.String(key)})
+		if len(batch) == putRecordsBatch {
+			flush()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fatalf("reading stdin failed: %v", err)
+	}
+	flush()
+
+	fmt.Printf("put %d record(s) to %s", put, cfg.StreamName)
+	if failed > 0 {
+		fmt.Printf(", %d failed (throttled or internal errors)\n", failed)
+		os.Exit(1)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"kinesis_consumer/consumer"
+)
+
+// ProtobufConfig is the handler_config of the "protobuf" handler.
+//
+//	"handler": "protobuf",
+//	"handler_config": {"path": "records.pb"}
+type ProtobufConfig struct {
+	// Path gets the records, required since stdout has the consumer's log on it.
+	Path string `json:"path"`
+}
+
+func init() {
+	consumer.RegisterHandlerFactory("protobuf", newProtobufWriter)
+}
+
+// protobufWriter writes records as length-delimited Record messages, see record.proto, for compact
+// archival and consumers that want them typed. Data is the decoded payload, what the handler sees.
+type protobufWriter struct {
+	mu   sync.Mutex
+	file *os.File
+	out  *bufio.Writer
+	buf  []byte
+}
+
+func newProtobufWriter(raw json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+	var cfg ProtobufConfig
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("invalid protobuf handler_config: %w", err)
+		}
+	}
+	if cfg.Path == "" {
+		return nil, nil, fmt.Errorf("the protobuf handler needs a path")
+	}
+
+	f, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open %s: %w", cfg.Path, err)
+	}
+	w := &protobufWriter{file: f, out: bufio.NewWriter(f)}
+	return w.handle, w, nil
+}
+
+func (w *protobufWriter) handle(_ context.Context, r *consumer.Record) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = marshalRecord(w.buf[:0], r)
+	w.out.Write(protowire.AppendVarint(nil, uint64(len(w.buf))))
+	w.out.Write(w.buf)
+	// a whole message per write, so a crash can't leave half of one in the file
+	return w.out.Flush()
+}
+
+// marshalRecord appends r encoded as a kinesis_consumer.Record message to b.
+func marshalRecord(b []byte, r *consumer.Record) []byte {
+	appendString := func(b []byte, num protowire.Number, s string) []byte {
+		if s == "" {
+			return b
+		}
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		return protowire.AppendString(b, s)
+	}
+	appendInt := func(b []byte, num protowire.Number, v int64) []byte {
+		if v == 0 {
+			return b
+		}
+		b = protowire.AppendTag(b, num, protowire.VarintType)
+		return protowire.AppendVarint(b, uint64(v))
+	}
+
+	b = appendString(b, 1, r.ShardID)
+	b = appendString(b, 2, r.SequenceNumber)
+	b = appendString(b, 3, r.PartitionKey)
+	b = appendInt(b, 4, r.ArrivalTime.UnixMilli())
+	if !r.EventTime.IsZero() {
+		b = appendInt(b, 5, r.EventTime.UnixMilli())
+	}
+	b = appendString(b, 6, r.EncryptionType)
+	b = appendInt(b, 7, int64(r.Size))
+
+	// map entries are messages with the key as field 1 and the value as field 2
+	keys := make([]string, 0, len(r.Header))
+	for k := range r.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry []byte
+		entry = appendString(entry, 1, k)
+		entry = appendString(entry, 2, r.Header[k])
+		b = protowire.AppendTag(b, 8, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+
+	if len(r.Data) > 0 {
+		b = protowire.AppendTag(b, 9, protowire.BytesType)
+		b = protowire.AppendBytes(b, r.Data)
+	}
+	return b
+}
+
+func (w *protobufWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.out.Flush()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	"kinesis_consumer/consumer"
+)
+
+// PubSubConfig is the handler_config of the "pubsub" handler.
+//
+//	"handler": "pubsub",
+//	"handler_config": {"project": "analytics", "topic": "orders-mirror", "ordering_key": true}
+type PubSubConfig struct {
+	Project string `json:"project"`
+	Topic   string `json:"topic"`
+	// OrderingKey sends the partition key as ordering key, for subscriptions with ordering enabled.
+	OrderingKey bool `json:"ordering_key"`
+	// Endpoint is https://pubsub.googleapis.com when not set; an http:// one, or
+	// PUBSUB_EMULATOR_HOST, is taken to be the emulator and called without credentials.
+	Endpoint string `json:"endpoint"`
+	// Flush is 100 records, at most 1000, and 50ms when not set.
+	Flush FlushConfig `json:"flush"`
+	legacyFlush
+}
+
+// pubsubMaxRequestBytes stays under the 10MB a publish request may carry.
+const pubsubMaxRequestBytes = 9 << 20
+
+func init() {
+	consumer.RegisterHandlerFactory("pubsub", newPubSubPublisher)
+}
+
+type pubsubMessage struct {
+	Data        []byte            `json:"data"` // base64
+	Attributes  map[string]string `json:"attributes"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
+}
+
+// pubsubPublisher mirrors records into a Google Cloud Pub/Sub topic through the REST API, with the
+// record's metadata as attributes. Records are batched and acknowledged with consumer.Async once
+// their publish call returned, records of a failed call with its error, so a shard is only
+// checkpointed past records Pub/Sub has taken or the poison policy has moved on from.
+type pubsubPublisher struct {
+	cfg    PubSubConfig
+	url    string
+	client *http.Client
+	batch  *asyncBatcher
+}
+
+func newPubSubPublisher(raw json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+	var cfg PubSubConfig
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("invalid pubsub handler_config: %w", err)
+		}
+	}
+	if cfg.Project == "" || cfg.Topic == "" {
+		return nil, nil, fmt.Errorf("the pubsub handler needs a project and a topic")
+	}
+	if host := os.Getenv("PUBSUB_EMULATOR_HOST"); cfg.Endpoint == "" && host != "" {
+		cfg.Endpoint = "http://" + host
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://pubsub.googleapis.com"
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	if !strings.HasPrefix(cfg.Endpoint, "http://") {
+		ts, err := google.DefaultTokenSource(context.Background(), "https://www.googleapis.com/auth/pubsub")
+		if err != nil {
+			return nil, nil, fmt.Errorf("no Google credentials for pubsub: %w", err)
+		}
+		client.Transport = &oauth2.Transport{Source: ts}
+	}
+
+	p := &pubsubPublisher{
+		cfg:    cfg,
+		url:    fmt.Sprintf("%s/v1/projects/%s/topics/%s:publish", strings.TrimSuffix(cfg.Endpoint, "/"), cfg.Project, cfg.Topic),
+		client: client,
+	}
+	p.batch = cfg.flush("pubsub", cfg.Flush).batcher("pubsub", FlushConfig{MaxRecords: 100, MaxLatency: Duration{50 * time.Millisecond}},
+		1000, pubsubMaxRequestBytes, p.publish)
+	return p.handle, p, nil
+}
+
+func (p *pubsubPublisher) handle(ctx context.Context, r *consumer.Record) error {
+	m := pubsubMessage{
+		Data: r.Data,
+		Attributes: map[string]string{
+			"kinesis_shard_id":        r.ShardID,
+			"kinesis_sequence_number": r.SequenceNumber,
+			"kinesis_partition_key":   r.PartitionKey,
+			"kinesis_arrival_time":    r.ArrivalTime.UTC().Format(time.RFC3339Nano),
+			"idempotency_key":         r.IdempotencyKey(),
+		},
+	}
+	if p.cfg.OrderingKey {
+		m.OrderingKey = r.PartitionKey
+	}
+	item, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return p.batch.add(ctx, item)
+}
+
+// publish sends JSON encoded pubsubMessages in one publish call.
+func (p *pubsubPublisher) publish(messages [][]byte) error {
+	body := append([]byte(`{"messages":[`), bytes.Join(messages, []byte(","))...)
+	body = append(body, "]}"...)
+	resp, err := p.client.Post(p.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("pubsub publish returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// Close publishes what is still pending.
+func (p *pubsubPublisher) Close() error {
+	p.batch.close()
+	return nil
+}
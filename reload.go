@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const configPollInterval = 2 * time.Second
+
+// watchConfig rebuilds the pipeline whenever the config file changes or the process gets a SIGHUP
+// (not on Windows), and swaps it in between batches.
+// Only what reloadable lists is picked up, everything else needs a restart.
+func watchConfig(path string, current *Config, pipes *pipelineRef) {
+	if path == "" {
+		return
+	}
+
+	hup := make(chan os.Signal, 1)
+	if len(reloadSignals) > 0 {
+		// Notify without signals would relay all of them
+		signal.Notify(hup, reloadSignals...)
+	}
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	lastMod := modTime(path)
+	for {
+		select {
+		case <-hup:
+			fmt.Println("SIGHUP received, reloading", path)
+		case <-ticker.C:
+			mod := modTime(path)
+			if mod.Equal(lastMod) {
+				continue
+			}
+			lastMod = mod
+			fmt.Println("config file changed, reloading", path)
+		}
+
+		cfg, err := loadConfig(path)
+		if err != nil {
+			fmt.Printf("config reload failed, keeping the current config, err=%+v\n", err)
+			continue
+		}
+		cfg, allApplied := reloadable(cfg, current)
+		if !allApplied {
+			fmt.Println("some of the changed settings only take effect on restart, ignoring them")
+		}
+
+		p, err := newPipeline(cfg)
+		if err != nil {
+			fmt.Printf("config reload failed, keeping the current config, err=%+v\n", err)
+			continue
+		}
+		pipes.swap(p)
+		fmt.Println("config reloaded")
+		current = cfg
+	}
+}
+
+// pipelineRef is the pipeline shared by all shards. Each batch takes the current one and holds on
+// to it until it's done, without a lock, so a reload swaps the pipeline right away and closes the
+// old one once the last batch using it has released it, and the last record a handler
+// acknowledges asynchronously has been acked.
+type pipelineRef struct {
+	mu sync.Mutex
+	p  *pipeline
+	// users counts the batches and pending acks holding each pipeline, the current one and those
+	// swapped out
+	users map[*pipeline]int
+	// retiring counts the swapped out pipelines being closed
+	retiring sync.WaitGroup
+	closed   bool
+}
+
+func newPipelineRef(p *pipeline) *pipelineRef {
+	r := &pipelineRef{p: p, users: make(map[*pipeline]int)}
+	p.ref = r
+	return r
+}
+
+func (r *pipelineRef) acquire() *pipeline {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.users[r.p]++
+	return r.p
+}
+
+// hold keeps p, which is in use, from being closed until it's released once more. Pipelines
+// built outside a pipelineRef aren't counted.
+func (r *pipelineRef) hold(p *pipeline) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.users[p]++
+}
+
+// release gives back p, which acquire returned or hold kept.
+func (r *pipelineRef) release(p *pipeline) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.users[p]--
+	if r.users[p] > 0 {
+		return
+	}
+	delete(r.users, p)
+	if p != r.p && !r.closed {
+		r.retire(p)
+	}
+}
+
+// retire closes the swapped out p in the background: the last release can come from an ack, in
+// the handler's own goroutine, which closing the handler waits for. r.mu must be held.
+func (r *pipelineRef) retire(p *pipeline) {
+	r.retiring.Add(1)
+	go func() {
+		defer r.retiring.Done()
+		p.close()
+	}()
+}
+
+// config returns the current config, for the settings that don't change on reload.
+func (r *pipelineRef) config() *Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.p.cfg
+}
+
+func (r *pipelineRef) swap(p *pipeline) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p.ref = r
+	old := r.p
+	r.p = p
+	if r.users[old] == 0 && !r.closed {
+		r.retire(old)
+	}
+}
+
+// close closes the current pipeline and the swapped out ones still in use, whose pending acks are
+// sent or interrupted by then, and waits for those already retiring.
+func (r *pipelineRef) close() {
+	r.mu.Lock()
+	r.closed = true
+	open := []*pipeline{r.p}
+	for p := range r.users {
+		if p != r.p {
+			open = append(open, p)
+		}
+	}
+	r.mu.Unlock()
+	for _, p := range open {
+		p.close()
+	}
+	r.retiring.Wait()
+}
+
+func modTime(path string) time.Time {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// reloadable takes the settings that can change at runtime from cfg and the rest from current.
+// allApplied is false when cfg also changed something that needs a restart.
+func reloadable(cfg, current *Config) (next *Config, allApplied bool) {
+	n := *current
+	n.Transform, n.WasmModule, n.Handler, n.HandlerConfig = cfg.Transform, cfg.WasmModule, cfg.Handler, cfg.HandlerConfig
+	n.Poison, n.Enrich, n.EventTime = cfg.Poison, cfg.Enrich, cfg.EventTime
+	return &n, reflect.DeepEqual(&n, cfg)
+}
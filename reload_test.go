@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"kinesis_consumer/consumer"
+)
+
+type closeFunc func() error
+
+func (f closeFunc) Close() error { return f() }
+
+func TestSwapKeepsPipelineWithPendingAcks(t *testing.T) {
+	newBatching := func(sent chan struct{}, closed chan struct{}) *pipeline {
+		pp, err := newPoisonPolicy(PoisonConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := &asyncBatcher{name: "test", maxItems: 1, maxBytes: 1 << 20, linger: time.Hour,
+			send: func([][]byte) error { <-sent; return nil }}
+		return &pipeline{
+			cfg:    &Config{StreamName: "stream", Handler: "batching"},
+			poison: pp,
+			handler: func(ctx context.Context, r *consumer.Record) error {
+				return b.add(ctx, append([]byte{}, r.Data...))
+			},
+			closer: closeFunc(func() error { b.close(); close(closed); return nil }),
+		}
+	}
+
+	sent, closed := make(chan struct{}), make(chan struct{})
+	pipes := newPipelineRef(newBatching(sent, closed))
+	acked := make(chan struct{})
+	p := pipes.acquire()
+	if err := p.handle(context.Background(), &consumer.Record{ShardID: "shardId-000000000000", SequenceNumber: "1", Data: []byte("x")},
+		func() { close(acked) }); err != nil {
+		t.Fatal(err)
+	}
+	pipes.release(p)
+
+	next := newBatching(make(chan struct{}), make(chan struct{}))
+	pipes.swap(next)
+	select {
+	case <-closed:
+		t.Fatal("pipeline closed while its batch was still sending")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(sent)
+	<-acked
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("pipeline not closed once its last record was acked")
+	}
+	pipes.close()
+}
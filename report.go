@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"kinesis_consumer/consumer"
+)
+
+// shutdownReport is what -report writes on exit, so a replay can be audited afterwards.
+type shutdownReport struct {
+	Stream      string                            `json:"stream"`
+	Started     time.Time                         `json:"started"`
+	Finished    time.Time                         `json:"finished"`
+	Elapsed     string                            `json:"elapsed"`
+	Records     int64                             `json:"records"`
+	ByShard     map[string]int64                  `json:"by_shard"`
+	ByCodec     map[string]codecReport            `json:"by_codec"`
+	Handlers    map[string]consumer.HandlerCounts `json:"handlers"`
+	Errors      errorReport                       `json:"errors"`
+	Checkpoints map[string]string                 `json:"checkpoints"`
+}
+
+type codecReport struct {
+	Records           int64 `json:"records"`
+	CompressedBytes   int64 `json:"compressed_bytes"`
+	DecompressedBytes int64 `json:"decompressed_bytes"`
+}
+
+type errorReport struct {
+	HandlerFailures int64 `json:"handler_failures"`
+	Skipped         int64 `json:"skipped"`
+	DecodeFailures  int64 `json:"decode_failures"`
+	CodecMismatches int64 `json:"codec_mismatches"`
+}
+
+// writeReport writes the shutdown report to path, or stdout for "-". Checkpoints are the ones
+// stored for cfg's stream when the consumer stopped, none without a store.
+func writeReport(path string, cfg *Config, store checkpointStore, started time.Time) error {
+	snap := stats.Snapshot()
+	finished := time.Now()
+	r := shutdownReport{
+		Stream:      cfg.StreamName,
+		Started:     started.UTC(),
+		Finished:    finished.UTC(),
+		Elapsed:     finished.Sub(started).Round(time.Millisecond).String(),
+		Records:     snap.Records,
+		ByShard:     snap.ByShard,
+		ByCodec:     make(map[string]codecReport),
+		Handlers:    snap.ByHandler,
+		Checkpoints: make(map[string]string),
+		Errors: errorReport{
+			Skipped:         counterTotal(skippedRecords),
+			DecodeFailures:  counterTotal(decodeFailures),
+			CodecMismatches: counterTotal(codecMismatches),
+		},
+	}
+	for _, h := range snap.ByHandler {
+		r.Errors.HandlerFailures += h.Failed
+	}
+
+	recordSizes.mu.Lock()
+	for codec, c := range recordSizes.byCodec {
+		r.ByCodec[codec] = codecReport{Records: c.records, CompressedBytes: c.compressed, DecompressedBytes: c.decompressed}
+	}
+	recordSizes.mu.Unlock()
+
+	if store != nil {
+		checkpoints, err := store.List()
+		if err != nil {
+			return fmt.Errorf("listing checkpoints for the report failed: %w", err)
+		}
+		for _, c := range checkpoints {
+			if c.Stream == cfg.StreamName {
+				r.Checkpoints[c.Shard] = c.SequenceNumber
+			}
+		}
+	}
+
+	out, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	out = append(out, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+	return os.WriteFile(path, out, 0644)
+}
+
+// counterTotal adds up every series of a counter or counter vec.
+func counterTotal(c prometheus.Collector) int64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	var total float64
+	for m := range ch {
+		var d dto.Metric
+		if m.Write(&d) == nil {
+			total += d.GetCounter().GetValue()
+		}
+	}
+	return int64(total)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// RetentionAlertConfig warns before a lagging shard falls off the trim horizon: once a shard is
+// further behind than the stream keeps data, the records it hasn't read yet are gone.
+type RetentionAlertConfig struct {
+	// Threshold is the fraction of the retention period a shard may lag before it's alerted on. Defaults to 0.5.
+	Threshold float64 `json:"threshold"`
+	// SNSTopicARN also gets a message when a shard crosses the threshold and when it recovers.
+	SNSTopicARN string `json:"sns_topic_arn"`
+}
+
+const retentionCheckInterval = time.Minute
+
+var (
+	retentionHeadroom = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "retention_headroom_seconds",
+		Help:      "How long a shard can keep lagging as much as it does before unread records are trimmed.",
+	}, []string{"shard"})
+	shardsAtRisk = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "shards_near_retention",
+		Help:      "Shards lagging more than retention_alert.threshold of the retention period.",
+	})
+)
+
+// watchRetention compares every shard's lag with the stream's retention period every minute
+// until ctx is done, and alerts when a shard crosses the threshold and again when it recovers.
+func watchRetention(ctx context.Context, client *kinesis.Client, snsClient *sns.Client, cfg *Config) {
+	rc := cfg.RetentionAlert
+	if rc.Threshold <= 0 || rc.Threshold > 1 {
+		rc.Threshold = 0.5
+	}
+	name, streamARN := cfg.streamRef()
+
+	atRisk := make(map[string]bool)
+	ticker := time.NewTicker(retentionCheckInterval)
+	defer ticker.Stop()
+	for {
+		summary, err := client.DescribeStreamSummary(ctx, &kinesis.DescribeStreamSummaryInput{
+			StreamName: name,
+			StreamARN:  streamARN,
+		})
+		if err != nil && ctx.Err() == nil {
+			fmt.Printf("DescribeStreamSummary failed, retention headroom not checked, err=%+v\n", err)
+		} else if err == nil {
+			retention := time.Duration(aws.ToInt32(summary.StreamDescriptionSummary.RetentionPeriodHours)) * time.Hour
+			limit := time.Duration(float64(retention) * rc.Threshold)
+
+			shardLag.Range(func(k, v any) bool {
+				shard, lag := k.(string), v.(time.Duration)
+				retentionHeadroom.WithLabelValues(shard).Set((retention - lag).Seconds())
+
+				switch {
+				case lag > limit && !atRisk[shard]:
+					atRisk[shard] = true
+					alertRetention(ctx, snsClient, rc, fmt.Sprintf(
+						"%s/%s is %s behind, unread records are trimmed after %s; %s left before data is lost",
+						cfg.StreamName, shard, lag.Round(time.Second), retention, (retention-lag).Round(time.Second)))
+				case lag <= limit && atRisk[shard]:
+					delete(atRisk, shard)
+					alertRetention(ctx, snsClient, rc, fmt.Sprintf(
+						"%s/%s recovered, %s behind with a retention of %s",
+						cfg.StreamName, shard, lag.Round(time.Second), retention))
+				}
+				return true
+			})
+			shardsAtRisk.Set(float64(len(atRisk)))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func alertRetention(ctx context.Context, snsClient *sns.Client, rc RetentionAlertConfig, msg string) {
+	fmt.Println("retention alert:", msg)
+	if rc.SNSTopicARN == "" {
+		return
+	}
+	_, err := snsClient.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(rc.SNSTopicARN),
+		Subject:  aws.String("kinesis_consumer retention alert"),
+		Message:  aws.String(msg),
+	})
+	if err != nil {
+		fmt.Printf("failed to publish retention alert to %s, err=%+v\n", rc.SNSTopicARN, err)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"kinesis_consumer/consumer"
+)
+
+// RetryConfig is the retry-topic pattern: a record the handler still fails on after max_attempts
+// isn't skipped right away but put into a retry stream, with its retry count and when it is due in
+// a record header. The consumer reads the retry stream as well and hands each record to the
+// handler again once it's due; after MaxRetries retries it is skipped, to the DLQ, as usual.
+//
+//	"poison": {"max_attempts": 2, "retry": {"stream_name": "orders-retry", "delay": "1m", "max_retries": 3}}
+type RetryConfig struct {
+	StreamName string `json:"stream_name"`
+	// StreamARN takes precedence over StreamName.
+	StreamARN string `json:"stream_arn"`
+	// Delay is how long a record waits in the retry stream, 30s when not set. Every retry waits as
+	// long, so the stream is in the order records are due. At most 4m, shard iterators expire after 5.
+	Delay Duration `json:"delay"`
+	// MaxRetries is how often a record goes through the retry stream, 3 when not set.
+	MaxRetries int `json:"max_retries"`
+}
+
+// The header entries of records in the retry stream. retry-origin is the stream, shard and
+// sequence number the record first failed at, with ":" and the sub-sequence number for a user record
+// of an aggregated record.
+const (
+	retryHeaderCount  = "retry"
+	retryHeaderAfter  = "retry-after"
+	retryHeaderOrigin = "retry-origin"
+	maxRetryDelay     = 4 * time.Minute
+)
+
+var errRetriesExhausted = errors.New("out of retries")
+
+var retriedRecords = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "retried_records_total",
+	Help:      "Records put into the retry stream after the handler failed on them max_attempts times.",
+})
+
+func (rc RetryConfig) enabled() bool {
+	return rc.StreamName != "" || rc.StreamARN != ""
+}
+
+// retryStreamConfig is cfg for reading and writing the retry stream: every shard from the oldest
+// record, with record headers and the MD5 footer retryPublisher writes. Records are handled as they
+// were put in, without transform, enrich or wasm_module. nil without a retry stream.
+func retryStreamConfig(cfg *Config) (*Config, error) {
+	rc := cfg.Poison.Retry
+	if !rc.enabled() {
+		return nil, nil
+	}
+	if rc.Delay.Duration > maxRetryDelay {
+		return nil, fmt.Errorf("poison retry delay %s is longer than %s", rc.Delay, maxRetryDelay)
+	}
+	retry := *cfg
+	retry.StreamName, retry.StreamARN = rc.StreamName, rc.StreamARN
+	retry.ShardID, retry.ShardFilter = allShards, ShardFilterConfig{}
+	retry.ShardIteratorType = string(types.ShardIteratorTypeTrimHorizon)
+	retry.MaxAge, retry.StartingSequenceNumber = Duration{}, ""
+	retry.Transform, retry.Enrich, retry.WasmModule = TransformConfig{}, EnrichConfig{}, ""
+	retry.Decode = DecodeConfig{Headers: true, Footer: FooterConfig{Format: "md5"}}
+	if err := retry.resolveStreamARN(); err != nil {
+		return nil, err
+	}
+	return &retry, nil
+}
+
+// retryPublisher puts records into the retry stream.
+type retryPublisher struct {
+	cfg    RetryConfig
+	dest   *Config
+	client *kinesis.Client
+}
+
+// newRetryPublisher returns nil when cfg has no retry stream.
+func newRetryPublisher(cfg *Config) (*retryPublisher, error) {
+	dest, err := retryStreamConfig(cfg)
+	if dest == nil || err != nil {
+		return nil, err
+	}
+	awsCfg, err := loadAWSConfig(context.TODO(), dest)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load SDK config for the retry stream, %v", err)
+	}
+	rc := cfg.Poison.Retry
+	if rc.Delay.Duration <= 0 {
+		rc.Delay.Duration = 30 * time.Second
+	}
+	if rc.MaxRetries <= 0 {
+		rc.MaxRetries = 3
+	}
+	return &retryPublisher{cfg: rc, dest: dest, client: kinesis.NewFromConfig(awsCfg)}, nil
+}
+
+// publish puts r into the retry stream, due after the delay. It returns errRetriesExhausted for
+// records that were retried max_retries times already.
+func (rp *retryPublisher) publish(ctx context.Context, stream string, r *consumer.Record) error {
+	retry := 1
+	if n, err := strconv.Atoi(r.Header[retryHeaderCount]); err == nil {
+		retry = n + 1
+	}
+	if retry > rp.cfg.MaxRetries {
+		return errRetriesExhausted
+	}
+
+	header := make(map[string]string, len(r.Header)+4)
+	for k, v := range r.Header {
+		header[k] = v
+	}
+	header["codec"] = "none"
+	header[retryHeaderCount] = strconv.Itoa(retry)
+	header[retryHeaderAfter] = strconv.FormatInt(time.Now().Add(rp.cfg.Delay.Duration).UnixMilli(), 10)
+	if header[retryHeaderOrigin] == "" {
+		header[retryHeaderOrigin] = stream + "/" + strings.Replace(r.IdempotencyKey(), ":", "/", 1)
+	}
+	data, err := appendHeader(nil, header)
+	if err != nil {
+		return err
+	}
+	data = append(data, r.Data...)
+	sum := md5.Sum(data)
+	data = append(data, sum[:]...)
+
+	name, streamARN := rp.dest.streamRef()
+	_, err = rp.client.PutRecord(ctx, &kinesis.PutRecordInput{
+		StreamName:   name,
+		StreamARN:    streamARN,
+		PartitionKey: aws.String(r.PartitionKey),
+		Data:         data,
+	})
+	if err != nil {
+		return err
+	}
+	retriedRecords.Inc()
+	fmt.Printf("\tput into the retry stream, retry %d of %d in %s\n", retry, rp.cfg.MaxRetries, rp.cfg.Delay)
+	return nil
+}
+
+// consumeRetries reads every shard of the retry stream until ctx is cancelled, handing the records
+// to the pipeline as they fall due. The shard list is refreshed every minute. With lease.backend
+// the retry stream's shards are leased like the stream's.
+func consumeRetries(ctx context.Context, cfg *Config, pipes *pipelineRef, store checkpointStore) {
+	awsCfg, err := loadAWSConfig(ctx, cfg)
+	if err != nil {
+		panic(fmt.Sprintf("unable to load SDK config for the retry stream, %v", err))
+	}
+	client := kinesis.NewFromConfig(awsCfg)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	started := make(map[string]bool)
+	ticker := time.NewTicker(shardListInterval)
+	defer ticker.Stop()
+	var leaseTicks <-chan time.Time
+	if shardLeases != nil {
+		t := time.NewTicker(shardLeases.rebalanceInterval())
+		defer t.Stop()
+		leaseTicks = t.C
+	}
+	var shards []types.Shard
+	list := true
+	for {
+		if list || shards == nil {
+			listed, err := listShards(ctx, client, cfg)
+			if err != nil && ctx.Err() == nil {
+				fmt.Printf("listing retry shards failed, err=%+v\n", err)
+			}
+			if err == nil {
+				shards = listed
+			}
+		}
+		var held map[string]context.Context
+		if shardLeases != nil {
+			held = claimRetryShards(ctx, cfg.StreamName, shards)
+		}
+		for _, shard := range shards {
+			id := aws.ToString(shard.ShardId)
+			shardCtx := ctx
+			if shardLeases != nil {
+				if shardCtx = held[id]; shardCtx == nil {
+					continue
+				}
+			}
+			mu.Lock()
+			if started[id] {
+				mu.Unlock()
+				continue
+			}
+			started[id] = true
+			mu.Unlock()
+			fmt.Println("starting retry", id)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				readRetryShard(shardCtx, client, cfg, pipes, store, id)
+				if shardLeases != nil && ctx.Err() == nil {
+					if shardCtx.Err() == nil {
+						// closed
+						if err := shardLeases.finish(ctx, cfg.StreamName, id); err != nil {
+							fmt.Printf("releasing the lease of closed retry %s failed, err=%+v\n", id, err)
+						}
+						return
+					}
+					// the lease was lost, the shard is started again if it is taken again
+					mu.Lock()
+					delete(started, id)
+					mu.Unlock()
+				}
+			}()
+		}
+
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case <-ticker.C:
+			list = true
+		case <-leaseTicks:
+			list = false
+		}
+	}
+}
+
+// claimRetryShards takes the leases of the retry stream's shards, leaving out the finished ones.
+func claimRetryShards(ctx context.Context, stream string, shards []types.Shard) map[string]context.Context {
+	leases, err := shardLeases.list(ctx, stream)
+	if err != nil {
+		if ctx.Err() == nil {
+			fmt.Printf("listing retry leases failed, err=%+v\n", err)
+		}
+		return nil
+	}
+	var ids []string
+	for _, shard := range shards {
+		if id := aws.ToString(shard.ShardId); !leases.finished[id] {
+			ids = append(ids, id)
+		}
+	}
+	return shardLeases.claim(ctx, leases, ids)
+}
+
+// readRetryShard reads one shard of the retry stream until ctx is cancelled or the shard is
+// closed. Each record waits until it is due; failures panic with a *consumer.ShardError.
+func readRetryShard(ctx context.Context, client *kinesis.Client, cfg *Config, pipes *pipelineRef, store checkpointStore, shardID string) {
+	fail := func(format string, args ...any) {
+		panic(&consumer.ShardError{Stream: cfg.StreamName, ShardID: shardID, Err: fmt.Errorf(format, args...)})
+	}
+	iteratorInput, err := shardStart(cfg, store, shardID)
+	if err != nil {
+		fail("%w", err)
+	}
+	iteratorResp, err := client.GetShardIterator(ctx, iteratorInput)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		fail("unable to get shard iterator: %w", err)
+	}
+	shardIterator := iteratorResp.ShardIterator
+
+	decoder := newDecoderPool(cfg.Decode, cfg.StreamName)
+	defer decoder.close()
+	acks := newAckTracker(ctx, 0)
+	defer acks.close()
+	checkpoint := func() {
+		if err := acks.checkpoint(store, cfg.StreamName, shardID); err != nil {
+			fail("failed to checkpoint: %w", err)
+		}
+	}
+	defer func() {
+		if ctx.Err() != nil {
+			acks.drain(ackShutdownTimeout)
+			checkpoint()
+		}
+	}()
+
+	_, streamARN := cfg.streamRef()
+	for ctx.Err() == nil {
+		resp, err := client.GetRecords(ctx, &kinesis.GetRecordsInput{
+			ShardIterator: shardIterator,
+			StreamARN:     streamARN,
+			Limit:         aws.Int32(100),
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			fail("failed to fetch records from the retry stream: %w", err)
+		}
+
+		// retryPublisher doesn't aggregate, so these are the records as fetched
+		records, decoded := decoder.decodeBatch(shardID, resp.Records)
+		for i, record := range records {
+			r := &consumer.Record{
+				ShardID:        shardID,
+				SequenceNumber: aws.ToString(record.SequenceNumber),
+				PartitionKey:   aws.ToString(record.PartitionKey),
+				ArrivalTime:    aws.ToTime(record.ApproximateArrivalTimestamp),
+				EncryptionType: string(record.EncryptionType),
+				Size:           len(aws.ToString(record.PartitionKey)) + len(record.Data),
+				Header:         decoded[i].header,
+				Data:           decoded[i].data,
+			}
+			if err := waitUntilDue(ctx, r.Header); err != nil {
+				return
+			}
+			fmt.Println("retry", r.Header[retryHeaderCount], "of", r.Header[retryHeaderOrigin])
+
+			entry := acks.add(ctx, r.SequenceNumber, int64(len(r.Data)))
+			p := pipes.acquire()
+			err := p.handle(ctx, r, func() { acks.ack(entry) })
+			pipes.release(p)
+			acks.returned(entry)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				fmt.Printf("\thandler %s failed, err=%+v\n", cfg.Handler, err)
+			}
+		}
+		checkpoint()
+
+		if resp.NextShardIterator == nil {
+			acks.drain(ackShutdownTimeout)
+			checkpoint()
+			fmt.Println("retry", shardID, "is closed")
+			return
+		}
+		shardIterator = resp.NextShardIterator
+		if len(resp.Records) == 0 {
+			// nothing to retry, don't spend the shard's GetRecords calls
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// waitUntilDue waits for the retry-after time in header, if any.
+func waitUntilDue(ctx context.Context, header map[string]string) error {
+	ms, err := strconv.ParseInt(header[retryHeaderAfter], 10, 64)
+	if err != nil {
+		return nil
+	}
+	wait := time.Until(time.UnixMilli(ms))
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"kinesis_consumer/consumer"
+)
+
+// RouterConfig is the handler_config of the "router" handler, which splits a shared stream into
+// per-tenant destinations. Each record goes to the first route that matches it.
+//
+//	"handler": "router",
+//	"handler_config": {"tenant_field": "tenant.id", "routes": [
+//		{"tenant": "acme", "handler": "clickhouse", "handler_config": {"table": "acme_events"}},
+//		{"partition_key": "globex-*", "handler": "pubsub", "handler_config": {"topic": "globex"}},
+//		{"tenant": "*", "per_tenant": true, "handler": "sqlite", "handler_config": {"path": "tenants/{tenant}.db"}}]}
+type RouterConfig struct {
+	// TenantField is a dotted path into the JSON payload holding the tenant. Without it the
+	// partition key is the tenant.
+	TenantField string        `json:"tenant_field"`
+	Routes      []RouteConfig `json:"routes"`
+	// Unrouted is what happens to records no route matches: "skip" (the default) or "fail", which
+	// sends them through the poison policy.
+	Unrouted string `json:"unrouted"`
+}
+
+// RouteConfig matches records by partition key and/or tenant, path.Match patterns such as "acme-*";
+// a route with neither matches every record.
+type RouteConfig struct {
+	// Name labels the route's metrics, the handler name when not set.
+	Name          string          `json:"name"`
+	PartitionKey  string          `json:"partition_key"`
+	Tenant        string          `json:"tenant"`
+	Handler       string          `json:"handler"`
+	HandlerConfig json.RawMessage `json:"handler_config"`
+	// PerTenant builds a handler for every tenant the route gets, with {tenant} in the
+	// handler_config replaced by the tenant, e.g. for a table or topic per tenant. Records of
+	// tenants with other characters than letters, digits, _, . and -, or a leading dot, fail.
+	PerTenant bool `json:"per_tenant"`
+	// MaxTenants caps the handlers PerTenant builds, 100 when not set; records of further tenants fail.
+	MaxTenants int `json:"max_tenants"`
+	// Retry calls the route's handler again when it fails.
+	Retry RouteRetryConfig `json:"retry"`
+	// CircuitBreaker stops calling the route's handler while its downstream is down. A record for
+	// an open route fails right away, into "poison", unless every route's breaker is open: then it
+	// waits for the probe, and with it reading the shards.
+	CircuitBreaker CircuitBreakerConfig `json:"circuit_breaker"`
+}
+
+// RouteRetryConfig retries a route's handler before its error reaches the poison policy. Only
+// failed calls are retried: a handler that acknowledges with consumer.Async hands its failures to
+// the poison policy directly.
+type RouteRetryConfig struct {
+	// MaxAttempts is how often the handler is called on a record, 1 when not set.
+	MaxAttempts int `json:"max_attempts"`
+	// Backoff is the wait between attempts, doubled after each one.
+	Backoff Duration `json:"backoff"`
+}
+
+// errRouteOpen fails the records of a route whose circuit breaker is open.
+var errRouteOpen = errors.New("circuit breaker is open")
+
+var routedRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "routed_records_total",
+	Help:      "Records the router handler sent to each route, \"unrouted\" for those no route matched.",
+}, []string{"route"})
+
+func init() {
+	consumer.RegisterHandlerFactory("router", newRouter)
+}
+
+type route struct {
+	cfg     RouteConfig
+	handler consumer.HandlerFunc
+	closer  io.Closer
+	// breaker is nil without a circuit_breaker; a PerTenant route's tenants share it
+	breaker *circuitBreaker
+
+	// per tenant handlers, for PerTenant routes
+	mu      sync.Mutex
+	tenants map[string]*route
+}
+
+type router struct {
+	cfg    RouterConfig
+	routes []*route
+
+	mu sync.Mutex
+	// changed is closed and replaced whenever a route's breaker changes state
+	changed chan struct{}
+}
+
+func newRouter(raw json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+	var cfg RouterConfig
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("invalid router handler_config: %w", err)
+		}
+	}
+	switch cfg.Unrouted {
+	case "":
+		cfg.Unrouted = "skip"
+	case "skip", "fail":
+	default:
+		return nil, nil, fmt.Errorf("router unrouted %q is not one of skip or fail", cfg.Unrouted)
+	}
+	if len(cfg.Routes) == 0 {
+		return nil, nil, fmt.Errorf("the router handler needs routes")
+	}
+
+	rt := &router{cfg: cfg, changed: make(chan struct{})}
+	for i, rc := range cfg.Routes {
+		if rc.Handler == "" {
+			rt.Close()
+			return nil, nil, fmt.Errorf("router route %d has no handler", i)
+		}
+		for _, pattern := range []string{rc.PartitionKey, rc.Tenant} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				rt.Close()
+				return nil, nil, fmt.Errorf("invalid router pattern %q: %w", pattern, err)
+			}
+		}
+		if rc.Name == "" {
+			rc.Name = rc.Handler
+		}
+		if rc.MaxTenants <= 0 {
+			rc.MaxTenants = 100
+		}
+		if rc.Retry.MaxAttempts < 1 {
+			rc.Retry.MaxAttempts = 1
+		}
+		r := &route{cfg: rc}
+		var err error
+		if r.breaker, err = newRouteBreaker(rc.Name, rc.CircuitBreaker, rc.Retry.MaxAttempts); err != nil {
+			rt.Close()
+			return nil, nil, fmt.Errorf("router route %s: %w", rc.Name, err)
+		}
+		if r.breaker != nil {
+			r.breaker.onChange = rt.breakerChanged
+		}
+		if rc.PerTenant {
+			r.tenants = make(map[string]*route)
+		} else {
+			if r.handler, r.closer, err = consumer.NewHandler(rc.Handler, rc.HandlerConfig); err != nil {
+				rt.Close()
+				return nil, nil, fmt.Errorf("router route %s: %w", rc.Name, err)
+			}
+		}
+		rt.routes = append(rt.routes, r)
+	}
+	return rt.handle, rt, nil
+}
+
+func (rt *router) handle(ctx context.Context, r *consumer.Record) error {
+	tenant, err := rt.tenant(r)
+	if err != nil {
+		return err
+	}
+	for _, rr := range rt.routes {
+		if !rr.matches(r.PartitionKey, tenant) {
+			continue
+		}
+		routedRecords.WithLabelValues(rr.cfg.Name).Inc()
+		handler, err := rr.handlerFor(tenant)
+		if err != nil {
+			return err
+		}
+		return rt.call(ctx, rr, handler, r)
+	}
+
+	routedRecords.WithLabelValues("unrouted").Inc()
+	if rt.cfg.Unrouted == "fail" {
+		return fmt.Errorf("no route for partition key %q, tenant %q", r.PartitionKey, tenant)
+	}
+	return nil
+}
+
+// call hands r to a route's handler through the route's circuit breaker, as often as its retry
+// settings allow. The failure that opens the breaker doesn't count as an attempt, like in the
+// poison policy.
+func (rt *router) call(ctx context.Context, rr *route, h consumer.HandlerFunc, r *consumer.Record) error {
+	if rr.breaker == nil && rr.cfg.Retry.MaxAttempts == 1 {
+		return h(ctx, r)
+	}
+	var err error
+	backoff := rr.cfg.Retry.Backoff.Duration
+	for attempt := 1; attempt <= rr.cfg.Retry.MaxAttempts; attempt++ {
+		if err = rt.acquire(ctx, rr); err != nil {
+			return err
+		}
+		// an acknowledgement counts for the breaker like a call's result
+		hctx, async := consumer.WithAckHook(ctx, func(err error) { rr.breaker.done(err) })
+		err = h(hctx, r)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil && async() {
+			return nil
+		}
+		if rr.breaker.done(err) {
+			attempt--
+			continue
+		}
+		if err == nil {
+			return nil
+		}
+		if attempt < rr.cfg.Retry.MaxAttempts {
+			fmt.Printf("\troute %s failed, attempt %d of %d, err=%+v\n", rr.cfg.Name, attempt, rr.cfg.Retry.MaxAttempts, err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-wallClock.After(backoff):
+			}
+			backoff *= 2
+		}
+	}
+	return err
+}
+
+// acquire waits until the route's breaker lets a call through. While it is open the record fails
+// with errRouteOpen, so the other routes' records keep flowing, unless every route's breaker is
+// open: then there is nowhere to send anything and the record waits for a probe.
+func (rt *router) acquire(ctx context.Context, rr *route) error {
+	for {
+		// taken first, so a breaker that closes while allOpen looks is noticed
+		rt.mu.Lock()
+		anyChanged := rt.changed
+		rt.mu.Unlock()
+
+		ok, wait, changed := rr.breaker.try()
+		if ok {
+			return nil
+		}
+		if !rt.allOpen() {
+			return fmt.Errorf("route %s: %w", rr.cfg.Name, errRouteOpen)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		case <-anyChanged:
+		case <-wallClock.After(wait):
+		}
+	}
+}
+
+// allOpen reports whether every route's circuit breaker is open; never when a route has none.
+func (rt *router) allOpen() bool {
+	for _, rr := range rt.routes {
+		if !rr.breaker.open() {
+			return false
+		}
+	}
+	return true
+}
+
+// breakerChanged wakes up the records waiting in acquire. It is called with the breaker's lock held.
+func (rt *router) breakerChanged() {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	close(rt.changed)
+	rt.changed = make(chan struct{})
+}
+
+// tenant reads the tenant of r, its partition key without a tenant_field. A record that isn't a
+// JSON object or lacks the field has no tenant, it only matches routes without a tenant pattern.
+func (rt *router) tenant(r *consumer.Record) (string, error) {
+	if rt.cfg.TenantField == "" {
+		return r.PartitionKey, nil
+	}
+	var fields map[string]any
+	dec := json.NewDecoder(bytes.NewReader(r.Data))
+	dec.UseNumber()
+	if dec.Decode(&fields) != nil {
+		return "", nil
+	}
+	v, ok := jsonField(fields, rt.cfg.TenantField)
+	if !ok || v == nil {
+		return "", nil
+	}
+	switch v.(type) {
+	case map[string]any, []any:
+		return "", fmt.Errorf("tenant field %s is not a string or number", rt.cfg.TenantField)
+	}
+	return fmt.Sprint(v), nil
+}
+
+func (rr *route) matches(partitionKey, tenant string) bool {
+	if ok, _ := path.Match(rr.cfg.PartitionKey, partitionKey); rr.cfg.PartitionKey != "" && !ok {
+		return false
+	}
+	if ok, _ := path.Match(rr.cfg.Tenant, tenant); rr.cfg.Tenant != "" && (tenant == "" || !ok) {
+		return false
+	}
+	return true
+}
+
+// handlerFor returns the route's handler, for PerTenant routes the tenant's, built on first use.
+func (rr *route) handlerFor(tenant string) (consumer.HandlerFunc, error) {
+	if rr.tenants == nil {
+		return rr.handler, nil
+	}
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if t := rr.tenants[tenant]; t != nil {
+		return t.handler, nil
+	}
+	if tenant == "" {
+		return nil, fmt.Errorf("route %s is per tenant, the record has no tenant", rr.cfg.Name)
+	}
+	if !safeTenant(tenant) {
+		return nil, fmt.Errorf("route %s is per tenant, tenant %q isn't made of letters, digits, _, . and -", rr.cfg.Name, tenant)
+	}
+	if len(rr.tenants) >= rr.cfg.MaxTenants {
+		return nil, fmt.Errorf("route %s has handlers for %d tenants already, not adding %s", rr.cfg.Name, len(rr.tenants), tenant)
+	}
+
+	config := strings.ReplaceAll(string(rr.cfg.HandlerConfig), "{tenant}", tenant)
+	t := &route{cfg: rr.cfg}
+	var err error
+	if t.handler, t.closer, err = consumer.NewHandler(rr.cfg.Handler, json.RawMessage(config)); err != nil {
+		return nil, fmt.Errorf("route %s, tenant %s: %w", rr.cfg.Name, tenant, err)
+	}
+	fmt.Printf("route %s: started %s handler for tenant %s\n", rr.cfg.Name, rr.cfg.Handler, tenant)
+	rr.tenants[tenant] = t
+	return t.handler, nil
+}
+
+// safeTenant reports whether tenant, which comes from the records, can go into a handler_config:
+// only letters, digits, _, . and -, and no leading dot, so it can't escape a JSON string or pick a
+// path like "tenants/../../etc/x.db".
+func safeTenant(tenant string) bool {
+	if tenant == "" || tenant[0] == '.' {
+		return false
+	}
+	for _, c := range tenant {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '_', c == '.', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (rr *route) close() error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	var errs []error
+	if rr.closer != nil {
+		errs = append(errs, rr.closer.Close())
+	}
+	for _, t := range rr.tenants {
+		errs = append(errs, t.close())
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes every route's handlers.
+func (rt *router) Close() error {
+	var errs []error
+	for _, rr := range rt.routes {
+		errs = append(errs, rr.close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"kinesis_consumer/consumer"
+)
+
+func TestSafeTenant(t *testing.T) {
+	for tenant, want := range map[string]bool{
+		"acme":         true,
+		"acme-eu_2.v1": true,
+		"":             false,
+		".hidden":      false,
+		"..":           false,
+		"../../etc/x":  false,
+		"a/b":          false,
+		`a"b`:          false,
+		"a\\b":         false,
+		"tenant ü":     false,
+	} {
+		if got := safeTenant(tenant); got != want {
+			t.Errorf("safeTenant(%q) = %v, want %v", tenant, got, want)
+		}
+	}
+}
+
+func TestRouterCircuitBreakers(t *testing.T) {
+	fake := useFakeWallClock(t)
+	var mu sync.Mutex
+	down := map[string]bool{"a": true}
+	calls := make(map[string]int)
+	for _, name := range []string{"a", "b"} {
+		consumer.RegisterHandler("router-test-"+name, func(context.Context, *consumer.Record) error {
+			mu.Lock()
+			defer mu.Unlock()
+			calls[name]++
+			if down[name] {
+				return fmt.Errorf("%s is down", name)
+			}
+			return nil
+		})
+	}
+	handle, closer, err := newRouter([]byte(`{"routes": [
+		{"partition_key": "a-*", "handler": "router-test-a", "circuit_breaker": {"failures": 2, "open_for": "1m"}},
+		{"partition_key": "b-*", "handler": "router-test-b", "retry": {"max_attempts": 2, "backoff": "1s"},
+			"circuit_breaker": {"failures": 3, "open_for": "1m"}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	send := func(key string) error {
+		return handle(context.Background(), &consumer.Record{PartitionKey: key, Data: []byte(`{}`)})
+	}
+
+	// a's second failure opens its breaker; b is up, so a's records fail right away
+	if err := send("a-1"); err == nil || errors.Is(err, errRouteOpen) {
+		t.Fatalf("first failure: err=%v", err)
+	}
+	if err := send("a-2"); !errors.Is(err, errRouteOpen) {
+		t.Fatalf("tripping failure: err=%v, want errRouteOpen", err)
+	}
+	if err := send("a-3"); !errors.Is(err, errRouteOpen) || calls["a"] != 2 {
+		t.Fatalf("open route: err=%v after %d calls, want errRouteOpen after 2", err, calls["a"])
+	}
+	if err := send("b-1"); err != nil {
+		t.Fatalf("b while a is open: err=%v", err)
+	}
+
+	// b fails too: its retry fails after a backoff, and its third failure in a row opens it with
+	// every route open, so the record waits for a probe instead of failing
+	mu.Lock()
+	down["b"] = true
+	mu.Unlock()
+	sent := make(chan error, 1)
+	go func() { sent <- send("b-2") }()
+	waitForWaiters(t, fake, 1)
+	fake.Advance(time.Second)
+	if err := <-sent; err == nil || errors.Is(err, errRouteOpen) {
+		t.Fatalf("b's retried failure: err=%v", err)
+	}
+	go func() { sent <- send("b-3") }()
+	waitForWaiters(t, fake, 1)
+	select {
+	case err := <-sent:
+		t.Fatalf("record didn't wait with every route open, err=%v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	mu.Lock()
+	down["b"] = false
+	mu.Unlock()
+	fake.Advance(time.Minute)
+	if err := <-sent; err != nil {
+		t.Fatalf("b's probe: err=%v", err)
+	}
+	if calls["b"] != 5 {
+		t.Errorf("b was called %d times, want 5", calls["b"])
+	}
+}
+
+func TestRouterCircuitBreakerAsync(t *testing.T) {
+	consumer.RegisterHandler("router-test-async", func(ctx context.Context, r *consumer.Record) error {
+		ack := consumer.Async(ctx)
+		go ack(errors.New("not acknowledged"))
+		return nil
+	})
+	handle, closer, err := newRouter([]byte(`{"routes": [
+		{"handler": "router-test-async", "circuit_breaker": {"failures": 2}},
+		{"partition_key": "never", "handler": "router-test-async"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	breaker := closer.(*router).routes[0].breaker
+
+	for i := range 2 {
+		acked := make(chan error, 1)
+		ctx, async := consumer.NewAsyncContext(context.Background(), func(err error) { acked <- err })
+		if err := handle(ctx, &consumer.Record{Data: []byte(`{}`)}); err != nil || !async() {
+			t.Fatalf("record %d: err=%v, async %v", i, err, async())
+		}
+		if err := <-acked; err == nil {
+			t.Fatalf("record %d acked without the error", i)
+		}
+	}
+	if !breaker.open() {
+		t.Error("failed acknowledgements didn't open the breaker")
+	}
+}
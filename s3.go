@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"kinesis_consumer/consumer"
+)
+
+// S3Config is the handler_config of the "s3" handler.
+//
+//	"handler": "s3",
+//	"handler_config": {"bucket": "archive", "prefix": "orders/{tenant}/",
+//		"compression": {"codec": "gzip"}, "flush": {"max_records": 100000, "max_latency": "5m"}}
+type S3Config struct {
+	Bucket string `json:"bucket"`
+	// Prefix is a recordTemplate the object keys start with.
+	Prefix string `json:"prefix"`
+	// Region is AWS_REGION, or the consumer's default region, when not set.
+	Region string `json:"region"`
+	// EndpointURL is for LocalStack and the like, which are addressed path style.
+	EndpointURL string            `json:"endpoint_url"`
+	Compression CompressionConfig `json:"compression"`
+	// Manifests commits every batch of a shard with a manifest under ManifestPrefix, for exactly
+	// once archival; it needs a shard's records handled in order, and uploads one batch at a time.
+	Manifests bool `json:"manifests"`
+	// ManifestPrefix is "_manifests/" when not set.
+	ManifestPrefix string `json:"manifest_prefix"`
+	// Multipart uploads objects in parts, see S3MultipartConfig; flush doesn't apply then.
+	Multipart S3MultipartConfig `json:"multipart"`
+	// Flush is 10000 records, 64MB and 1m when not set.
+	Flush FlushConfig `json:"flush"`
+}
+
+// s3MaxObjectBytes is the most a batch holds in memory before it is uploaded.
+const s3MaxObjectBytes = 256 << 20
+
+func init() {
+	consumer.RegisterHandlerFactory("s3", newS3Writer)
+}
+
+// s3Writer archives decoded payloads as JSON lines objects in a bucket. Each batch becomes an
+// object per prefix and shard, named after the shard and the positions of its first and last
+// record, so a batch that is uploaded again overwrites its object instead of adding one. Records
+// are acknowledged like the pubsub handler's once their object (and manifest) was put.
+type s3Writer struct {
+	cfg    S3Config
+	prefix recordTemplate
+	client *s3.Client
+	batch  *asyncBatcher
+	// manifests is nil unless cfg.Manifests is set
+	manifests *s3Manifests
+	// multipart is nil unless cfg.Multipart.StateDir is set, batch is nil when it isn't
+	multipart *s3Multipart
+}
+
+func newS3Writer(raw json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+	cfg := S3Config{ManifestPrefix: "_manifests/"}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("invalid s3 handler_config: %w", err)
+		}
+	}
+	if cfg.Bucket == "" {
+		return nil, nil, fmt.Errorf("the s3 handler needs a bucket")
+	}
+	if err := cfg.Compression.validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid s3 compression: %w", err)
+	}
+	prefix, err := newRecordTemplate(cfg.Prefix)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid s3 prefix: %w", err)
+	}
+
+	client, err := cfg.client()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w := &s3Writer{cfg: cfg, prefix: prefix, client: client}
+	flush := FlushConfig{MaxRecords: 10000, MaxBytes: 64 << 20, MaxLatency: Duration{time.Minute}}
+	if cfg.Manifests {
+		// a shard's manifests chain, so they are written in order
+		if cfg.Flush.MaxInFlight > 1 {
+			return nil, nil, fmt.Errorf("the s3 handler uploads one batch at a time with manifests, flush.max_in_flight can't be %d", cfg.Flush.MaxInFlight)
+		}
+		flush.MaxInFlight = 1
+		w.manifests = &s3Manifests{client: client, bucket: cfg.Bucket, prefix: cfg.ManifestPrefix, shards: make(map[string]*manifestState)}
+	}
+	if cfg.Multipart.StateDir != "" {
+		if w.multipart, err = newS3Multipart(w, cfg.Multipart); err != nil {
+			return nil, nil, fmt.Errorf("s3 multipart: %w", err)
+		}
+		return w.handle, w, nil
+	}
+	w.batch = cfg.Flush.batcher("s3", flush, 0, s3MaxObjectBytes, w.upload)
+	return w.handle, w, nil
+}
+
+// client returns an S3 client for the bucket's region, with the consumer's own -proxy and
+// -ca-bundle.
+func (cfg S3Config) client() (*s3.Client, error) {
+	dest := &Config{Region: cfg.Region}
+	if dest.Region == "" {
+		dest.Region = os.Getenv("AWS_REGION")
+	}
+	if dest.Region == "" {
+		dest.Region = region
+	}
+	dest.AWS.EndpointURL = cfg.EndpointURL
+	awsCfg, err := loadAWSConfig(context.TODO(), dest)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load SDK config for the s3 handler, %v", err)
+	}
+	return s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		o.UsePathStyle = cfg.EndpointURL != ""
+	}), nil
+}
+
+// handle queues the record as its prefix, shard and position followed by its line.
+func (w *s3Writer) handle(ctx context.Context, r *consumer.Record) error {
+	prefix, err := w.prefix.render(r, pathSegment)
+	if err != nil {
+		return err
+	}
+	if w.multipart != nil {
+		line := append(append([]byte(nil), r.Data...), '\n')
+		return w.multipart.add(ctx, prefix, r, line)
+	}
+	item := appendField(nil, prefix)
+	item = appendField(item, r.ShardID)
+	item = appendField(item, recordPosition(r))
+	item = append(item, r.Data...)
+	return w.batch.add(ctx, append(item, '\n'))
+}
+
+// s3Line is a queued record of a shard.
+type s3Line struct {
+	prefix, position string
+	line             []byte
+}
+
+// s3Object is the part of a batch that goes to one object.
+type s3Object struct {
+	prefix      string
+	first, last string
+	records     int
+	body        []byte
+}
+
+// upload puts a batch as one object per prefix and shard, and with manifests on commits each
+// shard's part with a manifest.
+func (w *s3Writer) upload(items [][]byte) error {
+	var shards []string
+	byShard := make(map[string][]s3Line)
+	for _, item := range items {
+		prefix, rest := cutField(item)
+		shard, rest := cutField(rest)
+		position, line := cutField(rest)
+		if _, ok := byShard[shard]; !ok {
+			shards = append(shards, shard)
+		}
+		byShard[shard] = append(byShard[shard], s3Line{prefix, position, line})
+	}
+	for _, shard := range shards {
+		if err := w.uploadShard(shard, byShard[shard]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *s3Writer) uploadShard(shard string, lines []s3Line) error {
+	var state *manifestState
+	if w.manifests != nil {
+		var err error
+		if state, err = w.manifests.state(shard); err != nil {
+			return err
+		}
+		if lines = state.unarchived(lines); len(lines) == 0 {
+			return nil
+		}
+	}
+
+	var objects []*s3Object
+	byPrefix := make(map[string]*s3Object)
+	for _, l := range lines {
+		o := byPrefix[l.prefix]
+		if o == nil {
+			o = &s3Object{prefix: l.prefix, first: l.position, last: l.position}
+			byPrefix[l.prefix] = o
+			objects = append(objects, o)
+		}
+		if positionLess(l.position, o.first) {
+			o.first = l.position
+		}
+		if positionLess(o.last, l.position) {
+			o.last = l.position
+		}
+		o.records++
+		o.body = append(o.body, l.line...)
+	}
+
+	written := make([]manifestObject, len(objects))
+	for i, o := range objects {
+		// <prefix><shard>-<first>-<last>.jsonl with the codec's extension
+		key := o.prefix + shard + "-" + o.first + "-" + o.last + ".jsonl" + compressionExtension(w.cfg.Compression.Codec)
+		var err error
+		if written[i], err = w.put(key, o.body); err != nil {
+			return err
+		}
+		written[i].First, written[i].Last, written[i].Records = o.first, o.last, o.records
+	}
+	if w.manifests != nil {
+		return w.manifests.commit(shard, state, written)
+	}
+	return nil
+}
+
+// put compresses body and puts it as key.
+func (w *s3Writer) put(key string, body []byte) (manifestObject, error) {
+	out, err := w.cfg.Compression.compress(body)
+	if err != nil {
+		return manifestObject{}, err
+	}
+	in := &s3.PutObjectInput{
+		Bucket:      aws.String(w.cfg.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(out),
+		ContentType: aws.String("application/x-ndjson"),
+	}
+	if w.cfg.Compression.Codec != "" {
+		in.ContentEncoding = aws.String(w.cfg.Compression.Codec)
+	}
+	if _, err := w.client.PutObject(context.TODO(), in); err != nil {
+		return manifestObject{}, fmt.Errorf("failed to put s3://%s/%s: %w", w.cfg.Bucket, key, err)
+	}
+	sum := sha256.Sum256(out)
+	return manifestObject{Key: key, Bytes: int64(len(out)), SHA256: hex.EncodeToString(sum[:])}, nil
+}
+
+// Close uploads what is still pending.
+func (w *s3Writer) Close() error {
+	if w.multipart != nil {
+		w.multipart.close()
+		return nil
+	}
+	w.batch.close()
+	return nil
+}
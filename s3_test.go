@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"kinesis_consumer/consumer"
+)
+
+// fakeS3 is a bucket with what the s3 handler and verify-s3 call: put, get, head, list and
+// multipart uploads. Objects are kept by key, with their Content-Encoding.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string]string
+	encoding map[string]string
+	// uploads has the parts of the multipart uploads in progress by upload id
+	uploads map[string]map[int]string
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, string) {
+	t.Helper()
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	s := &fakeS3{objects: make(map[string]string), encoding: make(map[string]string), uploads: make(map[string]map[int]string)}
+	srv := httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(srv.Close)
+	return s, srv.URL
+}
+
+func (s *fakeS3) serve(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// path style: /<bucket>/<key>
+	_, key, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	query := req.URL.Query()
+	uploadID := query.Get("uploadId")
+	parts, uploading := s.uploads[uploadID]
+	if uploadID != "" && !uploading {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `<Error><Code>NoSuchUpload</Code><Message>The specified upload does not exist.</Message></Error>`)
+		return
+	}
+	switch {
+	case req.Method == http.MethodPost && query.Has("uploads"):
+		uploadID = fmt.Sprintf("upload-%d", len(s.uploads)+1)
+		s.uploads[uploadID] = make(map[int]string)
+		s.encoding[key] = req.Header.Get("Content-Encoding")
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", key, uploadID)
+	case req.Method == http.MethodPut && uploading:
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		body, _ := io.ReadAll(req.Body)
+		parts[n] = string(body)
+		w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, n))
+	case req.Method == http.MethodGet && uploading:
+		fmt.Fprint(w, "<ListPartsResult><IsTruncated>false</IsTruncated></ListPartsResult>")
+	case req.Method == http.MethodPost && uploading:
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		xml.NewDecoder(req.Body).Decode(&complete)
+		var body strings.Builder
+		for _, p := range complete.Parts {
+			body.WriteString(parts[p.PartNumber])
+		}
+		s.objects[key] = body.String()
+		delete(s.uploads, uploadID)
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key></CompleteMultipartUploadResult>", key)
+	case req.Method == http.MethodDelete && uploading:
+		delete(s.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	case req.Method == http.MethodPut:
+		body, _ := io.ReadAll(req.Body)
+		s.objects[key] = string(body)
+		s.encoding[key] = req.Header.Get("Content-Encoding")
+	case req.Method == http.MethodGet && key == "" && query.Get("list-type") == "2":
+		var keys []string
+		for k := range s.objects {
+			if strings.HasPrefix(k, query.Get("prefix")) && k > query.Get("start-after") {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		fmt.Fprint(w, `<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><IsTruncated>false</IsTruncated>`)
+		for _, k := range keys {
+			fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size></Contents>", k, len(s.objects[k]))
+		}
+		fmt.Fprintf(w, "<KeyCount>%d</KeyCount></ListBucketResult>", len(keys))
+	case req.Method == http.MethodGet || req.Method == http.MethodHead:
+		body, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		if req.Method == http.MethodGet {
+			io.WriteString(w, body)
+		}
+	default:
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+	}
+}
+
+// putS3Records hands records to an s3 handler the way the consumer does, and waits until they are acked.
+func putS3Records(t *testing.T, handle consumer.HandlerFunc, closer io.Closer, records []*consumer.Record) {
+	t.Helper()
+	acked := make(chan error, len(records))
+	for _, r := range records {
+		ctx, _ := consumer.NewAsyncContext(context.Background(), func(err error) { acked <- err })
+		if err := handle(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closer.Close()
+	for range records {
+		if err := <-acked; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestS3Writer(t *testing.T) {
+	tests := []struct {
+		codec string
+		ext   string
+	}{
+		{"", ""},
+		{"gzip", ".gz"},
+		{"zstd", ".zst"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.codec, func(t *testing.T) {
+			s3, endpoint := newFakeS3(t)
+			config := fmt.Sprintf(`{"bucket": "archive", "prefix": "orders/{tenant}/", "region": "us-east-1",
+				"endpoint_url": %q, "compression": {"codec": %q}, "flush": {"max_records": 4}}`, endpoint, tt.codec)
+			handle, closer, err := newS3Writer([]byte(config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var records []*consumer.Record
+			for i, r := range []struct{ shard, tenant string }{
+				{"shardId-000000000000", "acme"},
+				{"shardId-000000000001", "acme"},
+				{"shardId-000000000000", "a/b"},
+				{"shardId-000000000000", "acme"},
+			} {
+				records = append(records, &consumer.Record{ShardID: r.shard, SequenceNumber: fmt.Sprint(100 + i),
+					Data: []byte(fmt.Sprintf(`{"tenant":%q}`, r.tenant))})
+			}
+			putS3Records(t, handle, closer, records)
+
+			want := map[string]string{
+				"orders/acme/shardId-000000000000-100-103.jsonl": "{\"tenant\":\"acme\"}\n{\"tenant\":\"acme\"}\n",
+				"orders/acme/shardId-000000000001-101-101.jsonl": "{\"tenant\":\"acme\"}\n",
+				"orders/a_b/shardId-000000000000-102-102.jsonl":  "{\"tenant\":\"a/b\"}\n",
+			}
+			if len(s3.objects) != len(want) {
+				t.Errorf("got objects %v, want %d", s3.objects, len(want))
+			}
+			for key, body := range want {
+				key += tt.ext
+				got, ok := s3.objects[key]
+				if !ok {
+					t.Errorf("no object %s", key)
+					continue
+				}
+				if s3.encoding[key] != tt.codec {
+					t.Errorf("%s has Content-Encoding %q, want %q", key, s3.encoding[key], tt.codec)
+				}
+				if got := decompressAll(t, tt.codec, []byte(got)); got != body {
+					t.Errorf("%s is %q, want %q", key, got, body)
+				}
+			}
+		})
+	}
+}
+
+func TestS3WriterConfig(t *testing.T) {
+	for _, config := range []string{
+		`{}`,
+		`{"bucket": "archive", "prefix": "{tenant"}`,
+		`{"bucket": "archive", "compression": {"codec": "zstd", "level": 23}}`,
+	} {
+		if _, _, err := newS3Writer([]byte(config)); err == nil {
+			t.Errorf("newS3Writer(%s) succeeded", config)
+		} else if !strings.Contains(err.Error(), "s3") {
+			t.Errorf("newS3Writer(%s) err=%v doesn't say which handler", config, err)
+		}
+	}
+}
+
+func TestS3Manifests(t *testing.T) {
+	fake, endpoint := newFakeS3(t)
+	config := []byte(fmt.Sprintf(`{"bucket": "archive", "prefix": "orders/", "region": "us-east-1", "endpoint_url": %q,
+		"manifests": true, "compression": {"codec": "gzip"}, "flush": {"max_records": 2}}`, endpoint))
+	sc := S3Config{Bucket: "archive", Prefix: "orders/", ManifestPrefix: "_manifests/", Compression: CompressionConfig{Codec: "gzip"}}
+	client, err := S3Config{Region: "us-east-1", EndpointURL: endpoint}.client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := func(from, to int) []*consumer.Record {
+		var rs []*consumer.Record
+		for seq := from; seq <= to; seq++ {
+			rs = append(rs, &consumer.Record{ShardID: "shardId-000000000000", SequenceNumber: strconv.Itoa(seq), Data: []byte(`{}`)})
+		}
+		return rs
+	}
+	verify := func() (int, string) { return verifyS3(t, client, sc) }
+
+	handle, closer, err := newS3Writer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putS3Records(t, handle, closer, records(100, 104))
+	if problems, out := verify(); problems != 0 {
+		t.Fatalf("%d problems:\n%s", problems, out)
+	}
+
+	// after a restart the records since the checkpoint come again: the archived ones are dropped
+	handle, closer, err = newS3Writer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putS3Records(t, handle, closer, records(102, 106))
+	if problems, out := verify(); problems != 0 || !strings.Contains(out, "5 batches, 7 records up to 106") {
+		t.Fatalf("%d problems:\n%s", problems, out)
+	}
+	if got := fake.objects["_manifests/shardId-000000000000/latest"]; !strings.HasSuffix(got, "106.00000.json") {
+		t.Errorf("latest is %q", got)
+	}
+
+	// an upload that didn't get to commit is an orphan, not a problem
+	fake.objects["orders/shardId-000000000000-107-108.jsonl.gz"] = "x"
+	if problems, out := verify(); problems != 0 || !strings.Contains(out, "orders/shardId-000000000000-107-108.jsonl.gz is in no manifest") {
+		t.Errorf("%d problems:\n%s", problems, out)
+	}
+
+	// a lost manifest breaks the chain, a changed object its checksum
+	for key := range fake.objects {
+		if strings.HasSuffix(key, "102.00000-"+positionKey("103")+".json") {
+			delete(fake.objects, key)
+		}
+	}
+	fake.objects["orders/shardId-000000000000-100-101.jsonl.gz"] = "changed"
+	problems, out := verify()
+	if problems != 2 || !strings.Contains(out, "the manifests between 101 and 104 are missing") || !strings.Contains(out, "checksum") {
+		t.Errorf("%d problems:\n%s", problems, out)
+	}
+}
+
+func TestPositionLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"99", "100", true},
+		{"100", "99", false},
+		{"100", "100", false},
+		{"100.1", "100.2", true},
+		{"100.10", "100.9", false},
+		{"100.3", "101", true},
+	}
+	for _, tt := range tests {
+		if got := positionLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("positionLess(%s, %s) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+		if got := positionKey(tt.a) < positionKey(tt.b); got != tt.want {
+			t.Errorf("positionKey(%s) < positionKey(%s) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestS3Multipart(t *testing.T) {
+	fake, endpoint := newFakeS3(t)
+	stateDir := t.TempDir()
+	config := []byte(fmt.Sprintf(`{"bucket": "archive", "region": "us-east-1", "endpoint_url": %q, "manifests": true,
+		"compression": {"codec": "gzip", "level": 1}, "multipart": {"state_dir": %q, "part_size": "5MB"}}`, endpoint, stateDir))
+	sc := S3Config{Bucket: "archive", ManifestPrefix: "_manifests/", Compression: CompressionConfig{Codec: "gzip"}}
+	client, err := S3Config{Region: "us-east-1", EndpointURL: endpoint}.client()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 512KB records that barely compress, so every 10 make a part
+	rand := mathrand.New(mathrand.NewPCG(1, 2))
+	data := make([][]byte, 40)
+	for i := range data {
+		b := make([]byte, 384<<10)
+		for j := range b {
+			b[j] = byte(rand.IntN(256))
+		}
+		data[i] = fmt.Appendf(nil, `{"n":%d,"data":%q}`, i, base64.StdEncoding.EncodeToString(b))
+	}
+	records := func(from, to int) []*consumer.Record {
+		var rs []*consumer.Record
+		for i := from; i <= to; i++ {
+			rs = append(rs, &consumer.Record{ShardID: "shardId-000000000000", SequenceNumber: strconv.Itoa(100 + i), Data: data[i]})
+		}
+		return rs
+	}
+	acks := func(handle consumer.HandlerFunc, rs []*consumer.Record) chan error {
+		acked := make(chan error, len(rs))
+		for _, r := range rs {
+			ctx, _ := consumer.NewAsyncContext(context.Background(), func(err error) { acked <- err })
+			if err := handle(ctx, r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return acked
+	}
+
+	handle, _, err := newS3Writer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a crash after 25 records: the 2 parts' 20 are acked, the other 5 aren't
+	acked := acks(handle, records(0, 24))
+	for range 20 {
+		if err := <-acked; err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-acked:
+		t.Fatal("a record that isn't in an uploaded part was acked")
+	default:
+	}
+	if len(fake.objects) != 0 || len(fake.uploads) != 1 {
+		t.Fatalf("got objects %d and uploads %d, want one upload in progress", len(fake.objects), len(fake.uploads))
+	}
+
+	// the restart goes on from a checkpoint before the last part: what is uploaded is dropped
+	handle, closer, err := newS3Writer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putS3Records(t, handle, closer, records(15, 39))
+	if len(fake.uploads) != 0 {
+		t.Errorf("%d uploads still in progress", len(fake.uploads))
+	}
+	key := "shardId-000000000000-100.jsonl.gz"
+	var want strings.Builder
+	for _, d := range data {
+		want.Write(d)
+		want.WriteByte('\n')
+	}
+	if got := decompressAll(t, "gzip", []byte(fake.objects[key])); got != want.String() {
+		t.Errorf("%s has %d bytes, want each record once, %d bytes", key, len(got), want.Len())
+	}
+	if problems, out := verifyS3(t, client, sc); problems != 0 || !strings.Contains(out, "1 batches, 40 records up to 139") {
+		t.Errorf("%d problems:\n%s", problems, out)
+	}
+	if files, _ := filepath.Glob(filepath.Join(stateDir, "*")); len(files) != 0 {
+		t.Errorf("state files left: %v", files)
+	}
+}
+
+func verifyS3(t *testing.T, client *s3.Client, sc S3Config) (int, string) {
+	t.Helper()
+	var out strings.Builder
+	problems, err := verifyS3Archive(context.Background(), client, sc, true, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return problems, out.String()
+}
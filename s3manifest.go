@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"kinesis_consumer/consumer"
+)
+
+// s3Manifest commits a batch of a shard to the s3 handler's archive: the objects it lists hold
+// exactly the shard's records from First to Last, and Previous chains it to the shard's manifest
+// before, so a missing or doubled batch shows as a break in the chain. Objects no manifest lists
+// are left over from uploads that didn't get to commit, and their records are in a later batch.
+type s3Manifest struct {
+	Shard string `json:"shard"`
+	// First and Last are the positions of the batch's first and last record, see recordPosition.
+	First string `json:"first"`
+	Last  string `json:"last"`
+	// Previous is the Last of the shard's manifest before this one, empty for its first.
+	Previous string           `json:"previous"`
+	Records  int              `json:"records"`
+	Objects  []manifestObject `json:"objects"`
+	Written  time.Time        `json:"written"`
+}
+
+type manifestObject struct {
+	Key     string `json:"key"`
+	First   string `json:"first"`
+	Last    string `json:"last"`
+	Records int    `json:"records"`
+	Bytes   int64  `json:"bytes"`
+	SHA256  string `json:"sha256"` // of the object as stored, compressed
+}
+
+// recordPosition is where a record is in its shard: its sequence number, with a . and the
+// sub-sequence number after it for the user records of an aggregated record.
+func recordPosition(r *consumer.Record) string {
+	if r.Aggregated {
+		return r.SequenceNumber + "." + strconv.Itoa(r.SubSequenceNumber)
+	}
+	return r.SequenceNumber
+}
+
+func splitPosition(p string) (seq string, sub int) {
+	seq, s, _ := strings.Cut(p, ".")
+	sub, _ = strconv.Atoi(s)
+	return seq, sub
+}
+
+func positionLess(a, b string) bool {
+	seqA, subA := splitPosition(a)
+	seqB, subB := splitPosition(b)
+	if seqA != seqB {
+		return sequenceLess(seqA, seqB)
+	}
+	return subA < subB
+}
+
+// positionKey pads a position so that manifest keys sort in position order.
+func positionKey(p string) string {
+	seq, sub := splitPosition(p)
+	return fmt.Sprintf("%s%s.%05d", strings.Repeat("0", max(0, 64-len(seq))), seq, sub)
+}
+
+// s3Manifests writes the manifests of an s3 handler, under <prefix><shard>/, named after the
+// padded positions of their first and last record, with <prefix><shard>/latest naming the newest.
+type s3Manifests struct {
+	client *s3.Client
+	bucket string
+	prefix string
+
+	mu     sync.Mutex
+	shards map[string]*manifestState
+}
+
+type manifestState struct {
+	// resume is the Last of the shard's newest manifest when the handler started: records up to
+	// it were archived before a restart and are dropped when they are delivered again
+	resume string
+	// last is the Last of the shard's newest manifest, the Previous of its next one
+	last string
+}
+
+// unarchived drops the lines that were archived before the handler started.
+func (st *manifestState) unarchived(lines []s3Line) []s3Line {
+	if st.resume == "" {
+		return lines
+	}
+	var out []s3Line
+	for _, l := range lines {
+		if positionLess(st.resume, l.position) {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// state returns a shard's manifest state, read from the bucket the first time.
+func (m *s3Manifests) state(shard string) (*manifestState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if st := m.shards[shard]; st != nil {
+		return st, nil
+	}
+	newest, err := m.newest(context.TODO(), shard)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the manifests of %s: %w", shard, err)
+	}
+	st := &manifestState{}
+	if newest != nil {
+		st.resume, st.last = newest.Last, newest.Last
+		fmt.Printf("s3 archive of %s resumes after %s\n", shard, newest.Last)
+	}
+	m.shards[shard] = st
+	return st, nil
+}
+
+// newest returns the shard's newest manifest, nil if it has none: the one latest names, or one
+// put after it if the handler stopped before updating latest.
+func (m *s3Manifests) newest(ctx context.Context, shard string) (*s3Manifest, error) {
+	dir := m.prefix + shard + "/"
+	after, err := m.get(ctx, dir+"latest")
+	if err != nil && !isNoSuchKey(err) {
+		return nil, err
+	}
+	newest := string(after)
+
+	in := &s3.ListObjectsV2Input{Bucket: aws.String(m.bucket), Prefix: aws.String(dir)}
+	if newest != "" {
+		in.StartAfter = aws.String(newest)
+	}
+	pages := s3.NewListObjectsV2Paginator(m.client, in)
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			if key := aws.ToString(obj.Key); strings.HasSuffix(key, ".json") && key > newest {
+				newest = key
+			}
+		}
+	}
+	if newest == "" {
+		return nil, nil
+	}
+	return m.manifest(ctx, newest)
+}
+
+func (m *s3Manifests) manifest(ctx context.Context, key string) (*s3Manifest, error) {
+	data, err := m.get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	var manifest s3Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", key, err)
+	}
+	return &manifest, nil
+}
+
+func (m *s3Manifests) get(ctx context.Context, key string) ([]byte, error) {
+	out, err := m.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(m.bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+func (m *s3Manifests) put(ctx context.Context, key, contentType string, body []byte) error {
+	_, err := m.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(m.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put s3://%s/%s: %w", m.bucket, key, err)
+	}
+	return nil
+}
+
+// commit writes the manifest of the objects a batch of shard was put as, then points latest at it.
+func (m *s3Manifests) commit(shard string, st *manifestState, objects []manifestObject) error {
+	manifest := s3Manifest{
+		Shard:    shard,
+		First:    objects[0].First,
+		Last:     objects[0].Last,
+		Previous: st.last,
+		Objects:  objects,
+		Written:  wallClock.Now().UTC(),
+	}
+	for _, o := range objects {
+		if positionLess(o.First, manifest.First) {
+			manifest.First = o.First
+		}
+		if positionLess(manifest.Last, o.Last) {
+			manifest.Last = o.Last
+		}
+		manifest.Records += o.Records
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.TODO()
+	key := m.prefix + shard + "/" + positionKey(manifest.First) + "-" + positionKey(manifest.Last) + ".json"
+	if err := m.put(ctx, key, "application/json", data); err != nil {
+		return err
+	}
+	// the batch is committed; a failed pointer update is caught up with by listing on a restart
+	st.last = manifest.Last
+	if err := m.put(ctx, m.prefix+shard+"/latest", "text/plain", []byte(key)); err != nil {
+		fmt.Printf("\tupdating the latest manifest of %s failed, err=%+v\n", shard, err)
+	}
+	return nil
+}
+
+func isNoSuchKey(err error) bool {
+	var noSuchKey *s3types.NoSuchKey
+	return errors.As(err, &noSuchKey)
+}
+
+// runVerifyS3 is the "verify-s3" subcommand. It checks the manifests of the s3 handler's archive,
+// that each shard's chain has no gaps and no overlaps and that the objects they list are there
+// (with -deep, that they hold what the manifest says), and lists the objects no manifest has.
+func runVerifyS3(configPath string, args []string) {
+	fs := flag.NewFlagSet("verify-s3", flag.ExitOnError)
+	deep := fs.Bool("deep", false, "download every object and check its checksum and record count")
+	fs.Parse(args)
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if cfg.Handler != "s3" {
+		fatalf("the config's handler is %q, verify-s3 checks the archive of the s3 handler", cfg.Handler)
+	}
+	sc := S3Config{ManifestPrefix: "_manifests/"}
+	if err := json.Unmarshal(cfg.HandlerConfig, &sc); err != nil {
+		fatalf("invalid s3 handler_config: %v", err)
+	}
+	client, err := sc.client()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	problems, err := verifyS3Archive(context.Background(), client, sc, *deep, os.Stdout)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if problems > 0 {
+		fmt.Printf("%d problem(s)\n", problems)
+		os.Exit(1)
+	}
+	fmt.Println("every batch is archived once")
+}
+
+// verifyS3Archive prints what it finds in the archive sc writes and returns the number of problems.
+func verifyS3Archive(ctx context.Context, client *s3.Client, sc S3Config, deep bool, out io.Writer) (int, error) {
+	m := &s3Manifests{client: client, bucket: sc.Bucket, prefix: sc.ManifestPrefix}
+	problems := 0
+	problem := func(format string, args ...any) {
+		problems++
+		fmt.Fprintf(out, "WARN     "+format+"\n", args...)
+	}
+
+	manifestKeys, err := listKeys(ctx, client, sc.Bucket, sc.ManifestPrefix)
+	if err != nil {
+		return 0, err
+	}
+	byShard := make(map[string][]string)
+	for _, key := range manifestKeys {
+		shard, name, ok := strings.Cut(strings.TrimPrefix(key, sc.ManifestPrefix), "/")
+		if ok && strings.HasSuffix(name, ".json") {
+			byShard[shard] = append(byShard[shard], key)
+		}
+	}
+	shards := make([]string, 0, len(byShard))
+	for shard := range byShard {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+
+	listed := make(map[string]bool)
+	for _, shard := range shards {
+		// keys are padded positions, so they list in order
+		var prev *s3Manifest
+		records := 0
+		for _, key := range byShard[shard] {
+			manifest, err := m.manifest(ctx, key)
+			if err != nil {
+				return 0, err
+			}
+			switch {
+			case prev == nil && manifest.Previous != "":
+				problem("%s: the first manifest, %s, follows %s, whose manifest is missing", shard, key, manifest.Previous)
+			case prev != nil && !positionLess(prev.Last, manifest.First):
+				problem("%s: %s overlaps the manifest before it, records from %s to %s are archived twice",
+					shard, key, manifest.First, prev.Last)
+			case prev != nil && manifest.Previous != prev.Last:
+				problem("%s: the manifests between %s and %s are missing", shard, prev.Last, manifest.First)
+			}
+			n := 0
+			for _, o := range manifest.Objects {
+				listed[o.Key] = true
+				n += o.Records
+				if err := checkManifestObject(ctx, client, sc, o, deep); err != nil {
+					problem("%s: %s lists %s: %v", shard, key, o.Key, err)
+				}
+			}
+			if n != manifest.Records {
+				problem("%s: %s counts %d records, its objects %d", shard, key, manifest.Records, n)
+			}
+			records += manifest.Records
+			prev = manifest
+		}
+		fmt.Fprintf(out, "ok       %s: %d batches, %d records up to %s\n", shard, len(byShard[shard]), records, prev.Last)
+	}
+
+	// objects are under the part of the prefix before its first placeholder
+	static, _, _ := strings.Cut(sc.Prefix, "{")
+	keys, err := listKeys(ctx, client, sc.Bucket, static)
+	if err != nil {
+		return 0, err
+	}
+	orphans := 0
+	for _, key := range keys {
+		if !listed[key] && !strings.HasPrefix(key, sc.ManifestPrefix) && strings.Contains(key, ".jsonl") {
+			orphans++
+			fmt.Fprintf(out, "         %s is in no manifest, left over from an upload that didn't commit\n", key)
+		}
+	}
+	if orphans > 0 {
+		fmt.Fprintf(out, "%d object(s) in no manifest can be deleted, their records are in later batches\n", orphans)
+	}
+	return problems, nil
+}
+
+// checkManifestObject checks that an object is there with the size, and with deep the checksum and
+// record count, its manifest says.
+func checkManifestObject(ctx context.Context, client *s3.Client, sc S3Config, o manifestObject, deep bool) error {
+	if !deep {
+		head, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(sc.Bucket), Key: aws.String(o.Key)})
+		if err != nil {
+			return err
+		}
+		if size := aws.ToInt64(head.ContentLength); size != o.Bytes {
+			return fmt.Errorf("it is %d bytes, not %d", size, o.Bytes)
+		}
+		return nil
+	}
+
+	m := &s3Manifests{client: client, bucket: sc.Bucket}
+	data, err := m.get(ctx, o.Key)
+	if err != nil {
+		return err
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != o.SHA256 {
+		return fmt.Errorf("its checksum doesn't match")
+	}
+	switch sc.Compression.Codec {
+	case "gzip":
+		data, err = gzipDecompress(data)
+	case "zstd":
+		data, err = zstdDecompress(data)
+	}
+	if err != nil {
+		return err
+	}
+	if n := bytes.Count(data, []byte("\n")); n != o.Records {
+		return fmt.Errorf("it has %d records, not %d", n, o.Records)
+	}
+	return nil
+}
+
+func listKeys(ctx context.Context, client *s3.Client, bucket, prefix string) ([]string, error) {
+	var keys []string
+	pages := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(prefix)})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list s3://%s/%s: %w", bucket, prefix, err)
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.ToString(obj.Key))
+		}
+	}
+	return keys, nil
+}
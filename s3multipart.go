@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"kinesis_consumer/consumer"
+)
+
+// S3MultipartConfig uploads the s3 handler's objects in parts, acknowledging records as soon as
+// the part they are in is uploaded and its state is saved, so objects can grow far beyond what a
+// batch holds in memory and a restart continues them instead of reading them from Kinesis again.
+//
+//	"multipart": {"state_dir": "s3-uploads", "part_size": "16MB", "object_size": "1GB", "max_age": "15m"}
+type S3MultipartConfig struct {
+	// StateDir keeps the state of the uploads in progress, one file each. Multipart is off when empty.
+	StateDir string `json:"state_dir"`
+	// PartSize is 8MB when not set, at least the 5MB S3 takes.
+	PartSize byteSize `json:"part_size"`
+	// ObjectSize completes an object once that much of it was uploaded, 1GB when not set.
+	ObjectSize byteSize `json:"object_size"`
+	// MaxAge completes an object that long after it was started, 10m when not set.
+	MaxAge Duration `json:"max_age"`
+}
+
+// s3MinPartBytes is the smallest part S3 takes, the last one of an object aside.
+const s3MinPartBytes = 5 << 20
+
+func (mc *S3MultipartConfig) setDefaults() error {
+	if mc.PartSize == 0 {
+		mc.PartSize = 8 << 20
+	}
+	if mc.PartSize < s3MinPartBytes {
+		return fmt.Errorf("multipart part_size must be at least 5MB, got %d bytes", mc.PartSize)
+	}
+	if mc.ObjectSize == 0 {
+		mc.ObjectSize = 1 << 30
+	}
+	if mc.MaxAge.Duration <= 0 {
+		mc.MaxAge.Duration = 10 * time.Minute
+	}
+	return nil
+}
+
+// multipartState is what is saved of an upload in progress after each part, enough to continue
+// it after a restart: the records up to Last are in its parts.
+type multipartState struct {
+	Key      string          `json:"key"`
+	UploadID string          `json:"upload_id"`
+	Prefix   string          `json:"prefix"`
+	Shard    string          `json:"shard"`
+	First    string          `json:"first"`
+	Last     string          `json:"last"`
+	Records  int             `json:"records"`
+	Bytes    int64           `json:"bytes"`
+	Started  time.Time       `json:"started"`
+	Parts    []multipartPart `json:"parts"`
+	// SHA256 is the state of the checksum of the parts so far, for the manifest.
+	SHA256 []byte `json:"sha256"`
+}
+
+type multipartPart struct {
+	Number int32  `json:"number"`
+	ETag   string `json:"etag"`
+}
+
+// multipartObject is an upload in progress and the records that will be its next part.
+type multipartObject struct {
+	mu    sync.Mutex
+	state multipartState
+	path  string // of the state file
+	hash  hash.Hash
+	timer *time.Timer
+	// done is set once the object was completed (or given up on), records go to a new one then
+	done bool
+
+	// buf is the next part, compressed as it's written to zw; S3's minimum part size is about
+	// what is uploaded, so parts are cut by their compressed size
+	buf bytes.Buffer
+	zw  io.WriteCloser
+	// bufEnd is the position of the last record in buf
+	bufEnd     string
+	bufRecords int
+	acks       []func(error)
+}
+
+// s3Multipart keeps an s3 handler's uploads in progress, one per prefix and shard.
+type s3Multipart struct {
+	w   *s3Writer
+	cfg S3MultipartConfig
+
+	mu      sync.Mutex
+	objects map[[2]string]*multipartObject
+}
+
+func newS3Multipart(w *s3Writer, cfg S3MultipartConfig) (*s3Multipart, error) {
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cfg.StateDir, 0755); err != nil {
+		return nil, err
+	}
+	u := &s3Multipart{w: w, cfg: cfg, objects: make(map[[2]string]*multipartObject)}
+	if err := u.resume(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// resume picks up the uploads a previous run left in progress. An upload that was completed
+// before its state file was removed only gets its manifest; one S3 no longer has (aborted, or
+// expired by a lifecycle rule) lost the records of its parts, which is logged for a replay.
+func (u *s3Multipart) resume() error {
+	paths, err := filepath.Glob(filepath.Join(u.cfg.StateDir, "*.json"))
+	if err != nil {
+		return err
+	}
+	ctx := context.TODO()
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		obj := &multipartObject{path: path, hash: sha256.New()}
+		if err := json.Unmarshal(data, &obj.state); err != nil {
+			return fmt.Errorf("invalid upload state %s: %w", path, err)
+		}
+		if err := obj.hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(obj.state.SHA256); err != nil {
+			return fmt.Errorf("invalid upload state %s: %w", path, err)
+		}
+		st := obj.state
+
+		_, err = u.w.client.ListParts(ctx, &s3.ListPartsInput{Bucket: aws.String(u.w.cfg.Bucket), Key: aws.String(st.Key), UploadId: aws.String(st.UploadID)})
+		var noSuchUpload *s3types.NoSuchUpload
+		switch {
+		case errors.As(err, &noSuchUpload):
+			if _, err := u.w.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(u.w.cfg.Bucket), Key: aws.String(st.Key)}); err != nil {
+				fmt.Printf("warning: the upload of s3://%s/%s is gone, records %s to %s of %s were lost, replay them\n",
+					u.w.cfg.Bucket, st.Key, st.First, st.Last, st.Shard)
+			} else if err := u.commit(obj); err != nil {
+				return err
+			}
+			os.Remove(path)
+			continue
+		case err != nil:
+			return fmt.Errorf("failed to list the parts of s3://%s/%s: %w", u.w.cfg.Bucket, st.Key, err)
+		}
+
+		k := [2]string{st.Prefix, st.Shard}
+		if u.objects[k] != nil {
+			// an upload that failed to complete, with a newer one started after it
+			if err := u.complete(obj); err != nil {
+				return fmt.Errorf("failed to complete s3://%s/%s: %w", u.w.cfg.Bucket, st.Key, err)
+			}
+			continue
+		}
+		fmt.Printf("continuing the upload of s3://%s/%s after %s\n", u.w.cfg.Bucket, st.Key, st.Last)
+		obj.timer = time.AfterFunc(max(0, u.cfg.MaxAge.Duration-wallClock.Now().Sub(st.Started)), func() { u.expire(obj) })
+		u.objects[k] = obj
+	}
+	return nil
+}
+
+// add queues a record's line for the next part of its object, and uploads the part once it's
+// big enough. The record is acknowledged when its part was uploaded, or dropped when it already
+// was before a restart.
+func (u *s3Multipart) add(ctx context.Context, prefix string, r *consumer.Record, line []byte) error {
+	ack := consumer.Async(ctx)
+	if ack == nil {
+		// outside the consumer, the record is written when its object completes
+		ack = func(error) {}
+	}
+	position := recordPosition(r)
+	if u.w.manifests != nil {
+		st, err := u.w.manifests.state(r.ShardID)
+		if err != nil {
+			return err
+		}
+		if st.resume != "" && !positionLess(st.resume, position) {
+			ack(nil)
+			return nil
+		}
+	}
+
+	obj, err := u.object(prefix, r.ShardID, position)
+	if err != nil {
+		return err
+	}
+	defer obj.mu.Unlock()
+	if obj.state.Last != "" && !positionLess(obj.state.Last, position) {
+		ack(nil)
+		return nil
+	}
+	if obj.zw == nil {
+		if obj.zw, err = u.w.cfg.Compression.writer(&obj.buf); err != nil {
+			return err
+		}
+	}
+	if _, err := obj.zw.Write(line); err != nil {
+		return err
+	}
+	obj.bufEnd = position
+	obj.bufRecords++
+	obj.acks = append(obj.acks, ack)
+
+	if obj.buf.Len() >= int(u.cfg.PartSize) {
+		if err := u.uploadPart(obj); err != nil {
+			fmt.Printf("\tuploading a part of s3://%s/%s failed, err=%+v\n", u.w.cfg.Bucket, obj.state.Key, err)
+		}
+	}
+	if obj.state.Bytes >= int64(u.cfg.ObjectSize) {
+		u.finish(obj)
+	}
+	return nil
+}
+
+// object returns the upload in progress for prefix and shard, locked, starting one at position
+// if there is none.
+func (u *s3Multipart) object(prefix, shard, position string) (*multipartObject, error) {
+	for {
+		u.mu.Lock()
+		obj := u.objects[[2]string{prefix, shard}]
+		if obj == nil {
+			var err error
+			if obj, err = u.create(prefix, shard, position); err != nil {
+				u.mu.Unlock()
+				return nil, err
+			}
+			u.objects[[2]string{prefix, shard}] = obj
+		}
+		u.mu.Unlock()
+		obj.mu.Lock()
+		if !obj.done {
+			return obj, nil
+		}
+		obj.mu.Unlock()
+		u.remove(obj)
+	}
+}
+
+// create starts an upload, <prefix><shard>-<first position>.jsonl with the codec's extension.
+func (u *s3Multipart) create(prefix, shard, position string) (*multipartObject, error) {
+	key := prefix + shard + "-" + position + ".jsonl" + compressionExtension(u.w.cfg.Compression.Codec)
+	in := &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(u.w.cfg.Bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String("application/x-ndjson"),
+	}
+	if u.w.cfg.Compression.Codec != "" {
+		in.ContentEncoding = aws.String(u.w.cfg.Compression.Codec)
+	}
+	out, err := u.w.client.CreateMultipartUpload(context.TODO(), in)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start the upload of s3://%s/%s: %w", u.w.cfg.Bucket, key, err)
+	}
+	sum := sha256.Sum256([]byte(key))
+	obj := &multipartObject{
+		path: filepath.Join(u.cfg.StateDir, hex.EncodeToString(sum[:8])+".json"),
+		hash: sha256.New(),
+		state: multipartState{
+			Key:      key,
+			UploadID: aws.ToString(out.UploadId),
+			Prefix:   prefix,
+			Shard:    shard,
+			First:    position,
+			Started:  wallClock.Now().UTC(),
+		},
+	}
+	obj.timer = time.AfterFunc(u.cfg.MaxAge.Duration, func() { u.expire(obj) })
+	return obj, nil
+}
+
+// uploadPart uploads what is queued as the object's next part, saves its state and acknowledges
+// the part's records. obj.mu must be held.
+func (u *s3Multipart) uploadPart(obj *multipartObject) error {
+	if obj.bufRecords == 0 {
+		return nil
+	}
+	acks := obj.acks
+	err := u.putPart(obj)
+	for _, ack := range acks {
+		ack(err)
+	}
+	obj.buf.Reset()
+	obj.zw, obj.bufEnd, obj.bufRecords, obj.acks = nil, "", 0, nil
+	return err
+}
+
+func (u *s3Multipart) putPart(obj *multipartObject) error {
+	if err := obj.zw.Close(); err != nil {
+		return err
+	}
+	data := obj.buf.Bytes()
+	number := int32(len(obj.state.Parts) + 1)
+	out, err := u.w.client.UploadPart(context.TODO(), &s3.UploadPartInput{
+		Bucket:     aws.String(u.w.cfg.Bucket),
+		Key:        aws.String(obj.state.Key),
+		UploadId:   aws.String(obj.state.UploadID),
+		PartNumber: aws.Int32(number),
+		Body:       bytes.NewReader(data),
+	})
+	if err != nil {
+		return err
+	}
+
+	st := obj.state
+	st.Parts = append(st.Parts[:len(st.Parts):len(st.Parts)], multipartPart{Number: number, ETag: aws.ToString(out.ETag)})
+	st.Last = obj.bufEnd
+	st.Records += obj.bufRecords
+	st.Bytes += int64(len(data))
+	hashed, err := cloneHash(obj.hash)
+	if err != nil {
+		return err
+	}
+	hashed.Write(data)
+	if st.SHA256, err = hashed.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+		return err
+	}
+	if err := saveMultipartState(obj.path, st); err != nil {
+		// the part is uploaded again under the same number once its records come again
+		return err
+	}
+	obj.state, obj.hash = st, hashed
+	return nil
+}
+
+// cloneHash copies a sha256 hash with what was written to it so far.
+func cloneHash(h hash.Hash) (hash.Hash, error) {
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	c := sha256.New()
+	return c, c.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+}
+
+// saveMultipartState replaces the state file at path, so a crash leaves the old or the new one.
+func saveMultipartState(path string, st multipartState) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// finish uploads the last part of an object and completes it. Records go to a new object after.
+// obj.mu must be held.
+func (u *s3Multipart) finish(obj *multipartObject) {
+	obj.done = true
+	obj.timer.Stop()
+	if err := u.uploadPart(obj); err != nil {
+		fmt.Printf("\tuploading the last part of s3://%s/%s failed, err=%+v\n", u.w.cfg.Bucket, obj.state.Key, err)
+	}
+	if err := u.complete(obj); err != nil {
+		// the state file stays, the next start completes the upload
+		fmt.Printf("\tcompleting s3://%s/%s failed, err=%+v\n", u.w.cfg.Bucket, obj.state.Key, err)
+	}
+}
+
+func (u *s3Multipart) complete(obj *multipartObject) error {
+	ctx := context.TODO()
+	st := obj.state
+	if len(st.Parts) == 0 {
+		u.w.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket: aws.String(u.w.cfg.Bucket), Key: aws.String(st.Key), UploadId: aws.String(st.UploadID),
+		})
+		os.Remove(obj.path)
+		return nil
+	}
+	parts := make([]s3types.CompletedPart, len(st.Parts))
+	for i, p := range st.Parts {
+		parts[i] = s3types.CompletedPart{PartNumber: aws.Int32(p.Number), ETag: aws.String(p.ETag)}
+	}
+	_, err := u.w.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(u.w.cfg.Bucket),
+		Key:             aws.String(st.Key),
+		UploadId:        aws.String(st.UploadID),
+		MultipartUpload: &s3types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return err
+	}
+	if err := u.commit(obj); err != nil {
+		return err
+	}
+	return os.Remove(obj.path)
+}
+
+// commit writes the manifest of a completed object, unless it already has one.
+func (u *s3Multipart) commit(obj *multipartObject) error {
+	m := u.w.manifests
+	if m == nil {
+		return nil
+	}
+	st := obj.state
+	ms, err := m.state(st.Shard)
+	if err != nil {
+		return err
+	}
+	if ms.last != "" && !positionLess(ms.last, st.Last) {
+		return nil
+	}
+	return m.commit(st.Shard, ms, []manifestObject{{
+		Key:     st.Key,
+		First:   st.First,
+		Last:    st.Last,
+		Records: st.Records,
+		Bytes:   st.Bytes,
+		SHA256:  hex.EncodeToString(obj.hash.Sum(nil)),
+	}})
+}
+
+// expire completes an object once it is max_age old.
+func (u *s3Multipart) expire(obj *multipartObject) {
+	obj.mu.Lock()
+	if !obj.done {
+		u.finish(obj)
+	}
+	obj.mu.Unlock()
+	u.remove(obj)
+}
+
+func (u *s3Multipart) remove(obj *multipartObject) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	k := [2]string{obj.state.Prefix, obj.state.Shard}
+	if u.objects[k] == obj {
+		delete(u.objects, k)
+	}
+}
+
+// close completes every object in progress.
+func (u *s3Multipart) close() {
+	u.mu.Lock()
+	objects := make([]*multipartObject, 0, len(u.objects))
+	for _, obj := range u.objects {
+		objects = append(objects, obj)
+	}
+	u.objects = make(map[[2]string]*multipartObject)
+	u.mu.Unlock()
+	for _, obj := range objects {
+		obj.mu.Lock()
+		if !obj.done {
+			u.finish(obj)
+		}
+		obj.mu.Unlock()
+	}
+}
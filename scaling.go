@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ScalingConfig feeds the required_workers metric an autoscaler (e.g. a Kubernetes HPA on an
+// external metric) can target.
+type ScalingConfig struct {
+	// Instances is how many consumers are currently deployed, used to warn about idle ones.
+	Instances int `json:"instances"`
+	// MaxShardsPerWorker is how many shards one instance keeps up with when not lagging. Defaults to 4.
+	MaxShardsPerWorker int `json:"max_shards_per_worker"`
+	// LagThreshold is how far behind a shard can be before it wants a worker of its own. Defaults to 1m.
+	LagThreshold Duration `json:"lag_threshold"`
+}
+
+const scalingInterval = time.Minute
+
+var (
+	openShardsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "open_shards",
+		Help:      "Open shards in the stream.",
+	})
+	requiredWorkersGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "required_workers",
+		Help:      "Consumer instances needed for the current shard count and lag.",
+	})
+)
+
+// shardLag is the latest MillisBehindLatest seen per shard.
+var shardLag sync.Map // shard id -> time.Duration
+
+func recordLag(shardID string, millisBehind *int64) {
+	if millisBehind != nil {
+		shardLag.Store(shardID, time.Duration(*millisBehind)*time.Millisecond)
+	}
+}
+
+// requiredWorkers gives every lagging shard a worker of its own and packs the rest
+// MaxShardsPerWorker to a worker. There's no point in more workers than shards.
+func requiredWorkers(sc ScalingConfig, openShards int) int {
+	lagging := 0
+	shardLag.Range(func(_, v any) bool {
+		if v.(time.Duration) > sc.LagThreshold.Duration {
+			lagging++
+		}
+		return true
+	})
+	lagging = min(lagging, openShards)
+
+	rest := openShards - lagging
+	return min(openShards, lagging+(rest+sc.MaxShardsPerWorker-1)/sc.MaxShardsPerWorker)
+}
+
+// watchScaling updates the scaling metrics every minute until ctx is done.
+func watchScaling(ctx context.Context, client *kinesis.Client, cfg *Config) {
+	sc := cfg.Scaling
+	if sc.MaxShardsPerWorker <= 0 {
+		sc.MaxShardsPerWorker = 4
+	}
+	if sc.LagThreshold.Duration <= 0 {
+		sc.LagThreshold.Duration = time.Minute
+	}
+	name, streamARN := cfg.streamRef()
+
+	ticker := time.NewTicker(scalingInterval)
+	defer ticker.Stop()
+	for {
+		summary, err := client.DescribeStreamSummary(ctx, &kinesis.DescribeStreamSummaryInput{
+			StreamName: name,
+			StreamARN:  streamARN,
+		})
+		if err != nil && ctx.Err() == nil {
+			fmt.Printf("DescribeStreamSummary failed, scaling metrics not updated, err=%+v\n", err)
+		} else if err == nil {
+			shards := int(aws.ToInt32(summary.StreamDescriptionSummary.OpenShardCount))
+			openShardsGauge.Set(float64(shards))
+			requiredWorkersGauge.Set(float64(requiredWorkers(sc, shards)))
+			if sc.Instances > shards {
+				fmt.Printf("warning: %d instances for %d open shards, %d of them are idle\n",
+					sc.Instances, shards, sc.Instances-shards)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SchemaDriftConfig tracks the fields and types of JSON payloads and warns when a field shows up
+// that wasn't seen before, or with a type it didn't have, e.g. after a producer deploy.
+//
+//	"schema_drift": {"baseline": "schema.json", "report": "drift.json"}
+type SchemaDriftConfig struct {
+	// Enabled turns tracking on; so does setting Baseline.
+	Enabled bool `json:"enabled"`
+	// Baseline is the schema drift is measured against, read at startup if it exists and written
+	// on exit with everything seen, so the next run starts from it.
+	Baseline string `json:"baseline"`
+	// Warmup is how many records are learned from before drift is reported when there is no
+	// baseline yet, 1000 when not set.
+	Warmup int `json:"warmup"`
+	// Report is where the drift seen is written as JSON on exit.
+	Report string `json:"report"`
+}
+
+const (
+	// schemaMaxFields stops tracking payloads that use objects as maps, whose keys never repeat
+	schemaMaxFields = 10000
+	schemaMaxDepth  = 16
+)
+
+var schemaDriftEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "schema_drift_total",
+	Help:      "Fields seen for the first time (new_field) or with a new type (new_type) in JSON payloads.",
+}, []string{"kind"})
+
+// schemaDrift is what a drift report lists.
+type schemaDrift struct {
+	Kind           string    `json:"kind"`
+	Field          string    `json:"field"`
+	Type           string    `json:"type"`
+	Known          []string  `json:"known_types,omitempty"`
+	Time           time.Time `json:"time"`
+	Shard          string    `json:"shard"`
+	SequenceNumber string    `json:"sequence_number"`
+	// Count is how many records had it
+	Count int64 `json:"count"`
+}
+
+// schemaTracker keeps the types seen per field path ("a.b", "list[].id"), over the whole run,
+// across config reloads.
+type schemaTracker struct {
+	mu     sync.Mutex
+	cfg    SchemaDriftConfig
+	on     bool
+	stream string
+	fields map[string]map[string]bool
+	seen   int
+	// warm is set once drift is reported: after the warmup, or right away with a baseline
+	warm  bool
+	full  bool
+	drift []*schemaDrift
+	// byKey finds the drift entry of "field type" to count later occurrences
+	byKey map[string]*schemaDrift
+}
+
+var schemaDrifts = &schemaTracker{}
+
+// configure starts tracking for cfg, loading the baseline if there is one.
+func (st *schemaTracker) configure(cfg *Config) error {
+	sc := cfg.SchemaDrift
+	if !sc.Enabled && sc.Baseline == "" {
+		return nil
+	}
+	if sc.Warmup <= 0 {
+		sc.Warmup = 1000
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.cfg, st.on, st.stream = sc, true, cfg.StreamName
+	st.fields = make(map[string]map[string]bool)
+	st.byKey = make(map[string]*schemaDrift)
+	if sc.Baseline == "" {
+		return nil
+	}
+	data, err := os.ReadFile(sc.Baseline)
+	if os.IsNotExist(err) {
+		fmt.Println("no schema baseline at", sc.Baseline, "yet, learning from the first", sc.Warmup, "records")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var baseline map[string][]string
+	if err := json.Unmarshal(data, &baseline); err != nil {
+		return fmt.Errorf("invalid schema baseline %s: %w", sc.Baseline, err)
+	}
+	for field, types := range baseline {
+		st.fields[field] = make(map[string]bool)
+		for _, t := range types {
+			st.fields[field][t] = true
+		}
+	}
+	st.warm = true
+	return nil
+}
+
+// observe records the fields of a payload; payloads that aren't JSON objects are ignored.
+func (st *schemaTracker) observe(shardID, sequenceNumber string, data []byte) {
+	st.mu.Lock()
+	on := st.on
+	st.mu.Unlock()
+	if !on {
+		return
+	}
+	var payload map[string]any
+	if json.Unmarshal(data, &payload) != nil {
+		return
+	}
+	types := make(map[string]string)
+	walkSchema("", payload, 0, types)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.seen++
+	warm := st.warm
+	st.warm = st.warm || st.seen >= st.cfg.Warmup
+	for field, t := range types {
+		known, ok := st.fields[field]
+		if ok && known[t] {
+			if d := st.byKey[field+" "+t]; d != nil {
+				d.Count++
+			}
+			continue
+		}
+		if !ok && len(st.fields) >= schemaMaxFields {
+			if !st.full {
+				st.full = true
+				fmt.Printf("schema drift: more than %d fields, new ones aren't tracked (objects used as maps?)\n", schemaMaxFields)
+			}
+			continue
+		}
+		if warm {
+			st.report(field, t, known, shardID, sequenceNumber)
+		}
+		if !ok {
+			known = make(map[string]bool)
+			st.fields[field] = known
+		}
+		known[t] = true
+	}
+}
+
+// report adds a drift to the report and warns about it. st.mu must be held.
+func (st *schemaTracker) report(field, t string, known map[string]bool, shardID, sequenceNumber string) {
+	d := &schemaDrift{Kind: "new_field", Field: field, Type: t, Time: time.Now().UTC(), Shard: shardID, SequenceNumber: sequenceNumber, Count: 1}
+	if known != nil {
+		d.Kind, d.Known = "new_type", sortedKeys(known)
+		fmt.Printf("schema drift: %s is %s in %s %s, it was %v\n", field, t, shardID, sequenceNumber, d.Known)
+	} else {
+		fmt.Printf("schema drift: new field %s (%s) in %s %s\n", field, t, shardID, sequenceNumber)
+	}
+	schemaDriftEvents.WithLabelValues(d.Kind).Inc()
+	st.drift = append(st.drift, d)
+	st.byKey[field+" "+t] = d
+}
+
+// walkSchema records the JSON type of every field under v, arrays as path[].
+func walkSchema(path string, v any, depth int, types map[string]string) {
+	if depth > schemaMaxDepth {
+		return
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		if path != "" {
+			types[path] = "object"
+			path += "."
+		}
+		for k, child := range v {
+			walkSchema(path+k, child, depth+1, types)
+		}
+	case []any:
+		types[path] = "array"
+		for _, child := range v {
+			walkSchema(path+"[]", child, depth+1, types)
+		}
+	case string:
+		types[path] = "string"
+	case float64:
+		types[path] = "number"
+	case bool:
+		types[path] = "bool"
+	case nil:
+		types[path] = "null"
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// close prints the drift seen, writes the report and saves the baseline.
+func (st *schemaTracker) close() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.on {
+		return
+	}
+
+	fmt.Printf("schema drift: %d fields, %d changes in %d records\n", len(st.fields), len(st.drift), st.seen)
+	for _, d := range st.drift {
+		fmt.Printf("\t%-9s %-40s %-7s %d records\n", d.Kind, d.Field, d.Type, d.Count)
+	}
+	if st.cfg.Report != "" {
+		report, _ := json.MarshalIndent(map[string]any{
+			"stream": st.stream,
+			"fields": len(st.fields),
+			"drift":  st.drift,
+		}, "", "  ")
+		if err := os.WriteFile(st.cfg.Report, append(report, '\n'), 0644); err != nil {
+			fmt.Printf("writing the schema drift report failed, err=%+v\n", err)
+		}
+	}
+	if st.cfg.Baseline != "" {
+		baseline := make(map[string][]string, len(st.fields))
+		for field, types := range st.fields {
+			baseline[field] = sortedKeys(types)
+		}
+		data, _ := json.MarshalIndent(baseline, "", "  ")
+		if err := os.WriteFile(st.cfg.Baseline, append(data, '\n'), 0644); err != nil {
+			fmt.Printf("writing the schema baseline failed, err=%+v\n", err)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"kinesis_consumer/consumer"
+)
+
+// SentryConfig reports decode, handler and sink errors to Sentry, with the record's stream, shard,
+// sequence number and partition key.
+//
+//	"sentry": {"dsn": "https://key@o1.ingest.sentry.io/42", "environment": "prod", "max_per_minute": 10}
+type SentryConfig struct {
+	// DSN is the project's, SENTRY_DSN when not set. Off when neither is.
+	DSN         string `json:"dsn"`
+	Environment string `json:"environment"`
+	// IncludePayload adds the first 4KB of the payload to events. Payloads aren't sent by default.
+	IncludePayload bool `json:"include_payload"`
+	// MaxPerMinute caps the events sent, 10 when not set; the rest are counted in the next one.
+	MaxPerMinute int `json:"max_per_minute"`
+}
+
+const sentryMaxPayload = 4 << 10
+
+// sentryEvent is the part of a Sentry event the reporter fills in.
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   float64           `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	Logger      string            `json:"logger"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Message     string            `json:"message"`
+	Fingerprint []string          `json:"fingerprint"`
+	Tags        map[string]string `json:"tags"`
+	Extra       map[string]any    `json:"extra"`
+}
+
+// sentryReporter sends events in the background so reporting never holds up a shard. Events that
+// come while the queue is full, or over MaxPerMinute, are dropped. A nil reporter reports nothing.
+type sentryReporter struct {
+	cfg      SentryConfig
+	url      string
+	auth     string
+	stream   string
+	hostname string
+	client   *http.Client
+	queue    chan sentryEvent
+	done     chan struct{}
+
+	mu      sync.Mutex
+	minute  time.Time
+	sent    int
+	dropped int
+	// until is when Sentry said to stop sending until (429 Retry-After)
+	until  time.Time
+	closed bool
+}
+
+func newSentryReporter(cfg *Config) (*sentryReporter, error) {
+	sc := cfg.Sentry
+	if sc.DSN == "" {
+		sc.DSN = os.Getenv("SENTRY_DSN")
+	}
+	if sc.DSN == "" {
+		return nil, nil
+	}
+	if sc.MaxPerMinute <= 0 {
+		sc.MaxPerMinute = 10
+	}
+	// https://<public key>@<host>/<project id>
+	dsn, err := url.Parse(sc.DSN)
+	if err != nil || dsn.User == nil || dsn.Host == "" {
+		return nil, fmt.Errorf("sentry dsn %q is not https://key@host/project", sc.DSN)
+	}
+	path, project, _ := strings.Cut(strings.TrimPrefix(dsn.Path, "/"), "/")
+	if project == "" {
+		path, project = "", path
+	}
+	if project == "" {
+		return nil, fmt.Errorf("sentry dsn %q has no project id", sc.DSN)
+	}
+	if path != "" {
+		path = "/" + path
+	}
+
+	s := &sentryReporter{
+		cfg:    sc,
+		url:    fmt.Sprintf("%s://%s%s/api/%s/envelope/", dsn.Scheme, dsn.Host, path, project),
+		auth:   "Sentry sentry_version=7, sentry_client=kinesis_consumer/1.0, sentry_key=" + dsn.User.Username(),
+		stream: cfg.StreamName,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan sentryEvent, 100),
+		done:   make(chan struct{}),
+	}
+	s.hostname, _ = os.Hostname()
+	go s.run()
+	return s, nil
+}
+
+// errorRecord is what an event says about the record that failed.
+type errorRecord struct {
+	shardID, sequenceNumber, partitionKey string
+	payload                               []byte
+	// size is the payload's, also when it isn't kept
+	size int
+}
+
+func errorRecordOf(r *consumer.Record) errorRecord {
+	return errorRecord{r.ShardID, r.SequenceNumber, r.PartitionKey, r.Data, len(r.Data)}
+}
+
+// retainedErrorRecord is errorRecordOf for a failure reported after the handler returned, when
+// r.Data may belong to another record already: the payload is copied if events include it.
+func (s *sentryReporter) retainedErrorRecord(r *consumer.Record) errorRecord {
+	rec := errorRecordOf(r)
+	rec.payload = nil
+	if s != nil && s.cfg.IncludePayload {
+		rec.payload = bytes.Clone(r.Data)
+	}
+	return rec
+}
+
+// report sends err, which happened at kind ("decode", "handler" or "sink") of rec.
+func (s *sentryReporter) report(kind, handler string, rec errorRecord, err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	now := time.Now()
+	if minute := now.Truncate(time.Minute); !minute.Equal(s.minute) {
+		s.minute, s.sent = minute, 0
+	}
+	if s.sent >= s.cfg.MaxPerMinute || now.Before(s.until) {
+		s.dropped++
+		s.mu.Unlock()
+		return
+	}
+	s.sent++
+	dropped := s.dropped
+	s.dropped = 0
+	s.mu.Unlock()
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	ev := sentryEvent{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   float64(now.UnixMicro()) / 1e6,
+		Level:       "error",
+		Platform:    "go",
+		Logger:      "kinesis_consumer",
+		ServerName:  s.hostname,
+		Environment: s.cfg.Environment,
+		Message:     fmt.Sprintf("%s failed: %v", kind, err),
+		// one issue per kind and handler, not per record
+		Fingerprint: []string{"kinesis_consumer", kind, handler},
+		Tags: map[string]string{
+			"kind":     kind,
+			"stream":   s.stream,
+			"shard_id": rec.shardID,
+			"handler":  handler,
+		},
+		Extra: map[string]any{
+			"sequence_number": rec.sequenceNumber,
+			"partition_key":   rec.partitionKey,
+			"size":            rec.size,
+		},
+	}
+	if dropped > 0 {
+		ev.Extra["events_dropped_before"] = dropped
+	}
+	if s.cfg.IncludePayload {
+		head := rec.payload[:min(sentryMaxPayload, len(rec.payload))]
+		if utf8.Valid(head) {
+			ev.Extra["payload"] = string(head)
+		} else {
+			ev.Extra["payload_base64"] = base64.StdEncoding.EncodeToString(head)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- ev:
+	default:
+		s.dropped++
+	}
+}
+
+func (s *sentryReporter) run() {
+	defer close(s.done)
+	for ev := range s.queue {
+		if err := s.send(ev); err != nil {
+			fmt.Printf("sending an error to sentry failed, err=%+v\n", err)
+		}
+	}
+}
+
+func (s *sentryReporter) send(ev sentryEvent) error {
+	event, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "{\"event_id\":%q}\n{\"type\":\"event\",\"length\":%d}\n", ev.EventID, len(event))
+	body.Write(event)
+	body.WriteByte('\n')
+
+	req, err := http.NewRequest(http.MethodPost, s.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", s.auth)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		wait := time.Minute
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			wait = time.Duration(secs) * time.Second
+		}
+		s.mu.Lock()
+		s.until = time.Now().Add(wait)
+		s.mu.Unlock()
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("sentry returned %s", resp.Status)
+	}
+	return nil
+}
+
+// close sends what is queued; errors reported after it, e.g. late acks, are dropped.
+func (s *sentryReporter) close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.closed = true
+	close(s.queue)
+	s.mu.Unlock()
+	<-s.done
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+
+	"kinesis_consumer/consumer"
+)
+
+// allShards as shard_id reads every shard ListShards returns.
+const allShards = "*"
+
+// ShardFilterConfig narrows down which shards are read when shard_id is "*".
+//
+//	"shard_filter": {"type": "AT_LATEST"}
+//	"shard_filter": {"type": "FROM_TIMESTAMP", "timestamp": "2024-05-01T00:00:00Z"}
+type ShardFilterConfig struct {
+	// Type is a ListShards ShardFilterType: AT_LATEST, AT_TRIM_HORIZON, FROM_TRIM_HORIZON,
+	// AT_TIMESTAMP, FROM_TIMESTAMP or AFTER_SHARD_ID.
+	Type      string `json:"type"`
+	Timestamp string `json:"timestamp"`
+	ShardID   string `json:"shard_id"`
+}
+
+// how often the shard list is refreshed to pick up shards created by resharding
+const shardListInterval = time.Minute
+
+func (sf ShardFilterConfig) filter() (*types.ShardFilter, error) {
+	if sf.Type == "" {
+		return nil, nil
+	}
+
+	f := &types.ShardFilter{Type: types.ShardFilterType(sf.Type)}
+	if sf.Timestamp != "" {
+		ts, err := time.Parse(time.RFC3339, sf.Timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shard_filter timestamp: %w", err)
+		}
+		f.Timestamp = aws.Time(ts)
+	}
+	if sf.ShardID != "" {
+		f.ShardId = aws.String(sf.ShardID)
+	}
+	return f, nil
+}
+
+// listShards pages through ListShards, so streams with thousands of shards are listed completely.
+func listShards(ctx context.Context, client *kinesis.Client, cfg *Config) ([]types.Shard, error) {
+	filter, err := cfg.ShardFilter.filter()
+	if err != nil {
+		return nil, err
+	}
+
+	name, streamARN := cfg.streamRef()
+	in := &kinesis.ListShardsInput{
+		StreamName:  name,
+		StreamARN:   streamARN,
+		ShardFilter: filter,
+	}
+
+	var shards []types.Shard
+	for {
+		resp, err := client.ListShards(ctx, in)
+		if err != nil {
+			return nil, fmt.Errorf("ListShards failed: %w", err)
+		}
+		shards = append(shards, resp.Shards...)
+		if resp.NextToken == nil {
+			return shards, nil
+		}
+		// the stream and filter are part of the token, they must not be sent again
+		in = &kinesis.ListShardsInput{NextToken: resp.NextToken}
+	}
+}
+
+// consumeShards reads the configured shard, or with shard_id "*" every listed shard in parallel,
+// until ctx is cancelled. The shard list is refreshed every minute and whenever a shard closes,
+// so the children of a reshard are picked up. A child is only started once the parents it has
+// among the listed shards have been read to their end, so a key's records stay in order. With
+// lease.backend only the shards whose leases this consumer holds are read, and the leases are
+// taken every lease.balancer.rebalance_interval.
+func consumeShards(ctx context.Context, client *kinesis.Client, pipes *pipelineRef, store checkpointStore) {
+	cfg := pipes.config()
+	if cfg.ShardID != allShards {
+		processKinesisRecords(ctx, client, pipes, store, cfg.ShardID)
+		return
+	}
+
+	var wg sync.WaitGroup
+	started := make(map[string]bool)
+	// finished are the shards read to their end
+	finished := make(map[string]bool)
+	// ended gets the shards that stopped being read before ctx was cancelled: closed ones, and
+	// with leases the ones whose lease was lost
+	ended := make(chan shardEnd)
+	var shards []types.Shard
+
+	refresh := func(list bool) {
+		if list || shards == nil {
+			listed, err := listShards(ctx, client, cfg)
+			if err != nil {
+				if ctx.Err() == nil {
+					fmt.Printf("listing shards failed, err=%+v\n", err)
+				}
+				return
+			}
+			shards = listed
+		}
+		var leases *leaseListing
+		if shardLeases != nil {
+			var err error
+			if leases, err = shardLeases.list(ctx, cfg.StreamName); err != nil {
+				if ctx.Err() == nil {
+					fmt.Printf("listing leases failed, err=%+v\n", err)
+				}
+				return
+			}
+			for id := range leases.finished {
+				finished[id] = true
+			}
+		}
+
+		listed := make(map[string]bool, len(shards))
+		for _, shard := range shards {
+			listed[aws.ToString(shard.ShardId)] = true
+		}
+		var ready []types.Shard
+		for _, shard := range shards {
+			id := aws.ToString(shard.ShardId)
+			if finished[id] {
+				continue
+			}
+			if parent := unfinishedParent(shard, listed, finished); parent != "" {
+				if list {
+					fmt.Println("holding back", id, "until its parent", parent, "is closed")
+				}
+				continue
+			}
+			ready = append(ready, shard)
+		}
+		var held map[string]context.Context
+		if leases != nil {
+			ids := make([]string, len(ready))
+			for i, shard := range ready {
+				ids[i] = aws.ToString(shard.ShardId)
+			}
+			held = shardLeases.claim(ctx, leases, ids)
+		}
+
+		for _, shard := range ready {
+			id := aws.ToString(shard.ShardId)
+			shardCtx := ctx
+			if leases != nil {
+				if shardCtx = held[id]; shardCtx == nil {
+					continue
+				}
+			}
+			if started[id] {
+				continue
+			}
+			started[id] = true
+			fmt.Println("starting", id)
+			priorities.assign(shard)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer priorities.done(id)
+				err := processKinesisRecords(shardCtx, client, pipes, store, id)
+				select {
+				case ended <- shardEnd{id, errors.Is(err, consumer.ErrShardClosed)}:
+				case <-ctx.Done():
+				}
+			}()
+		}
+	}
+
+	ticker := time.NewTicker(shardListInterval)
+	defer ticker.Stop()
+	// leaseTicks takes leases between the shard list refreshes
+	var leaseTicks <-chan time.Time
+	if shardLeases != nil {
+		t := time.NewTicker(shardLeases.rebalanceInterval())
+		defer t.Stop()
+		leaseTicks = t.C
+	}
+
+	refresh(true)
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case e := <-ended:
+			if !e.closed {
+				// the lease was lost; the shard is started again if it is taken again
+				delete(started, e.shard)
+				continue
+			}
+			finished[e.shard] = true
+			if shardLeases != nil {
+				if err := shardLeases.finish(ctx, cfg.StreamName, e.shard); err != nil {
+					fmt.Printf("releasing the lease of closed %s failed, err=%+v\n", e.shard, err)
+				}
+			}
+			refresh(true)
+		case <-ticker.C:
+			refresh(true)
+		case <-leaseTicks:
+			refresh(false)
+		}
+	}
+}
+
+// shardEnd is a shard that stopped being read, closed when it was read to its end.
+type shardEnd struct {
+	shard  string
+	closed bool
+}
+
+// unfinishedParent returns a parent of shard that is listed but hasn't been read to its end, ""
+// when there is none. Parents that aren't listed are past the retention period or filtered out.
+func unfinishedParent(shard types.Shard, listed, finished map[string]bool) string {
+	for _, parent := range []*string{shard.ParentShardId, shard.AdjacentParentShardId} {
+		if id := aws.ToString(parent); id != "" && listed[id] && !finished[id] {
+			return id
+		}
+	}
+	return ""
+}
+
+// partitionKeyHash is the hash key Kinesis maps partitionKey to: the MD5 of the key, read as a
+// 128-bit unsigned integer.
+func partitionKeyHash(partitionKey string) *big.Int {
+	sum := md5.Sum([]byte(partitionKey))
+	return new(big.Int).SetBytes(sum[:])
+}
+
+// shardForPartitionKey finds the open shard Kinesis puts records with partitionKey into: the one
+// whose hash key range holds the key's hash key.
+func shardForPartitionKey(ctx context.Context, client *kinesis.Client, cfg *Config, partitionKey string) (string, error) {
+	hash := partitionKeyHash(partitionKey)
+
+	open := *cfg
+	open.ShardFilter = ShardFilterConfig{Type: string(types.ShardFilterTypeAtLatest)}
+	shards, err := listShards(ctx, client, &open)
+	if err != nil {
+		return "", err
+	}
+	for _, s := range shards {
+		if s.HashKeyRange == nil {
+			continue
+		}
+		start, ok1 := new(big.Int).SetString(aws.ToString(s.HashKeyRange.StartingHashKey), 10)
+		end, ok2 := new(big.Int).SetString(aws.ToString(s.HashKeyRange.EndingHashKey), 10)
+		if ok1 && ok2 && hash.Cmp(start) >= 0 && hash.Cmp(end) <= 0 {
+			return aws.ToString(s.ShardId), nil
+		}
+	}
+	return "", fmt.Errorf("no open shard of %s covers partition key %q (hash key %s)", cfg.StreamName, partitionKey, hash)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+func TestUnfinishedParent(t *testing.T) {
+	merged := types.Shard{
+		ShardId:               aws.String("shardId-000000000003"),
+		ParentShardId:         aws.String("shardId-000000000001"),
+		AdjacentParentShardId: aws.String("shardId-000000000002"),
+	}
+	listed := map[string]bool{"shardId-000000000001": true, "shardId-000000000002": true, "shardId-000000000003": true}
+
+	tests := []struct {
+		finished map[string]bool
+		listed   map[string]bool
+		want     string
+	}{
+		{map[string]bool{}, listed, "shardId-000000000001"},
+		{map[string]bool{"shardId-000000000001": true}, listed, "shardId-000000000002"},
+		{map[string]bool{"shardId-000000000001": true, "shardId-000000000002": true}, listed, ""},
+		// parents past the retention period aren't waited for
+		{map[string]bool{}, map[string]bool{"shardId-000000000003": true}, ""},
+	}
+	for i, tt := range tests {
+		if got := unfinishedParent(merged, tt.listed, tt.finished); got != tt.want {
+			t.Errorf("case %d: got %q, want %q", i, got, tt.want)
+		}
+	}
+	if got := unfinishedParent(types.Shard{ShardId: aws.String("shardId-000000000000")}, listed, nil); got != "" {
+		t.Errorf("shard without parents waits for %q", got)
+	}
+}
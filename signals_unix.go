@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	// shutdownSignals stop the consumer after the current batch.
+	shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	// reloadSignals make it reload the config file right away.
+	reloadSignals = []os.Signal{syscall.SIGHUP}
+)
@@ -0,0 +1,16 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	// Ctrl-C and Ctrl-Break arrive as os.Interrupt; closing the console, logging off and shutting
+	// down as SIGTERM.
+	shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	// Windows has no SIGHUP, the config file is still picked up when it changes.
+	reloadSignals []os.Signal
+)
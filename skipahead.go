@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SkipAheadConfig trades completeness for freshness: a shard that falls more than MaxLag behind
+// the tip jumps ahead instead of working through the backlog.
+//
+//	"skip_ahead": {"max_lag": "10m", "to": "1m"}
+type SkipAheadConfig struct {
+	// MaxLag is how far behind the tip a shard can get, skipping ahead is off when 0.
+	MaxLag Duration `json:"max_lag"`
+	// To is how far behind the tip reading starts again, 0 for LATEST.
+	To Duration `json:"to"`
+}
+
+var (
+	skipAheads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "skip_aheads_total",
+		Help:      "Times a shard jumped ahead because it was further behind than skip_ahead.max_lag.",
+	}, []string{"shard"})
+	recordsSkippedAhead = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "records_skipped_ahead",
+		Help:      "Records skipped by jumping ahead, estimated from the rate of the batch that triggered it.",
+	}, []string{"shard"})
+)
+
+func (sc SkipAheadConfig) validate() error {
+	if sc.MaxLag.Duration > 0 && sc.To.Duration >= sc.MaxLag.Duration {
+		return fmt.Errorf("skip_ahead.to (%s) must be less than max_lag (%s)", sc.To, sc.MaxLag)
+	}
+	return nil
+}
+
+// due tells whether a shard millisBehind the tip should jump ahead.
+func (sc SkipAheadConfig) due(millisBehind *int64) bool {
+	return sc.MaxLag.Duration > 0 && millisBehind != nil &&
+		time.Duration(*millisBehind)*time.Millisecond > sc.MaxLag.Duration
+}
+
+// target is where reading starts again: LATEST, or AT_TIMESTAMP To before now.
+func (sc SkipAheadConfig) target() (types.ShardIteratorType, *time.Time) {
+	if sc.To.Duration <= 0 {
+		return types.ShardIteratorTypeLatest, nil
+	}
+	return types.ShardIteratorTypeAtTimestamp, aws.Time(time.Now().Add(-sc.To.Duration))
+}
+
+// skipAhead logs and counts the jump over batch, which isn't handled, and the rest of the
+// backlog. Kinesis doesn't say how many records that is, so the backlog is estimated from the
+// rate at which batch's records arrived.
+func (sc SkipAheadConfig) skipAhead(shardID string, millisBehind int64, batch []types.Record) {
+	lag := time.Duration(millisBehind) * time.Millisecond
+	skipped := time.Duration(max(0, int64(lag-sc.To.Duration)))
+
+	estimate := float64(len(batch))
+	if len(batch) > 1 {
+		first := aws.ToTime(batch[0].ApproximateArrivalTimestamp)
+		last := aws.ToTime(batch[len(batch)-1].ApproximateArrivalTimestamp)
+		if span := last.Sub(first); span > 0 {
+			estimate += float64(len(batch)) / span.Seconds() * skipped.Seconds()
+		}
+	}
+
+	skipAheads.WithLabelValues(shardID).Inc()
+	recordsSkippedAhead.WithLabelValues(shardID).Add(estimate)
+	fmt.Printf("%s is %s behind, over skip_ahead.max_lag %s: skipping about %.0f records (%s of the stream)\n",
+		shardID, lag.Round(time.Second), sc.MaxLag, estimate, skipped.Round(time.Second))
+	// not an operator's doing, but it loses records like a reset does
+	operatorAudit.record("skip_ahead", "skip_ahead.max_lag", map[string]any{
+		"shard": shardID, "behind": lag.Round(time.Second).String(), "records_estimate": int64(estimate),
+	})
+}
@@ -0,0 +1,97 @@
+//go:build sqlite
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"kinesis_consumer/consumer"
+)
+
+// SQLiteConfig is the handler_config of the "sqlite" handler, in builds with -tags sqlite
+// (which needs cgo).
+//
+//	"handler": "sqlite",
+//	"handler_config": {"path": "capture.db", "table": "orders"}
+type SQLiteConfig struct {
+	Path string `json:"path"`
+	// Table is created if it doesn't exist, "records" when not set.
+	Table string `json:"table"`
+}
+
+func init() {
+	consumer.RegisterHandlerFactory("sqlite", newSQLiteWriter)
+	handlerConfigs["sqlite"] = SQLiteConfig{}
+}
+
+// sqliteWriter inserts records into one table of a local SQLite database, to query captured data
+// with SQL right away. A record already in the table (a replay) is left as it is.
+type sqliteWriter struct {
+	db     *sql.DB
+	insert *sql.Stmt
+}
+
+func newSQLiteWriter(raw json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+	cfg := SQLiteConfig{Table: "records"}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("invalid sqlite handler_config: %w", err)
+		}
+	}
+	if cfg.Path == "" {
+		return nil, nil, fmt.Errorf("the sqlite handler needs a path")
+	}
+	if !plainIdentifier.MatchString(cfg.Table) {
+		return nil, nil, fmt.Errorf("sqlite table %q is not a plain identifier", cfg.Table)
+	}
+
+	// WAL with synchronous=NORMAL makes a commit per record cheap enough
+	db, err := sql.Open("sqlite3", "file:"+cfg.Path+"?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open %s: %w", cfg.Path, err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS "` + cfg.Table + `" (
+		shard           TEXT NOT NULL,
+		sequence_number TEXT NOT NULL,
+		partition_key   TEXT NOT NULL,
+		arrival_time    TEXT NOT NULL,
+		event_time      TEXT,
+		data            TEXT NOT NULL,
+		PRIMARY KEY (shard, sequence_number)
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("failed to create table %s in %s: %w", cfg.Table, cfg.Path, err)
+	}
+	insert, err := db.Prepare(`INSERT OR IGNORE INTO "` + cfg.Table + `"
+		(shard, sequence_number, partition_key, arrival_time, event_time, data) VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	w := &sqliteWriter{db: db, insert: insert}
+	return w.handle, w, nil
+}
+
+func (w *sqliteWriter) handle(ctx context.Context, r *consumer.Record) error {
+	var eventTime any
+	if !r.EventTime.IsZero() {
+		eventTime = r.EventTime.UTC().Format(time.RFC3339Nano)
+	}
+	_, err := w.insert.ExecContext(ctx, r.ShardID, r.SequenceNumber, r.PartitionKey,
+		r.ArrivalTime.UTC().Format(time.RFC3339Nano), eventTime, string(r.Data))
+	return err
+}
+
+func (w *sqliteWriter) Close() error {
+	w.insert.Close()
+	return w.db.Close()
+}
@@ -0,0 +1,19 @@
+//go:build !sqlite
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+
+	"kinesis_consumer/consumer"
+)
+
+// Without -tags sqlite the handler is still known, so its config gets a clear error instead of
+// "unknown handler".
+func init() {
+	consumer.RegisterHandlerFactory("sqlite", func(json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+		return nil, nil, errors.New("the sqlite handler needs a build with -tags sqlite")
+	})
+}
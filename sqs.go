@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+
+	"kinesis_consumer/consumer"
+)
+
+// SQSConfig is the handler_config of the "sqs" handler, which sends records to an SQS queue.
+//
+//	"handler": "sqs",
+//	"handler_config": {"queue_url": "https://sqs.eu-west-1.amazonaws.com/123456789012/orders.fifo",
+//		"partition_key": {"template": "{customer.id}"}}
+type SQSConfig struct {
+	QueueURL string `json:"queue_url"`
+	// Region is AWS_REGION, or the consumer's default region, when not set.
+	Region string `json:"region"`
+	// EndpointURL is for LocalStack and the like.
+	EndpointURL string `json:"endpoint_url"`
+	// PartitionKey is the MessageGroupId of a FIFO queue, the record's partition key when not set.
+	PartitionKey PartitionKeyConfig `json:"partition_key"`
+	// Flush is 10 messages, 256KB and 100ms when not set, and one batch at a time for a FIFO queue.
+	Flush FlushConfig `json:"flush"`
+}
+
+const (
+	// SendMessageBatch takes at most 10 messages and 256KB a call, attributes included
+	sqsMaxBatch        = 10
+	sqsMaxBatchBytes   = 256 << 10
+	sqsMaxMessageBytes = 256 << 10
+	// sqsMaxGroupID is the longest MessageGroupId SQS takes
+	sqsMaxGroupID = 128
+	// sqsSendAttempts is how often messages SQS fails to take are sent before giving up
+	sqsSendAttempts = 5
+)
+
+func init() {
+	consumer.RegisterHandlerFactory("sqs", newSQSSender)
+}
+
+// sqsSender sends the decoded payloads to a queue with SendMessageBatch, batched and acknowledged
+// like the kinesis handler's. Every message has the record's idempotency key as its
+// idempotency_key attribute, and on a FIFO queue as its MessageDeduplicationId, so SQS drops
+// what a restart or replay sends again within its five minute deduplication interval. Payloads
+// SQS can't carry as text (binary, or not valid UTF-8) are sent base64 encoded, with a
+// content_transfer_encoding attribute of "base64".
+type sqsSender struct {
+	cfg    SQSConfig
+	fifo   bool
+	keyer  *partitionKeyer
+	client *sqs.Client
+	batch  *asyncBatcher
+}
+
+func newSQSSender(raw json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+	var cfg SQSConfig
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("invalid sqs handler_config: %w", err)
+		}
+	}
+	if cfg.QueueURL == "" {
+		return nil, nil, fmt.Errorf("the sqs handler needs a queue_url")
+	}
+	keyer, err := newPartitionKeyer(cfg.PartitionKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the queue's region, with the consumer's own -proxy and -ca-bundle
+	dest := &Config{Region: cfg.Region}
+	if dest.Region == "" {
+		dest.Region = os.Getenv("AWS_REGION")
+	}
+	if dest.Region == "" {
+		dest.Region = region
+	}
+	dest.AWS.EndpointURL = cfg.EndpointURL
+	awsCfg, err := loadAWSConfig(context.TODO(), dest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to load SDK config for the sqs handler, %v", err)
+	}
+
+	s := &sqsSender{cfg: cfg, fifo: strings.HasSuffix(cfg.QueueURL, ".fifo"), keyer: keyer, client: sqs.NewFromConfig(awsCfg)}
+	flush := FlushConfig{MaxRecords: sqsMaxBatch, MaxLatency: Duration{100 * time.Millisecond}}
+	if s.fifo {
+		// a group's messages are only in order when batches are sent one after the other
+		if cfg.Flush.MaxInFlight > 1 {
+			return nil, nil, fmt.Errorf("the sqs handler sends one batch at a time to a FIFO queue, flush.max_in_flight can't be %d", cfg.Flush.MaxInFlight)
+		}
+		flush.MaxInFlight = 1
+	}
+	s.batch = cfg.Flush.batcher("sqs", flush, sqsMaxBatch, sqsMaxBatchBytes, s.send)
+	return s.handle, s, nil
+}
+
+// handle queues the record as its group id, idempotency key and transfer encoding, with length
+// prefixes, followed by its body.
+func (s *sqsSender) handle(ctx context.Context, r *consumer.Record) error {
+	var group string
+	if s.fifo {
+		var err error
+		if group, err = s.keyer.key(r); err != nil {
+			return err
+		}
+		if len(group) > sqsMaxGroupID {
+			return fmt.Errorf("message group id %q is longer than the %d characters SQS takes, see partition_key.hash", group, sqsMaxGroupID)
+		}
+	}
+	body, encoding := string(r.Data), ""
+	if !sqsText(body) {
+		body, encoding = base64.StdEncoding.EncodeToString(r.Data), "base64"
+	}
+	item := appendField(nil, group)
+	item = appendField(item, r.IdempotencyKey())
+	item = appendField(item, encoding)
+	item = append(item, body...)
+	if len(item) > sqsMaxMessageBytes {
+		return fmt.Errorf("message is %d bytes with its attributes, more than the 256KB SQS takes", len(item))
+	}
+	return s.batch.add(ctx, item)
+}
+
+// sqsText says whether SQS takes s as a message body: valid UTF-8 of the characters XML allows.
+func sqsText(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c == '\t' || c == '\n' || c == '\r':
+		case c < 0x20, c >= 0xD800 && c < 0xE000, c == 0xFFFE, c == 0xFFFF:
+			return false
+		}
+	}
+	return true
+}
+
+// entries builds the SendMessageBatch entries of a batch, with their index as id.
+func (s *sqsSender) entries(items [][]byte) []types.SendMessageBatchRequestEntry {
+	entries := make([]types.SendMessageBatchRequestEntry, len(items))
+	for i, item := range items {
+		group, rest := cutField(item)
+		key, rest := cutField(rest)
+		encoding, body := cutField(rest)
+		e := types.SendMessageBatchRequestEntry{
+			Id:          aws.String(strconv.Itoa(i)),
+			MessageBody: aws.String(string(body)),
+			MessageAttributes: map[string]types.MessageAttributeValue{
+				"idempotency_key": {DataType: aws.String("String"), StringValue: aws.String(key)},
+			},
+		}
+		if encoding != "" {
+			e.MessageAttributes["content_transfer_encoding"] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(encoding)}
+		}
+		if s.fifo {
+			e.MessageGroupId = aws.String(group)
+			e.MessageDeduplicationId = aws.String(key)
+		}
+		entries[i] = e
+	}
+	return entries
+}
+
+// send sends items in one SendMessageBatch call, and again the ones SQS failed to take. Messages
+// it rejects as the sender's fault (too large, invalid) fail the batch right away.
+func (s *sqsSender) send(items [][]byte) error {
+	entries := s.entries(items)
+	backoff := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		resp, err := s.client.SendMessageBatch(context.TODO(), &sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(s.cfg.QueueURL),
+			Entries:  entries,
+		})
+		if err != nil {
+			return err
+		}
+		if len(resp.Failed) == 0 {
+			return nil
+		}
+
+		byID := make(map[string]types.SendMessageBatchRequestEntry, len(entries))
+		for _, e := range entries {
+			byID[aws.ToString(e.Id)] = e
+		}
+		var failed []types.SendMessageBatchRequestEntry
+		var last string
+		for _, res := range resp.Failed {
+			last = aws.ToString(res.Code) + ": " + aws.ToString(res.Message)
+			if res.SenderFault {
+				return fmt.Errorf("sqs rejected %d of %d messages, %s", len(resp.Failed), len(entries), last)
+			}
+			failed = append(failed, byID[aws.ToString(res.Id)])
+		}
+		if attempt == sqsSendAttempts {
+			return fmt.Errorf("%d of %d messages still failed after %d attempts, last %s", len(failed), len(entries), attempt, last)
+		}
+		entries = failed
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Close sends what is still pending.
+func (s *sqsSender) Close() error {
+	s.batch.close()
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"kinesis_consumer/consumer"
+)
+
+// sqsEntry is a SendMessageBatch entry as the fake SQS gets it.
+type sqsEntry struct {
+	Id                     string
+	MessageBody            string
+	MessageGroupId         string
+	MessageDeduplicationId string
+	MessageAttributes      map[string]struct{ StringValue string }
+}
+
+func TestSQSSender(t *testing.T) {
+	tests := []struct {
+		name string
+		// fail is returned for the first entry of the first call
+		fail    string
+		wantErr bool
+	}{
+		{"sent", "", false},
+		{"retried", `{"Id": "0", "Code": "InternalError", "SenderFault": false}`, false},
+		{"rejected", `{"Id": "0", "Code": "InvalidParameterValue", "SenderFault": true}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AWS_ACCESS_KEY_ID", "test")
+			t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+			var mu sync.Mutex
+			var got []sqsEntry
+			fail := tt.fail
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				if target := req.Header.Get("X-Amz-Target"); target != "AmazonSQS.SendMessageBatch" {
+					t.Errorf("got %s", target)
+				}
+				var in struct{ Entries []sqsEntry }
+				if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+					t.Fatal(err)
+				}
+				var successful, failed []string
+				for i, e := range in.Entries {
+					if i == 0 && fail != "" {
+						failed = append(failed, fail)
+						fail = ""
+						continue
+					}
+					got = append(got, e)
+					sum := md5.Sum([]byte(e.MessageBody))
+					successful = append(successful, fmt.Sprintf(`{"Id": %q, "MessageId": "m-%s", "MD5OfMessageBody": %q}`,
+						e.Id, e.MessageDeduplicationId, hex.EncodeToString(sum[:])))
+				}
+				fmt.Fprintf(w, `{"Successful": [%s], "Failed": [%s]}`, strings.Join(successful, ","), strings.Join(failed, ","))
+			}))
+			defer srv.Close()
+
+			config := fmt.Sprintf(`{"queue_url": %q, "endpoint_url": %q, "region": "us-east-1", "flush": {"max_records": 3}}`,
+				srv.URL+"/000000000000/orders.fifo", srv.URL)
+			handle, closer, err := newSQSSender([]byte(config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			payloads := []string{`{"n":0}`, `{"n":1}`, "\x00\xff"}
+			acked := make(chan error, len(payloads))
+			for i, data := range payloads {
+				ctx, _ := consumer.NewAsyncContext(context.Background(), func(err error) { acked <- err })
+				r := &consumer.Record{ShardID: "shardId-000000000000", SequenceNumber: fmt.Sprint(i), PartitionKey: "device-1", Data: []byte(data)}
+				if err := handle(ctx, r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			closer.Close()
+			for range payloads {
+				if err := <-acked; (err != nil) != tt.wantErr {
+					t.Fatalf("ack err=%v, want error %v", err, tt.wantErr)
+				}
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if len(got) != len(payloads) {
+				t.Fatalf("got %d messages, want %d", len(got), len(payloads))
+			}
+			bodies := make(map[string]sqsEntry)
+			for _, e := range got {
+				bodies[e.MessageDeduplicationId] = e
+			}
+			for i, data := range payloads {
+				key := fmt.Sprintf("shardId-000000000000:%d", i)
+				e, ok := bodies[key]
+				if !ok {
+					t.Fatalf("no message deduplicated by %s", key)
+				}
+				body := e.MessageBody
+				if e.MessageAttributes["content_transfer_encoding"].StringValue == "base64" {
+					b, _ := base64.StdEncoding.DecodeString(body)
+					body = string(b)
+				}
+				if body != data || e.MessageGroupId != "device-1" || e.MessageAttributes["idempotency_key"].StringValue != key {
+					t.Errorf("got message %+v, want %q in group device-1 with idempotency_key %s", e, data, key)
+				}
+			}
+		})
+	}
+}
+
+func TestSQSText(t *testing.T) {
+	for s, want := range map[string]bool{
+		`{"n":1}`:    true,
+		"tab\tok\n":  true,
+		"héllo":      true,
+		"\x00":       false,
+		"\xff\xfe":   false,
+		"bell\x07":   false,
+		"\uFFFE":     false,
+		"\U0001F600": true,
+	} {
+		if got := sqsText(s); got != want {
+			t.Errorf("sqsText(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// stateDir is state_dir while the consumer runs, "" otherwise. The caches that warm up as records
+// are handled, the duplicates handler's window and the enrich lookup cache, are saved there on
+// shutdown and loaded on start, so a consumer restarted on the same volume (a StatefulSet pod,
+// with lease.sticky_for reading the same shards again) doesn't start cold.
+var stateDir string
+
+// saveState writes v as JSON to the file name in stateDir.
+func saveState(name string, v any) error {
+	if stateDir == "" {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(stateDir, name)
+	// a crash while writing leaves the previous state
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to save %s: %w", path, err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to save %s: %w", path, err)
+	}
+	return nil
+}
+
+// loadState reads what saveState wrote to name into v, leaving v as it is when there is nothing.
+func loadState(name string, v any) error {
+	if stateDir == "" {
+		return nil
+	}
+	path := filepath.Join(stateDir, name)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to load %s: %w", path, err)
+	}
+	return nil
+}
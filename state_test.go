@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"kinesis_consumer/consumer"
+)
+
+func useStateDir(t *testing.T) {
+	stateDir = t.TempDir()
+	t.Cleanup(func() { stateDir = "" })
+}
+
+func TestDuplicatesState(t *testing.T) {
+	useStateDir(t)
+	r := &consumer.Record{PartitionKey: "k", Data: []byte(`{"n":1}`), ArrivalTime: time.Now()}
+
+	handle, closer, err := newDuplicateDetector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle(context.Background(), r)
+	closer.Close()
+
+	// a restarted consumer remembers the payload it saw before
+	handle, closer, err = newDuplicateDetector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle(context.Background(), r)
+	if k := closer.(*duplicateDetector).keys["k"]; k.duplicates != 1 {
+		t.Errorf("got %d duplicates after a restart, want 1", k.duplicates)
+	}
+}
+
+func TestEnrichCacheState(t *testing.T) {
+	useStateDir(t)
+	lookups := 0
+	lookup := func(ctx context.Context, key string) (map[string]any, error) {
+		lookups++
+		return map[string]any{"name": key}, nil
+	}
+	ec := EnrichConfig{CacheTTL: Duration{time.Minute}, CacheSize: 10}
+
+	c := newLookupCache(ec, lookup)
+	c.get(context.Background(), "a")
+	if err := c.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	c = newLookupCache(ec, lookup)
+	if err := c.load(); err != nil {
+		t.Fatal(err)
+	}
+	row, err := c.get(context.Background(), "a")
+	if err != nil || row["name"] != "a" {
+		t.Fatalf("got %v, err=%v", row, err)
+	}
+	if lookups != 1 {
+		t.Errorf("looked up %d times, want the saved row used", lookups)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"kinesis_consumer/consumer"
+)
+
+var (
+	compressedSizeHist = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "record_compressed_bytes",
+		Help:      "Size of records as read from the stream.",
+		Buckets:   prometheus.ExponentialBuckets(64, 4, 10),
+	}, []string{"codec"})
+	decompressedSizeHist = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "record_decompressed_bytes",
+		Help:      "Size of records after decompression.",
+		Buckets:   prometheus.ExponentialBuckets(64, 4, 10),
+	}, []string{"codec"})
+	compressionRatioHist = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "record_compression_ratio",
+		Help:      "Decompressed size divided by compressed size.",
+		Buckets:   []float64{1, 1.5, 2, 3, 4, 6, 8, 12, 16, 24, 32},
+	}, []string{"codec"})
+	recordsRead = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "records_read_total",
+		Help:      "Records read, by shard and codec.",
+	}, []string{"shard", "codec"})
+	recordsHandled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "records_handled_total",
+		Help:      "Records handlers are done with, by handler and result (ok or failed).",
+	}, []string{"handler", "result"})
+)
+
+// stats counts records per shard, codec and handler for the summary and the metrics above.
+var stats consumer.Stats = promStats{consumer.NewStats()}
+
+// promStats exports what it counts as Prometheus metrics too.
+type promStats struct {
+	consumer.Stats
+}
+
+func (s promStats) RecordRead(shardID, codec string) int64 {
+	recordsRead.WithLabelValues(shardID, codec).Inc()
+	return s.Stats.RecordRead(shardID, codec)
+}
+
+func (s promStats) RecordHandled(handler string, failed bool) {
+	result := "ok"
+	if failed {
+		result = "failed"
+	}
+	recordsHandled.WithLabelValues(handler, result).Inc()
+	s.Stats.RecordHandled(handler, failed)
+}
+
+type codecSizes struct {
+	records         int64
+	compressed      int64
+	decompressed    int64
+	maxCompressed   int
+	maxDecompressed int
+}
+
+// sizeStats tracks compressed vs decompressed record sizes per codec,
+// so producers can see what their compression settings buy them.
+type sizeStats struct {
+	mu      sync.Mutex
+	byCodec map[string]*codecSizes
+}
+
+var recordSizes = &sizeStats{byCodec: make(map[string]*codecSizes)}
+
+func (s *sizeStats) observe(codec string, compressed, decompressed int) {
+	compressedSizeHist.WithLabelValues(codec).Observe(float64(compressed))
+	decompressedSizeHist.WithLabelValues(codec).Observe(float64(decompressed))
+	if compressed > 0 {
+		compressionRatioHist.WithLabelValues(codec).Observe(float64(decompressed) / float64(compressed))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.byCodec[codec]
+	if c == nil {
+		c = &codecSizes{}
+		s.byCodec[codec] = c
+	}
+	c.records++
+	c.compressed += int64(compressed)
+	c.decompressed += int64(decompressed)
+	c.maxCompressed = max(c.maxCompressed, compressed)
+	c.maxDecompressed = max(c.maxDecompressed, decompressed)
+}
+
+// printSummary is shown when the consumer shuts down.
+func printSummary() {
+	snap := stats.Snapshot()
+	fmt.Println("summary")
+	fmt.Println("\tmessages", snap.Records)
+
+	shards := make([]string, 0, len(snap.ByShard))
+	for shard := range snap.ByShard {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+	for _, shard := range shards {
+		fmt.Printf("\t%-24s %10d\n", shard, snap.ByShard[shard])
+	}
+
+	handlers := make([]string, 0, len(snap.ByHandler))
+	for handler := range snap.ByHandler {
+		handlers = append(handlers, handler)
+	}
+	sort.Strings(handlers)
+	for _, handler := range handlers {
+		h := snap.ByHandler[handler]
+		fmt.Printf("\thandler %-16s %10d handled %10d failed\n", handler, h.Handled, h.Failed)
+	}
+
+	recordSizes.mu.Lock()
+	defer recordSizes.mu.Unlock()
+
+	codecs := make([]string, 0, len(recordSizes.byCodec))
+	for codec := range recordSizes.byCodec {
+		codecs = append(codecs, codec)
+	}
+	sort.Strings(codecs)
+
+	fmt.Printf("\t%-6s %10s %14s %14s %14s %14s %7s\n",
+		"codec", "records", "avg in", "avg out", "max in", "max out", "ratio")
+	for _, codec := range codecs {
+		c := recordSizes.byCodec[codec]
+		ratio := 0.0
+		if c.compressed > 0 {
+			ratio = float64(c.decompressed) / float64(c.compressed)
+		}
+		fmt.Printf("\t%-6s %10d %14d %14d %14d %14d %7.2f\n",
+			codec, c.records, c.compressed/c.records, c.decompressed/c.records, c.maxCompressed, c.maxDecompressed, ratio)
+	}
+}
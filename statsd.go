@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// StatsDConfig also sends the consumer's metrics to a StatsD or DogStatsD agent.
+//
+//	"statsd": {"addr": "127.0.0.1:8125", "dogstatsd": true, "tags": ["env:prod"]}
+type StatsDConfig struct {
+	// Addr is the agent's UDP address. Off when empty.
+	Addr string `json:"addr"`
+	// Prefix goes before every metric name, "kinesis_consumer." when not set.
+	Prefix string `json:"prefix"`
+	// DogStatsD sends labels as tags; plain StatsD has none, so label values are appended to the
+	// metric name instead, e.g. kinesis_consumer.records_read_total.shardId-000000000001.
+	DogStatsD bool `json:"dogstatsd"`
+	// Tags are added to every metric, DogStatsD only.
+	Tags []string `json:"tags"`
+	// Interval is how often metrics are sent, 10s when not set.
+	Interval Duration `json:"interval"`
+}
+
+// statsdMaxPacket keeps packets under a typical MTU so they aren't fragmented.
+const statsdMaxPacket = 1432
+
+var statsdUnsafe = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// emitStatsD sends the consumer's Prometheus metrics to cfg.Addr every interval until ctx is done,
+// and once more then. Gauges are sent as gauges; counters, and histogram and summary sums and
+// counts, as counters of how much they grew since the last send.
+func emitStatsD(ctx context.Context, cfg StatsDConfig) {
+	if cfg.Addr == "" {
+		return
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = metricsNamespace + "."
+	}
+	if cfg.Interval.Duration <= 0 {
+		cfg.Interval.Duration = 10 * time.Second
+	}
+	conn, err := net.Dial("udp", cfg.Addr)
+	if err != nil {
+		fmt.Printf("statsd disabled, err=%+v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	last := make(map[string]float64)
+	ticker := time.NewTicker(cfg.Interval.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			sendStatsD(conn, cfg, last)
+			return
+		case <-ticker.C:
+			sendStatsD(conn, cfg, last)
+		}
+	}
+}
+
+// sendStatsD sends one round of metrics; last holds what counters were at the previous one.
+func sendStatsD(conn net.Conn, cfg StatsDConfig, last map[string]float64) {
+	var packet bytes.Buffer
+	eachMetric(func(name string, labels []*dto.LabelPair, cumulative bool, value float64) {
+		line := statsdLine(cfg, name, labels)
+		kind := "g"
+		if cumulative {
+			key := name + labelString(labels)
+			delta := value - last[key]
+			if delta < 0 {
+				// reset, e.g. a handler that was reloaded
+				delta = value
+			}
+			last[key] = value
+			if delta == 0 {
+				return
+			}
+			value, kind = delta, "c"
+		}
+		metric := line.name + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + kind + line.tags
+
+		if packet.Len() > 0 && packet.Len()+1+len(metric) > statsdMaxPacket {
+			conn.Write(packet.Bytes())
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(metric)
+	})
+	if packet.Len() > 0 {
+		conn.Write(packet.Bytes())
+	}
+}
+
+type statsdMetric struct {
+	name string
+	// tags is the "|#k:v,..." suffix, empty for plain StatsD
+	tags string
+}
+
+func statsdLine(cfg StatsDConfig, name string, labels []*dto.LabelPair) statsdMetric {
+	m := statsdMetric{name: cfg.Prefix + strings.TrimPrefix(name, metricsNamespace+"_")}
+	if !cfg.DogStatsD {
+		for _, l := range labels {
+			m.name += "." + statsdUnsafe.ReplaceAllString(l.GetValue(), "_")
+		}
+		return m
+	}
+	tags := append([]string(nil), cfg.Tags...)
+	for _, l := range labels {
+		// DogStatsD reserves "," and "|" in tags
+		tags = append(tags, l.GetName()+":"+strings.NewReplacer(",", "_", "|", "_").Replace(l.GetValue()))
+	}
+	if len(tags) > 0 {
+		m.tags = "|#" + strings.Join(tags, ",")
+	}
+	return m
+}
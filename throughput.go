@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"kinesis_consumer/consumer"
+)
+
+// Write limits of a provisioned shard.
+const (
+	shardBytesPerSec   = 1 << 20
+	shardRecordsPerSec = 1000
+)
+
+// ThroughputConfig is the handler_config of the "throughput" handler.
+//
+//	"handler": "throughput",
+//	"handler_config": {"target": 0.7}
+type ThroughputConfig struct {
+	// Target is the share of a shard's write limits the recommendation plans for at peak.
+	Target float64 `json:"target"`
+	// Cost, when set, also prices the measured throughput (the cost command).
+	Cost *CostConfig `json:"cost"`
+}
+
+func init() {
+	consumer.RegisterHandlerFactory("throughput", newThroughputMeter)
+}
+
+// rate counts records and bytes, over the whole sample and per second of arrival.
+type rate struct {
+	records, bytes int64
+	seconds        map[int64]*rate
+}
+
+func (r *rate) add(sec int64, records, bytes int64) {
+	r.records += records
+	r.bytes += bytes
+	if r.seconds == nil {
+		r.seconds = make(map[int64]*rate)
+	}
+	s := r.seconds[sec]
+	if s == nil {
+		s = &rate{}
+		r.seconds[sec] = s
+	}
+	s.records += records
+	s.bytes += bytes
+}
+
+// peak returns the most records and the most bytes seen in a second.
+func (r *rate) peak() (records, bytes int64) {
+	for _, s := range r.seconds {
+		records = max(records, s.records)
+		bytes = max(bytes, s.bytes)
+	}
+	return records, bytes
+}
+
+// throughputMeter measures records/sec and bytes/sec per shard and for the whole stream, and on
+// close recommends a shard count that keeps the busiest second under target of the write limits.
+type throughputMeter struct {
+	cfg     ThroughputConfig
+	started time.Time
+
+	mu     sync.Mutex
+	shards map[string]*rate
+}
+
+func newThroughputMeter(raw json.RawMessage) (consumer.HandlerFunc, io.Closer, error) {
+	cfg := ThroughputConfig{Target: 0.7}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("invalid throughput handler_config: %w", err)
+		}
+	}
+	if cfg.Target <= 0 || cfg.Target > 1 {
+		return nil, nil, fmt.Errorf("throughput target must be in (0, 1], got %g", cfg.Target)
+	}
+	m := &throughputMeter{
+		cfg:     cfg,
+		started: time.Now(),
+		shards:  make(map[string]*rate),
+	}
+	return m.handle, m, nil
+}
+
+func (m *throughputMeter) handle(_ context.Context, r *consumer.Record) error {
+	sec := r.ArrivalTime.Unix()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.shards[r.ShardID]
+	if s == nil {
+		s = &rate{}
+		m.shards[r.ShardID] = s
+	}
+	s.add(sec, 1, int64(r.Size))
+	return nil
+}
+
+// Close prints the report.
+func (m *throughputMeter) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elapsed := time.Since(m.started).Seconds()
+	fmt.Printf("throughput over %s\n", time.Since(m.started).Round(time.Second))
+
+	names := make([]string, 0, len(m.shards))
+	for name := range m.shards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var total rate
+	for _, name := range names {
+		s := m.shards[name]
+		for sec, c := range s.seconds {
+			total.add(sec, c.records, c.bytes)
+		}
+		peakRecords, peakBytes := s.peak()
+		fmt.Printf("\t%-24s %8.1f rec/s %10.1f KB/s   peak %6d rec/s %8.1f KB/s   %3.0f%% of limit\n", name,
+			float64(s.records)/elapsed, float64(s.bytes)/elapsed/1024,
+			peakRecords, float64(peakBytes)/1024, 100*shardUse(peakRecords, peakBytes))
+	}
+	peakRecords, peakBytes := total.peak()
+	fmt.Printf("\t%-24s %8.1f rec/s %10.1f KB/s   peak %6d rec/s %8.1f KB/s\n", "stream",
+		float64(total.records)/elapsed, float64(total.bytes)/elapsed/1024, peakRecords, float64(peakBytes)/1024)
+
+	// the peak needs this many shards, assuming partition keys spread evenly over them
+	need := int(math.Ceil(shardUse(peakRecords, peakBytes) / m.cfg.Target))
+	need = max(need, 1)
+	fmt.Printf("recommended shards: %d (%d had records), for the peak second at %.0f%% of the write limits\n",
+		need, len(names), 100*m.cfg.Target)
+
+	if m.cfg.Cost != nil {
+		m.cfg.Cost.report(float64(total.bytes) / elapsed)
+	}
+	return nil
+}
+
+// shardUse is how many shards' worth of write capacity a second with these records and bytes takes.
+func shardUse(records, bytes int64) float64 {
+	return max(float64(records)/shardRecordsPerSec, float64(bytes)/shardBytesPerSec)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"kinesis_consumer/consumer"
+)
+
+var handlerTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "handler_timeouts_total",
+	Help:      "Handler calls that ran past handle.timeout (scope record) or handle.batch_timeout (scope batch).",
+}, []string{"handler", "scope"})
+
+type batchDeadlineKey struct{}
+
+// withBatchDeadline returns ctx for handling the records of one batch, which must all be done
+// within d; 0 doesn't limit them.
+func withBatchDeadline(ctx context.Context, d time.Duration) context.Context {
+	if d <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, batchDeadlineKey{}, wallClock.Now().Add(d))
+}
+
+// timeoutHandler cancels the context of a call to h after timeout, or at the deadline of the
+// batch the record is in if that comes first. A call that fails after its deadline fails with a
+// consumer.RecordError wrapping consumer.ErrHandlerTimeout, for the poison policy to retry or skip
+// the record, so a wedged downstream call can't stall the shard. One that ignores its context
+// can't be stopped, but doesn't go unnoticed: it's logged and counted once its deadline passes.
+// The context is cancelled when h returns, also if it went on with consumer.Async.
+func timeoutHandler(name string, timeout time.Duration, h consumer.HandlerFunc) consumer.HandlerFunc {
+	return func(ctx context.Context, r *consumer.Record) error {
+		var deadline time.Time
+		scope := "record"
+		if timeout > 0 {
+			deadline = wallClock.Now().Add(timeout)
+		}
+		if batch, ok := ctx.Value(batchDeadlineKey{}).(time.Time); ok && (deadline.IsZero() || batch.Before(deadline)) {
+			deadline, scope = batch, "batch"
+		}
+		if deadline.IsZero() {
+			return h(ctx, r)
+		}
+
+		hctx, cancel := context.WithDeadline(ctx, deadline)
+		defer cancel()
+		// overdue is set once the deadline passed with h still running
+		var mu sync.Mutex
+		returned, overdue := false, false
+		stop := make(chan struct{})
+		defer close(stop)
+		due := wallClock.After(deadline.Sub(wallClock.Now()))
+		go func() {
+			select {
+			case <-stop:
+				return
+			case <-due:
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if returned {
+				return
+			}
+			overdue = true
+			handlerTimeouts.WithLabelValues(name, scope).Inc()
+			fmt.Printf("\thandler %s ran past its %s timeout with %s %s\n", name, scope, r.ShardID, r.SequenceNumber)
+		}()
+		err := h(hctx, r)
+		mu.Lock()
+		returned = true
+		late := overdue
+		mu.Unlock()
+		if !late || err == nil || ctx.Err() != nil {
+			return err
+		}
+		return &consumer.RecordError{
+			ShardID:        r.ShardID,
+			SequenceNumber: r.SequenceNumber,
+			PartitionKey:   r.PartitionKey,
+			Err:            fmt.Errorf("%w (%s): %w", consumer.ErrHandlerTimeout, scope, err),
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"kinesis_consumer/consumer"
+)
+
+func TestTimeoutHandler(t *testing.T) {
+	failed := errors.New("downstream call failed")
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		batch   time.Duration
+		// advance is how far the clock moves while the handler runs, 0 for a handler that returns
+		// right away
+		advance     time.Duration
+		result      error
+		wantTimeout bool
+		wantScope   string
+	}{
+		{"no timeout", 0, 0, 0, failed, false, ""},
+		{"in time", time.Minute, 0, 0, failed, false, ""},
+		{"past the record timeout", time.Minute, 0, time.Minute, failed, true, "record"},
+		{"past the timeout but succeeded", time.Minute, 0, time.Minute, nil, false, "record"},
+		{"batch deadline first", time.Hour, time.Minute, time.Minute, failed, true, "batch"},
+		{"record timeout first", time.Minute, time.Hour, time.Minute, failed, true, "record"},
+		{"before the deadline", time.Minute, 0, 59 * time.Second, failed, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeWallClock(t)
+			release := make(chan struct{})
+			h := timeoutHandler("test", tt.timeout, func(ctx context.Context, r *consumer.Record) error {
+				if tt.advance > 0 {
+					<-release
+				}
+				return tt.result
+			})
+
+			counted := 0.0
+			if tt.wantScope != "" {
+				counted = testutil.ToFloat64(handlerTimeouts.WithLabelValues("test", tt.wantScope))
+			}
+			ctx := withBatchDeadline(context.Background(), tt.batch)
+			result := make(chan error, 1)
+			go func() {
+				result <- h(ctx, &consumer.Record{ShardID: "shardId-000000000000", SequenceNumber: "1"})
+			}()
+			if tt.advance > 0 {
+				waitForWaiters(t, fake, 1)
+				fake.Advance(tt.advance)
+				if tt.wantScope != "" {
+					// the handler is still running as its deadline passes
+					for deadline := time.Now().Add(5 * time.Second); testutil.ToFloat64(handlerTimeouts.WithLabelValues("test", tt.wantScope)) == counted; time.Sleep(time.Millisecond) {
+						if time.Now().After(deadline) {
+							t.Fatal("timeout not counted")
+						}
+					}
+				}
+				close(release)
+			}
+
+			err := <-result
+			if got := errors.Is(err, consumer.ErrHandlerTimeout); got != tt.wantTimeout {
+				t.Fatalf("got %v, want a timeout %v", err, tt.wantTimeout)
+			}
+			if !errors.Is(err, tt.result) {
+				t.Errorf("%v doesn't wrap the handler's error %v", err, tt.result)
+			}
+			if tt.wantTimeout && !strings.Contains(err.Error(), "("+tt.wantScope+")") {
+				t.Errorf("%v doesn't name the %s scope", err, tt.wantScope)
+			}
+		})
+	}
+}
+
+func TestTimeoutHandlerShutdown(t *testing.T) {
+	useFakeWallClock(t)
+	h := timeoutHandler("test", time.Minute, func(ctx context.Context, r *consumer.Record) error {
+		return ctx.Err()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := h(ctx, &consumer.Record{}); !errors.Is(err, context.Canceled) || errors.Is(err, consumer.ErrHandlerTimeout) {
+		t.Errorf("interrupted call failed with %v", err)
+	}
+}
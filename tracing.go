@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kinesis_consumer/consumer"
+)
+
+// TracingConfig continues the distributed traces producers start: a record carrying a Datadog or
+// W3C trace context gets spans for its consumption, its handler call and, for handlers that ack
+// asynchronously, the wait for its sink, sent to a Datadog agent.
+//
+//	"tracing": {"field": "meta.trace", "service": "orders-consumer", "env": "prod"}
+type TracingConfig struct {
+	// Field is a dotted path into the JSON payload holding the trace context: a traceparent string,
+	// or an object with traceparent or x-datadog-trace-id and x-datadog-parent-id (plus
+	// x-datadog-sampling-priority and x-datadog-tags). Without the field, the record header's
+	// entries are used. Tracing is off when empty.
+	Field string `json:"field"`
+	// AgentURL is DD_TRACE_AGENT_URL, or http://$DD_AGENT_HOST:8126, when not set.
+	AgentURL string `json:"agent_url"`
+	// Service is DD_SERVICE, or kinesis_consumer, when not set.
+	Service string `json:"service"`
+	Env     string `json:"env"`
+}
+
+const (
+	traceFlushInterval = time.Second
+	// traceMaxPending is how many spans are kept while the agent is unreachable; more are dropped
+	traceMaxPending = 10000
+)
+
+// traceContext is the producer's span a record's spans continue.
+type traceContext struct {
+	traceID uint64
+	// traceIDHigh is the upper half of a 128 bit trace id, 0 for 64 bit ones
+	traceIDHigh uint64
+	parentID    uint64
+	priority    int
+}
+
+// parseTraceContext reads a trace context from header-like entries, traceparent first.
+func parseTraceContext(get func(key string) string) (traceContext, bool) {
+	if tp := get("traceparent"); tp != "" {
+		// version-traceid-parentid-flags
+		parts := strings.Split(tp, "-")
+		if len(parts) < 4 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+			return traceContext{}, false
+		}
+		high, err1 := strconv.ParseUint(parts[1][:16], 16, 64)
+		low, err2 := strconv.ParseUint(parts[1][16:], 16, 64)
+		parent, err3 := strconv.ParseUint(parts[2], 16, 64)
+		flags, err4 := strconv.ParseUint(parts[3], 16, 8)
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+			return traceContext{}, false
+		}
+		tc := traceContext{traceID: low, traceIDHigh: high, parentID: parent}
+		tc.priority = int(flags & 1)
+		return tc, tc.traceID != 0 || tc.traceIDHigh != 0
+	}
+
+	var tc traceContext
+	var err error
+	if tc.traceID, err = strconv.ParseUint(get("x-datadog-trace-id"), 10, 64); err != nil {
+		return traceContext{}, false
+	}
+	if tc.parentID, err = strconv.ParseUint(get("x-datadog-parent-id"), 10, 64); err != nil {
+		return traceContext{}, false
+	}
+	tc.priority = 1
+	if p, err := strconv.Atoi(get("x-datadog-sampling-priority")); err == nil {
+		tc.priority = p
+	}
+	for _, tag := range strings.Split(get("x-datadog-tags"), ",") {
+		if v, ok := strings.CutPrefix(tag, "_dd.p.tid="); ok {
+			tc.traceIDHigh, _ = strconv.ParseUint(v, 16, 64)
+		}
+	}
+	return tc, tc.traceID != 0
+}
+
+// ddSpan is a span as the agent's /v0.4/traces endpoint takes it.
+type ddSpan struct {
+	TraceID  uint64             `json:"trace_id"`
+	SpanID   uint64             `json:"span_id"`
+	ParentID uint64             `json:"parent_id"`
+	Name     string             `json:"name"`
+	Resource string             `json:"resource"`
+	Service  string             `json:"service"`
+	Type     string             `json:"type"`
+	Start    int64              `json:"start"`
+	Duration int64              `json:"duration"`
+	Error    int32              `json:"error"`
+	Meta     map[string]string  `json:"meta"`
+	Metrics  map[string]float64 `json:"metrics"`
+}
+
+// tracer collects spans and sends them to the agent every second. A nil tracer traces nothing.
+type tracer struct {
+	cfg    TracingConfig
+	stream string
+	client *http.Client
+
+	mu      sync.Mutex
+	pending []ddSpan
+	dropped int
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newTracer(cfg *Config) *tracer {
+	tc := cfg.Tracing
+	if tc.Field == "" {
+		return nil
+	}
+	if tc.AgentURL == "" {
+		tc.AgentURL = os.Getenv("DD_TRACE_AGENT_URL")
+	}
+	if tc.AgentURL == "" {
+		host := os.Getenv("DD_AGENT_HOST")
+		if host == "" {
+			host = "localhost"
+		}
+		tc.AgentURL = "http://" + host + ":8126"
+	}
+	if tc.Service == "" {
+		tc.Service = os.Getenv("DD_SERVICE")
+	}
+	if tc.Service == "" {
+		tc.Service = "kinesis_consumer"
+	}
+	if tc.Env == "" {
+		tc.Env = os.Getenv("DD_ENV")
+	}
+
+	t := &tracer{
+		cfg:    tc,
+		stream: cfg.StreamName,
+		client: &http.Client{Timeout: 10 * time.Second},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// recordTrace times one record's spans.
+type recordTrace struct {
+	t       *tracer
+	tc      traceContext
+	handler string
+	meta    map[string]string
+	start   time.Time
+
+	// an async ack may come before the handler returned
+	mu      sync.Mutex
+	handled time.Time
+}
+
+// start returns the trace of r, nil when r carries no trace context.
+func (t *tracer) start(r *consumer.Record, handler string) *recordTrace {
+	if t == nil {
+		return nil
+	}
+	tc, ok := t.extract(r)
+	if !ok {
+		return nil
+	}
+	meta := map[string]string{
+		"kinesis.stream":          t.stream,
+		"kinesis.shard_id":        r.ShardID,
+		"kinesis.sequence_number": r.SequenceNumber,
+		"kinesis.partition_key":   r.PartitionKey,
+	}
+	if tc.traceIDHigh != 0 {
+		meta["_dd.p.tid"] = fmt.Sprintf("%016x", tc.traceIDHigh)
+	}
+	if t.cfg.Env != "" {
+		meta["env"] = t.cfg.Env
+	}
+	return &recordTrace{t: t, tc: tc, handler: handler, meta: meta, start: time.Now()}
+}
+
+func (t *tracer) extract(r *consumer.Record) (traceContext, bool) {
+	var fields map[string]any
+	dec := json.NewDecoder(bytes.NewReader(r.Data))
+	// 64 bit ids written as numbers don't survive float64
+	dec.UseNumber()
+	if dec.Decode(&fields) == nil {
+		switch v, _ := jsonField(fields, t.cfg.Field); v := v.(type) {
+		case string:
+			return parseTraceContext(func(key string) string {
+				if key == "traceparent" {
+					return v
+				}
+				return ""
+			})
+		case map[string]any:
+			return parseTraceContext(func(key string) string {
+				switch s := v[key].(type) {
+				case string:
+					return s
+				case json.Number:
+					return s.String()
+				}
+				return ""
+			})
+		}
+	}
+	if r.Header != nil {
+		return parseTraceContext(func(key string) string { return r.Header[key] })
+	}
+	return traceContext{}, false
+}
+
+// handlerReturned marks the end of the handler call.
+func (rt *recordTrace) handlerReturned() {
+	if rt == nil {
+		return
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.handled.IsZero() {
+		rt.handled = time.Now()
+	}
+}
+
+// finish records the spans of a record that is done with, err being how it ended; async says
+// the handler acknowledged it.
+func (rt *recordTrace) finish(err error, async bool) {
+	if rt == nil {
+		return
+	}
+	rt.handlerReturned()
+	end := time.Now()
+	consume := rt.span("kinesis.consume", rt.t.stream, rt.tc.parentID, rt.start, end, err)
+	consume.Meta["span.kind"] = "consumer"
+	consume.Metrics["_sampling_priority_v1"] = float64(rt.tc.priority)
+	if !async {
+		rt.t.add([]ddSpan{consume, rt.span("kinesis.handler", rt.handler, consume.SpanID, rt.start, rt.handled, err)})
+		return
+	}
+	rt.t.add([]ddSpan{
+		consume,
+		rt.span("kinesis.handler", rt.handler, consume.SpanID, rt.start, rt.handled, nil),
+		rt.span("kinesis.sink", rt.handler, consume.SpanID, rt.handled, end, err),
+	})
+}
+
+func (rt *recordTrace) span(name, resource string, parent uint64, start, end time.Time, err error) ddSpan {
+	s := ddSpan{
+		TraceID:  rt.tc.traceID,
+		SpanID:   rand.Uint64(),
+		ParentID: parent,
+		Name:     name,
+		Resource: resource,
+		Service:  rt.t.cfg.Service,
+		Type:     "queue",
+		Start:    start.UnixNano(),
+		Duration: end.Sub(start).Nanoseconds(),
+		Meta:     make(map[string]string, len(rt.meta)+1),
+		Metrics:  map[string]float64{},
+	}
+	for k, v := range rt.meta {
+		s.Meta[k] = v
+	}
+	if err != nil {
+		s.Error = 1
+		s.Meta["error.message"] = err.Error()
+	}
+	return s
+}
+
+func (t *tracer) add(spans []ddSpan) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending)+len(spans) > traceMaxPending {
+		t.dropped += len(spans)
+		return
+	}
+	t.pending = append(t.pending, spans...)
+}
+
+func (t *tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			t.flush()
+			return
+		case <-ticker.C:
+			t.flush()
+		}
+	}
+}
+
+// flush sends the pending spans, grouped by trace as the agent wants them.
+func (t *tracer) flush() {
+	t.mu.Lock()
+	spans, dropped := t.pending, t.dropped
+	t.pending, t.dropped = nil, 0
+	t.mu.Unlock()
+	if dropped > 0 {
+		fmt.Printf("dropped %d spans, the trace agent at %s isn't keeping up\n", dropped, t.cfg.AgentURL)
+	}
+	if len(spans) == 0 {
+		return
+	}
+
+	var traces [][]ddSpan
+	index := make(map[uint64]int)
+	for _, s := range spans {
+		i, ok := index[s.TraceID]
+		if !ok {
+			i = len(traces)
+			index[s.TraceID] = i
+			traces = append(traces, nil)
+		}
+		traces[i] = append(traces[i], s)
+	}
+	body, err := json.Marshal(traces)
+	if err != nil {
+		fmt.Printf("encoding spans failed, err=%+v\n", err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPut, strings.TrimSuffix(t.cfg.AgentURL, "/")+"/v0.4/traces", bytes.NewReader(body))
+	if err != nil {
+		fmt.Printf("sending spans failed, err=%+v\n", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Datadog-Trace-Count", strconv.Itoa(len(traces)))
+	resp, err := t.client.Do(req)
+	if err != nil {
+		fmt.Printf("sending %d spans to %s failed, err=%+v\n", len(spans), t.cfg.AgentURL, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("sending %d spans to %s returned %s\n", len(spans), t.cfg.AgentURL, resp.Status)
+	}
+}
+
+// close sends what is still pending.
+func (t *tracer) close() {
+	if t != nil {
+		close(t.stop)
+		<-t.done
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// TransformConfig describes how decoded JSON records are reshaped before they are printed.
+//
+//	"transform": {
+//		"rename": [{"from": "ts", "to": "timestamp"}],
+//		"set": [{"field": "total", "expr": "price * qty"}, {"field": "source", "expr": "'kinesis'"}]
+//	}
+//
+// Renames are applied first, in order, then each "set" expression is evaluated
+// (https://expr-lang.org) in order with the record's fields in scope, the fields set before it
+// included, and the result stored under the given field.
+type TransformConfig struct {
+	Rename []RenameRule `json:"rename"`
+	Set    []SetRule    `json:"set"`
+}
+
+type RenameRule struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type SetRule struct {
+	Field string `json:"field"`
+	Expr  string `json:"expr"`
+}
+
+type transformer struct {
+	rename []RenameRule
+	set    []compiledSet
+}
+
+type compiledSet struct {
+	field   string
+	program *vm.Program
+}
+
+func newTransformer(tc TransformConfig) (*transformer, error) {
+	if len(tc.Rename) == 0 && len(tc.Set) == 0 {
+		return nil, nil
+	}
+
+	t := &transformer{rename: tc.Rename, set: make([]compiledSet, 0, len(tc.Set))}
+	for _, rule := range tc.Rename {
+		if rule.From == "" || rule.To == "" {
+			return nil, fmt.Errorf("transform rename needs from and to, got %+v", rule)
+		}
+	}
+	for _, rule := range tc.Set {
+		if rule.Field == "" {
+			return nil, fmt.Errorf("transform set needs a field, got %+v", rule)
+		}
+		program, err := expr.Compile(rule.Expr, expr.AllowUndefinedVariables())
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile transform for field %q: %w", rule.Field, err)
+		}
+		t.set = append(t.set, compiledSet{rule.Field, program})
+	}
+	return t, nil
+}
+
+// apply returns the transformed record. Records that aren't JSON objects are passed through untouched.
+func (t *transformer) apply(data []byte) ([]byte, error) {
+	if t == nil {
+		return data, nil
+	}
+
+	var fields map[string]any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&fields); err != nil || fields == nil {
+		return data, nil
+	}
+	exactNumbers(fields)
+
+	for _, rule := range t.rename {
+		if v, ok := fields[rule.From]; ok {
+			delete(fields, rule.From)
+			fields[rule.To] = v
+		}
+	}
+
+	for _, s := range t.set {
+		v, err := expr.Run(s.program, fields)
+		if err != nil {
+			return nil, fmt.Errorf("transform for field %q failed: %w", s.field, err)
+		}
+		fields[s.field] = v
+	}
+
+	return json.Marshal(fields)
+}
+
+// exactNumbers replaces the json.Numbers in v, in place, with int64 where they are integers that
+// fit and float64 otherwise, so expressions can compute with them. Integers too big for an int64
+// stay json.Numbers and are written back as they came, not rounded to a float64.
+func exactNumbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if strings.ContainsAny(string(v), ".eE") {
+			if f, err := v.Float64(); err == nil {
+				return f
+			}
+		}
+		return v
+	case map[string]any:
+		for k, e := range v {
+			v[k] = exactNumbers(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = exactNumbers(e)
+		}
+	}
+	return v
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTransformer(t *testing.T) {
+	tests := []struct {
+		name   string
+		config TransformConfig
+		in     string
+		want   string
+	}{
+		{
+			name:   "rename",
+			config: TransformConfig{Rename: []RenameRule{{From: "ts", To: "timestamp"}}},
+			in:     `{"ts": 1, "id": "a"}`,
+			want:   `{"id":"a","timestamp":1}`,
+		},
+		{
+			name:   "renames in order",
+			config: TransformConfig{Rename: []RenameRule{{From: "a", To: "b"}, {From: "b", To: "c"}}},
+			in:     `{"a": 1}`,
+			want:   `{"c":1}`,
+		},
+		{
+			name:   "set sees renamed and earlier fields",
+			config: TransformConfig{Rename: []RenameRule{{From: "p", To: "price"}}, Set: []SetRule{{Field: "total", Expr: "price * qty"}, {Field: "double", Expr: "total * 2"}}},
+			in:     `{"p": 3, "qty": 2}`,
+			want:   `{"double":12,"price":3,"qty":2,"total":6}`,
+		},
+		{
+			name:   "big integers stay exact",
+			config: TransformConfig{Set: []SetRule{{Field: "source", Expr: "'kinesis'"}}},
+			in:     `{"id": 123456789012345678901234567890, "n": 9007199254740993}`,
+			want:   `{"id":123456789012345678901234567890,"n":9007199254740993,"source":"kinesis"}`,
+		},
+		{
+			name:   "floats",
+			config: TransformConfig{Set: []SetRule{{Field: "half", Expr: "x / 2"}}},
+			in:     `{"x": 1.5e0}`,
+			want:   `{"half":0.75,"x":1.5}`,
+		},
+		{
+			name:   "not an object",
+			config: TransformConfig{Set: []SetRule{{Field: "source", Expr: "'kinesis'"}}},
+			in:     `[1, 2]`,
+			want:   `[1, 2]`,
+		},
+		{
+			name:   "not JSON",
+			config: TransformConfig{Rename: []RenameRule{{From: "a", To: "b"}}},
+			in:     `plain text`,
+			want:   `plain text`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr, err := newTransformer(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := tr.apply([]byte(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformerErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  TransformConfig
+		in      string
+		wantErr string
+	}{
+		{"rename without to", TransformConfig{Rename: []RenameRule{{From: "a"}}}, "", "needs from and to"},
+		{"set without field", TransformConfig{Set: []SetRule{{Expr: "1"}}}, "", "needs a field"},
+		{"invalid expression", TransformConfig{Set: []SetRule{{Field: "x", Expr: "1 +"}}}, "", "failed to compile"},
+		{"failing expression", TransformConfig{Set: []SetRule{{Field: "x", Expr: "a.b.c()"}}}, `{"a": 1}`, `transform for field "x" failed`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr, err := newTransformer(tt.config)
+			if err == nil {
+				_, err = tr.apply([]byte(tt.in))
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNoTransformer(t *testing.T) {
+	tr, err := newTransformer(TransformConfig{})
+	if err != nil || tr != nil {
+		t.Fatalf("empty config gave %v, %v", tr, err)
+	}
+	if got, _ := tr.apply([]byte(`{"a": 1}`)); string(got) != `{"a": 1}` {
+		t.Errorf("nil transformer changed the record to %s", got)
+	}
+}
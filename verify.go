@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// runVerify is the "verify" subcommand. It checks that every checkpoint of the stream still points
+// at data Kinesis has, so a restart continues without a gap: a checkpoint behind the trim horizon
+// means the records in between were deleted by retention before they were read.
+func runVerify(configPath string) {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	var store checkpointStore
+	switch {
+	case cfg.Lease.Backend != "":
+		if store, err = openLeaseStore(cfg); err != nil {
+			fatalf("%v", err)
+		}
+	case cfg.Checkpoint.Path != "":
+		if store, err = openBoltStoreReadOnly(cfg.Checkpoint.Path); err != nil {
+			fatalf("%v (is a consumer running on it?)", err)
+		}
+	default:
+		fatalf("no checkpoint store configured, set checkpoint.path in the config file")
+	}
+	checkpoints, err := store.List()
+	store.Close()
+	if err != nil {
+		fatalf("failed to read checkpoints: %v", err)
+	}
+
+	ctx := context.Background()
+	awsCfg, err := loadAWSConfig(ctx, cfg)
+	if err != nil {
+		fatalf("unable to load SDK config, %v", err)
+	}
+	client := kinesis.NewFromConfig(awsCfg)
+	name, streamARN := cfg.streamRef()
+
+	summary, err := client.DescribeStreamSummary(ctx, &kinesis.DescribeStreamSummaryInput{StreamName: name, StreamARN: streamARN})
+	if err != nil {
+		fatalf("DescribeStreamSummary failed: %v", err)
+	}
+	retention := time.Duration(aws.ToInt32(summary.StreamDescriptionSummary.RetentionPeriodHours)) * time.Hour
+	fmt.Printf("%s keeps data for %s\n", cfg.StreamName, retention)
+
+	// every shard still within retention, closed ones included, whatever shard_filter says
+	all := *cfg
+	all.ShardFilter = ShardFilterConfig{}
+	shards, err := listShards(ctx, client, &all)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	listed := make(map[string]bool, len(shards))
+	for _, s := range shards {
+		listed[aws.ToString(s.ShardId)] = true
+	}
+
+	warnings := 0
+	warn := func(format string, args ...any) {
+		warnings++
+		fmt.Printf("WARN     "+format+"\n", args...)
+	}
+
+	checkpointed := make(map[string]bool)
+	for _, c := range checkpoints {
+		if c.Stream != cfg.StreamName {
+			continue
+		}
+		checkpointed[c.Shard] = true
+
+		if !listed[c.Shard] {
+			warn("%s: checkpoint %s is for a shard that no longer exists, it was closed more than %s ago",
+				c.Shard, c.SequenceNumber, retention)
+			continue
+		}
+
+		switch {
+		case c.SequenceNumber == string(types.ShardIteratorTypeTrimHorizon) || c.SequenceNumber == string(types.ShardIteratorTypeLatest):
+			fmt.Printf("ok       %s: starts at %s\n", c.Shard, c.SequenceNumber)
+		case strings.HasPrefix(c.SequenceNumber, atTimestampPrefix):
+			ts, err := time.Parse(time.RFC3339, strings.TrimPrefix(c.SequenceNumber, atTimestampPrefix))
+			if err != nil {
+				warn("%s: invalid checkpoint %q", c.Shard, c.SequenceNumber)
+			} else if time.Since(ts) > retention {
+				warn("%s: starts at %s, data from before %s has been trimmed",
+					c.Shard, ts.Format(time.RFC3339), time.Now().Add(-retention).Format(time.RFC3339))
+			} else {
+				fmt.Printf("ok       %s: starts at %s\n", c.Shard, ts.Format(time.RFC3339))
+			}
+		default:
+			oldest, err := oldestSequenceNumber(ctx, client, cfg, c.Shard)
+			if err != nil {
+				warn("%s: could not read the trim horizon: %v", c.Shard, err)
+			} else if oldest != "" && sequenceLess(c.SequenceNumber, oldest) {
+				warn("%s: checkpoint %s is behind the oldest record %s, records in between may have been trimmed",
+					c.Shard, c.SequenceNumber, oldest)
+			} else if err := checkResumable(ctx, client, cfg, c); err != nil {
+				warn("%s: cannot resume after %s: %v", c.Shard, c.SequenceNumber, err)
+			} else {
+				fmt.Printf("ok       %s: resumes after %s\n", c.Shard, c.SequenceNumber)
+			}
+		}
+	}
+
+	for _, s := range shards {
+		if id := aws.ToString(s.ShardId); !checkpointed[id] {
+			fmt.Printf("         %s: no checkpoint, starts at %s\n", id, cfg.ShardIteratorType)
+		}
+	}
+
+	if warnings > 0 {
+		fmt.Printf("%d warning(s)\n", warnings)
+		os.Exit(1)
+	}
+	fmt.Println("all checkpoints are within retention")
+}
+
+// oldestSequenceNumber returns the sequence number of the first record at the trim horizon,
+// or "" if the shard is empty.
+func oldestSequenceNumber(ctx context.Context, client *kinesis.Client, cfg *Config, shardID string) (string, error) {
+	name, streamARN := cfg.streamRef()
+	it, err := client.GetShardIterator(ctx, &kinesis.GetShardIteratorInput{
+		StreamName:        name,
+		StreamARN:         streamARN,
+		ShardId:           aws.String(shardID),
+		ShardIteratorType: types.ShardIteratorTypeTrimHorizon,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// GetRecords can come back empty while it skips over trimmed data, so give it a few calls
+	iterator := it.ShardIterator
+	for i := 0; i < 10 && iterator != nil; i++ {
+		resp, err := client.GetRecords(ctx, &kinesis.GetRecordsInput{ShardIterator: iterator, StreamARN: streamARN, Limit: aws.Int32(1)})
+		if err != nil {
+			return "", err
+		}
+		if len(resp.Records) > 0 {
+			return aws.ToString(resp.Records[0].SequenceNumber), nil
+		}
+		if aws.ToInt64(resp.MillisBehindLatest) == 0 {
+			break
+		}
+		iterator = resp.NextShardIterator
+	}
+	return "", nil
+}
+
+// checkResumable asks for the iterator a restart would ask for.
+func checkResumable(ctx context.Context, client *kinesis.Client, cfg *Config, c checkpoint) error {
+	name, streamARN := cfg.streamRef()
+	in := &kinesis.GetShardIteratorInput{StreamName: name, StreamARN: streamARN, ShardId: aws.String(c.Shard)}
+	if err := applyCheckpoint(in, c.SequenceNumber); err != nil {
+		return err
+	}
+	_, err := client.GetShardIterator(ctx, in)
+	var invalid *types.InvalidArgumentException
+	if errors.As(err, &invalid) {
+		return fmt.Errorf("sequence number is not in the shard: %s", aws.ToString(invalid.Message))
+	}
+	return err
+}
+
+// sequenceLess compares Kinesis sequence numbers, which are decimal strings too long for an int64.
+func sequenceLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// A WASM plugin gets every decoded record after the transform step and decides what gets printed.
+// The module must export:
+//
+//	memory
+//	alloc(size i32) i32             -- returns a buffer the consumer copies the record into
+//	process(ptr i32, len i32) i64   -- see below
+//	free(ptr i32, len i32)          -- releases a buffer of alloc or the output of process
+//
+// process returns the output record packed as ptr<<32 | len, or
+//
+//	-1  drop the record
+//	-2  the record could not be processed (counted as an error, the original is printed)
+//
+// The consumer frees the input buffer after process, and the output once it has copied it unless
+// it is the input buffer, so a long-running consumer doesn't grow the module's memory without bound.
+//
+// WASI is available so modules built with TinyGo or Rust's wasm32-wasi target work as is.
+const (
+	wasmDrop  = -1
+	wasmError = -2
+)
+
+var errWasmDrop = errors.New("record dropped by wasm plugin")
+
+var wasmErrors = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "wasm_errors_total",
+	Help:      "Records the wasm plugin failed on, with -2 or a failed call; the original record is handed on.",
+})
+
+type wasmPlugin struct {
+	// a module instance has one memory, so shards take turns
+	mu      sync.Mutex
+	runtime wazero.Runtime
+	memory  api.Memory
+	alloc   api.Function
+	process api.Function
+	free    api.Function
+}
+
+func loadWasmPlugin(ctx context.Context, path string) (*wasmPlugin, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	wasmBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read wasm module %s: %w", path, err)
+	}
+
+	r := wazero.NewRuntime(ctx)
+	wasi_snapshot_preview1.MustInstantiate(ctx, r)
+
+	mod, err := r.Instantiate(ctx, wasmBytes)
+	if err != nil {
+		r.Close(ctx)
+		return nil, fmt.Errorf("failed to instantiate wasm module %s: %w", path, err)
+	}
+
+	p := &wasmPlugin{
+		runtime: r,
+		memory:  mod.Memory(),
+		alloc:   mod.ExportedFunction("alloc"),
+		process: mod.ExportedFunction("process"),
+		free:    mod.ExportedFunction("free"),
+	}
+	if p.memory == nil || p.alloc == nil || p.process == nil || p.free == nil {
+		r.Close(ctx)
+		return nil, fmt.Errorf("wasm module %s must export memory, alloc, process and free", path)
+	}
+	return p, nil
+}
+
+// apply runs the record through the plugin. errWasmDrop means the record should not be printed.
+func (p *wasmPlugin) apply(ctx context.Context, data []byte) ([]byte, error) {
+	if p == nil {
+		return data, nil
+	}
+	out, err := p.call(ctx, data)
+	if err != nil && err != errWasmDrop {
+		wasmErrors.Inc()
+	}
+	return out, err
+}
+
+func (p *wasmPlugin) call(ctx context.Context, data []byte) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	res, err := p.alloc.Call(ctx, uint64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("wasm alloc failed: %w", err)
+	}
+	ptr := uint32(res[0])
+	if !p.memory.Write(ptr, data) {
+		return nil, fmt.Errorf("wasm alloc returned an out of range buffer")
+	}
+
+	res, err = p.process.Call(ctx, uint64(ptr), uint64(len(data)))
+	if err != nil {
+		p.free.Call(ctx, uint64(ptr), uint64(len(data)))
+		return nil, fmt.Errorf("wasm process failed: %w", err)
+	}
+
+	// the output may be the input, transformed in place, or in a block the input's was reused for,
+	// so it's copied before anything is freed
+	var out []byte
+	// output is true when the plugin returned a buffer of its own to free, empty ones included
+	var output bool
+	ret := int64(res[0])
+	outPtr, outLen := uint32(ret>>32), uint32(ret)
+	switch ret {
+	case wasmDrop:
+		err = errWasmDrop
+	case wasmError:
+		err = fmt.Errorf("wasm plugin could not process the record")
+	default:
+		if buf, ok := p.memory.Read(outPtr, outLen); ok {
+			// an empty result is an empty record, not a missing one
+			out = append([]byte{}, buf...)
+			output = outPtr != 0 && outPtr != ptr
+		} else {
+			err = fmt.Errorf("wasm process returned an out of range buffer")
+		}
+	}
+
+	if _, ferr := p.free.Call(ctx, uint64(ptr), uint64(len(data))); ferr != nil && err == nil {
+		err = fmt.Errorf("wasm free failed: %w", ferr)
+	}
+	if output {
+		if _, ferr := p.free.Call(ctx, uint64(outPtr), uint64(outLen)); ferr != nil && err == nil {
+			err = fmt.Errorf("wasm free failed: %w", ferr)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (p *wasmPlugin) close(ctx context.Context) {
+	if p != nil {
+		p.runtime.Close(ctx)
+	}
+}